@@ -0,0 +1,252 @@
+package ahrs
+
+import (
+	"math"
+
+	"github.com/skelterjohn/go.matrix"
+)
+
+// KalmanNoise holds the noise parameters of a KalmanFilter.  The gyro figures are those an Allan variance
+// analysis gives: the angle random walk is the deviation at τ = 1 s and the rate random walk the slope of the
+// +1/2 segment.
+type KalmanNoise struct {
+	GyroNoise     float64 // Gyro white noise density (angle random walk), rad/s/√Hz
+	GyroBiasWalk  float64 // Gyro bias random walk (rate random walk), rad/s/√s
+	AccelNoise    float64 // Standard deviation of the normalized accelerometer vector
+	MagNoise      float64 // Standard deviation of the normalized magnetometer vector
+	GyroBiasStart float64 // Standard deviation of the gyro bias before any measurements, rad/s
+}
+
+/*
+DefaultKalmanNoise is tuned for the ICM20948.  The gyro noise density is the datasheet's 0.015 °/s/√Hz and the
+initial bias uncertainty its ±5 °/s zero-rate offset.  The accelerometer and magnetometer noise are well above
+the sensor noise, since they stand for the disturbances the filter can't model: linear accelerations when
+maneuvering and local magnetic fields.
+*/
+var DefaultKalmanNoise = KalmanNoise{
+	GyroNoise:     0.015 * Deg,
+	GyroBiasWalk:  0.001 * Deg,
+	AccelNoise:    0.05,
+	MagNoise:      0.05,
+	GyroBiasStart: 5 * Deg,
+}
+
+const kalmanInitAttitudeVar = 0.01 // Variance of the quaternion components after initializing from accel/mag
+
+/*
+KalmanFilter is a lightweight extended Kalman filter fusing gyro, accelerometer and magnetometer readings into
+an attitude, while estimating the gyro biases.  Its state is the quaternion rotating the aircraft frame to the
+earth frame and the three gyro biases.
+
+Both frames follow the aviation convention of QuaternionToEuler: the aircraft frame is x to the nose, y to the
+right wing and z down, the earth frame North-East-Down.  Sensor readings must be rotated into the aircraft frame
+before they are passed in.  Gyro rates are in rad/s; accelerometer and magnetometer readings can be in any unit,
+since only their directions are used.  The accelerometer is assumed to measure gravity alone, so attitude
+degrades in sustained turns and accelerations, and heading is magnetic.
+
+Call Predict for each gyro reading and Update whenever accelerometer and magnetometer readings are available.
+The first Update initializes the attitude from the accelerometer and magnetometer.
+*/
+type KalmanFilter struct {
+	q0, q1, q2, q3 float64 // Quaternion rotating aircraft frame to earth frame
+	b1, b2, b3     float64 // Gyro biases, aircraft frame, rad/s
+	noise          KalmanNoise
+	p              *matrix.DenseMatrix // Covariance of the state, q0-q3 then b1-b3
+	initialized    bool                // The attitude has been initialized by Update
+}
+
+// NewKalmanFilter returns a KalmanFilter using the given noise parameters, e.g. DefaultKalmanNoise.
+func NewKalmanFilter(noise KalmanNoise) *KalmanFilter {
+	f := &KalmanFilter{q0: 1, noise: noise}
+	f.p = matrix.Zeros(7, 7)
+	for i := 0; i < 4; i++ {
+		f.p.Set(i, i, 1)
+	}
+	for i := 4; i < 7; i++ {
+		f.p.Set(i, i, noise.GyroBiasStart*noise.GyroBiasStart)
+	}
+	return f
+}
+
+// Predict advances the attitude by dt seconds at the measured gyro rates, corrected by the estimated biases.
+func (f *KalmanFilter) Predict(dt float64, gyro [3]float64) {
+	if dt <= 0 {
+		return
+	}
+	w1, w2, w3 := gyro[0]-f.b1, gyro[1]-f.b2, gyro[2]-f.b3
+	q0, q1, q2, q3 := f.q0, f.q1, f.q2, f.q3
+
+	// Jacobian of the transition: quaternion by quaternion, then quaternion by bias.
+	h := 0.5 * dt
+	jac := matrix.MakeDenseMatrixStacked([][]float64{
+		{1, -h * w1, -h * w2, -h * w3, h * q1, h * q2, h * q3},
+		{h * w1, 1, h * w3, -h * w2, -h * q0, h * q3, -h * q2},
+		{h * w2, -h * w3, 1, h * w1, -h * q3, -h * q0, h * q1},
+		{h * w3, h * w2, -h * w1, 1, h * q2, -h * q1, -h * q0},
+		{0, 0, 0, 0, 1, 0, 0},
+		{0, 0, 0, 0, 0, 1, 0},
+		{0, 0, 0, 0, 0, 0, 1},
+	})
+
+	f.q0 += h * (-w1*q1 - w2*q2 - w3*q3)
+	f.q1 += h * (+w1*q0 + w3*q2 - w2*q3)
+	f.q2 += h * (+w2*q0 - w3*q1 + w1*q3)
+	f.q3 += h * (+w3*q0 + w2*q1 - w1*q2)
+	f.normalize()
+
+	// Gyro noise enters the quaternion through the same matrix as the biases.
+	xi := matrix.MakeDenseMatrixStacked([][]float64{
+		{-q1, -q2, -q3},
+		{q0, -q3, q2},
+		{q3, q0, -q1},
+		{-q2, q1, q0},
+	})
+	qq := matrix.Scaled(matrix.Product(xi, xi.Transpose()), 0.25*f.noise.GyroNoise*f.noise.GyroNoise*dt)
+	qn := matrix.Zeros(7, 7)
+	qn.SetMatrix(0, 0, qq)
+	for i := 4; i < 7; i++ {
+		qn.Set(i, i, f.noise.GyroBiasWalk*f.noise.GyroBiasWalk*dt)
+	}
+
+	f.p = matrix.Sum(matrix.Product(jac, matrix.Product(f.p, jac.Transpose())), qn)
+}
+
+// Update corrects the attitude and gyro biases with accelerometer and magnetometer readings.  A zero mag vector
+// means no magnetometer reading, leaving heading to the gyros.
+func (f *KalmanFilter) Update(accel, mag [3]float64) {
+	a, err := MakeUnitVector(accel)
+	if err != nil {
+		return
+	}
+	m, err := MakeUnitVector(mag)
+	hasMag := err == nil
+
+	if !f.initialized {
+		f.initialize(a, m)
+		return
+	}
+
+	// The accelerometer measures the reaction to gravity, up in the earth frame.
+	g := [3]float64{0, 0, -1}
+	rows := 3
+	if hasMag {
+		rows = 6
+	}
+	y := matrix.Zeros(rows, 1)
+	h := matrix.Zeros(rows, 7)
+	r := matrix.Zeros(rows, rows)
+	f.setMeasurement(y, h, 0, g, *a)
+	for i := 0; i < 3; i++ {
+		r.Set(i, i, f.noise.AccelNoise*f.noise.AccelNoise)
+	}
+	if hasMag {
+		// Compare the magnetometer with the earth field as it would be measured at the estimated attitude, so
+		// that the field's dip doesn't disturb roll and pitch.
+		rot := QuaternionToRotationMatrix(f.q0, f.q1, f.q2, f.q3)
+		var e [3]float64
+		for i := 0; i < 3; i++ {
+			e[i] = rot[i][0]*m[0] + rot[i][1]*m[1] + rot[i][2]*m[2]
+		}
+		b := [3]float64{math.Hypot(e[0], e[1]), 0, e[2]}
+		f.setMeasurement(y, h, 3, b, *m)
+		for i := 3; i < 6; i++ {
+			r.Set(i, i, f.noise.MagNoise*f.noise.MagNoise)
+		}
+	}
+
+	s := matrix.Sum(matrix.Product(h, matrix.Product(f.p, h.Transpose())), r)
+	si, err := s.Inverse()
+	if err != nil {
+		return
+	}
+	k := matrix.Product(f.p, matrix.Product(h.Transpose(), si))
+	dx := matrix.Product(k, y)
+	f.q0 += dx.Get(0, 0)
+	f.q1 += dx.Get(1, 0)
+	f.q2 += dx.Get(2, 0)
+	f.q3 += dx.Get(3, 0)
+	f.b1 += dx.Get(4, 0)
+	f.b2 += dx.Get(5, 0)
+	f.b3 += dx.Get(6, 0)
+	f.normalize()
+	f.p = matrix.Product(matrix.Difference(matrix.Eye(7), matrix.Product(k, h)), f.p)
+	f.symmetrize()
+}
+
+// setMeasurement fills rows row to row+2 of the innovation y and Jacobian h for a measured aircraft-frame unit
+// vector meas of the earth-frame vector v.
+func (f *KalmanFilter) setMeasurement(y, h *matrix.DenseMatrix, row int, v, meas [3]float64) {
+	q0, q1, q2, q3 := f.q0, f.q1, f.q2, f.q3
+	v0, v1, v2 := v[0], v[1], v[2]
+	rot := QuaternionToRotationMatrix(q0, q1, q2, q3)
+	for i := 0; i < 3; i++ {
+		pred := rot[0][i]*v0 + rot[1][i]*v1 + rot[2][i]*v2 // Transpose rotates earth to aircraft frame
+		y.Set(row+i, 0, meas[i]-pred)
+	}
+	jac := [3][4]float64{
+		{q0*v0 + q3*v1 - q2*v2, q1*v0 + q2*v1 + q3*v2, -q2*v0 + q1*v1 - q0*v2, -q3*v0 + q0*v1 + q1*v2},
+		{-q3*v0 + q0*v1 + q1*v2, q2*v0 - q1*v1 + q0*v2, q1*v0 + q2*v1 + q3*v2, -q0*v0 - q3*v1 + q2*v2},
+		{q2*v0 - q1*v1 + q0*v2, q3*v0 - q0*v1 - q1*v2, q0*v0 + q3*v1 - q2*v2, q1*v0 + q2*v1 + q3*v2},
+	}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 4; j++ {
+			h.Set(row+i, j, 2*jac[i][j])
+		}
+	}
+}
+
+// initialize sets the attitude from unit accelerometer and magnetometer vectors a and m; m may be nil.
+func (f *KalmanFilter) initialize(a, m *[3]float64) {
+	roll := math.Atan2(-a[1], -a[2])
+	pitch := math.Atan2(a[0], math.Hypot(a[1], a[2]))
+	var yaw float64
+	if m != nil {
+		// Level the magnetometer vector to find the heading.
+		q0, q1, q2, q3 := EulerToQuaternion(roll, pitch, 0)
+		rot := QuaternionToRotationMatrix(q0, q1, q2, q3)
+		e0 := rot[0][0]*m[0] + rot[0][1]*m[1] + rot[0][2]*m[2]
+		e1 := rot[1][0]*m[0] + rot[1][1]*m[1] + rot[1][2]*m[2]
+		yaw = math.Atan2(-e1, e0)
+	}
+	f.q0, f.q1, f.q2, f.q3 = EulerToQuaternion(roll, pitch, yaw)
+	for i := 0; i < 4; i++ {
+		f.p.Set(i, i, kalmanInitAttitudeVar)
+	}
+	f.initialized = true
+}
+
+// normalize rescales the quaternion to unit length.
+func (f *KalmanFilter) normalize() {
+	f.q0, f.q1, f.q2, f.q3 = QuaternionNormalize(f.q0, f.q1, f.q2, f.q3)
+}
+
+// symmetrize removes the asymmetry rounding errors build up in the covariance.
+func (f *KalmanFilter) symmetrize() {
+	for i := 0; i < 7; i++ {
+		for j := 0; j < i; j++ {
+			v := (f.p.Get(i, j) + f.p.Get(j, i)) / 2
+			f.p.Set(i, j, v)
+			f.p.Set(j, i, v)
+		}
+	}
+}
+
+// Valid returns whether the attitude has been initialized by Update.
+func (f *KalmanFilter) Valid() bool {
+	return f.initialized
+}
+
+// Attitude returns the estimated roll, pitch and (magnetic) yaw in radians; see QuaternionToEuler.
+func (f *KalmanFilter) Attitude() (roll, pitch, yaw float64) {
+	return QuaternionToEuler(f.q0, f.q1, f.q2, f.q3)
+}
+
+// Quaternion returns the estimated quaternion rotating the aircraft frame to the earth frame.
+func (f *KalmanFilter) Quaternion() (q0, q1, q2, q3 float64) {
+	return f.q0, f.q1, f.q2, f.q3
+}
+
+// GyroBias returns the estimated gyro biases in the aircraft frame, rad/s.
+func (f *KalmanFilter) GyroBias() [3]float64 {
+	return [3]float64{f.b1, f.b2, f.b3}
+}
@@ -0,0 +1,112 @@
+package ahrs
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/skelterjohn/go.matrix"
+)
+
+// earthToAircraft rotates the earth-frame vector v into the aircraft frame of quaternion q.
+func earthToAircraft(q [4]float64, v [3]float64) (r [3]float64) {
+	rot := QuaternionToRotationMatrix(q[0], q[1], q[2], q[3])
+	for i := 0; i < 3; i++ {
+		r[i] = rot[0][i]*v[0] + rot[1][i]*v[1] + rot[2][i]*v[2]
+	}
+	return
+}
+
+func TestKalmanFilterJacobian(t *testing.T) {
+	f := NewKalmanFilter(DefaultKalmanNoise)
+	f.q0, f.q1, f.q2, f.q3 = EulerToQuaternion(0.3, -0.2, 2)
+	v := [3]float64{0.4, 0, 0.9}
+	y, h := matrix.Zeros(3, 1), matrix.Zeros(3, 7)
+	f.setMeasurement(y, h, 0, v, [3]float64{})
+
+	// Compare with finite differences of the predicted measurement, -y.
+	const eps = 1e-7
+	q := [4]float64{f.q0, f.q1, f.q2, f.q3}
+	for j := 0; j < 4; j++ {
+		qp := q
+		qp[j] += eps
+		pp := earthToAircraft(qp, v)
+		p := earthToAircraft(q, v)
+		for i := 0; i < 3; i++ {
+			if d := (pp[i] - p[i]) / eps; math.Abs(d-h.Get(i, j)) > 1e-5 {
+				t.Errorf("d meas%d / d q%d = %g, expected %g", i, j, h.Get(i, j), d)
+			}
+		}
+	}
+}
+
+// TestKalmanFilterConvergence runs the filter on simulated ICM20948 readings of an aircraft turning steadily
+// with biased, noisy gyros, and checks that it finds the attitude and the biases.
+func TestKalmanFilterConvergence(t *testing.T) {
+	const (
+		dt       = 0.01 // 100 Hz
+		duration = 120  // s
+	)
+	rnd := rand.New(rand.NewSource(1))
+	bias := [3]float64{0.5 * Deg, -0.3 * Deg, 0.8 * Deg}
+	rate := [3]float64{0, 0, 3 * Deg}
+	field := [3]float64{20, 0, 45} // µT, NED
+	noise := func(sd float64) float64 { return rnd.NormFloat64() * sd }
+	gyroSD := DefaultKalmanNoise.GyroNoise / math.Sqrt(dt)
+
+	// Truth: constant body rate from an initial attitude, q(t) = q(0) ⊗ exp(rate t / 2).
+	var q0 [4]float64
+	q0[0], q0[1], q0[2], q0[3] = EulerToQuaternion(20*Deg, -10*Deg, 120*Deg)
+	truth := func(t float64) (q [4]float64) {
+		w := math.Sqrt(rate[0]*rate[0] + rate[1]*rate[1] + rate[2]*rate[2])
+		c, s := math.Cos(w*t/2), math.Sin(w*t/2)
+		d := [4]float64{c, s * rate[0] / w, s * rate[1] / w, s * rate[2] / w}
+		q[0] = q0[0]*d[0] - q0[1]*d[1] - q0[2]*d[2] - q0[3]*d[3]
+		q[1] = q0[0]*d[1] + q0[1]*d[0] + q0[2]*d[3] - q0[3]*d[2]
+		q[2] = q0[0]*d[2] - q0[1]*d[3] + q0[2]*d[0] + q0[3]*d[1]
+		q[3] = q0[0]*d[3] + q0[1]*d[2] - q0[2]*d[1] + q0[3]*d[0]
+		return
+	}
+
+	f := NewKalmanFilter(DefaultKalmanNoise)
+	if f.Valid() {
+		t.Error("Valid before the first Update")
+	}
+	var q [4]float64
+	for i := 0; i <= duration/dt; i++ {
+		tt := float64(i) * dt
+		q = truth(tt)
+		if i > 0 {
+			f.Predict(dt, [3]float64{rate[0] + bias[0] + noise(gyroSD), rate[1] + bias[1] + noise(gyroSD),
+				rate[2] + bias[2] + noise(gyroSD)})
+		}
+		a := earthToAircraft(q, [3]float64{0, 0, -1})
+		m := earthToAircraft(q, field)
+		f.Update([3]float64{a[0] + noise(0.005), a[1] + noise(0.005), a[2] + noise(0.005)},
+			[3]float64{m[0] + noise(0.6), m[1] + noise(0.6), m[2] + noise(0.6)})
+	}
+	if !f.Valid() {
+		t.Fatal("not Valid after Update")
+	}
+
+	roll, pitch, yaw := f.Attitude()
+	r, p, y := QuaternionToEuler(q[0], q[1], q[2], q[3])
+	for _, c := range []struct {
+		name          string
+		got, expected float64
+	}{
+		{"roll", roll, r},
+		{"pitch", pitch, p},
+		{"yaw", yaw, y},
+	} {
+		if d := AngleDiff(c.got, c.expected); math.Abs(d) > 0.5*Deg {
+			t.Errorf("%s is %.2f°, expected %.2f°", c.name, c.got/Deg, c.expected/Deg)
+		}
+	}
+	b := f.GyroBias()
+	for i := range b {
+		if math.Abs(b[i]-bias[i]) > 0.05*Deg {
+			t.Errorf("gyro bias %d is %.3f°/s, expected %.3f°/s", i+1, b[i]/Deg, bias[i]/Deg)
+		}
+	}
+}
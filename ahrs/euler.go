@@ -0,0 +1,67 @@
+package ahrs
+
+import (
+	"math"
+)
+
+// gimbalLockLimit is how close sin(pitch) must be to ±1 for QuaternionToEuler to treat the attitude as
+// gimbal-locked, about 0.0026° from vertical.
+const gimbalLockLimit = 1 - Small
+
+/*
+EulerToQuaternion calculates the rotation quaternion q0, q1, q2, q3 (scalar first) for the aviation (aerospace
+ZYX) Euler angles roll, pitch, yaw in radians: the body is rotated first by yaw about the down axis, then by
+pitch about the new right-wing axis, then by roll about the new nose axis, in a North-East-Down earth frame.
+Positive roll is right wing down, positive pitch is nose up and yaw is the heading clockwise from north.
+The quaternion rotates body-frame vectors into the earth frame.
+
+These are the textbook angles.  ToQuaternion and FromQuaternion instead use the frame of the AHRS State, with
+theta and psi adjusted for it, so the two pairs of functions don't give the same quaternions.
+*/
+func EulerToQuaternion(roll, pitch, yaw float64) (q0, q1, q2, q3 float64) {
+	cr, sr := math.Cos(roll/2), math.Sin(roll/2)
+	cp, sp := math.Cos(pitch/2), math.Sin(pitch/2)
+	cy, sy := math.Cos(yaw/2), math.Sin(yaw/2)
+
+	q0 = cr*cp*cy + sr*sp*sy
+	q1 = sr*cp*cy - cr*sp*sy
+	q2 = cr*sp*cy + sr*cp*sy
+	q3 = cr*cp*sy - sr*sp*cy
+	return
+}
+
+/*
+QuaternionToEuler calculates the aviation Euler angles roll, pitch, yaw in radians for the rotation quaternion
+q0, q1, q2, q3, which needn't be normalized; it is the inverse of EulerToQuaternion.  Roll is in (-π, π], pitch
+in [-π/2, π/2] and yaw in [0, 2π).
+
+With the nose straight up or down (gimbal lock) roll and yaw rotate about the same axis and only their
+difference (pitch up) or sum (pitch down) is defined.  QuaternionToEuler then returns pitch exactly ±π/2, roll 0
+and the whole rotation about the vertical in yaw, so the angles still give back the same rotation.
+*/
+func QuaternionToEuler(q0, q1, q2, q3 float64) (roll, pitch, yaw float64) {
+	qq := q0*q0 + q1*q1 + q2*q2 + q3*q3
+	sp := 2 * (q0*q2 - q1*q3) / qq
+
+	switch {
+	case sp >= gimbalLockLimit:
+		pitch = Pi / 2
+		yaw = 2 * math.Atan2(q3, q0)
+	case sp <= -gimbalLockLimit:
+		pitch = -Pi / 2
+		yaw = 2 * math.Atan2(q3, q0)
+	default:
+		roll = math.Atan2(2*(q0*q1+q2*q3), q0*q0-q1*q1-q2*q2+q3*q3)
+		pitch = math.Asin(sp)
+		yaw = math.Atan2(2*(q0*q3+q1*q2), q0*q0+q1*q1-q2*q2-q3*q3)
+	}
+
+	yaw = math.Mod(yaw, 2*Pi)
+	if yaw < 0 {
+		yaw += 2 * Pi
+	}
+	if yaw >= 2*Pi { // A tiny negative yaw rounds up to 2π
+		yaw = 0
+	}
+	return
+}
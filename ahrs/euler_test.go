@@ -0,0 +1,94 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+// sameRotation checks whether two quaternions describe the same rotation, allowing for q and -q.
+func sameRotation(p0, p1, p2, p3, q0, q1, q2, q3 float64) bool {
+	pp := math.Sqrt(p0*p0 + p1*p1 + p2*p2 + p3*p3)
+	qq := math.Sqrt(q0*q0 + q1*q1 + q2*q2 + q3*q3)
+	return 1-math.Abs(p0*q0+p1*q1+p2*q2+p3*q3)/(pp*qq) < 1e-12
+}
+
+// angleDiff returns the difference between two angles, wrapped to [-π, π).
+func angleDiff(a, b float64) float64 {
+	return math.Mod(math.Mod(a-b+Pi, 2*Pi)+2*Pi, 2*Pi) - Pi
+}
+
+func TestEulerToQuaternion(t *testing.T) {
+	for _, c := range []struct {
+		roll, pitch, yaw float64
+		q0, q1, q2, q3   float64
+	}{
+		{0, 0, 0, 1, 0, 0, 0},
+		{Pi / 2, 0, 0, math.Sqrt2 / 2, math.Sqrt2 / 2, 0, 0},
+		{0, Pi / 2, 0, math.Sqrt2 / 2, 0, math.Sqrt2 / 2, 0},
+		{0, 0, Pi / 2, math.Sqrt2 / 2, 0, 0, math.Sqrt2 / 2},
+	} {
+		q0, q1, q2, q3 := EulerToQuaternion(c.roll, c.pitch, c.yaw)
+		if !sameRotation(q0, q1, q2, q3, c.q0, c.q1, c.q2, c.q3) {
+			t.Errorf("EulerToQuaternion(%g, %g, %g) = %g, %g, %g, %g, expected %g, %g, %g, %g",
+				c.roll, c.pitch, c.yaw, q0, q1, q2, q3, c.q0, c.q1, c.q2, c.q3)
+		}
+	}
+
+	// Pitching up by 90° points the nose (body x) straight up (earth -z).
+	q0, q1, q2, q3 := EulerToQuaternion(0, Pi/2, 0)
+	r := QuaternionToRotationMatrix(q0, q1, q2, q3)
+	if x, y, z := r[0][0], r[1][0], r[2][0]; math.Abs(x) > 1e-12 || math.Abs(y) > 1e-12 || math.Abs(z+1) > 1e-12 {
+		t.Errorf("nose points to %g, %g, %g after pitching up, expected 0, 0, -1", x, y, z)
+	}
+}
+
+func TestEulerRoundTrip(t *testing.T) {
+	const tol = 1e-9
+	for _, roll := range []float64{-3, -1, -0.2, 0, 0.3, 1.5, 3} {
+		for _, pitch := range []float64{-1.5, -0.5, 0, 0.2, 1, 1.5} {
+			for _, yaw := range []float64{0, 0.1, 1, 2.5, 4, 6} {
+				r, p, y := QuaternionToEuler(EulerToQuaternion(roll, pitch, yaw))
+				if math.Abs(r-roll) > tol || math.Abs(p-pitch) > tol || math.Abs(angleDiff(y, yaw)) > tol {
+					t.Errorf("round trip of %g, %g, %g gave %g, %g, %g", roll, pitch, yaw, r, p, y)
+				}
+			}
+		}
+	}
+}
+
+func TestQuaternionToEulerScale(t *testing.T) {
+	q0, q1, q2, q3 := EulerToQuaternion(0.3, -0.4, 2)
+	r, p, y := QuaternionToEuler(3*q0, 3*q1, 3*q2, 3*q3)
+	if math.Abs(r-0.3) > 1e-9 || math.Abs(p+0.4) > 1e-9 || math.Abs(y-2) > 1e-9 {
+		t.Errorf("unnormalized quaternion gave %g, %g, %g, expected 0.3, -0.4, 2", r, p, y)
+	}
+}
+
+func TestEulerGimbalLock(t *testing.T) {
+	for _, pitch := range []float64{Pi / 2, -Pi / 2, Pi/2 - 1e-6, -Pi/2 + 1e-6, Pi/2 - 1e-9, -Pi/2 + 1e-9} {
+		for _, roll := range []float64{0, 0.5, -2} {
+			for _, yaw := range []float64{0, 1, 5} {
+				q0, q1, q2, q3 := EulerToQuaternion(roll, pitch, yaw)
+				r, p, y := QuaternionToEuler(q0, q1, q2, q3)
+				if math.IsNaN(r) || math.IsNaN(p) || math.IsNaN(y) {
+					t.Fatalf("NaN for %g, %g, %g", roll, pitch, yaw)
+				}
+				if p < -Pi/2 || p > Pi/2 || y < 0 || y >= 2*Pi {
+					t.Errorf("angles %g, %g, %g for %g, %g, %g are out of range", r, p, y, roll, pitch, yaw)
+				}
+				// Near the poles the individual angles are ill-defined, but they must give back the same rotation.
+				if p0, p1, p2, p3 := EulerToQuaternion(r, p, y); !sameRotation(p0, p1, p2, p3, q0, q1, q2, q3) {
+					t.Errorf("%g, %g, %g gave %g, %g, %g, a different rotation", roll, pitch, yaw, r, p, y)
+				}
+			}
+		}
+	}
+
+	// Exactly at the poles roll is folded into yaw.
+	if r, p, y := QuaternionToEuler(EulerToQuaternion(0.5, Pi/2, 1)); r != 0 || p != Pi/2 || math.Abs(y-0.5) > 1e-12 {
+		t.Errorf("pitch up gave %g, %g, %g, expected 0, π/2, 0.5", r, p, y)
+	}
+	if r, p, y := QuaternionToEuler(EulerToQuaternion(0.5, -Pi/2, 1)); r != 0 || p != -Pi/2 || math.Abs(y-1.5) > 1e-12 {
+		t.Errorf("pitch down gave %g, %g, %g, expected 0, -π/2, 1.5", r, p, y)
+	}
+}
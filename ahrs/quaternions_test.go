@@ -98,9 +98,9 @@ func TestSpecificToQuaternion(t *testing.T) {
 		w = quaternion.Quaternion{X: w1s[i], Y: w2s[i], Z: w3s[i]}
 		e0, e1, e2, e3 = ToQuaternion(phis[i], thetas[i], psis[i])
 		e = quaternion.Quaternion{W: e0, X: e1, Y: e2, Z: e3}
-		uu = quaternion.Prod(e, x, quaternion.Conj(e))
-		vv = quaternion.Prod(e, y, quaternion.Conj(e))
-		ww = quaternion.Prod(e, z, quaternion.Conj(e))
+		uu = quaternion.Prod(e, x, e.Conj())
+		vv = quaternion.Prod(e, y, e.Conj())
+		ww = quaternion.Prod(e, z, e.Conj())
 
 		if notSmall(u.W-uu.W) || notSmall(u.X-uu.X) ||
 			notSmall(u.Y-uu.Y) || notSmall(u.Z-uu.Z) {
@@ -131,15 +131,15 @@ func TestSpecificToQuaternion(t *testing.T) {
 // A negative pitch rate about the y-axis should pitch the nose up
 func TestPitchRotationQuaternion(t *testing.T) {
 
-	q_nose_aircraft := quaternion.Quaternion{0, 1, 0, 0}
-	q_rt_wing_aircraft := quaternion.Quaternion{0, 0, -1, 0}
-	q_ae := quaternion.Quaternion{1, 0, 0, 0} // headed East
-	h_a := quaternion.Quaternion{1, 0, -0.5 * Pi / 180, 0}
+	q_nose_aircraft := quaternion.Quaternion{W: 0, X: 1, Y: 0, Z: 0}
+	q_rt_wing_aircraft := quaternion.Quaternion{W: 0, X: 0, Y: -1, Z: 0}
+	q_ae := quaternion.Quaternion{W: 1, X: 0, Y: 0, Z: 0} // headed East
+	h_a := quaternion.Quaternion{W: 1, X: 0, Y: -0.5 * Pi / 180, Z: 0}
 
-	q_nose_pitched_a := quaternion.Prod(h_a, q_nose_aircraft, quaternion.Conj(h_a))
-	q_nose_pitched_e := quaternion.Prod(quaternion.Conj(q_ae), q_nose_pitched_a, q_ae)
-	q_rt_wing_pitched_a := quaternion.Prod(h_a, q_rt_wing_aircraft, quaternion.Conj(h_a))
-	q_rt_wing_pitched_e := quaternion.Prod(quaternion.Conj(q_ae), q_rt_wing_pitched_a, q_ae)
+	q_nose_pitched_a := quaternion.Prod(h_a, q_nose_aircraft, h_a.Conj())
+	q_nose_pitched_e := quaternion.Prod(q_ae.Conj(), q_nose_pitched_a, q_ae)
+	q_rt_wing_pitched_a := quaternion.Prod(h_a, q_rt_wing_aircraft, h_a.Conj())
+	q_rt_wing_pitched_e := quaternion.Prod(q_ae.Conj(), q_rt_wing_pitched_a, q_ae)
 	if q_nose_pitched_e.Z < Tolerance || notSmall(q_nose_pitched_e.Y) ||
 		notSmall(q_rt_wing_pitched_e.X) || notSmall(q_rt_wing_pitched_e.Z) {
 		fmt.Println("Testing pitch directionality")
@@ -152,15 +152,15 @@ func TestPitchRotationQuaternion(t *testing.T) {
 // A positive roll rate about the x-axis should roll the right wing down
 func TestRollRotationQuaternion(t *testing.T) {
 
-	q_nose_aircraft := quaternion.Quaternion{0, 1, 0, 0}
-	q_rt_wing_aircraft := quaternion.Quaternion{0, 0, -1, 0}
-	q_ae := quaternion.Quaternion{1, 0, 0, 0} // headed East
-	h_a := quaternion.Quaternion{1, 0.5 * Pi / 180, 0, 0}
+	q_nose_aircraft := quaternion.Quaternion{W: 0, X: 1, Y: 0, Z: 0}
+	q_rt_wing_aircraft := quaternion.Quaternion{W: 0, X: 0, Y: -1, Z: 0}
+	q_ae := quaternion.Quaternion{W: 1, X: 0, Y: 0, Z: 0} // headed East
+	h_a := quaternion.Quaternion{W: 1, X: 0.5 * Pi / 180, Y: 0, Z: 0}
 
-	q_nose_rolled_a := quaternion.Prod(h_a, q_nose_aircraft, quaternion.Conj(h_a))
-	q_nose_rolled_e := quaternion.Prod(quaternion.Conj(q_ae), q_nose_rolled_a, q_ae)
-	q_rt_wing_rolled_a := quaternion.Prod(h_a, q_rt_wing_aircraft, quaternion.Conj(h_a))
-	q_rt_wing_rolled_e := quaternion.Prod(quaternion.Conj(q_ae), q_rt_wing_rolled_a, q_ae)
+	q_nose_rolled_a := quaternion.Prod(h_a, q_nose_aircraft, h_a.Conj())
+	q_nose_rolled_e := quaternion.Prod(q_ae.Conj(), q_nose_rolled_a, q_ae)
+	q_rt_wing_rolled_a := quaternion.Prod(h_a, q_rt_wing_aircraft, h_a.Conj())
+	q_rt_wing_rolled_e := quaternion.Prod(q_ae.Conj(), q_rt_wing_rolled_a, q_ae)
 	if notSmall(q_nose_rolled_e.Z) || notSmall(q_nose_rolled_e.Y) ||
 		q_rt_wing_rolled_e.Z > Tolerance || notSmall(q_rt_wing_rolled_e.X) {
 		fmt.Println("Testing roll directionality")
@@ -173,15 +173,15 @@ func TestRollRotationQuaternion(t *testing.T) {
 // A negative yaw rate about the z-axis should turn the nose to the right
 func TestYawRotationQuaternion(t *testing.T) {
 
-	q_nose_aircraft := quaternion.Quaternion{0, 1, 0, 0}
-	q_rt_wing_aircraft := quaternion.Quaternion{0, 0, -1, 0}
-	q_ae := quaternion.Quaternion{1, 0, 0, 0} // headed East
-	h_a := quaternion.Quaternion{1, 0, 0, -0.5 * Pi / 180}
+	q_nose_aircraft := quaternion.Quaternion{W: 0, X: 1, Y: 0, Z: 0}
+	q_rt_wing_aircraft := quaternion.Quaternion{W: 0, X: 0, Y: -1, Z: 0}
+	q_ae := quaternion.Quaternion{W: 1, X: 0, Y: 0, Z: 0} // headed East
+	h_a := quaternion.Quaternion{W: 1, X: 0, Y: 0, Z: -0.5 * Pi / 180}
 
-	q_nose_yawed_a := quaternion.Prod(h_a, q_nose_aircraft, quaternion.Conj(h_a))
-	q_nose_yawed_e := quaternion.Prod(quaternion.Conj(q_ae), q_nose_yawed_a, q_ae)
-	q_rt_wing_yawed_a := quaternion.Prod(h_a, q_rt_wing_aircraft, quaternion.Conj(h_a))
-	q_rt_wing_yawed_e := quaternion.Prod(quaternion.Conj(q_ae), q_rt_wing_yawed_a, q_ae)
+	q_nose_yawed_a := quaternion.Prod(h_a, q_nose_aircraft, h_a.Conj())
+	q_nose_yawed_e := quaternion.Prod(q_ae.Conj(), q_nose_yawed_a, q_ae)
+	q_rt_wing_yawed_a := quaternion.Prod(h_a, q_rt_wing_aircraft, h_a.Conj())
+	q_rt_wing_yawed_e := quaternion.Prod(q_ae.Conj(), q_rt_wing_yawed_a, q_ae)
 	if notSmall(q_nose_yawed_e.Z) || q_nose_yawed_e.X < Tolerance ||
 		notSmall(q_rt_wing_yawed_e.Z) || q_rt_wing_yawed_e.X > -Tolerance {
 		fmt.Println("Testing yaw directionality")
@@ -236,9 +236,9 @@ func TestQuaternionAToB(t *testing.T) {
 		bb = math.Sqrt(b1*b1 + b2*b2 + b3*b3)
 
 		q0, q1, q2, q3 = QuaternionAToB(a1, a2, a3, b1, b2, b3)
-		a = quaternion.Quaternion{0, a1 / aa, a2 / aa, a3 / aa}
-		q = quaternion.Quaternion{q0, q1, q2, q3}
-		z = quaternion.Prod(q, a, quaternion.Conj(q))
+		a = quaternion.Quaternion{W: 0, X: a1 / aa, Y: a2 / aa, Z: a3 / aa}
+		q = quaternion.Quaternion{W: q0, X: q1, Y: q2, Z: q3}
+		z = quaternion.Prod(q, a, q.Conj())
 		if notSmall(z.W) || notSmall(z.X-b1/bb) ||
 			notSmall(z.Y-b2/bb) || notSmall(z.Z-b3/bb) {
 			fmt.Printf("A:  %4f %4f %4f\n", a1, a2, a3)
@@ -250,9 +250,9 @@ func TestQuaternionAToB(t *testing.T) {
 
 	// Additional test: opposite vectors
 	q0, q1, q2, q3 = QuaternionAToB(a1, a2, a3, -a1, -a2, -a3)
-	a = quaternion.Quaternion{0, a1, a2, a3}
-	q = quaternion.Quaternion{q0, q1, q2, q3}
-	z = quaternion.Prod(q, a, quaternion.Conj(q))
+	a = quaternion.Quaternion{W: 0, X: a1, Y: a2, Z: a3}
+	q = quaternion.Quaternion{W: q0, X: q1, Y: q2, Z: q3}
+	z = quaternion.Prod(q, a, q.Conj())
 	if notSmall(z.W) || notSmall(z.X+a1) ||
 		notSmall(z.Y+a2) || notSmall(z.Z+a3) {
 		fmt.Printf("A:  %4f %4f %4f\n", a1, a2, a3)
@@ -266,25 +266,25 @@ func TestQuaternionAToB(t *testing.T) {
 // Composing pitch & yaw rotations results in just separate net rotations
 func TestMultipleRotations(t *testing.T) {
 	// Starting orientation: nose pointing East, no roll
-	q0 := quaternion.Quaternion{1, 0, 0, 0}
-	q0 = quaternion.Unit(q0)
+	q0 := quaternion.Quaternion{W: 1, X: 0, Y: 0, Z: 0}
+	q0 = q0.Unit()
 	p := Pi / 3  // Pitch up
 	r := Pi / 4  // Roll right
 	y := +Pi / 2 // Yaw left
 
 	// Define some rotations in appropriate frame
-	qap1 := quaternion.Quaternion{math.Cos(-p / 2), 0, math.Sin(-p / 2), 0}
-	qap2 := quaternion.Conj(qap1)                                         // Conj for opposite action
-	qey := quaternion.Quaternion{math.Cos(y / 2), 0, 0, math.Sin(y / 2)}  // Yaw is always defined in the earth frame, no matter the attitude
-	qar1 := quaternion.Quaternion{math.Cos(r / 2), math.Sin(r / 2), 0, 0} // Roll is always defined in the aircraft frame, no matter the attitude
-	qar2 := quaternion.Conj(qar1)
+	qap1 := quaternion.Quaternion{W: math.Cos(-p / 2), X: 0, Y: math.Sin(-p / 2), Z: 0}
+	qap2 := qap1.Conj()                                         // Conj for opposite action
+	qey := quaternion.Quaternion{W: math.Cos(y / 2), X: 0, Y: 0, Z: math.Sin(y / 2)}  // Yaw is always defined in the earth frame, no matter the attitude
+	qar1 := quaternion.Quaternion{W: math.Cos(r / 2), X: math.Sin(r / 2), Y: 0, Z: 0} // Roll is always defined in the aircraft frame, no matter the attitude
+	qar2 := qar1.Conj()
 
 	// Earth frame
 	qe := qap1
 	if !checkQ(qe, 0, p, Pi/2) {
 		t.Fail()
 	}
-	qe = quaternion.Prod(quaternion.Prod(qe, qar1, quaternion.Conj(qe)), qe) // How we translate airplane frame to earth frame
+	qe = quaternion.Prod(quaternion.Prod(qe, qar1, qe.Conj()), qe) // How we translate airplane frame to earth frame
 	if !checkQ(qe, r, p, Pi/2) {
 		t.Fail()
 	}
@@ -292,11 +292,11 @@ func TestMultipleRotations(t *testing.T) {
 	if !checkQ(qe, r, p, Pi/2-y) {
 		t.Fail()
 	}
-	qe = quaternion.Prod(quaternion.Prod(qe, qar2, quaternion.Conj(qe)), qe)
+	qe = quaternion.Prod(quaternion.Prod(qe, qar2, qe.Conj()), qe)
 	if !checkQ(qe, 0, p, Pi/2-y) {
 		t.Fail()
 	}
-	qe = quaternion.Prod(quaternion.Prod(qe, qap2, quaternion.Conj(qe)), qe)
+	qe = quaternion.Prod(quaternion.Prod(qe, qap2, qe.Conj()), qe)
 	if !checkQ(qe, 0, 0, Pi/2-y) {
 		t.Fail()
 	}
@@ -311,7 +311,7 @@ func TestMultipleRotations(t *testing.T) {
 	if !checkQ(qa, r, p, Pi/2) {
 		t.Fail()
 	}
-	qa = quaternion.Prod(qa, quaternion.Prod(quaternion.Conj(qa), qey, qa)) // How we translate earth frame to airplane frame
+	qa = quaternion.Prod(qa, quaternion.Prod(qa.Conj(), qey, qa)) // How we translate earth frame to airplane frame
 	if !checkQ(qa, r, p, Pi/2-y) {
 		t.Fail()
 	}
@@ -329,7 +329,7 @@ func TestMultipleRotations(t *testing.T) {
 // Composing a large number of small aircraft-frame rotations (e.g. from a sensor) adds up to the net earth-frame rotation
 func TestSmallCompositions(t *testing.T) {
 	// Starting orientation: nose pointing East, no roll
-	q0 := quaternion.Quaternion{1, 0, 0, 0}
+	q0 := quaternion.Quaternion{W: 1, X: 0, Y: 0, Z: 0}
 	n := 100                    // Number of divisions for each rotation
 	dp := (Pi / 3) / float64(n) // Pitch up 60°
 	dr := (Pi / 4) / float64(n) // Roll right 45°
@@ -337,11 +337,11 @@ func TestSmallCompositions(t *testing.T) {
 
 	// Define some rotations in earth frame
 	var qqs []quaternion.Quaternion = []quaternion.Quaternion{
-		quaternion.Quaternion{math.Cos(-dp / 2), 0, math.Sin(-dp / 2), 0}, // Pitch up
-		quaternion.Quaternion{math.Cos(-dr / 2), math.Sin(-dr / 2), 0, 0}, // Roll left (aircraft frame!)
-		quaternion.Quaternion{math.Cos(dy / 2), 0, 0, math.Sin(dy / 2)},   // Yaw left
-		quaternion.Quaternion{math.Cos(dr / 2), math.Sin(dr / 2), 0, 0},   // Roll right (aircraft frame!)
-		quaternion.Quaternion{math.Cos(-dp / 2), math.Sin(-dp / 2), 0, 0}, // Pitch down
+		quaternion.Quaternion{W: math.Cos(-dp / 2), X: 0, Y: math.Sin(-dp / 2), Z: 0}, // Pitch up
+		quaternion.Quaternion{W: math.Cos(-dr / 2), X: math.Sin(-dr / 2), Y: 0, Z: 0}, // Roll left (aircraft frame!)
+		quaternion.Quaternion{W: math.Cos(dy / 2), X: 0, Y: 0, Z: math.Sin(dy / 2)},   // Yaw left
+		quaternion.Quaternion{W: math.Cos(dr / 2), X: math.Sin(dr / 2), Y: 0, Z: 0},   // Roll right (aircraft frame!)
+		quaternion.Quaternion{W: math.Cos(-dp / 2), X: math.Sin(-dp / 2), Y: 0, Z: 0}, // Pitch down
 	}
 
 	// Apply the rotations successively
@@ -351,16 +351,16 @@ func TestSmallCompositions(t *testing.T) {
 	for _, qq := range qqs {
 		for i := 0; i < n; i++ {
 			// Convert aircraft frame to earth frame
-			qqs[1] = quaternion.Prod(qq, qqs[1], quaternion.Conj(qq))
-			qqs[3] = quaternion.Prod(qq, qqs[3], quaternion.Conj(qq))
+			qqs[1] = quaternion.Prod(qq, qqs[1], qq.Conj())
+			qqs[3] = quaternion.Prod(qq, qqs[3], qq.Conj())
 
 			// Apply to current earth-frame orientation
 			qe = quaternion.Prod(qq, qe)
 
 			// Apply to current aircraft-frame orientation
-			qqa = quaternion.Prod(quaternion.Conj(qa), qq, qa) // Translate from earth to aircraft frame
+			qqa = quaternion.Prod(qa.Conj(), qq, qa) // Translate from earth to aircraft frame
 			qa0, qa1, qa2, qa3 := QuaternionRotate(qa.W, qa.X, qa.Y, qa.Z, 2*qqa.X, 2*qqa.Y, 2*qqa.Z)
-			qa = quaternion.Quaternion{qa0, qa1, qa2, qa3}
+			qa = quaternion.Quaternion{W: qa0, X: qa1, Y: qa2, Z: qa3}
 		}
 	}
 
@@ -1,7 +1,9 @@
 package ahrs
 
 import (
+	"compress/gzip"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
@@ -9,6 +11,8 @@ import (
 
 type AHRSLogger struct {
 	f      *os.File
+	gz     *gzip.Writer // Set when the log is compressed
+	w      io.Writer
 	logMap map[string]interface{}
 	Header []string
 	fmt    string
@@ -16,12 +20,27 @@ type AHRSLogger struct {
 }
 
 func NewAHRSLogger(filename string, logMap map[string]interface{}) (l *AHRSLogger) {
+	return newAHRSLogger(filename, logMap, false)
+}
+
+// NewGzipAHRSLogger is like NewAHRSLogger but compresses the log with gzip, appending ".gz" to filename.
+// Close must be called to finish the gzip stream, or the end of the log is lost.
+func NewGzipAHRSLogger(filename string, logMap map[string]interface{}) (l *AHRSLogger) {
+	return newAHRSLogger(filename+".gz", logMap, true)
+}
+
+func newAHRSLogger(filename string, logMap map[string]interface{}, compress bool) (l *AHRSLogger) {
 	l = new(AHRSLogger)
 	f, err := os.Create(filename)
 	if err != nil {
 		log.Fatalln(err)
 	}
 	l.f = f
+	l.w = f
+	if compress {
+		l.gz = gzip.NewWriter(f)
+		l.w = l.gz
+	}
 	l.logMap = logMap
 
 	l.Header = make([]string, len(logMap))
@@ -31,7 +50,7 @@ func NewAHRSLogger(filename string, logMap map[string]interface{}) (l *AHRSLogge
 		i++
 	}
 
-	fmt.Fprint(l.f, strings.Join(l.Header, ","), "\n")
+	fmt.Fprint(l.w, strings.Join(l.Header, ","), "\n")
 	s := strings.Repeat("%f,", len(l.Header))
 	l.fmt = strings.Join([]string{s[:len(s)-1], "\n"}, "")
 	l.vals = make([]interface{}, len(l.Header))
@@ -42,9 +61,12 @@ func (l *AHRSLogger) Log() {
 	for i, k := range l.Header {
 		l.vals[i] = (l.logMap)[k]
 	}
-	fmt.Fprintf(l.f, l.fmt, l.vals...)
+	fmt.Fprintf(l.w, l.fmt, l.vals...)
 }
 
 func (l *AHRSLogger) Close() {
+	if l.gz != nil {
+		l.gz.Close()
+	}
 	l.f.Close()
 }
@@ -0,0 +1,27 @@
+package icm20948
+
+import (
+	"math"
+	"time"
+)
+
+/*
+Age returns how long ago the gyro and accel were last read successfully, so that consumers of C, which always
+holds the latest values however old they are, can tell fresh data from stale, e.g. to gray out a display when
+reads have stalled.  It grows while the driver is paused, and is the longest possible duration if there has been
+no successful read yet.  The watchdog (see SetWatchdog) reports the same condition on Faults.
+*/
+func (mpu *ICM20948) Age() time.Duration {
+	mpu.mu.Lock()
+	last := mpu.lastSample
+	mpu.mu.Unlock()
+	if last.IsZero() {
+		return math.MaxInt64
+	}
+	return time.Since(last)
+}
+
+// Age returns how long ago the sample was taken, i.e. the time since T.
+func (d *MPUData) Age() time.Duration {
+	return time.Since(d.T)
+}
@@ -0,0 +1,65 @@
+package icm20948
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+const autoRangeHeadroom = 0.8 // Fraction of full scale the observed peak may use in the chosen range
+
+var (
+	accelRanges = []int{2, 4, 8, 16}          // G
+	gyroRanges  = []int{250, 500, 1000, 2000} // °/s
+)
+
+// AutoRange samples the accelerometer at its widest range (16G) for duration while the installation experiences
+// its typical motion, then selects and applies the tightest range whose full scale leaves headroom above the
+// observed peak.  The chosen range in G is returned.
+func (mpu *ICM20948) AutoRange(duration time.Duration) (int, error) {
+	return mpu.autoRange(duration, accelRanges, mpu.SetAccelSensitivity,
+		func(d *MPUData) float64 { return math.Max(math.Abs(d.A1), math.Max(math.Abs(d.A2), math.Abs(d.A3))) })
+}
+
+// AutoRangeGyro is like AutoRange but for the gyro: it samples at 2000°/s and returns the chosen range in °/s.
+func (mpu *ICM20948) AutoRangeGyro(duration time.Duration) (int, error) {
+	return mpu.autoRange(duration, gyroRanges, mpu.SetGyroSensitivity,
+		func(d *MPUData) float64 { return math.Max(math.Abs(d.G1), math.Max(math.Abs(d.G2), math.Abs(d.G3))) })
+}
+
+func (mpu *ICM20948) autoRange(duration time.Duration, ranges []int, set func(int) error, peakOf func(*MPUData) float64) (int, error) {
+	widest := ranges[len(ranges)-1]
+	if err := set(widest); err != nil {
+		return 0, err
+	}
+
+	var (
+		peak    float64
+		samples int
+	)
+	period := time.Second / time.Duration(mpu.SampleRate())
+	end := time.Now().Add(duration)
+	for time.Now().Before(end) {
+		d := <-mpu.C
+		if d != nil && d.GAError == nil {
+			peak = math.Max(peak, peakOf(d))
+			samples++
+		}
+		time.Sleep(period)
+	}
+	if samples == 0 {
+		return widest, errors.New("ICM20948 Error: no samples read while auto-ranging")
+	}
+
+	chosen := widest
+	for _, r := range ranges {
+		if peak <= autoRangeHeadroom*float64(r) {
+			chosen = r
+			break
+		}
+	}
+	if err := set(chosen); err != nil {
+		return 0, err
+	}
+	return chosen, nil
+}
@@ -0,0 +1,138 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const auxTimeout = 100 * time.Millisecond // How long to wait for a Slave 4 transaction to complete
+
+// AuxRead reads n bytes starting at register reg from the device at addr on the auxiliary I2C bus.
+// It uses the I2C master's Slave 4 for single-byte transactions, so the Slave 0 magnetometer stream is undisturbed.
+func (mpu *ICM20948) AuxRead(addr, reg byte, n int) ([]byte, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("ICM20948 Error: can't read %d bytes from the aux bus", n)
+	}
+
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	if err := mpu.enableI2CMaster(); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, n)
+	for i := range data {
+		v, err := mpu.auxTransaction(BIT_I2C_READ|addr, reg+byte(i), 0)
+		if err != nil {
+			return nil, err
+		}
+		data[i] = v
+	}
+	return data, nil
+}
+
+// AuxWrite writes val to register reg of the device at addr on the auxiliary I2C bus, using Slave 4.
+func (mpu *ICM20948) AuxWrite(addr, reg, val byte) error {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	if err := mpu.enableI2CMaster(); err != nil {
+		return err
+	}
+
+	_, err := mpu.auxTransaction(addr, reg, val)
+	return err
+}
+
+// enableI2CMaster turns on the internal I2C master if it isn't already running (e.g. when the magnetometer is disabled).
+func (mpu *ICM20948) enableI2CMaster() error {
+	userCtrl, err := mpu.i2cRead(ICMREG_USER_CTRL)
+	if err != nil {
+		return errors.New("ICM20948 Error: couldn't read USER_CTRL")
+	}
+	if userCtrl&BIT_AUX_IF_EN != 0 {
+		return nil
+	}
+
+	if err := mpu.i2cWrite(ICMREG_USER_CTRL, userCtrl|BIT_AUX_IF_EN); err != nil {
+		return errors.New("ICM20948 Error: couldn't enable I2C master mode")
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if err := mpu.setRegBank(3); err != nil {
+		return errors.New("ICM20948 Error: change register bank.")
+	}
+	defer mpu.setRegBank(0)
+
+	// Set I2C master clock to 400 kHz
+	if err := mpu.i2cWrite(ICMREG_I2C_MST_CTRL, 0x07); err != nil {
+		return errors.New("ICM20948 Error: couldn't set up I2C master clock")
+	}
+	return nil
+}
+
+// auxTransaction runs a single Slave 4 transaction.  addrRW is the 7-bit address, or'ed with BIT_I2C_READ for reads.
+// For reads the byte returned by the slave is returned; for writes val is written.
+// The caller must hold busMu and leave the chip on register bank 0.
+func (mpu *ICM20948) auxTransaction(addrRW, reg, val byte) (byte, error) {
+	if err := mpu.setRegBank(3); err != nil {
+		return 0, errors.New("ICM20948 Error: change register bank.")
+	}
+	if err := mpu.i2cWrite(ICMREG_I2C_SLV4_ADDR, addrRW); err != nil {
+		mpu.setRegBank(0)
+		return 0, errors.New("ICM20948 Error: couldn't set Slave 4 address")
+	}
+	if err := mpu.i2cWrite(ICMREG_I2C_SLV4_REG, reg); err != nil {
+		mpu.setRegBank(0)
+		return 0, errors.New("ICM20948 Error: couldn't set Slave 4 register")
+	}
+	if addrRW&BIT_I2C_READ == 0 {
+		if err := mpu.i2cWrite(ICMREG_I2C_SLV4_DO, val); err != nil {
+			mpu.setRegBank(0)
+			return 0, errors.New("ICM20948 Error: couldn't set Slave 4 data")
+		}
+	}
+	// Kick off the transaction.
+	if err := mpu.i2cWrite(ICMREG_I2C_SLV4_CTRL, BIT_SLAVE_EN); err != nil {
+		mpu.setRegBank(0)
+		return 0, errors.New("ICM20948 Error: couldn't start Slave 4 transaction")
+	}
+	if err := mpu.setRegBank(0); err != nil {
+		return 0, errors.New("ICM20948 Error: change register bank.")
+	}
+
+	// I2C_MST_STATUS is on bank 0 and clears on read, so poll it until the transaction is done.
+	deadline := time.Now().Add(auxTimeout)
+	for {
+		status, err := mpu.i2cRead(ICMREG_I2C_MST_STATUS)
+		if err != nil {
+			return 0, errors.New("ICM20948 Error: couldn't read I2C master status")
+		}
+		if status&BIT_I2C_SLV4_NACK != 0 {
+			return 0, fmt.Errorf("ICM20948 Error: aux device 0x%02X didn't acknowledge", addrRW&^BIT_I2C_READ)
+		}
+		if status&BIT_I2C_SLV4_DONE != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("ICM20948 Error: timed out waiting for aux device 0x%02X", addrRW&^BIT_I2C_READ)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if addrRW&BIT_I2C_READ == 0 {
+		return 0, nil
+	}
+
+	if err := mpu.setRegBank(3); err != nil {
+		return 0, errors.New("ICM20948 Error: change register bank.")
+	}
+	defer mpu.setRegBank(0)
+	v, err := mpu.i2cRead(ICMREG_I2C_SLV4_DI)
+	if err != nil {
+		return 0, errors.New("ICM20948 Error: couldn't read Slave 4 data")
+	}
+	return v, nil
+}
@@ -0,0 +1,187 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	numAuxSlaves   = 4  // I2C master slaves 0-3, which read into EXT_SENS_DATA on every cycle
+	extSensDataLen = 24 // Size of EXT_SENS_DATA
+	magSlaveLen    = 9  // Bytes Slave 0 reads from the AK09916: ST1, the data and ST2
+	maxAuxSlaveLen = 15 // Longest read a slave can make, set by I2C_SLVx_LENG
+)
+
+// auxSlaveRegs holds the ADDR, REG and CTRL registers (bank 3) of each of Slaves 0-3.
+var auxSlaveRegs = [numAuxSlaves][3]byte{
+	{ICMREG_I2C_SLV0_ADDR, ICMREG_I2C_SLV0_REG, ICMREG_I2C_SLV0_CTRL},
+	{ICMREG_I2C_SLV1_ADDR, ICMREG_I2C_SLV1_REG, ICMREG_I2C_SLV1_CTRL},
+	{ICMREG_I2C_SLV2_ADDR, ICMREG_I2C_SLV2_REG, ICMREG_I2C_SLV2_CTRL},
+	{ICMREG_I2C_SLV3_ADDR, ICMREG_I2C_SLV3_REG, ICMREG_I2C_SLV3_CTRL},
+}
+
+// auxSlave is a read set up on one of Slaves 0-3 with ConfigureAuxSlave.  n is 0 if the slave isn't in use.
+type auxSlave struct {
+	addr, reg, n byte
+}
+
+// AuxDataFunc receives the bytes read by aux slave idx, as set up with ConfigureAuxSlave, and when they were read.
+// data is only valid during the call.
+type AuxDataFunc func(idx int, data []byte, t time.Time)
+
+/*
+ConfigureAuxSlave sets up Slave idx (0-3) of the internal I2C master to read n bytes, starting at register reg,
+from the device at addr on the auxiliary I2C bus on every I2C master cycle, e.g. to read a barometer alongside the
+magnetometer.  n of 0 stops the slave.  When the magnetometer is enabled it uses Slaves 0 and 1, so only 2 and 3
+are available.
+
+The I2C master stores the bytes of each slave in EXT_SENS_DATA one after the other, in slave order, and it has
+room for 24 bytes in all, including the magnetometer's 9; ConfigureAuxSlave keeps track of where each slave's
+bytes are, and returns an error, leaving the slaves as they were, if the new slave's would overflow the space.
+AuxDataBudget tells how much is left.  They are read on the magnetometer clock and passed to the function set with
+SetAuxDataFunc.
+*/
+func (mpu *ICM20948) ConfigureAuxSlave(idx int, addr, reg, n byte) error {
+	if idx < 0 || idx >= numAuxSlaves {
+		return fmt.Errorf("ICM20948 Error: aux slave %d doesn't exist, use 0-3", idx)
+	}
+	if mpu.enableMag && idx < 2 {
+		return fmt.Errorf("ICM20948 Error: aux slave %d is used by the magnetometer", idx)
+	}
+	if n > maxAuxSlaveLen {
+		return fmt.Errorf("ICM20948 Error: aux slaves can read at most %d bytes, not %d", maxAuxSlaveLen, n)
+	}
+
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	mpu.mu.Lock()
+	slaves := mpu.auxSlaves
+	mpu.mu.Unlock()
+	slaves[idx] = auxSlave{addr: addr, reg: reg, n: n}
+	if _, total := auxOffsets(slaves, mpu.enableMag); total > extSensDataLen {
+		return fmt.Errorf("ICM20948 Error: aux slaves would need %d bytes of EXT_SENS_DATA, only %d are available",
+			total, extSensDataLen)
+	}
+
+	if err := mpu.enableI2CMaster(); err != nil {
+		return err
+	}
+	if err := mpu.armAuxSlave(idx, slaves[idx]); err != nil {
+		return err
+	}
+	mpu.mu.Lock()
+	mpu.auxSlaves = slaves
+	mpu.mu.Unlock()
+	return nil
+}
+
+// AuxDataBudget returns how many bytes of EXT_SENS_DATA the slaves set up with ConfigureAuxSlave use, including
+// the magnetometer's if it is enabled, and how many there are in all.  total-used bytes are left for more slaves.
+func (mpu *ICM20948) AuxDataBudget() (used, total int) {
+	mpu.mu.Lock()
+	slaves := mpu.auxSlaves
+	mpu.mu.Unlock()
+	_, used = auxOffsets(slaves, mpu.enableMag)
+	return used, extSensDataLen
+}
+
+// SetAuxDataFunc sets the function called with the bytes read by each slave set up with ConfigureAuxSlave.
+// It is called from the read loop, so it must return quickly.  nil stops the calls.
+func (mpu *ICM20948) SetAuxDataFunc(f AuxDataFunc) {
+	mpu.mu.Lock()
+	mpu.auxDataFunc = f
+	mpu.mu.Unlock()
+}
+
+// armAuxSlave writes the settings of Slave idx to the chip.  The caller must hold busMu.
+func (mpu *ICM20948) armAuxSlave(idx int, s auxSlave) error {
+	regs := auxSlaveRegs[idx]
+	if err := mpu.setRegBank(3); err != nil {
+		return errors.New("ICM20948 Error: change register bank.")
+	}
+	defer mpu.setRegBank(0)
+
+	if s.n == 0 {
+		if err := mpu.i2cWrite(regs[2], 0); err != nil {
+			return fmt.Errorf("ICM20948 Error: couldn't disable aux slave %d: %s", idx, err.Error())
+		}
+		return nil
+	}
+	if err := mpu.i2cWrite(regs[0], BIT_I2C_READ|s.addr); err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't set aux slave %d address: %s", idx, err.Error())
+	}
+	if err := mpu.i2cWrite(regs[1], s.reg); err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't set aux slave %d register: %s", idx, err.Error())
+	}
+	if err := mpu.i2cWrite(regs[2], BIT_SLAVE_EN|s.n); err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't enable aux slave %d: %s", idx, err.Error())
+	}
+	return nil
+}
+
+// rearmAuxSlaves restores the slaves set up with ConfigureAuxSlave after the chip has been reconfigured.
+// The caller must hold busMu.
+func (mpu *ICM20948) rearmAuxSlaves() error {
+	mpu.mu.Lock()
+	slaves := mpu.auxSlaves
+	mpu.mu.Unlock()
+	for idx, s := range slaves {
+		if s.n == 0 {
+			continue
+		}
+		if err := mpu.enableI2CMaster(); err != nil {
+			return err
+		}
+		if err := mpu.armAuxSlave(idx, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auxOffsets returns where the bytes of each slave start in EXT_SENS_DATA, and how many bytes there are in all.
+// The magnetometer, when enabled, reads on Slave 0.
+func auxOffsets(slaves [numAuxSlaves]auxSlave, mag bool) (offsets [numAuxSlaves]int, total int) {
+	for idx, s := range slaves {
+		offsets[idx] = total
+		switch {
+		case idx == 0 && mag:
+			total += magSlaveLen
+		case mag && idx == 1: // Slave 1 writes the magnetometer's mode, so it reads nothing.
+		default:
+			total += int(s.n)
+		}
+	}
+	return
+}
+
+// readAux reads the bytes of the slaves set up with ConfigureAuxSlave from EXT_SENS_DATA and passes them to the
+// function set with SetAuxDataFunc, if any.
+func (mpu *ICM20948) readAux(t time.Time) {
+	mpu.mu.Lock()
+	slaves, f := mpu.auxSlaves, mpu.auxDataFunc
+	mpu.mu.Unlock()
+	if f == nil {
+		return
+	}
+
+	offsets, _ := auxOffsets(slaves, mpu.enableMag)
+	for idx, s := range slaves {
+		if s.n == 0 {
+			continue
+		}
+		data := make([]byte, s.n)
+		mpu.busMu.Lock()
+		_, err := mpu.busOp(func() (uint16, error) {
+			return 0, mpu.i2cbus.ReadFromReg(mpu.address, ICMREG_EXT_SENS_DATA_00+byte(offsets[idx]), data)
+		})
+		mpu.busMu.Unlock()
+		if err != nil {
+			mpu.readError(SourceBus, fmt.Errorf("error reading aux slave %d: %w", idx, err))
+			continue
+		}
+		f(idx, data, t)
+	}
+}
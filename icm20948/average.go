@@ -0,0 +1,94 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const defaultExpAvgTau = time.Second // Default time constant of the exponential average on CExpAvg
+
+// expAvg is an exponential moving average of the instantaneous sensor values.
+type expAvg struct {
+	tau float64 // Time constant, s
+	d   *MPUData
+}
+
+// update blends a new sample into the average.  The caller must hold mpu.mu.
+func (e *expAvg) update(d *MPUData) {
+	if d.GAError != nil {
+		return
+	}
+	if e.d == nil {
+		v := *d
+		e.d = &v
+		return
+	}
+	dt := d.T.Sub(e.d.T).Seconds()
+	if dt <= 0 {
+		return
+	}
+	alpha := dt / (e.tau + dt)
+	v := *e.d // The previous value may already have been sent, so build a new one.
+	v.G1 += alpha * (d.G1 - v.G1)
+	v.G2 += alpha * (d.G2 - v.G2)
+	v.G3 += alpha * (d.G3 - v.G3)
+	v.A1 += alpha * (d.A1 - v.A1)
+	v.A2 += alpha * (d.A2 - v.A2)
+	v.A3 += alpha * (d.A3 - v.A3)
+	v.Temp += alpha * (d.Temp - v.Temp)
+	if d.MagError == nil {
+		if v.MagError != nil {
+			v.M1, v.M2, v.M3 = d.M1, d.M2, d.M3
+		} else {
+			v.M1 += alpha * (d.M1 - v.M1)
+			v.M2 += alpha * (d.M2 - v.M2)
+			v.M3 += alpha * (d.M3 - v.M3)
+		}
+		v.MagError, v.TM, v.MagAnomaly = nil, d.TM, d.MagAnomaly
+	}
+	v.Saturated |= d.Saturated
+	v.N++
+	v.T, v.Seq = d.T, d.Seq
+	e.d = &v
+}
+
+// SetExpAvgTimeConstant sets the time constant of the exponential average sent on CExpAvg; the default is 1s.
+// Changing it restarts the average.
+func (mpu *ICM20948) SetExpAvgTimeConstant(tau time.Duration) error {
+	if tau <= 0 {
+		return fmt.Errorf("ICM20948 Error: %s is not a valid averaging time constant", tau)
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.expAvg = expAvg{tau: tau.Seconds()}
+	return nil
+}
+
+// avgRequest asks readSensors for the averages accumulated so far, to be sent on c, optionally starting a new
+// window.
+type avgRequest struct {
+	reset bool
+	c     chan *MPUData
+}
+
+/*
+AverageSince returns the average sensor values since the averaging window was last reset, and resets it if
+reset is true.  The window is shared with CAvg, which is equivalent to AverageSince(true) delivered on a channel.
+
+CAvg both computes and resets the averages on every read, so two consumers reading it each get a partial window.
+New code should use CExpAvg for a smoothed value that never resets, and AverageSince for windowed averages:
+a single owner of the window calls AverageSince(true), while others can peek with AverageSince(false).
+*/
+func (mpu *ICM20948) AverageSince(reset bool) *MPUData {
+	req := avgRequest{reset: reset, c: make(chan *MPUData, 1)}
+	select {
+	case mpu.cAvgReq <- req:
+		return <-req.c
+	case <-mpu.cDone:
+		return &MPUData{
+			GAError:  errors.New("ICM20948 Error: driver is closed"),
+			MagError: errors.New("ICM20948 Error: driver is closed"),
+		}
+	}
+}
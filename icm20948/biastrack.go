@@ -0,0 +1,133 @@
+package icm20948
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	defaultStationaryMaxGyro  = 1.0                    // Max gyro rate on any axis while stationary, °/s
+	defaultStationaryMaxAccel = 0.05                   // Max deviation of the accel magnitude from 1 G while stationary
+	defaultStationaryWindow   = 2 * time.Second        // Time the sensor must be quiet for to be stationary
+	stationaryMaxGap          = 500 * time.Millisecond // Gap in the samples after which the window starts again
+)
+
+// stationaryDetector decides from the calibrated samples whether the sensor is stationary: every sample quiet,
+// with no rotation or acceleration beyond the thresholds, for the whole window.
+type stationaryDetector struct {
+	maxGyro, maxAccel float64
+	window            time.Duration
+	quietSince        time.Time // Time of the first of the current run of quiet samples; zero if not in one
+	last              time.Time // Time of the last sample
+	stationary        bool
+}
+
+// update feeds d to the detector and returns whether the sensor is now stationary.
+func (s *stationaryDetector) update(d *MPUData) bool {
+	if d.GAError != nil {
+		return s.stationary
+	}
+	quiet := math.Abs(d.G1) <= s.maxGyro && math.Abs(d.G2) <= s.maxGyro && math.Abs(d.G3) <= s.maxGyro &&
+		math.Abs(math.Sqrt(d.A1*d.A1+d.A2*d.A2+d.A3*d.A3)-1) <= s.maxAccel
+	switch {
+	case !quiet || d.T.Sub(s.last) > stationaryMaxGap:
+		// Motion, or a gap in which there may have been motion, starts the window again.
+		s.quietSince = time.Time{}
+		if quiet {
+			s.quietSince = d.T
+		}
+	case s.quietSince.IsZero():
+		s.quietSince = d.T
+	}
+	s.last = d.T
+	s.stationary = !s.quietSince.IsZero() && d.T.Sub(s.quietSince) >= s.window
+	return s.stationary
+}
+
+// WithStationaryThresholds sets the thresholds of the stationary detector; see SetStationaryThresholds.
+func WithStationaryThresholds(maxGyro, maxAccel float64, window time.Duration) Option {
+	return func(mpu *ICM20948) {
+		mpu.stationary.maxGyro, mpu.stationary.maxAccel, mpu.stationary.window = maxGyro, maxAccel, window
+	}
+}
+
+/*
+SetStationaryThresholds sets when the sensor is taken to be stationary, for IsStationary and bias tracking: every
+sample for window must have a gyro rate of at most maxGyro °/s on each axis and an accel magnitude within maxAccel G
+of 1 G.  The defaults are 1 °/s, 0.05 G and 2 s.  maxGyro must be above the gyro noise and the error in the gyro
+bias, or the sensor is never stationary, but below the slowest rotation to be expected, as a rotation slower than
+it for longer than window would be taken for bias.
+*/
+func (mpu *ICM20948) SetStationaryThresholds(maxGyro, maxAccel float64, window time.Duration) error {
+	if err := checkStationaryThresholds(maxGyro, maxAccel, window); err != nil {
+		return err
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.stationary = stationaryDetector{maxGyro: maxGyro, maxAccel: maxAccel, window: window}
+	return nil
+}
+
+func checkStationaryThresholds(maxGyro, maxAccel float64, window time.Duration) error {
+	if !(maxGyro > 0) || !(maxAccel > 0) || !finite(maxGyro, maxAccel) || window <= 0 {
+		return errors.New("ICM20948 Error: stationary thresholds and window must be positive")
+	}
+	return nil
+}
+
+// IsStationary returns whether the sensor is stationary, i.e. has been neither rotating nor accelerating for the
+// window set with SetStationaryThresholds.
+func (mpu *ICM20948) IsStationary() bool {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return mpu.stationary.stationary
+}
+
+// WithBiasTracking turns on gyro bias tracking; see SetBiasTracking.
+func WithBiasTracking(gain float64) Option {
+	return func(mpu *ICM20948) {
+		mpu.biasGain = gain
+	}
+}
+
+/*
+SetBiasTracking turns on tracking of the gyro bias while the driver runs, to keep the drift of integrated rates
+bounded on long flights as the bias wanders with temperature and age.  On every sample for which IsStationary is
+true, the bias is moved by gain times the remaining gyro reading, so it settles with a time constant of about
+1/gain samples; e.g. 0.001 at 100 Hz is 10 s.  The bias is never updated while the sensor is rotating or
+accelerating, when the gyro reading is motion rather than bias.  gain must be between 0 and 1; 0, the default,
+turns tracking off.  CurrentGyroBias returns the bias; it is applied to the samples, but not saved until
+SaveCalibration is called.  SetGyroHighPass removes the drift from the readings itself, leaving little to track.
+*/
+func (mpu *ICM20948) SetBiasTracking(gain float64) error {
+	if !(gain >= 0 && gain <= 1) {
+		return errors.New("ICM20948 Error: bias tracking gain must be between 0 and 1")
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.biasGain = gain
+	return nil
+}
+
+// CurrentGyroBias returns the gyro bias being applied, in °/s in the chip's axes, as set with SetGyroBias, loaded
+// from the calibration file or tracked with SetBiasTracking.
+func (mpu *ICM20948) CurrentGyroBias() (x, y, z float64) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return mpu.G01 * mpu.scaleGyro, mpu.G02 * mpu.scaleGyro, mpu.G03 * mpu.scaleGyro
+}
+
+// trackBias feeds d to the stationary detector and, while the sensor is stationary and bias tracking is on, moves
+// the gyro bias towards its reading.  The caller must hold mpu.mu.
+func (mpu *ICM20948) trackBias(d *MPUData) {
+	if !mpu.stationary.update(d) || mpu.biasGain == 0 || d.GAError != nil {
+		return
+	}
+	// The reading is in the output axes but the bias is in the chip's.
+	g1, g2, g3 := mpu.toChipAxes(d.G1, d.G2, d.G3)
+	k := mpu.biasGain / mpu.scaleGyro
+	mpu.G01 += k * g1
+	mpu.G02 += k * g2
+	mpu.G03 += k * g3
+}
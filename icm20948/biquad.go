@@ -0,0 +1,144 @@
+package icm20948
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	filteredBufSize = 100                    // Size of the CFiltered buffer
+	biquadMaxGap    = 500 * time.Millisecond // Gap in the input after which the filter restarts
+)
+
+// biquad holds the coefficients of a second-order IIR filter, normalized so that a0 is 1.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+}
+
+// butterworth returns the second-order Butterworth low-pass filter with a -3 dB cutoff of cutoff Hz at rate
+// samples per second, designed with the bilinear transform, pre-warped so the cutoff is exact.  ok is false if the
+// cutoff isn't below the Nyquist frequency.
+func butterworth(cutoff float64, rate int) (f biquad, ok bool) {
+	if rate <= 0 || cutoff <= 0 || cutoff >= float64(rate)/2 {
+		return f, false
+	}
+	k := math.Tan(math.Pi * cutoff / float64(rate))
+	norm := 1 / (1 + math.Sqrt2*k + k*k)
+	f.b0 = k * k * norm
+	f.b1 = 2 * f.b0
+	f.b2 = f.b0
+	f.a1 = 2 * (k*k - 1) * norm
+	f.a2 = (1 - math.Sqrt2*k + k*k) * norm
+	return f, true
+}
+
+// biquadFilter filters the gyro and accel values of the samples from readSensors for CFiltered.
+type biquadFilter struct {
+	cutoff   float64 // -3 dB cutoff, Hz
+	rate     int     // Sample rate the coefficients are for; 0 to compute them on the next sample
+	ok       bool    // The cutoff is valid for rate; if not, samples pass through unfiltered
+	f        biquad
+	x1, x2   [6]float64 // Previous two inputs of G1-G3 and A1-A3
+	y1, y2   [6]float64 // Previous two outputs
+	prev     time.Time  // Time of the previous input
+	started  bool       // The state holds a previous input
+	warnRate int        // Rate last warned about, so each invalid rate is only logged once
+}
+
+// push filters d, with the coefficients for the sample rate rate, and returns the filtered sample, or nil if d has
+// no gyro/accel values.  The first sample, and the first after a gap, start the filter in the steady state at
+// their values.
+func (bf *biquadFilter) push(d *MPUData, rate int) *MPUData {
+	if d.GAError != nil {
+		return nil
+	}
+	if rate != bf.rate {
+		bf.rate = rate
+		bf.f, bf.ok = butterworth(bf.cutoff, rate)
+		if !bf.ok && bf.warnRate != rate {
+			log.Printf("ICM20948 Warning: biquad cutoff %g Hz isn't below half the %d Hz sample rate, not filtering\n",
+				bf.cutoff, rate)
+			bf.warnRate = rate
+		}
+	}
+
+	x := [6]float64{d.G1, d.G2, d.G3, d.A1, d.A2, d.A3}
+	if !bf.started || d.T.Sub(bf.prev) > biquadMaxGap {
+		bf.x1, bf.x2, bf.y1, bf.y2 = x, x, x, x
+		bf.started = true
+	}
+	bf.prev = d.T
+
+	var y [6]float64
+	for i := range x {
+		if bf.ok {
+			y[i] = bf.f.b0*x[i] + bf.f.b1*bf.x1[i] + bf.f.b2*bf.x2[i] - bf.f.a1*bf.y1[i] - bf.f.a2*bf.y2[i]
+		} else {
+			y[i] = x[i]
+		}
+	}
+	bf.x2, bf.x1 = bf.x1, x
+	bf.y2, bf.y1 = bf.y1, y
+
+	v := *d
+	v.G1, v.G2, v.G3, v.A1, v.A2, v.A3 = y[0], y[1], y[2], y[3], y[4], y[5]
+	return &v
+}
+
+// WithBiquad turns on the low-pass filter stage; see SetBiquad.
+func WithBiquad(cutoffHz float64) Option {
+	return func(mpu *ICM20948) {
+		if cutoffHz != 0 {
+			mpu.biquad = &biquadFilter{cutoff: cutoffHz}
+		}
+	}
+}
+
+/*
+SetBiquad turns on a second-order Butterworth low-pass filter stage with a -3 dB cutoff of cutoffHz, whose output
+is sent on CFiltered, for displays and analysis that want a steeper roll-off than the exponential average on
+CExpAvg: 12 dB per octave above the cutoff.  The gyro and accel values are filtered; the magnetometer and
+temperature pass through, as do the other fields, so Seq and T are those of the input samples.  The other
+channels, including CBuf, are unaffected.
+
+The coefficients are computed for the gyro sample rate and recomputed when it changes (with a separate accel
+rate, the extra accel samples are filtered as if at the gyro rate).  While the cutoff isn't below half the
+sample rate, samples pass through unfiltered.  After a gap of more than 500 ms, e.g. while paused, the filter
+restarts.  cutoffHz of 0 turns the stage off; CFiltered is then no longer sent to but isn't closed until CloseMPU.
+If CFiltered isn't read fast enough, the oldest samples are dropped.
+*/
+func (mpu *ICM20948) SetBiquad(cutoffHz float64) error {
+	if cutoffHz < 0 || !finite(cutoffHz) {
+		return fmt.Errorf("ICM20948 Error: %g Hz is not a valid filter cutoff", cutoffHz)
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.biquad = nil
+	if cutoffHz != 0 {
+		mpu.biquad = &biquadFilter{cutoff: cutoffHz}
+	}
+	return nil
+}
+
+// filter feeds d to the biquad filter, if enabled, and sends the result on CFiltered, dropping the oldest sample if
+// it is full.  The caller must hold mpu.mu.
+func (mpu *ICM20948) filter(d *MPUData) {
+	if mpu.biquad == nil {
+		return
+	}
+	v := mpu.biquad.push(d, mpu.gyroRate)
+	if v == nil {
+		return
+	}
+	select {
+	case mpu.cFiltered <- v:
+	default:
+		select {
+		case <-mpu.cFiltered:
+		default:
+		}
+		mpu.cFiltered <- v
+	}
+}
@@ -0,0 +1,160 @@
+package icm20948
+
+import (
+	"errors"
+	"log"
+	"math"
+	"strings"
+)
+
+// AxisMap rotates readings from the chip's axes into the caller's: output axis i is the sum over j of
+// AxisMap[i][j] times chip axis j.  It must be a rotation, usually a signed permutation of the axes.
+type AxisMap [3][3]float64
+
+// IdentityAxisMap leaves the readings in the chip's axes.
+var IdentityAxisMap = AxisMap{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+
+// flipMag turns the AK09916 axes into the accel/gyro axes, or back: X is shared but Y and Z point the opposite way.
+var flipMag = AxisMap{{1, 0, 0}, {0, -1, 0}, {0, 0, -1}}
+
+/*
+boardPresets maps common breakouts to the rotation from the chip's axes to the package's usual frame, axis 1 to
+the nose, 2 to the left wing and 3 up, as the horizon filter and the ahrs package use.  Each board is assumed to be
+mounted flat, component side up, with the edge given below toward the nose:
+
+	sparkfun:  SparkFun 9DoF IMU Breakout (Qwiic).  The silkscreen X arrow to the nose; the silkscreen axes are
+	           the chip's, so this is the identity.
+	adafruit:  Adafruit ICM-20948 9-DoF IMU (STEMMA QT).  The silkscreen Y arrow to the nose; the chip's X axis
+	           then points to the right wing.
+	waveshare: Waveshare ICM20948 modules, e.g. the 10 DOF IMU Sensor (D).  The pin header to the nose; the chip's
+	           X axis then points to the tail.
+*/
+var boardPresets = map[string]AxisMap{
+	"sparkfun":  IdentityAxisMap,
+	"adafruit":  {{0, 1, 0}, {-1, 0, 0}, {0, 0, 1}},
+	"waveshare": {{-1, 0, 0}, {0, -1, 0}, {0, 0, 1}},
+}
+
+// fluToFRD turns the nose-left-up frame into nose-right-down, the body frame of North-East-Down conventions.
+var fluToFRD = AxisMap{{1, 0, 0}, {0, -1, 0}, {0, 0, -1}}
+
+/*
+DetectBoard returns the axis map for a breakout board preset, and whether the board is known.  The name is one of
+"sparkfun", "adafruit" or "waveshare", case insensitive, mounted as described for boardPresets; the readings then
+come out with axis 1 to the nose, 2 to the left wing and 3 up, the East-North-Up style frame.  Adding "-ned" to
+the name, e.g. "sparkfun-ned", gives instead axis 1 to the nose, 2 to the right wing and 3 down, the
+North-East-Down style frame the ahrs KalmanFilter expects.  Unknown boards give IdentityAxisMap.
+*/
+func DetectBoard(name string) (AxisMap, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	ned := strings.HasSuffix(name, "-ned")
+	m, ok := boardPresets[strings.TrimSuffix(name, "-ned")]
+	if !ok {
+		return IdentityAxisMap, false
+	}
+	if ned {
+		m = fluToFRD.mul(m)
+	}
+	return m, true
+}
+
+// WithBoardPreset rotates all readings, including the magnetometer's, from the chip's axes into a conventional
+// frame for a known breakout board; see DetectBoard.  Unknown boards log a warning and keep the chip's axes.
+func WithBoardPreset(name string) Option {
+	return func(mpu *ICM20948) {
+		m, ok := DetectBoard(name)
+		if !ok {
+			log.Printf("ICM20948 Warning: unknown board preset %q, using the chip's axes\n", name)
+			mpu.axisMap = nil
+			return
+		}
+		mpu.axisMap = &m
+	}
+}
+
+/*
+WithAxisMap rotates all readings from the chip's axes by m, for boards without a preset or mounted differently.
+The gyro and accelerometer are rotated by m directly.  The magnetometer is first turned from the AK09916's axes
+into the accel/gyro axes, so that M1-M3 then share the axes of A1-A3 and G1-G3; without an axis map they keep the
+AK09916's axes.  Calibration offsets stay in the chip's axes.
+*/
+func WithAxisMap(m AxisMap) Option {
+	return func(mpu *ICM20948) {
+		mpu.axisMap = &m
+	}
+}
+
+// validate checks that m is a rotation, allowing for rounding in hand-entered values.
+func (m AxisMap) validate() error {
+	p := m.mul(m.transpose())
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			want := 0.0
+			if i == j {
+				want = 1
+			}
+			if math.Abs(p[i][j]-want) > 1e-3 {
+				return errors.New("ICM20948 Error: axis map must be a rotation")
+			}
+		}
+	}
+	if m.det() < 0 {
+		return errors.New("ICM20948 Error: axis map must be a rotation, not a reflection")
+	}
+	return nil
+}
+
+// apply returns m times the vector v1, v2, v3.
+func (m *AxisMap) apply(v1, v2, v3 float64) (float64, float64, float64) {
+	return mulVec(*m, v1, v2, v3)
+}
+
+// mul returns the product m times n.
+func (m AxisMap) mul(n AxisMap) (p AxisMap) {
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				p[i][j] += m[i][k] * n[k][j]
+			}
+		}
+	}
+	return
+}
+
+// transpose returns the transpose of m, which is its inverse for a rotation.
+func (m AxisMap) transpose() (t AxisMap) {
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			t[i][j] = m[j][i]
+		}
+	}
+	return
+}
+
+// det returns the determinant of m.
+func (m AxisMap) det() float64 {
+	return m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+}
+
+// remap rotates the calibrated readings in d into the axes set by WithAxisMap or WithBoardPreset, if any.
+// The caller must hold mpu.mu.
+func (mpu *ICM20948) remap(d *MPUData) {
+	m := mpu.axisMap
+	if m == nil {
+		return
+	}
+	d.G1, d.G2, d.G3 = m.apply(d.G1, d.G2, d.G3)
+	d.A1, d.A2, d.A3 = m.apply(d.A1, d.A2, d.A3)
+	d.M1, d.M2, d.M3 = m.apply(flipMag.apply(d.M1, d.M2, d.M3))
+}
+
+// toChipAxes rotates a vector from the axes set by WithAxisMap or WithBoardPreset back into the chip's axes.
+func (mpu *ICM20948) toChipAxes(v1, v2, v3 float64) (float64, float64, float64) {
+	if mpu.axisMap == nil {
+		return v1, v2, v3
+	}
+	t := mpu.axisMap.transpose()
+	return t.apply(v1, v2, v3)
+}
@@ -0,0 +1,365 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	bootSamples       = 50                    // Samples taken for each self-test reading and for the noise check
+	bootSamplePeriod  = 2 * time.Millisecond  // Shortest time between them
+	selfTestSettle    = 20 * time.Millisecond // Time for the outputs to settle after changing the self-test or ranges
+	selfTestOTPBase   = 2620                  // Factory self-test response (LSB) of code 1, at ±250 °/s and ±2 G
+	bootNoiseGyroMax  = 0.5                   // Largest gyro standard deviation of a still, healthy sensor, °/s
+	bootNoiseAccelMax = 0.02                  // Largest accel standard deviation of a still, healthy sensor, G
+)
+
+// Self-test limits from the data sheets: the gyro response must be more than half the factory response, the accel
+// response within 50% of it, and the AK09916 self-test field (LSB) within these ranges on each axis.
+var (
+	gyroSelfTestLimits    = [2]float64{0.5, math.Inf(1)}
+	accelSelfTestLimits   = [2]float64{0.5, 1.5}
+	ak09916SelfTestLimits = [3][2]int16{{-200, 200}, {-200, 200}, {-1000, -200}}
+)
+
+// BootCheckResult is the outcome of one check of BootCheck.
+type BootCheckResult struct {
+	Run    bool   // The check was run; if not, Detail says why it was skipped
+	Passed bool   // The check was run and passed
+	Detail string // What was measured, or why the check failed or was skipped
+}
+
+// BootReport is the outcome of BootCheck for each subsystem.
+type BootReport struct {
+	WhoAmI        BootCheckResult // The chip answers with the ICM20948 WHO_AM_I
+	GyroSelfTest  BootCheckResult // The gyro self-test response matches the factory response
+	AccelSelfTest BootCheckResult // The accel self-test response matches the factory response
+	MagWhoAmI     BootCheckResult // The AK09916 answers with its device ID; skipped with the magnetometer disabled
+	MagSelfTest   BootCheckResult // The AK09916 self-test field is in range; skipped with the magnetometer disabled
+	Noise         BootCheckResult // The gyro and accel are still and no noisier than expected
+}
+
+func (r BootReport) results() []struct {
+	name string
+	BootCheckResult
+} {
+	return []struct {
+		name string
+		BootCheckResult
+	}{
+		{"WHO_AM_I", r.WhoAmI},
+		{"gyro self-test", r.GyroSelfTest},
+		{"accel self-test", r.AccelSelfTest},
+		{"mag WHO_AM_I", r.MagWhoAmI},
+		{"mag self-test", r.MagSelfTest},
+		{"noise", r.Noise},
+	}
+}
+
+// Passed returns whether every check that was run passed.  The magnetometer checks are skipped when it is
+// disabled; the others are only skipped when an earlier check failed.
+func (r BootReport) Passed() bool {
+	for _, c := range r.results() {
+		if c.Run && !c.Passed {
+			return false
+		}
+	}
+	return r.WhoAmI.Passed
+}
+
+// String formats r with one line per check, e.g. for a preflight log.
+func (r BootReport) String() string {
+	var b strings.Builder
+	for _, c := range r.results() {
+		status := "skipped"
+		if c.Passed {
+			status = "pass"
+		} else if c.Run {
+			status = "FAIL"
+		}
+		fmt.Fprintf(&b, "%s: %s (%s)\n", c.name, status, c.Detail)
+	}
+	return b.String()
+}
+
+/*
+BootCheck runs a built-in self-test of the installation, as a go/no-go gate for a preflight check: it checks the
+ICM20948 WHO_AM_I, runs the gyro and accel self-tests against the factory responses, checks the AK09916 device ID
+and runs its self-test if the magnetometer is enabled, and finally checks that the gyro and accel are quiet over
+a short window.  The device must be kept still for the whole check, which takes about half a second at the
+usual sample rates.
+
+Reading is paused during the check and resumed afterwards, unless it was already paused, and the ranges, filters
+and magnetometer mode are restored, so the driver carries on as configured.  The outcome of each check is in the
+report; an error is only returned if the check can't be run, e.g. while the chip is asleep, or the configuration
+couldn't be restored, in which case Reset re-applies it.
+*/
+func (mpu *ICM20948) BootCheck() (BootReport, error) {
+	var r BootReport
+	if mpu.Asleep() {
+		return r, errors.New("ICM20948 Error: can't run the boot check while the chip is asleep")
+	}
+	if !mpu.Paused() {
+		mpu.Pause()
+		defer mpu.Resume()
+	}
+
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	whoAmI, err := mpu.i2cRead(ICMREG_WHOAMI)
+	r.WhoAmI = bootResult(err == nil && whoAmI == ICM20948_WHOAMI, "0x%02X, expected 0x%02X", whoAmI, ICM20948_WHOAMI)
+	if err != nil {
+		r.WhoAmI.Detail = fmt.Sprintf("couldn't read it: %s", err)
+	}
+	if !r.WhoAmI.Passed {
+		skip := BootCheckResult{Detail: "the chip didn't identify itself"}
+		r.GyroSelfTest, r.AccelSelfTest, r.MagWhoAmI, r.MagSelfTest, r.Noise = skip, skip, skip, skip, skip
+		return r, nil
+	}
+
+	if err := mpu.gyroAccelSelfTest(&r); err != nil {
+		return r, err
+	}
+	if mpu.enableMag {
+		if err := mpu.magBootCheck(&r); err != nil {
+			return r, err
+		}
+	} else {
+		skip := BootCheckResult{Detail: "magnetometer disabled"}
+		r.MagWhoAmI, r.MagSelfTest = skip, skip
+	}
+	r.Noise = mpu.noiseCheck()
+	return r, nil
+}
+
+// bootResult returns the result of a check that was run, with the formatted detail.
+func bootResult(passed bool, format string, a ...interface{}) BootCheckResult {
+	return BootCheckResult{Run: true, Passed: passed, Detail: fmt.Sprintf(format, a...)}
+}
+
+// bootFailure returns the result of a check that couldn't complete because of err.
+func bootFailure(what string, err error) BootCheckResult {
+	return bootResult(false, "couldn't %s: %s", what, err)
+}
+
+// gyroAccelSelfTest runs the gyro and accel self-tests at ±250 °/s and ±2 G, as the factory responses were
+// measured, and fills in their results.  It only returns an error if the ranges and filters couldn't be restored.
+// The caller must hold busMu.
+func (mpu *ICM20948) gyroAccelSelfTest(r *BootReport) error {
+	otp, err := mpu.readBank(1, ICMREG_SELF_TEST_X_GYRO, ICMREG_SELF_TEST_Y_GYRO, ICMREG_SELF_TEST_Z_GYRO,
+		ICMREG_SELF_TEST_X_ACCEL, ICMREG_SELF_TEST_Y_ACCEL, ICMREG_SELF_TEST_Z_ACCEL)
+	if err != nil {
+		r.GyroSelfTest = bootFailure("read the factory self-test responses", err)
+		r.AccelSelfTest = r.GyroSelfTest
+		return nil
+	}
+	saved, err := mpu.readBank(2, ICMREG_GYRO_CONFIG, ICMREG_GYRO_CONFIG_2, ICMREG_ACCEL_CONFIG, ICMREG_ACCEL_CONFIG_2)
+	if err != nil {
+		r.GyroSelfTest = bootFailure("read the configuration", err)
+		r.AccelSelfTest = r.GyroSelfTest
+		return nil
+	}
+
+	var off, on [2][3]float64 // Gyro and accel means with the self-test off and on
+	err = mpu.writeBank(2, ICMREG_GYRO_CONFIG, BITS_DLPF_GYRO_CFG_120HZ|BITS_FS_250DPS, ICMREG_GYRO_CONFIG_2, 0,
+		ICMREG_ACCEL_CONFIG, BITS_DLPF_ACCEL_CFG_111HZ|BITS_FS_2G, ICMREG_ACCEL_CONFIG_2, 0)
+	if err == nil {
+		time.Sleep(selfTestSettle)
+		off, err = mpu.gyroAccelMeans()
+	}
+	if err == nil {
+		err = mpu.writeBank(2, ICMREG_GYRO_CONFIG_2, BITS_GYRO_ST_EN, ICMREG_ACCEL_CONFIG_2, BITS_ACCEL_ST_EN)
+	}
+	if err == nil {
+		time.Sleep(selfTestSettle)
+		on, err = mpu.gyroAccelMeans()
+	}
+	if err != nil {
+		r.GyroSelfTest = bootFailure("run the self-test", err)
+		r.AccelSelfTest = r.GyroSelfTest
+	} else {
+		r.GyroSelfTest = selfTestResult(otp[0:3], off[0], on[0], gyroSelfTestLimits)
+		r.AccelSelfTest = selfTestResult(otp[3:6], off[1], on[1], accelSelfTestLimits)
+	}
+
+	err = mpu.writeBank(2, ICMREG_GYRO_CONFIG, saved[0], ICMREG_GYRO_CONFIG_2, saved[1],
+		ICMREG_ACCEL_CONFIG, saved[2], ICMREG_ACCEL_CONFIG_2, saved[3])
+	if err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't restore the configuration after the self-test: %s", err.Error())
+	}
+	time.Sleep(selfTestSettle)
+	return nil
+}
+
+// gyroAccelMeans returns the mean raw gyro and accel readings over bootSamples.  The caller must hold busMu.
+func (mpu *ICM20948) gyroAccelMeans() (means [2][3]float64, err error) {
+	if means[0], _, err = mpu.sampleAxes(ICMREG_GYRO_XOUT_H); err != nil {
+		return means, err
+	}
+	means[1], _, err = mpu.sampleAxes(ICMREG_ACCEL_XOUT_H)
+	return means, err
+}
+
+// selfTestResult compares the self-test responses, on - off, with the factory responses given by the codes otp.
+func selfTestResult(otp []byte, off, on [3]float64, limits [2]float64) BootCheckResult {
+	r := BootCheckResult{Run: true, Passed: true}
+	ratios := make([]string, len(otp))
+	for i, code := range otp {
+		if code == 0 {
+			r.Passed = false
+			ratios[i] = "no factory response"
+			continue
+		}
+		ratio := math.Abs(on[i]-off[i]) / (selfTestOTPBase * math.Pow(1.01, float64(code)-1))
+		if ratio < limits[0] || ratio > limits[1] {
+			r.Passed = false
+		}
+		ratios[i] = fmt.Sprintf("%.2f", ratio)
+	}
+	r.Detail = "response relative to factory: " + strings.Join(ratios, ", ")
+	return r
+}
+
+// magBootCheck checks the AK09916 device ID and runs its self-test, then restores its mode.  It only returns an
+// error if the mode couldn't be restored.  The caller must hold busMu.
+func (mpu *ICM20948) magBootCheck(r *BootReport) error {
+	if err := mpu.checkMagWhoAmI(); err != nil {
+		r.MagWhoAmI = bootResult(false, "%s", err)
+		r.MagSelfTest = BootCheckResult{Detail: "the magnetometer didn't identify itself"}
+		return nil
+	}
+	r.MagWhoAmI = bootResult(true, "0x%02X", AK09916_Device_ID)
+
+	// Stop Slave 1 rewriting the continuous mode and power down, as the AK09916 needs before a mode change.
+	err := mpu.setMagSingle(true)
+	if err == nil {
+		_, err = mpu.auxTransaction(AK09916_I2C_ADDR, AK09916_CNTL2, AK09916_MODE_SELF_TEST)
+	}
+	var h [3]int16
+	var st2 byte
+	if err == nil {
+		time.Sleep(2 * ak09916MeasureTime)
+		for i := range h {
+			var lo, hi byte
+			if lo, err = mpu.auxTransaction(BIT_I2C_READ|AK09916_I2C_ADDR, AK09916_HXL+byte(2*i), 0); err != nil {
+				break
+			}
+			if hi, err = mpu.auxTransaction(BIT_I2C_READ|AK09916_I2C_ADDR, AK09916_HXH+byte(2*i), 0); err != nil {
+				break
+			}
+			h[i] = int16(uint16(hi)<<8 | uint16(lo))
+		}
+	}
+	if err == nil {
+		// Reading ST2 ends the measurement.
+		st2, err = mpu.auxTransaction(BIT_I2C_READ|AK09916_I2C_ADDR, AK09916_ST2, 0)
+	}
+	if err != nil {
+		r.MagSelfTest = bootFailure("run the self-test", err)
+	} else {
+		ok := st2&AK09916_ST2_HOFL == 0
+		for i, lim := range ak09916SelfTestLimits {
+			ok = ok && h[i] >= lim[0] && h[i] <= lim[1]
+		}
+		r.MagSelfTest = bootResult(ok, "field %d, %d, %d LSB (ST2=0x%02X)", h[0], h[1], h[2], st2)
+	}
+
+	// The AK09916 powers down after the self-test, ready for its mode to be restored.
+	mpu.mu.Lock()
+	single := mpu.magSingle
+	mpu.mu.Unlock()
+	if err := mpu.setMagSingle(single); err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't restore the magnetometer mode after the self-test: %s", err.Error())
+	}
+	return nil
+}
+
+// noiseCheck measures the standard deviations of the gyro and accel in their configured ranges.  The caller must
+// hold busMu.
+func (mpu *ICM20948) noiseCheck() BootCheckResult {
+	_, gsd, err := mpu.sampleAxes(ICMREG_GYRO_XOUT_H)
+	if err != nil {
+		return bootFailure("read the gyro", err)
+	}
+	_, asd, err := mpu.sampleAxes(ICMREG_ACCEL_XOUT_H)
+	if err != nil {
+		return bootFailure("read the accelerometer", err)
+	}
+	mpu.mu.Lock()
+	scaleGyro, scaleAccel := mpu.scaleGyro, mpu.scaleAccel
+	mpu.mu.Unlock()
+	g := math.Max(gsd[0], math.Max(gsd[1], gsd[2])) * scaleGyro
+	a := math.Max(asd[0], math.Max(asd[1], asd[2])) * scaleAccel
+	return bootResult(g <= bootNoiseGyroMax && a <= bootNoiseAccelMax,
+		"largest standard deviation gyro %.3f °/s, accel %.4f G; limits %.1f °/s, %.2f G", g, a,
+		bootNoiseGyroMax, bootNoiseAccelMax)
+}
+
+// sampleAxes reads the three big-endian axes starting at reg bootSamples times, at the gyro sample rate or every
+// bootSamplePeriod if that is slower, and returns their means and standard deviations in LSB.  The caller must hold
+// busMu.
+func (mpu *ICM20948) sampleAxes(reg byte) (mean, sd [3]float64, err error) {
+	mpu.mu.Lock()
+	period := bootSamplePeriod
+	if mpu.gyroRate > 0 && time.Second/time.Duration(mpu.gyroRate) > period {
+		period = time.Second / time.Duration(mpu.gyroRate)
+	}
+	mpu.mu.Unlock()
+
+	var sum, sumSq [3]float64
+	for n := 0; n < bootSamples; n++ {
+		if n > 0 {
+			time.Sleep(period)
+		}
+		for i := range sum {
+			v, err := mpu.i2cRead2(reg + byte(2*i))
+			if err != nil {
+				return mean, sd, err
+			}
+			sum[i] += float64(v)
+			sumSq[i] += float64(v) * float64(v)
+		}
+	}
+	for i := range sum {
+		mean[i] = sum[i] / bootSamples
+		sd[i] = math.Sqrt(math.Max(sumSq[i]/bootSamples-mean[i]*mean[i], 0))
+	}
+	return mean, sd, nil
+}
+
+// readBank reads the registers regs of register bank bank, and leaves the chip on bank 0.  The caller must hold
+// busMu.
+func (mpu *ICM20948) readBank(bank byte, regs ...byte) ([]byte, error) {
+	if err := mpu.setRegBank(bank); err != nil {
+		return nil, err
+	}
+	defer mpu.setRegBank(0)
+	vals := make([]byte, len(regs))
+	for i, reg := range regs {
+		v, err := mpu.i2cRead(reg)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// writeBank writes register, value pairs to register bank bank, and leaves the chip on bank 0.  The caller must
+// hold busMu.
+func (mpu *ICM20948) writeBank(bank byte, regVals ...byte) error {
+	if err := mpu.setRegBank(bank); err != nil {
+		return err
+	}
+	defer mpu.setRegBank(0)
+	for i := 0; i+1 < len(regVals); i += 2 {
+		if err := mpu.i2cWrite(regVals[i], regVals[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+)
+
+const busFaultZeroSamples = 10 // All-zero gyro/accel samples in a row taken as a bus fault
+
+// ErrBusFault is wrapped by the GAError of samples whose gyro/accel words look like a bus fault rather than data.
+var ErrBusFault = errors.New("ICM20948 Error: gyro/accel read looks like a bus fault")
+
+// busFaultDetector recognizes gyro/accel words that a working chip can't return.
+type busFaultDetector struct {
+	zeros int // All-zero samples in a row
+}
+
+/*
+update checks the latest raw gyro and accel words, G1 to A3, and returns whether they look like a bus fault:
+  - all six read 0xFFFF (-1), as from an open bus whose missing ACK the I2C driver doesn't report, or
+  - all six have read 0x0000 for busFaultZeroSamples samples in a row, as from a chip that has lost its
+    configuration and stopped sampling, e.g. after a brownout.
+
+A working accelerometer always measures gravity or acceleration on some axis, and its noise moves the reading
+between samples, so neither happens with a connected, running sensor, even at rest or in free fall.
+*/
+func (b *busFaultDetector) update(vs ...int16) bool {
+	ones, zeros := true, true
+	for _, v := range vs {
+		ones = ones && v == -1
+		zeros = zeros && v == 0
+	}
+	if !zeros {
+		b.zeros = 0
+		return ones
+	}
+	b.zeros++
+	return b.zeros >= busFaultZeroSamples
+}
+
+// checkBusFault checks the raw gyro and accel words of a sample, returning an error wrapping ErrBusFault, counted
+// in Stats, if they look like a bus fault.
+func (mpu *ICM20948) checkBusFault(g1, g2, g3, a1, a2, a3 int16) error {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	if !mpu.busFault.update(g1, g2, g3, a1, a2, a3) {
+		return nil
+	}
+	mpu.stats.BusFaults++
+	return fmt.Errorf("%w: all gyro/accel words read 0x%04X", ErrBusFault, uint16(g1))
+}
@@ -0,0 +1,83 @@
+package icm20948
+
+import "fmt"
+
+const (
+	defaultBusClock  = 100000 // Raspberry Pi default I2C clock, Hz
+	busLoadWarnLevel = 0.8    // Fraction of the bus capacity above which EstimateBusLoad warns
+
+	// Bytes on the wire per register read: address, register, address again and the data.
+	bytesReadByte = 4
+	bytesReadWord = 5
+)
+
+// BusLoad is the I2C traffic the driver generates for a Config; see EstimateBusLoad.
+type BusLoad struct {
+	Transactions float64 // I2C transactions per second
+	Bytes        float64 // Bytes on the wire per second, including addresses and register numbers
+	Utilization  float64 // Fraction of the bus capacity used
+	Warning      string  // Set if the load is too high to sustain reliably
+}
+
+/*
+EstimateBusLoad estimates the I2C traffic the driver generates when run with cfg, for checking that a sample rate
+is feasible before committing to it.  It follows the driver's read strategy: one 16-bit register read per
+axis and for the temperature on each accel/gyro read (split between the gyro and accel reads when they run at
+different rates), and on each magnetometer poll a read of ST1 followed, when there is new data, by three 16-bit
+reads and a read of ST2.  The driver doesn't use the FIFO.
+The estimate only counts bus clocks; the per-transaction overhead of the kernel driver and the occasional
+configuration check are not included, so treat anything close to the warning level as infeasible.  WithRateCheck
+measures the actual read times on the target, and AchievedRate the rate the driver gets.
+*/
+func EstimateBusLoad(cfg Config) BusLoad {
+	var load BusLoad
+	busClock := cfg.BusClock
+	if busClock <= 0 {
+		busClock = defaultBusClock
+	}
+	if cfg.SampleRate <= 0 {
+		load.Warning = fmt.Sprintf("%d Hz is not a valid sample rate", cfg.SampleRate)
+		return load
+	}
+
+	var clocks float64
+	// Each byte takes 9 clocks (8 bits and ACK), plus about 3 for the start, repeated start and stop.
+	add := func(rate float64, n int, bytesEach int) {
+		load.Transactions += rate * float64(n)
+		load.Bytes += rate * float64(n*bytesEach)
+		clocks += rate * float64(n*(9*bytesEach+3))
+	}
+
+	gyroRate, accelRate := float64(cfg.SampleRate), float64(cfg.AccelSampleRate)
+	sampleRate := cfg.SampleRate
+	if cfg.AccelSampleRate <= 0 || cfg.AccelSampleRate == cfg.SampleRate {
+		add(gyroRate, 7, bytesReadWord) // Gyro, accel and temperature
+	} else {
+		add(gyroRate, 4, bytesReadWord)  // Gyro and temperature
+		add(accelRate, 3, bytesReadWord) // Accel
+		if cfg.AccelSampleRate > sampleRate {
+			sampleRate = cfg.AccelSampleRate
+		}
+	}
+
+	if cfg.EnableMag {
+		pollRate := sampleRate
+		if pollRate > 100 {
+			pollRate = 100
+		}
+		_, magRate := ak09916Mode(sampleRate)
+		if magRate > pollRate {
+			magRate = pollRate
+		}
+		add(float64(pollRate), 1, bytesReadByte)
+		add(float64(magRate), 3, bytesReadWord)
+		add(float64(magRate), 1, bytesReadByte)
+	}
+
+	load.Utilization = clocks / float64(busClock)
+	if load.Utilization > busLoadWarnLevel {
+		load.Warning = fmt.Sprintf("I2C bus %.0f%% loaded at %d Hz; lower the sample rate or raise the bus clock",
+			100*load.Utilization, busClock)
+	}
+	return load
+}
@@ -0,0 +1,65 @@
+package icm20948
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const defaultBusTimeout = 100 * time.Millisecond // Longest a single I2C transaction may take before it is abandoned
+
+// ErrBusTimeout is returned (wrapped) by operations whose I2C transaction didn't complete within the bus timeout.
+var ErrBusTimeout = errors.New("ICM20948 Error: I2C transaction timed out")
+
+// WithBusTimeout sets the bus timeout; see SetBusTimeout.
+func WithBusTimeout(timeout time.Duration) Option {
+	return func(mpu *ICM20948) {
+		mpu.busTimeout = int64(timeout)
+	}
+}
+
+/*
+SetBusTimeout sets how long a single I2C transaction may take before it is abandoned with ErrBusTimeout; the
+default is 100ms.  A stalled bus would otherwise hang readSensors, and everything waiting on its channels,
+forever; instead the failed reads show up as GAError/MagError and the watchdog can act on them.  Timeouts are
+counted in Stats.  A timeout of 0 waits indefinitely.
+The kernel can't cancel a transaction, so an abandoned one still completes (or stays stuck) in the background.
+*/
+func (mpu *ICM20948) SetBusTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return errors.New("ICM20948 Error: bus timeout must not be negative")
+	}
+	atomic.StoreInt64(&mpu.busTimeout, int64(timeout))
+	return nil
+}
+
+// busResult is the outcome of an I2C transaction run by busOp.
+type busResult struct {
+	v   uint16
+	err error
+}
+
+// busOp runs the I2C transaction op, giving up after the bus timeout.  op must not write to anything the
+// caller uses after a timeout, since it may still be running.  busOp doesn't lock, so it may be called with
+// mpu.mu held.
+func (mpu *ICM20948) busOp(op func() (uint16, error)) (uint16, error) {
+	timeout := time.Duration(atomic.LoadInt64(&mpu.busTimeout))
+	if timeout <= 0 {
+		return op()
+	}
+
+	c := make(chan busResult, 1) // Buffered so an abandoned op can finish and exit
+	go func() {
+		v, err := op()
+		c <- busResult{v, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-c:
+		return r.v, r.err
+	case <-timer.C:
+		atomic.AddInt64(&mpu.busTimeouts, 1)
+		return 0, ErrBusTimeout
+	}
+}
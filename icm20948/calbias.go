@@ -0,0 +1,76 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+/*
+SetGyroBias sets the gyro bias, in °/s, for users who calibrate externally and already have the numbers.  It
+replaces whatever bias was loaded from the calibration file or read from the chip's factory offsets (see
+WithHWOffsets); those are only read when the driver is created, so a bias set here is kept until it is set again
+or changed by a calibration routine.  The bias is held in raw units internally, so it stays the same in °/s if
+the sensitivity is changed.  Like the calibration file, the bias is in the chip's axes, whatever axis map is set.
+The new bias isn't saved; call SaveCalibration to keep it.
+*/
+func (mpu *ICM20948) SetGyroBias(x, y, z float64) error {
+	if !finite(x, y, z) {
+		return errors.New("ICM20948 Error: gyro bias must be finite")
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.G01, mpu.G02, mpu.G03 = x/mpu.scaleGyro, y/mpu.scaleGyro, z/mpu.scaleGyro
+	mpu.calTime, mpu.calSource = time.Now(), "gyro bias set with SetGyroBias"
+	return nil
+}
+
+// SetAccelBias sets the accelerometer bias, in G, in the chip's axes.  It interacts with the factory offsets and
+// sensitivity changes as SetGyroBias does, and isn't saved until SaveCalibration is called.
+func (mpu *ICM20948) SetAccelBias(x, y, z float64) error {
+	if !finite(x, y, z) {
+		return errors.New("ICM20948 Error: accel bias must be finite")
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.A01, mpu.A02, mpu.A03 = x/mpu.scaleAccel, y/mpu.scaleAccel, z/mpu.scaleAccel
+	mpu.calTime, mpu.calSource = time.Now(), "accel bias set with SetAccelBias"
+	return nil
+}
+
+// SetMagHardIron sets the magnetometer hard-iron offsets (M01-M03), in µT, in the AK09916's axes.  They are
+// subtracted before the soft-iron matrix is applied, unless turned off with SetMagCorrection.  The chip has no
+// factory hard-iron offsets, so WithHWOffsets doesn't affect them.  They aren't saved until SaveCalibration is
+// called.
+func (mpu *ICM20948) SetMagHardIron(x, y, z float64) error {
+	if !finite(x, y, z) {
+		return errors.New("ICM20948 Error: magnetometer hard-iron offsets must be finite")
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.M01, mpu.M02, mpu.M03 = x, y, z
+	mpu.calTime, mpu.calSource = time.Now(), "magnetometer hard iron set with SetMagHardIron"
+	return nil
+}
+
+// SaveCalibration saves the calibration currently applied to the calibration file, e.g. after setting the biases
+// with SetGyroBias, SetAccelBias or SetMagHardIron.
+func (mpu *ICM20948) SaveCalibration() error {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	if err := mpu.mpuCalData.save(mpu.calPath); err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't save the calibration: %s", err.Error())
+	}
+	return nil
+}
+
+// finite reports whether none of vs is NaN or infinite.
+func finite(vs ...float64) bool {
+	for _, v := range vs {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
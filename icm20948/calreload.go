@@ -0,0 +1,90 @@
+package icm20948
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const minSoftIronDet = 1e-6 // Smallest soft-iron determinant accepted, below which the matrix is degenerate
+
+/*
+ReloadCalibration re-reads the calibration file, e.g. after it has been rewritten by a separate calibration tool,
+and applies it from the next sample without restarting the driver.  The file is checked first: every value must
+be finite, the soft-iron matrix must not be degenerate or mirror the field, and the field must not be negative.
+If it fails the check or can't be read, an error is returned and the calibration in use is kept.  The values that
+changed are logged.  With SetHWBiasRemoval enabled, any change in the biases is removed in software until it is
+called again.
+*/
+func (mpu *ICM20948) ReloadCalibration() error {
+	f, err := os.Open(mpu.calPath)
+	if err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't read the calibration: %s", err.Error())
+	}
+	defer f.Close()
+	return mpu.reloadCalibration(f, mpu.calPath)
+}
+
+// ReloadCalibrationFrom is ReloadCalibration for a calibration in the calibration file format read from r.
+func (mpu *ICM20948) ReloadCalibrationFrom(r io.Reader) error {
+	return mpu.reloadCalibration(r, "reader")
+}
+
+// reloadCalibration reads, checks and applies the calibration in r, which came from source.
+func (mpu *ICM20948) reloadCalibration(r io.Reader, source string) error {
+	var cal mpuCalData
+	if err := json.NewDecoder(r).Decode(&cal); err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't parse the calibration from %s: %s", source, err.Error())
+	}
+	if err := cal.validate(); err != nil {
+		return err
+	}
+
+	mpu.mu.Lock()
+	old := mpu.mpuCalData
+	mpu.mpuCalData = cal
+	mpu.calTime, mpu.calSource = time.Now(), "reloaded from "+source
+	mpu.mu.Unlock()
+
+	if changes := cal.diff(old); len(changes) > 0 {
+		log.Printf("ICM20948: Calibration reloaded from %s: %s\n", source, strings.Join(changes, ", "))
+	} else {
+		log.Printf("ICM20948: Calibration reloaded from %s, unchanged\n", source)
+	}
+	return nil
+}
+
+// validate checks that the calibration is usable.
+func (d *mpuCalData) validate() error {
+	v := reflect.ValueOf(*d)
+	for i := 0; i < v.NumField(); i++ {
+		if !finite(v.Field(i).Float()) {
+			return fmt.Errorf("ICM20948 Error: calibration %s is %g", v.Type().Field(i).Name, v.Field(i).Float())
+		}
+	}
+	soft := AxisMap{{d.Ms11, d.Ms12, d.Ms13}, {d.Ms21, d.Ms22, d.Ms23}, {d.Ms31, d.Ms32, d.Ms33}}
+	if det := soft.det(); det < minSoftIronDet {
+		return fmt.Errorf("ICM20948 Error: calibration soft-iron matrix has determinant %g", det)
+	}
+	if d.MagField < 0 || d.MagNoise < 0 {
+		return errors.New("ICM20948 Error: calibration magnetic field and noise must not be negative")
+	}
+	return nil
+}
+
+// diff describes the fields of d that differ from old, as "name old -> new".
+func (d *mpuCalData) diff(old mpuCalData) (changes []string) {
+	v, o := reflect.ValueOf(*d), reflect.ValueOf(old)
+	for i := 0; i < v.NumField(); i++ {
+		if nv, ov := v.Field(i).Float(), o.Field(i).Float(); nv != ov {
+			changes = append(changes, fmt.Sprintf("%s %g -> %g", v.Type().Field(i).Name, ov, nv))
+		}
+	}
+	return changes
+}
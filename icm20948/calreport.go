@@ -0,0 +1,64 @@
+package icm20948
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+/*
+CalibrationReport writes a human-readable summary of the calibration currently applied to w, for support and for
+checking by eye that it is sane: the gyro and accel biases in °/s and G, the magnetometer hard-iron offsets in µT,
+the soft-iron matrix and its determinant, which should be near 1 for a matrix near the identity, the calibrated
+field and the gyro g-sensitivity, followed by when and how the calibration was loaded or last changed.  The
+biases are in the chip's axes, and the magnetometer calibration in the AK09916's, as in the calibration file.
+Errors writing to w are ignored.
+*/
+func (mpu *ICM20948) CalibrationReport(w io.Writer) {
+	mpu.mu.Lock()
+	cal, scaleGyro, scaleAccel := mpu.mpuCalData, mpu.scaleGyro, mpu.scaleAccel
+	skipHardIron, skipSoftIron := mpu.skipHardIron, mpu.skipSoftIron
+	calTime, calSource := mpu.calTime, mpu.calSource
+	mpu.mu.Unlock()
+
+	notApplied := func(skip bool) string {
+		if skip {
+			return " (not applied; see SetMagCorrection)"
+		}
+		return ""
+	}
+	fmt.Fprintf(w, "Gyro bias:          %8.3f %8.3f %8.3f °/s\n", cal.G01*scaleGyro, cal.G02*scaleGyro, cal.G03*scaleGyro)
+	fmt.Fprintf(w, "Accel bias:         %8.4f %8.4f %8.4f G\n", cal.A01*scaleAccel, cal.A02*scaleAccel, cal.A03*scaleAccel)
+	fmt.Fprintf(w, "Mag hard iron:      %8.2f %8.2f %8.2f µT%s\n", cal.M01, cal.M02, cal.M03, notApplied(skipHardIron))
+	soft := AxisMap{{cal.Ms11, cal.Ms12, cal.Ms13}, {cal.Ms21, cal.Ms22, cal.Ms23}, {cal.Ms31, cal.Ms32, cal.Ms33}}
+	for i, row := range soft {
+		label := ""
+		if i == 0 {
+			label = "Mag soft iron:"
+		}
+		fmt.Fprintf(w, "%-19s %8.4f %8.4f %8.4f\n", label, row[0], row[1], row[2])
+	}
+	fmt.Fprintf(w, "%-19s determinant %.4f%s\n", "", soft.det(), notApplied(skipSoftIron))
+	if cal.MagField > 0 {
+		fmt.Fprintf(w, "Mag field:          %8.2f µT (noise %.1f%%)\n", cal.MagField, 100*cal.MagNoise)
+	} else {
+		fmt.Fprintln(w, "Mag field:          unknown")
+	}
+	gs := [3][3]float64{{cal.Gs11, cal.Gs12, cal.Gs13}, {cal.Gs21, cal.Gs22, cal.Gs23}, {cal.Gs31, cal.Gs32, cal.Gs33}}
+	if gs == [3][3]float64{} {
+		fmt.Fprintln(w, "Gyro g-sensitivity: none")
+	} else {
+		for i, row := range gs {
+			label := ""
+			if i == 0 {
+				label = "Gyro g-sensitivity:"
+			}
+			fmt.Fprintf(w, "%-19s %8.4f %8.4f %8.4f °/s per G\n", label, row[0], row[1], row[2])
+		}
+	}
+	if calTime.IsZero() {
+		fmt.Fprintln(w, "Derived:            never loaded")
+		return
+	}
+	fmt.Fprintf(w, "Derived:            %s, %s\n", calTime.Format(time.RFC3339), calSource)
+}
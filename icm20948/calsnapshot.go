@@ -0,0 +1,42 @@
+package icm20948
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+/*
+CalibrationSnapshot returns the calibration currently applied, serialized as JSON in the same format as the
+calibration file, and the time it was loaded or last changed (e.g. by reading the factory biases).
+It is intended for flight log headers, so there is a record of exactly which calibration was active.
+*/
+func (mpu *ICM20948) CalibrationSnapshot() ([]byte, time.Time) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	buf, err := json.Marshal(mpu.mpuCalData)
+	if err != nil {
+		log.Printf("ICM20948: Error marshaling calibration data: %s", err)
+	}
+	return buf, mpu.calTime
+}
+
+// CalibrationDrift compares the calibration currently applied with the calibration file and reports whether
+// they differ, e.g. because the file was rewritten by another process or the biases were changed at runtime.
+// An error is returned if the file can't be read.
+func (mpu *ICM20948) CalibrationDrift() (bool, error) {
+	var onDisk mpuCalData
+	if err := onDisk.load(mpu.calPath); err != nil {
+		return false, err
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return onDisk != mpu.mpuCalData, nil
+}
+
+// calibrationChanged records that the calibration was loaded or changed, and how.
+func (mpu *ICM20948) calibrationChanged(how string) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.calTime, mpu.calSource = time.Now(), how
+}
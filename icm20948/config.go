@@ -0,0 +1,227 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultSensitivityGyro  = 250 // °/s
+	defaultSensitivityAccel = 4   // G
+	defaultSampleRate       = 50  // Hz
+)
+
+// Config describes how the ICM20948 is to be run.  Zero values take the defaults given below.  Validate checks a
+// Config without the hardware.
+type Config struct {
+	SensitivityGyro  int    // Gyro range, °/s: 250 (default), 500, 1000 or 2000
+	SensitivityAccel int    // Accel range, G: 2, 4 (default), 8 or 16
+	SampleRate       int    // Gyro (and accel) sample rate, Hz; default 50
+	AccelSampleRate  int    // Accel sample rate if different from SampleRate, Hz; 0 for the same
+	EnableMag        bool   // Whether the magnetometer is read; default off
+	ApplyHWOffsets   bool   // Whether to start from the factory accel and gyro offsets; default off
+	CalibrationPath  string // Calibration file; default /etc/icm20948cal.json
+	Address          byte   // I2C address: 0x68 (default, AD0 low) or 0x69 (AD0 high)
+	BusClock         int    // I2C bus clock, Hz, for EstimateBusLoad; 0 for the Raspberry Pi default of 100 kHz
+}
+
+// withDefaults returns cfg with the defaults filled in.
+func (cfg Config) withDefaults() Config {
+	if cfg.SensitivityGyro == 0 {
+		cfg.SensitivityGyro = defaultSensitivityGyro
+	}
+	if cfg.SensitivityAccel == 0 {
+		cfg.SensitivityAccel = defaultSensitivityAccel
+	}
+	if cfg.SampleRate == 0 {
+		cfg.SampleRate = defaultSampleRate
+	}
+	if cfg.AccelSampleRate == 0 {
+		cfg.AccelSampleRate = cfg.SampleRate
+	}
+	if cfg.CalibrationPath == "" {
+		cfg.CalibrationPath = calDataLocation
+	}
+	if cfg.Address == 0 {
+		cfg.Address = MPU_ADDRESS
+	}
+	return cfg
+}
+
+// validate checks a Config with its defaults filled in, returning the first problem, as the constructor does.
+func (cfg Config) validate() error {
+	if errs := cfg.check(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// check returns all the problems with a Config with its defaults filled in that the constructor rejects.
+func (cfg Config) check() (errs []error) {
+	if !validRange(cfg.SensitivityGyro, gyroRanges) {
+		errs = append(errs, fmt.Errorf("ICM20948 Error: %d is not a valid gyro sensitivity", cfg.SensitivityGyro))
+	}
+	if !validRange(cfg.SensitivityAccel, accelRanges) {
+		errs = append(errs, fmt.Errorf("ICM20948 Error: %d is not a valid accel sensitivity", cfg.SensitivityAccel))
+	}
+	if _, err := sampleRateDivider(cfg.SampleRate, maxGyroDivider); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := sampleRateDivider(cfg.AccelSampleRate, maxAccelDivider); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Address != MPU_ADDRESS && cfg.Address != MPU_ADDRESS+1 {
+		errs = append(errs, fmt.Errorf("ICM20948 Error: 0x%02X is not a valid ICM20948 address", cfg.Address))
+	}
+	if cfg.BusClock < 0 {
+		errs = append(errs, fmt.Errorf("ICM20948 Error: %d Hz is not a valid bus clock", cfg.BusClock))
+	}
+	return errs
+}
+
+// ConfigErrors is the error returned by Config.Validate: each problem found with the Config.
+type ConfigErrors []error
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = strings.TrimPrefix(err.Error(), "ICM20948 Error: ")
+	}
+	return "ICM20948 Error: invalid configuration: " + strings.Join(msgs, "; ")
+}
+
+/*
+Validate checks cfg, with the defaults filled in, without opening the bus, e.g. to check a configuration in CI or
+a configuration UI before it is deployed.  It makes the checks the constructor makes, and also checks that the
+configuration is achievable:
+  - the magnetometer, if enabled, measures no faster than the samples are read, i.e. at 10 Hz or more;
+  - reading the sensors fits in the bus clock, as estimated by EstimateBusLoad;
+  - the calibration file can be written, or created in an existing directory, so calibrations can be saved.
+
+The constructor doesn't need these, as it only warns, or fails later, when they don't hold.  All the problems
+found are returned together as ConfigErrors, or nil if there are none.
+*/
+func (cfg Config) Validate() error {
+	cfg = cfg.withDefaults()
+	errs := cfg.check()
+	if len(errs) == 0 {
+		// The rates are valid, so the cross-checks make sense.
+		rate := cfg.SampleRate
+		if cfg.AccelSampleRate > rate {
+			rate = cfg.AccelSampleRate
+		}
+		if _, magRate := ak09916Mode(rate); cfg.EnableMag && magRate > rate {
+			errs = append(errs, fmt.Errorf("ICM20948 Error: the magnetometer measures at %d Hz, faster than the "+
+				"%d Hz sample rate reads it", magRate, rate))
+		}
+		if load := EstimateBusLoad(cfg); load.Utilization > 1 {
+			errs = append(errs, fmt.Errorf("ICM20948 Error: reading the sensors needs %.0f%% of the I2C bus",
+				100*load.Utilization))
+		}
+	}
+	if err := checkWritable(cfg.CalibrationPath); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return ConfigErrors(errs)
+}
+
+// checkWritable checks that the file at path can be written, or created if it doesn't exist, without changing it.
+func checkWritable(path string) error {
+	fi, err := os.Stat(path)
+	switch {
+	case err == nil && fi.IsDir():
+		return fmt.Errorf("ICM20948 Error: calibration path %s is a directory", path)
+	case err == nil:
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("ICM20948 Error: calibration file can't be written: %s", err.Error())
+		}
+		return f.Close()
+	case !errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("ICM20948 Error: calibration file can't be checked: %s", err.Error())
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".icm20948cal")
+	if err != nil {
+		return fmt.Errorf("ICM20948 Error: calibration file %s can't be created: %s", path, err.Error())
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func validRange(r int, ranges []int) bool {
+	for _, v := range ranges {
+		if r == v {
+			return true
+		}
+	}
+	return false
+}
+
+// WithConfig sets all the Config settings at once.  It replaces any settings made by earlier options.
+func WithConfig(cfg Config) Option {
+	return func(mpu *ICM20948) {
+		mpu.cfg = cfg
+	}
+}
+
+// WithGyroSensitivity sets the gyro range in °/s; see SetGyroSensitivity.
+func WithGyroSensitivity(dps int) Option {
+	return func(mpu *ICM20948) {
+		mpu.cfg.SensitivityGyro = dps
+	}
+}
+
+// WithAccelSensitivity sets the accel range in G; see SetAccelSensitivity.
+func WithAccelSensitivity(g int) Option {
+	return func(mpu *ICM20948) {
+		mpu.cfg.SensitivityAccel = g
+	}
+}
+
+// WithSampleRate sets the gyro and accel sample rate in Hz.
+func WithSampleRate(hz int) Option {
+	return func(mpu *ICM20948) {
+		mpu.cfg.SampleRate = hz
+	}
+}
+
+// WithAccelSampleRate sets an accel sample rate different from the gyro's; see SetGyroSampleRate.
+func WithAccelSampleRate(hz int) Option {
+	return func(mpu *ICM20948) {
+		mpu.cfg.AccelSampleRate = hz
+	}
+}
+
+// WithMagnetometer sets whether the magnetometer is read.
+func WithMagnetometer(enable bool) Option {
+	return func(mpu *ICM20948) {
+		mpu.cfg.EnableMag = enable
+	}
+}
+
+// WithHWOffsets sets whether the factory accel and gyro offsets stored on the chip are used as the biases.
+func WithHWOffsets(apply bool) Option {
+	return func(mpu *ICM20948) {
+		mpu.cfg.ApplyHWOffsets = apply
+	}
+}
+
+// WithCalibrationPath sets the file the calibration is loaded from and saved to.
+func WithCalibrationPath(path string) Option {
+	return func(mpu *ICM20948) {
+		mpu.cfg.CalibrationPath = path
+	}
+}
+
+// WithAddress sets the I2C address of the ICM20948: 0x68, or 0x69 if its AD0 pin is high.
+func WithAddress(addr byte) Option {
+	return func(mpu *ICM20948) {
+		mpu.cfg.Address = addr
+	}
+}
@@ -0,0 +1,129 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const decimatedBufSize = 10 // Size of the channel of each DecimatedStream
+
+// decimator averages every factor samples into one, for DecimatedStream.
+type decimator struct {
+	factor int
+	c      chan *MPUData
+	sum    MPUData   // Sums of the values, and the other fields of the output being built
+	n      int       // Input samples in sum, with or without errors
+	nm     int       // New magnetometer readings in sum
+	lastTM time.Time // Time of the last magnetometer reading counted
+	lastT  time.Time // Time of the last input of the previous output
+	seq    uint64    // Seq of the latest output
+}
+
+// add adds d to the average and returns the average once factor samples have been added, otherwise nil.
+func (dc *decimator) add(d *MPUData) *MPUData {
+	s := &dc.sum
+	if dc.lastT.IsZero() {
+		dc.lastT = d.T
+	}
+	dc.n++
+	if d.GAError == nil {
+		s.G1, s.G2, s.G3 = s.G1+d.G1, s.G2+d.G2, s.G3+d.G3
+		s.A1, s.A2, s.A3 = s.A1+d.A1, s.A2+d.A2, s.A3+d.A3
+		s.Temp += d.Temp
+		s.N++
+	}
+	if d.MagError == nil && !d.TM.IsZero() && !d.TM.Equal(dc.lastTM) {
+		s.M1, s.M2, s.M3 = s.M1+d.M1, s.M2+d.M2, s.M3+d.M3
+		s.TM, s.MagAnomaly = d.TM, s.MagAnomaly || d.MagAnomaly
+		dc.lastTM = d.TM
+		dc.nm++
+	}
+	s.Saturated |= d.Saturated
+	s.MagOverrun = s.MagOverrun || d.MagOverrun
+	s.T = d.T
+	if dc.n < dc.factor {
+		return nil
+	}
+
+	v := *s
+	if v.N > 0 {
+		n := float64(v.N)
+		v.G1, v.G2, v.G3 = v.G1/n, v.G2/n, v.G3/n
+		v.A1, v.A2, v.A3 = v.A1/n, v.A2/n, v.A3/n
+		v.Temp /= n
+	} else {
+		v.GAError = errors.New("ICM20948 Error: No accel/gyro values in decimation interval")
+	}
+	if dc.nm > 0 {
+		nm := float64(dc.nm)
+		v.M1, v.M2, v.M3 = v.M1/nm, v.M2/nm, v.M3/nm
+		v.NM = dc.nm
+	} else {
+		v.MagError = errors.New("ICM20948 Error: No magnetometer values in decimation interval")
+	}
+	v.DT = v.T.Sub(dc.lastT)
+	dc.seq++
+	v.Seq = dc.seq
+
+	dc.lastT = v.T
+	dc.sum, dc.n, dc.nm = MPUData{}, 0, 0
+	return &v
+}
+
+/*
+DecimatedStream returns a channel on which every factor samples are averaged into one, e.g. a factor of 10 turns
+100 Hz reads into 10 Hz output, each the mean of the ten reads since the last, as anti-aliased decimation for
+logging at a lower rate.  Unlike CAvg, whose window depends on when it is read, the windows are always exactly
+factor samples long.  N counts the accel/gyro samples averaged, NM the new magnetometer readings, T is the time of
+the last sample in the window, DT the time since the previous output and Seq counts the outputs.  Saturated,
+MagAnomaly and MagOverrun are set if they were on any sample in the window.
+
+Each call starts a new stream.  If the output isn't read fast enough the oldest is dropped.  The channel is
+closed by CloseMPU.
+*/
+func (mpu *ICM20948) DecimatedStream(factor int) (<-chan *MPUData, error) {
+	if factor < 1 {
+		return nil, fmt.Errorf("ICM20948 Error: %d is not a valid decimation factor", factor)
+	}
+	dc := &decimator{factor: factor, c: make(chan *MPUData, decimatedBufSize)}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	select {
+	case <-mpu.cDone:
+		return nil, errors.New("ICM20948 Error: driver closed")
+	default:
+	}
+	mpu.decimators = append(mpu.decimators, dc)
+	return dc.c, nil
+}
+
+// decimate feeds d to the streams from DecimatedStream and sends their completed averages, dropping the oldest
+// if a stream is full.  The caller must hold mpu.mu.
+func (mpu *ICM20948) decimate(d *MPUData) {
+	for _, dc := range mpu.decimators {
+		v := dc.add(d)
+		if v == nil {
+			continue
+		}
+		select {
+		case dc.c <- v:
+		default:
+			select {
+			case <-dc.c:
+			default:
+			}
+			dc.c <- v
+		}
+	}
+}
+
+// closeDecimators closes the channels of the streams from DecimatedStream.
+func (mpu *ICM20948) closeDecimators() {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	for _, dc := range mpu.decimators {
+		close(dc.c)
+	}
+	mpu.decimators = nil
+}
@@ -0,0 +1,220 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+Diagnostics summarizes what the driver found on the bus when it last configured the chip, at startup or on
+Reset, for attaching to bug reports.  Fields that couldn't be read are left zero and the failure is described
+in Problems.
+*/
+type Diagnostics struct {
+	WhoAmI           byte     // ICM20948 WHO_AM_I; ICM20948_WHOAMI (0xEA) for a genuine part
+	I2CMasterEnabled bool     // The internal I2C master is on (USER_CTRL I2C_MST_EN)
+	BypassDisabled   bool     // The aux bus isn't bypassed to the host (INT_PIN_CFG BYPASS_EN off), as the I2C master needs
+	I2CMasterStatus  byte     // I2C_MST_STATUS, e.g. NACK flags from the aux devices
+	MagEnabled       bool     // The magnetometer was requested
+	MagDetected      bool     // The magnetometer answered with the expected device ID
+	MagModel         string   // Magnetometer model, e.g. "AK09916"
+	MagWhoAmI        byte     // Magnetometer device ID (AK09916 WIA2); AK09916_Device_ID (0x09) expected
+	MagMode          byte     // Magnetometer CNTL2 (measurement mode) read back after setting it
+	Problems         []string // Anything that looked wrong
+}
+
+// Diagnostics returns the results of the probing done when the chip was last configured.
+func (mpu *ICM20948) Diagnostics() Diagnostics {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	d := mpu.diag
+	d.Problems = append([]string(nil), mpu.diag.Problems...)
+	return d
+}
+
+// diagnose probes the chip after configure and records the results for Diagnostics.  Problems are recorded
+// rather than returned, so a partly working chip still starts.  The caller must hold busMu if readSensors is
+// running.
+func (mpu *ICM20948) diagnose() {
+	var d Diagnostics
+	problem := func(format string, a ...interface{}) {
+		d.Problems = append(d.Problems, fmt.Sprintf(format, a...))
+	}
+
+	var err error
+	if d.WhoAmI, err = mpu.i2cRead(ICMREG_WHOAMI); err != nil {
+		problem("couldn't read WHO_AM_I: %s", err)
+	} else if d.WhoAmI != ICM20948_WHOAMI {
+		problem("WHO_AM_I is 0x%02X, expected 0x%02X", d.WhoAmI, ICM20948_WHOAMI)
+	}
+
+	if userCtrl, err := mpu.i2cRead(ICMREG_USER_CTRL); err != nil {
+		problem("couldn't read USER_CTRL: %s", err)
+	} else {
+		d.I2CMasterEnabled = userCtrl&BIT_AUX_IF_EN != 0
+	}
+	if intPinCfg, err := mpu.i2cRead(ICMREG_INT_PIN_CFG); err != nil {
+		problem("couldn't read INT_PIN_CFG: %s", err)
+	} else {
+		d.BypassDisabled = intPinCfg&BIT_BYPASS_EN == 0
+	}
+	if d.I2CMasterStatus, err = mpu.i2cRead(ICMREG_I2C_MST_STATUS); err != nil {
+		problem("couldn't read I2C_MST_STATUS: %s", err)
+	}
+
+	mpu.mu.Lock()
+	d.MagEnabled, d.MagModel = mpu.enableMag, mpu.magModel
+	magSingle := mpu.magSingle
+	mpu.mu.Unlock()
+	if d.MagEnabled {
+		if !d.I2CMasterEnabled {
+			problem("magnetometer enabled but the I2C master is off")
+		}
+		if !d.BypassDisabled {
+			problem("magnetometer enabled but the aux bus is bypassed")
+		}
+		if d.MagWhoAmI, err = mpu.auxTransaction(BIT_I2C_READ|AK09916_I2C_ADDR, AK09916_WIA2, 0); err != nil {
+			problem("couldn't read the magnetometer device ID: %s", err)
+		} else if d.MagDetected = d.MagWhoAmI == AK09916_Device_ID; !d.MagDetected {
+			problem("magnetometer device ID is 0x%02X, expected 0x%02X", d.MagWhoAmI, AK09916_Device_ID)
+		}
+		mode, _ := ak09916Mode(mpu.SampleRate())
+		if d.MagMode, err = mpu.auxTransaction(BIT_I2C_READ|AK09916_I2C_ADDR, AK09916_CNTL2, 0); err != nil {
+			problem("couldn't read back the magnetometer mode: %s", err)
+		} else if !magSingle && d.MagMode != mode {
+			problem("magnetometer mode is 0x%02X, expected 0x%02X", d.MagMode, mode)
+		}
+	}
+
+	mpu.mu.Lock()
+	mpu.diag = d
+	mpu.mu.Unlock()
+}
+
+// gyroDLPFBandwidth and accelDLPFBandwidth are the 3 dB bandwidths (Hz) of the DLPF settings 0-7 (DLPFCFG).
+var (
+	gyroDLPFBandwidth  = [8]float64{196.6, 151.8, 119.5, 51.2, 23.9, 11.6, 5.7, 361.4}
+	accelDLPFBandwidth = [8]float64{246.0, 246.0, 111.4, 50.4, 23.9, 11.5, 5.7, 473.0}
+)
+
+const (
+	gyroBypassRate, gyroBypassBandwidth   = 9000, 12106 // Gyro output rate and bandwidth (Hz) with the DLPF bypassed
+	accelBypassRate, accelBypassBandwidth = 4500, 1209  // Accel output rate and bandwidth (Hz) with the DLPF bypassed
+)
+
+/*
+Configuration is the sampling and filtering the chip is actually set to, decoded from its registers by
+Configuration, for diagnosing data that looks filtered or aliased.
+*/
+type Configuration struct {
+	GyroRate, AccelRate           float64 // Output data rates, Hz
+	GyroDLPF, AccelDLPF           bool    // The DLPF is on (FCHOICE); if not, the rates and bandwidths are those of the bypass
+	GyroDLPFCfg, AccelDLPFCfg     byte    // DLPF settings (DLPFCFG 0-7)
+	GyroBandwidth, AccelBandwidth float64 // 3 dB bandwidths, Hz
+	GyroSensitivity               int     // Gyro full scale, °/s
+	AccelSensitivity              int     // Accel full scale, G
+	I2CMasterRate                 float64 // I2C master rate (I2C_MST_ODR_CONFIG), Hz; the magnetometer is read at this rate
+	MagEnabled                    bool    // The magnetometer is enabled, so MagMode and MagRate were read
+	MagMode                       byte    // AK09916 CNTL2
+	MagRate                       int     // Continuous measurement rate of MagMode, Hz; 0 if powered down or in single mode
+}
+
+// String formats c on one line, e.g. for a log or a register dump.
+func (c Configuration) String() string {
+	dlpf := func(on bool, cfg byte) string {
+		if !on {
+			return "bypassed"
+		}
+		return fmt.Sprintf("DLPFCFG %d", cfg)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "gyro %.1f Hz, %s, %.1f Hz bandwidth, %d °/s; ", c.GyroRate, dlpf(c.GyroDLPF, c.GyroDLPFCfg),
+		c.GyroBandwidth, c.GyroSensitivity)
+	fmt.Fprintf(&b, "accel %.1f Hz, %s, %.1f Hz bandwidth, %d G; ", c.AccelRate, dlpf(c.AccelDLPF, c.AccelDLPFCfg),
+		c.AccelBandwidth, c.AccelSensitivity)
+	fmt.Fprintf(&b, "I2C master %.2f Hz; ", c.I2CMasterRate)
+	if c.MagEnabled {
+		fmt.Fprintf(&b, "mag mode 0x%02X, %d Hz", c.MagMode, c.MagRate)
+	} else {
+		b.WriteString("mag disabled")
+	}
+	return b.String()
+}
+
+/*
+Configuration reads the sample rates, DLPF settings, full scales and magnetometer mode back from the chip and
+decodes them.  Unlike the settings the driver keeps, these are the registers' actual values, so they show if the
+chip has drifted from the expected configuration, e.g. after a brownout.
+*/
+func (mpu *ICM20948) Configuration() (Configuration, error) {
+	var c Configuration
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	if err := mpu.setRegBank(2); err != nil {
+		return c, errors.New("ICM20948 Error: change register bank.")
+	}
+	var regs [5]byte
+	for i, reg := range []byte{ICMREG_GYRO_SMPLRT_DIV, ICMREG_GYRO_CONFIG, ICMREG_ACCEL_SMPLRT_DIV_1,
+		ICMREG_ACCEL_SMPLRT_DIV_2, ICMREG_ACCEL_CONFIG} {
+		v, err := mpu.i2cRead(reg)
+		if err != nil {
+			mpu.setRegBank(0)
+			return c, fmt.Errorf("ICM20948 Error: couldn't read the configuration: %s", err.Error())
+		}
+		regs[i] = v
+	}
+	if err := mpu.setRegBank(3); err != nil {
+		mpu.setRegBank(0)
+		return c, errors.New("ICM20948 Error: change register bank.")
+	}
+	odrConfig, err := mpu.i2cRead(ICMREG_I2C_MST_ODR_CONFIG)
+	mpu.setRegBank(0)
+	if err != nil {
+		return c, fmt.Errorf("ICM20948 Error: couldn't read the configuration: %s", err.Error())
+	}
+	gyroDiv, gyroConfig, accelDiv, accelConfig := int(regs[0]), regs[1], int(regs[2]&0x0F)<<8|int(regs[3]), regs[4]
+
+	c.GyroDLPF, c.GyroDLPFCfg = gyroConfig&BITS_FCHOICE != 0, gyroConfig&BITS_DLPFCFG_MASK>>3
+	c.GyroRate, c.GyroBandwidth = gyroBypassRate, gyroBypassBandwidth
+	if c.GyroDLPF {
+		c.GyroRate, c.GyroBandwidth = 1125/float64(1+gyroDiv), gyroDLPFBandwidth[c.GyroDLPFCfg]
+	}
+	c.GyroSensitivity = 250 << (gyroConfig & BITS_FS_SEL_MASK >> 1)
+
+	c.AccelDLPF, c.AccelDLPFCfg = accelConfig&BITS_FCHOICE != 0, accelConfig&BITS_DLPFCFG_MASK>>3
+	c.AccelRate, c.AccelBandwidth = accelBypassRate, accelBypassBandwidth
+	if c.AccelDLPF {
+		c.AccelRate, c.AccelBandwidth = 1125/float64(1+accelDiv), accelDLPFBandwidth[c.AccelDLPFCfg]
+	}
+	c.AccelSensitivity = 2 << (accelConfig & BITS_FS_SEL_MASK >> 1)
+
+	c.I2CMasterRate = 1100.0 / float64(int(1)<<(odrConfig&0x0F))
+
+	mpu.mu.Lock()
+	c.MagEnabled = mpu.enableMag
+	mpu.mu.Unlock()
+	if c.MagEnabled {
+		if c.MagMode, err = mpu.auxTransaction(BIT_I2C_READ|AK09916_I2C_ADDR, AK09916_CNTL2, 0); err != nil {
+			return c, fmt.Errorf("ICM20948 Error: couldn't read the magnetometer mode: %s", err.Error())
+		}
+		c.MagRate = ak09916ModeRate(c.MagMode)
+	}
+	return c, nil
+}
+
+// ak09916ModeRate returns the rate in Hz of an AK09916 continuous measurement mode, or 0 for other modes.
+func ak09916ModeRate(mode byte) int {
+	switch mode {
+	case AK09916_MODE_CONT1:
+		return 10
+	case AK09916_MODE_CONT2:
+		return 20
+	case AK09916_MODE_CONT3:
+		return 50
+	case AK09916_MODE_CONT4:
+		return 100
+	}
+	return 0
+}
@@ -0,0 +1,120 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+SetGyroDLPFBypass turns the gyro digital low pass filter off (bypass true) or back on.  With the DLPF bypassed
+the gyro runs at 9 kHz with a bandwidth of about 12 kHz, rather than the DLPF setting from SetGyroLPF (at most
+197 Hz), for high-rate control loops that need the lowest latency.  The price is much more noise (roughly 8x the
+RMS noise at 197 Hz) and, since the sample rate divider only applies with the DLPF on, the polled reads
+undersample the output so high-frequency vibration aliases into the data unless the sample rate is high.
+The setting is kept across Reset.
+*/
+func (mpu *ICM20948) SetGyroDLPFBypass(bypass bool) error {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	cfg, err := mpu.setFChoice(ICMREG_GYRO_CONFIG, !bypass)
+	if err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't set gyro DLPF bypass: %s", err.Error())
+	}
+	mpu.mu.Lock()
+	mpu.gyroDLPFBypass = bypass
+	mpu.mu.Unlock()
+	mpu.gyroConfig = cfg
+	return nil
+}
+
+/*
+SetAccelDLPFBypass turns the accelerometer digital low pass filter off (bypass true) or back on.  With the DLPF
+bypassed the accelerometer runs at 4.5 kHz with a bandwidth of about 1.2 kHz, rather than the DLPF setting from
+SetAccelLPF (at most 246 Hz).  As for the gyro, this trades noise (roughly 2x the RMS noise at 246 Hz) and
+aliasing of vibration for bandwidth.  The setting is kept across Reset.
+*/
+func (mpu *ICM20948) SetAccelDLPFBypass(bypass bool) error {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	if _, err := mpu.setFChoice(ICMREG_ACCEL_CONFIG, !bypass); err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't set accel DLPF bypass: %s", err.Error())
+	}
+	mpu.mu.Lock()
+	mpu.accelDLPFBypass = bypass
+	mpu.mu.Unlock()
+	return nil
+}
+
+// setFChoice sets or clears the DLPF enable bit of GYRO_CONFIG or ACCEL_CONFIG, leaving the other bits alone,
+// and returns the new register value.
+func (mpu *ICM20948) setFChoice(reg byte, enable bool) (byte, error) {
+	if err := mpu.setRegBank(2); err != nil {
+		return 0, errors.New("ICM20948 Error: change register bank.")
+	}
+	defer mpu.setRegBank(0)
+
+	cfg, err := mpu.i2cRead(reg)
+	if err != nil {
+		return 0, err
+	}
+	if enable {
+		cfg |= BITS_FCHOICE
+	} else {
+		cfg &^= BITS_FCHOICE
+	}
+	if err := mpu.i2cWrite(reg, cfg); err != nil {
+		return 0, err
+	}
+	return cfg, nil
+}
+
+/*
+SetAccelDLPFConfig sets the accelerometer DLPF directly to one of the ACCEL_DLPFCFG values 0-7, for matching a
+specific anti-aliasing requirement.  SetAccelLPF picks from these by bandwidth but can't select 1 or 7:
+
+	DLPFCFG  3 dB bandwidth (Hz)  Noise bandwidth (Hz)
+	0        246.0                265.0
+	1        246.0                265.0
+	2        111.4                136.0
+	3         50.4                 68.8
+	4         23.9                 34.4
+	5         11.5                 17.0
+	6          5.7                  8.3
+	7        473.0                499.0
+
+The filter only applies while the DLPF isn't bypassed; see SetAccelDLPFBypass.
+*/
+func (mpu *ICM20948) SetAccelDLPFConfig(dlpfcfg byte) error {
+	if dlpfcfg > 7 {
+		return fmt.Errorf("ICM20948 Error: %d is not a valid accel DLPF configuration", dlpfcfg)
+	}
+
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+	return mpu.setAccelDLPFConfig(dlpfcfg)
+}
+
+// setAccelDLPFConfig is SetAccelDLPFConfig for callers that hold mpu.busMu, such as configure.
+func (mpu *ICM20948) setAccelDLPFConfig(dlpfcfg byte) error {
+	// Accel config registers on Bank 2.
+	if err := mpu.setRegBank(2); err != nil {
+		return errors.New("ICM20948 Error: change register bank.")
+	}
+	defer mpu.setRegBank(0)
+
+	cfg, err := mpu.i2cRead(ICMREG_ACCEL_CONFIG)
+	if err != nil {
+		return errors.New("ICM20948 Error: SetAccelDLPFConfig error reading chip")
+	}
+	cfg = cfg&^BITS_DLPFCFG_MASK | dlpfcfg<<3 | BITS_FCHOICE
+	if mpu.accelDLPFBypass {
+		cfg &^= BITS_FCHOICE
+	}
+
+	if err := mpu.i2cWrite(ICMREG_ACCEL_CONFIG, cfg); err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't set Accel LPF: %s", err.Error())
+	}
+	return nil
+}
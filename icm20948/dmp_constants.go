@@ -24,8 +24,13 @@ const (
 	ICMREG_LP_ACCEL_ODR       = 0x1E
 	ICMREG_MOT_THR            = 0x1F
 	ICMREG_FIFO_EN            = 0x23
-	ICMREG_INT_PIN_CFG        = 0x37
+	ICMREG_INT_PIN_CFG        = 0x0F
 	ICMREG_INT_ENABLE         = 0x38
+	ICMREG_I2C_MST_STATUS     = 0x17
+	ICMREG_INT_STATUS         = 0x19
+	ICMREG_INT_STATUS_1       = 0x1A
+	ICMREG_INT_STATUS_2       = 0x1B
+	ICMREG_INT_STATUS_3       = 0x1C
 	ICMREG_ACCEL_XOUT_H       = 0x2D //
 	ICMREG_ACCEL_XOUT_L       = 0x2E //
 	ICMREG_ACCEL_YOUT_H       = 0x2F //
@@ -71,18 +76,19 @@ const (
 	ICMREG_I2C_MST_DELAY_CTRL = 0x67
 	ICMREG_SIGNAL_PATH_RESET  = 0x68
 	ICMREG_MOT_DETECT_CTRL    = 0x69
-	ICMREG_USER_CTRL          = 0x6A
+	ICMREG_USER_CTRL          = 0x03
 	ICMREG_PWR_MGMT_1         = 0x06
-	ICMREG_PWR_MGMT_2         = 0x6C
+	ICMREG_PWR_MGMT_2         = 0x07
 	ICMREG_BANK_SEL           = 0x7F // New use.
-	ICMREG_MEM_START_ADDR     = 0x6E
-	ICMREG_MEM_R_W            = 0x6F
+	ICMREG_MEM_START_ADDR     = 0x7C
+	ICMREG_MEM_R_W            = 0x7D
+	ICMREG_MEM_BANK_SEL       = 0x7E
 	ICMREG_DMP_CFG_1          = 0x70
 	ICMREG_DMP_CFG_2          = 0x71
 	ICMREG_FIFO_COUNTH        = 0x72
 	ICMREG_FIFO_COUNTL        = 0x73
 	ICMREG_FIFO_R_W           = 0x74
-	ICMREG_WHOAMI             = 0x75
+	ICMREG_WHOAMI             = 0x00 // Reads ICM20948_WHOAMI
 	ICMREG_XA_OFFSET_H        = 0x14
 	ICMREG_XA_OFFSET_L        = 0x15
 	ICMREG_YA_OFFSET_H        = 0x17
@@ -90,9 +96,18 @@ const (
 	ICMREG_ZA_OFFSET_H        = 0x1A
 	ICMREG_ZA_OFFSET_L        = 0x1B
 
+	// Reg bank 1: factory self-test responses.
+	ICMREG_SELF_TEST_X_GYRO  = 0x02
+	ICMREG_SELF_TEST_Y_GYRO  = 0x03
+	ICMREG_SELF_TEST_Z_GYRO  = 0x04
+	ICMREG_SELF_TEST_X_ACCEL = 0x0E
+	ICMREG_SELF_TEST_Y_ACCEL = 0x0F
+	ICMREG_SELF_TEST_Z_ACCEL = 0x10
+
 	// Reg bank 2.
 	ICMREG_ACCEL_CONFIG       = 0x14
 	ICMREG_GYRO_CONFIG        = 0x01
+	ICMREG_GYRO_CONFIG_2      = 0x02
 	ICMREG_ACCEL_CONFIG_2     = 0x15
 	ICMREG_TEMP_CONFIG        = 0x53
 	ICMREG_GYRO_SMPLRT_DIV    = 0x00
@@ -120,6 +135,16 @@ const (
 	BITS_DLPF_ACCEL_CFG_12HZ  = 0x29 // ACCEL_CONFIG
 	BITS_DLPF_ACCEL_CFG_5HZ   = 0x31 // ACCEL_CONFIG
 
+	BITS_FCHOICE      = 0x01 // GYRO_CONFIG, ACCEL_CONFIG: DLPF enabled
+	BITS_DLPFCFG_MASK = 0x38 // GYRO_CONFIG, ACCEL_CONFIG
+
+	BITS_GYRO_AVGCFG_MASK = 0x07 // GYRO_CONFIG_2
+	BITS_ACCEL_DEC3_MASK  = 0x03 // ACCEL_CONFIG_2
+	BITS_GYRO_ST_EN       = 0x38 // GYRO_CONFIG_2: XGYRO_CTEN, YGYRO_CTEN, ZGYRO_CTEN
+	BITS_ACCEL_ST_EN      = 0x1C // ACCEL_CONFIG_2: AX_ST_EN_REG, AY_ST_EN_REG, AZ_ST_EN_REG
+
+	BITS_FS_SEL_MASK = 0x06 // GYRO_CONFIG, ACCEL_CONFIG
+
 	BITS_FS_250DPS  = 0x00 // GYRO_CONFIG
 	BITS_FS_500DPS  = 0x02 // GYRO_CONFIG
 	BITS_FS_1000DPS = 0x04 // GYRO_CONFIG
@@ -131,14 +156,25 @@ const (
 	BITS_FS_16G = 0x06 // ACCEL_CONFIG
 
 	// Reg bank 3.
-	ICMREG_I2C_MST_CTRL  = 0x01
-	ICMREG_I2C_SLV0_ADDR = 0x03
-	ICMREG_I2C_SLV0_REG  = 0x04
-	ICMREG_I2C_SLV0_CTRL = 0x05
-	ICMREG_I2C_SLV1_ADDR = 0x07
-	ICMREG_I2C_SLV1_REG  = 0x08
-	ICMREG_I2C_SLV1_CTRL = 0x09
-	ICMREG_I2C_SLV4_CTRL = 0x15
+	ICMREG_I2C_MST_ODR_CONFIG = 0x00
+	ICMREG_I2C_MST_CTRL       = 0x01
+	ICMREG_I2C_SLV0_ADDR      = 0x03
+	ICMREG_I2C_SLV0_REG       = 0x04
+	ICMREG_I2C_SLV0_CTRL      = 0x05
+	ICMREG_I2C_SLV1_ADDR      = 0x07
+	ICMREG_I2C_SLV1_REG       = 0x08
+	ICMREG_I2C_SLV1_CTRL      = 0x09
+	ICMREG_I2C_SLV2_ADDR      = 0x0B
+	ICMREG_I2C_SLV2_REG       = 0x0C
+	ICMREG_I2C_SLV2_CTRL      = 0x0D
+	ICMREG_I2C_SLV3_ADDR      = 0x0F
+	ICMREG_I2C_SLV3_REG       = 0x10
+	ICMREG_I2C_SLV3_CTRL      = 0x11
+	ICMREG_I2C_SLV4_ADDR      = 0x13
+	ICMREG_I2C_SLV4_REG       = 0x14
+	ICMREG_I2C_SLV4_CTRL      = 0x15
+	ICMREG_I2C_SLV4_DO        = 0x16
+	ICMREG_I2C_SLV4_DI        = 0x17
 
 	/* ---- AK8963 Reg In MPU9250 ----------------------------------------------- */
 	AK8963_I2C_ADDR        = 0x0C //0x18
@@ -167,6 +203,8 @@ const (
 	AK8963_ASAY = 0x11
 	AK8963_ASAZ = 0x12
 
+	ICM20948_WHOAMI = 0xEA // WHO_AM_I value of the ICM20948
+
 	/* ---- AK09916 Reg In ICM20948 --------------------------------------------- */
 	AK09916_I2C_ADDR        = 0x0C
 	AK09916_Device_ID       = 0x09
@@ -203,6 +241,8 @@ const (
 	BIT_SLEEP                  = 0x40
 	BIT_H_RESET                = 0x80
 	BITS_CLKSEL                = 0x07
+	BITS_DISABLE_ACCEL         = 0x38 // PWR_MGMT_2
+	BITS_DISABLE_GYRO          = 0x07 // PWR_MGMT_2
 	MPU_CLK_SEL_PLLGYROX       = 0x01
 	MPU_CLK_SEL_PLLGYROZ       = 0x03
 	MPU_EXT_SYNC_GYROX         = 0x02
@@ -230,6 +270,14 @@ const (
 	AKM_POWER_DOWN               = 0x00
 	BIT_I2C_READ                 = 0x80
 	BIT_SLAVE_EN                 = 0x80
+	BIT_I2C_SLV4_DONE            = 0x40 // I2C_MST_STATUS
+	BIT_I2C_SLV4_NACK            = 0x10 // I2C_MST_STATUS
+	BIT_WOM_INT                  = 0x08 // INT_STATUS
+	BIT_PLL_RDY_INT              = 0x04 // INT_STATUS
+	BIT_DMP_INT1                 = 0x02 // INT_STATUS
+	BIT_I2C_MST_INT              = 0x01 // INT_STATUS
+	BIT_RAW_DATA_0_RDY_INT       = 0x01 // INT_STATUS_1
+	BITS_FIFO_INT_MASK           = 0x1F // INT_STATUS_2 (overflow), INT_STATUS_3 (watermark)
 	AKM_SINGLE_MEASUREMENT       = 0x01
 	INV_CLK_PLL                  = 0x01
 	AK89xx_FSR                   = 9830
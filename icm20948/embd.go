@@ -0,0 +1,34 @@
+package icm20948
+
+import "github.com/kidoman/embd"
+
+// An embd bus can be used directly.
+var _ I2C = embd.I2CBus(nil)
+
+/*
+NewICM20948 creates a new ICM20948 object according to the supplied parameters.  If there is no ICM20948 available or there
+is an error creating the object, an error is returned.
+It is equivalent to NewWithOptions with the corresponding WithGyroSensitivity, WithAccelSensitivity, WithSampleRate,
+WithMagnetometer and WithHWOffsets options, followed by opts.
+*/
+func NewICM20948(i2cbus *embd.I2CBus, sensitivityGyro, sensitivityAccel, sampleRate int, enableMag bool, applyHWOffsets bool, opts ...Option) (*ICM20948, error) {
+	return NewWithOptions(i2cbus, append([]Option{
+		WithGyroSensitivity(sensitivityGyro),
+		WithAccelSensitivity(sensitivityAccel),
+		WithSampleRate(sampleRate),
+		WithMagnetometer(enableMag),
+		WithHWOffsets(applyHWOffsets),
+	}, opts...)...)
+}
+
+/*
+NewWithOptions creates a new ICM20948 object configured by opts, e.g.
+
+	mpu, err := icm20948.NewWithOptions(&i2cbus, icm20948.WithSampleRate(100), icm20948.WithMagnetometer(true))
+
+Anything not set defaults as described for Config.  If the options are invalid, there is no ICM20948 available
+or there is an error creating the object, an error is returned.  See NewWithBus for other I2C implementations.
+*/
+func NewWithOptions(i2cbus *embd.I2CBus, opts ...Option) (*ICM20948, error) {
+	return NewWithBus(*i2cbus, opts...)
+}
@@ -0,0 +1,36 @@
+package icm20948
+
+import (
+	"fmt"
+	"math"
+)
+
+const eulerRateMaxPitch = 89.0 // Pitch (°) beyond which EulerRates refuses, as the roll and heading rates blow up
+
+/*
+EulerRates converts body rotation rates from the gyro into the rates of change of the Euler angles, given the
+current pitch and roll in degrees as in HorizonData.  g1-g3 are the gyro rates in °/s in the axes HorizonData
+assumes (1 to the nose, 2 to the left wing and 3 up), so the outputs of a sample, after WithAxisMap or
+WithBoardPreset if the chip isn't mounted that way, can be passed directly.  The results, in °/s, are signed as
+HorizonData: rollRate is positive rolling right, pitchRate nose up and headingRate turning clockwise.
+
+The gyro axes move with the aircraft, so they only give the Euler rates when level: in a banked turn, for
+instance, the pitch and yaw gyros each read part of the turn rate.  This applies the full kinematic transform
+rather than reading the rates off the gyro axes.  The roll and heading rates become
+infinite with the nose straight up or down (gimbal lock), so an error is returned if the pitch is within 1° of
+±90°.
+*/
+func EulerRates(pitch, roll, g1, g2, g3 float64) (rollRate, pitchRate, headingRate float64, err error) {
+	if math.Abs(pitch) > eulerRateMaxPitch {
+		return 0, 0, 0, fmt.Errorf("ICM20948 Error: Euler rates are undefined at %g° pitch", pitch)
+	}
+	// Body rates in the aerospace convention, about the nose, the right wing and down.
+	p, q, r := g1, -g2, -g3
+	sinRoll, cosRoll := math.Sincos(roll * deg)
+	sinPitch, cosPitch := math.Sincos(pitch * deg)
+	turn := q*sinRoll + r*cosRoll // Rate about the vertical of the bank
+	rollRate = p + turn*sinPitch/cosPitch
+	pitchRate = q*cosRoll - r*sinRoll
+	headingRate = turn / cosPitch
+	return rollRate, pitchRate, headingRate, nil
+}
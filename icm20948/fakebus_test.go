@@ -0,0 +1,107 @@
+package icm20948
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kidoman/embd"
+)
+
+// fakeBus is an embd.I2CBus that stores register writes and reads them back; multi-byte reads return consecutive
+// registers.  All register banks share one map.  If fail is set, every transaction fails.  Transactions the driver doesn't use aren't implemented.
+type fakeBus struct {
+	embd.I2CBus
+	mu        sync.Mutex
+	regs      map[byte]byte
+	mem       map[uint16]byte // DMP memory, written and read through MEM_R_W
+	fail      bool
+	readOnly  bool                   // DMP memory writes are ignored
+	addr      byte                   // I2C address of the last register write
+	stall     chan bool              // If set, 16-bit reads block until it is closed; set it under mu once in use
+	wordReads int                    // Number of 16-bit reads
+	delay     time.Duration          // If set, 16-bit reads take this long
+	onRead    func(reg, v byte) byte // If set, single-byte reads return onRead of the stored value
+}
+
+var errFakeBus = errors.New("fake bus failure")
+
+func (b *fakeBus) ReadByteFromReg(addr, reg byte) (byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.fail {
+		return 0, errFakeBus
+	}
+	if b.onRead != nil {
+		return b.onRead(reg, b.regs[reg]), nil
+	}
+	return b.regs[reg], nil
+}
+
+func (b *fakeBus) WriteByteToReg(addr, reg, value byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.fail {
+		return errFakeBus
+	}
+	if b.regs == nil {
+		b.regs = make(map[byte]byte)
+	}
+	b.regs[reg] = value
+	b.addr = addr
+	return nil
+}
+
+func (b *fakeBus) WriteToReg(addr, reg byte, value []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.fail {
+		return errFakeBus
+	}
+	if reg == ICMREG_MEM_R_W && !b.readOnly {
+		if b.mem == nil {
+			b.mem = make(map[uint16]byte)
+		}
+		for i, v := range value {
+			b.mem[b.memAddr()+uint16(i)] = v
+		}
+	}
+	return nil
+}
+
+func (b *fakeBus) ReadFromReg(addr, reg byte, value []byte) error {
+	if reg == ICMREG_MEM_R_W {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.fail {
+			return errFakeBus
+		}
+		for i := range value {
+			value[i] = b.mem[b.memAddr()+uint16(i)]
+		}
+		return nil
+	}
+
+	b.mu.Lock()
+	stall, delay := b.stall, b.delay
+	b.mu.Unlock()
+	if stall != nil {
+		<-stall
+	}
+	time.Sleep(delay)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.wordReads++
+	if b.fail {
+		return errFakeBus
+	}
+	for i := range value {
+		value[i] = b.regs[reg+byte(i)]
+	}
+	return nil
+}
+
+// memAddr returns the DMP memory address selected by MEM_BANK_SEL and MEM_START_ADDR.
+func (b *fakeBus) memAddr() uint16 {
+	return uint16(b.regs[ICMREG_MEM_BANK_SEL])<<8 | uint16(b.regs[ICMREG_MEM_START_ADDR])
+}
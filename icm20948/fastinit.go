@@ -0,0 +1,67 @@
+package icm20948
+
+import (
+	"fmt"
+	"time"
+)
+
+const fastInitResetTimeout = 100 * time.Millisecond // How long a fast init waits for the chip to come out of reset
+
+// WithFastInit sets whether the chip is configured with the fast init; see SetFastInit.
+func WithFastInit(enable bool) Option {
+	return func(mpu *ICM20948) {
+		mpu.fastInit = enable
+	}
+}
+
+/*
+SetFastInit chooses a faster (re)initialization for known-good boards, used by Reset and by the watchdog and
+configuration check when they recover the chip.  Instead of fixed waits for the chip to come out of reset and
+for the magnetometer to start, it polls WHO_AM_I until the chip answers, checks that the AK09916 answers at 0x0C
+and skips the diagnostics (see Diagnostics, which then keep their previous values).  If the ICM20948 or the
+AK09916 doesn't give the expected WHO_AM_I, (re)initialization fails at once with an error.
+
+It is safe when the board has been brought up before with the same wiring, e.g. to recover from a brownout.  Leave
+it off for the first bring-up of a new board, where the diagnostics help find wiring and address problems.
+*/
+func (mpu *ICM20948) SetFastInit(enable bool) {
+	mpu.mu.Lock()
+	mpu.fastInit = enable
+	mpu.mu.Unlock()
+}
+
+// waitForReset waits for the chip to come out of a reset: a fixed 100 ms, or with the fast init until it
+// answers with the expected WHO_AM_I.  The caller must hold busMu.
+func (mpu *ICM20948) waitForReset(fast bool) error {
+	if !fast {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}
+	deadline := time.Now().Add(fastInitResetTimeout)
+	for {
+		whoAmI, err := mpu.i2cRead(ICMREG_WHOAMI)
+		if err == nil && whoAmI == ICM20948_WHOAMI {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("ICM20948 Error: no answer after reset: %s", err.Error())
+			}
+			return fmt.Errorf("ICM20948 Error: WHO_AM_I is 0x%02X, expected 0x%02X", whoAmI, ICM20948_WHOAMI)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// checkMagWhoAmI checks that the AK09916 answers at its usual address with its device ID.  The caller must hold
+// busMu and have enabled the I2C master.
+func (mpu *ICM20948) checkMagWhoAmI() error {
+	id, err := mpu.auxTransaction(BIT_I2C_READ|AK09916_I2C_ADDR, AK09916_WIA2, 0)
+	if err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't read the magnetometer device ID: %s", err.Error())
+	}
+	if id != AK09916_Device_ID {
+		return fmt.Errorf("ICM20948 Error: magnetometer device ID is 0x%02X, expected 0x%02X", id, AK09916_Device_ID)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+)
+
+const bitsFIFOCountH = 0x1F // FIFO_COUNTH holds the top 5 bits of the 13-bit count
+
+/*
+FIFOCount returns the number of bytes in the FIFO, from FIFO_COUNTH/L.  The driver polls the sensor registers
+rather than using the FIFO, so this is 0 unless the FIFO has been enabled, e.g. through FIFO_EN.
+*/
+func (mpu *ICM20948) FIFOCount() (int, error) {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	// FIFO registers on Bank 0.
+	if err := mpu.setRegBank(0); err != nil {
+		return 0, errors.New("ICM20948 Error: change register bank.")
+	}
+	// Reading COUNTH latches COUNTL, so read both in one transaction.
+	b, err := mpu.i2cReadPair(ICMREG_FIFO_COUNTH)
+	if err != nil {
+		return 0, fmt.Errorf("ICM20948 Error: FIFOCount error reading chip: %s", err.Error())
+	}
+	return int(b[0]&bitsFIFOCountH)<<8 | int(b[1]), nil
+}
+
+/*
+FIFOOverflow returns whether a FIFO has overflowed since the last check, from INT_STATUS_2.  The chip clears
+INT_STATUS_2 when it is read, so this also clears the overflow flags, as ReadInterruptStatus does.  It is
+always false while the FIFO isn't enabled.
+*/
+func (mpu *ICM20948) FIFOOverflow() (bool, error) {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	// Interrupt status registers on Bank 0.
+	if err := mpu.setRegBank(0); err != nil {
+		return false, errors.New("ICM20948 Error: change register bank.")
+	}
+	st, err := mpu.i2cRead(ICMREG_INT_STATUS_2)
+	if err != nil {
+		return false, errors.New("ICM20948 Error: FIFOOverflow error reading chip")
+	}
+	return st&BITS_FIFO_INT_MASK != 0, nil
+}
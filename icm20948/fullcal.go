@@ -0,0 +1,261 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	fullCalGyroTime      = 2 * time.Second      // How long the gyro is averaged for its bias, by the sample times
+	fullCalMaxGyroStdDev = 0.5                  // Max gyro noise while averaging the bias, °/s
+	fullCalStepTimeout   = 2 * time.Minute      // Longest wait for the sensor to be placed or turned as prompted
+	fullCalPoll          = 5 * time.Millisecond // How often RunFullCalibration looks for new samples
+)
+
+// fullCalOrientations are the prompts for the six positions of the accel calibration.
+var fullCalOrientations = []string{
+	"Place the sensor still with axis 3 up",
+	"Place the sensor still with axis 3 down",
+	"Place the sensor still with axis 1 up",
+	"Place the sensor still with axis 1 down",
+	"Place the sensor still with axis 2 up",
+	"Place the sensor still with axis 2 down",
+}
+
+// FullCalReport summarizes the calibration found by RunFullCalibration.  The biases are in the chip's axes, and
+// the magnetometer calibration in the AK09916's, as in the calibration file.
+type FullCalReport struct {
+	GyroBias    [3]float64 // °/s
+	GyroNoise   float64    // RMS gyro noise while the bias was measured, °/s
+	AccelBias   [3]float64 // G
+	AccelResid  float64    // RMS residual of the six-position fit, G
+	MagDone     bool       // The magnetometer was calibrated; false if it isn't enabled
+	MagHardIron [3]float64 // µT
+	MagScale    [3]float64 // Diagonal of the soft-iron matrix
+	MagField    float64    // µT
+	MagResid    float64    // RMS residual of the ellipsoid fit, as a fraction of the field
+	MagPoints   int        // Distinct magnetometer readings fitted
+}
+
+// String returns the report as a few lines of text.
+func (r FullCalReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Gyro bias:     %8.3f %8.3f %8.3f °/s (noise %.3f °/s)\n", r.GyroBias[0], r.GyroBias[1], r.GyroBias[2],
+		r.GyroNoise)
+	fmt.Fprintf(&b, "Accel bias:    %8.4f %8.4f %8.4f G (fit residual %.4f G)\n", r.AccelBias[0], r.AccelBias[1],
+		r.AccelBias[2], r.AccelResid)
+	if !r.MagDone {
+		b.WriteString("Magnetometer:  not enabled\n")
+		return b.String()
+	}
+	fmt.Fprintf(&b, "Mag hard iron: %8.2f %8.2f %8.2f µT\n", r.MagHardIron[0], r.MagHardIron[1], r.MagHardIron[2])
+	fmt.Fprintf(&b, "Mag scale:     %8.4f %8.4f %8.4f\n", r.MagScale[0], r.MagScale[1], r.MagScale[2])
+	fmt.Fprintf(&b, "Mag field:     %8.2f µT (fit residual %.1f%%, %d readings)\n", r.MagField, 100*r.MagResid,
+		r.MagPoints)
+	return b.String()
+}
+
+/*
+RunFullCalibration runs the whole calibration a new installation needs, in order: the gyro bias with the sensor
+still, the accelerometer biases from six still orientations, and, if the magnetometer is enabled, the hard- and
+soft-iron correction while the sensor is turned through all orientations.  Before each step prompt is called
+with an instruction for the user, e.g. "Place the sensor still with axis 3 up", and the step starts when it
+returns; an error from prompt aborts the calibration and is returned.  Each step waits up to two minutes for
+the sensor to be placed or turned as asked.
+
+Each step's result is checked: the sensor must be still (gyro noise under 0.5 °/s) while the gyro bias is
+measured, and the accelerometer and magnetometer fits must be good and cover enough directions.  Only if every
+step succeeds is the calibration applied, in place of the old one, and saved to the calibration file; a
+FullCalReport summarizing it is returned.  The samples are watched without being consumed, and while the
+calibration runs the gyro high-pass filter (see SetGyroHighPass) and the magnetometer correction are suspended.
+*/
+func (mpu *ICM20948) RunFullCalibration(prompt func(step string) error) (FullCalReport, error) {
+	var r FullCalReport
+
+	mpu.mu.Lock()
+	hp, skipHardIron, skipSoftIron := mpu.gyroHighPass, mpu.skipHardIron, mpu.skipSoftIron
+	mpu.gyroHighPass = nil
+	mpu.mu.Unlock()
+	defer func() {
+		mpu.mu.Lock()
+		if hp != nil {
+			mpu.gyroHighPass = newGyroHighPass(time.Duration(hp.tau * float64(time.Second)))
+		}
+		mpu.skipHardIron, mpu.skipSoftIron = skipHardIron, skipSoftIron
+		mpu.mu.Unlock()
+	}()
+
+	if err := prompt("Place the sensor still for the gyro calibration"); err != nil {
+		return r, err
+	}
+	if err := mpu.fullCalGyro(&r); err != nil {
+		return r, err
+	}
+
+	var accel passiveCal // For its stillness detection
+	for _, step := range fullCalOrientations {
+		if err := prompt(step); err != nil {
+			return r, err
+		}
+		if err := mpu.fullCalWait(step, func(d *MPUData) bool { return accel.addAccel(d) }); err != nil {
+			return r, err
+		}
+	}
+	b, resid, err := fitSphere(accel.orients)
+	if err != nil {
+		return r, err
+	}
+	r.AccelResid = resid
+	if resid > passiveCalMaxAccelResid || !coverage(accel.orients, b, [3]float64{1, 1, 1}) {
+		return r, fmt.Errorf("ICM20948 Error: accel calibration fit is poor (residual %.3f G), check the orientations", resid)
+	}
+	// The fit is in the output axes but the biases are in the chip's.
+	r.AccelBias[0], r.AccelBias[1], r.AccelBias[2] = mpu.toChipAxes(b[0], b[1], b[2])
+
+	if mpu.enableMag {
+		if err := prompt("Turn the sensor slowly through all orientations"); err != nil {
+			return r, err
+		}
+		if err := mpu.fullCalMag(&r); err != nil {
+			return r, err
+		}
+	}
+
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.G01 += r.GyroBias[0] / mpu.scaleGyro
+	mpu.G02 += r.GyroBias[1] / mpu.scaleGyro
+	mpu.G03 += r.GyroBias[2] / mpu.scaleGyro
+	mpu.A01 += r.AccelBias[0] / mpu.scaleAccel
+	mpu.A02 += r.AccelBias[1] / mpu.scaleAccel
+	mpu.A03 += r.AccelBias[2] / mpu.scaleAccel
+	r.GyroBias[0], r.GyroBias[1], r.GyroBias[2] = mpu.G01*mpu.scaleGyro, mpu.G02*mpu.scaleGyro, mpu.G03*mpu.scaleGyro
+	r.AccelBias[0], r.AccelBias[1], r.AccelBias[2] = mpu.A01*mpu.scaleAccel, mpu.A02*mpu.scaleAccel, mpu.A03*mpu.scaleAccel
+	if r.MagDone {
+		mpu.M01, mpu.M02, mpu.M03 = r.MagHardIron[0], r.MagHardIron[1], r.MagHardIron[2]
+		mpu.Ms11, mpu.Ms12, mpu.Ms13 = r.MagScale[0], 0, 0
+		mpu.Ms21, mpu.Ms22, mpu.Ms23 = 0, r.MagScale[1], 0
+		mpu.Ms31, mpu.Ms32, mpu.Ms33 = 0, 0, r.MagScale[2]
+		mpu.MagField, mpu.MagNoise = r.MagField, r.MagResid
+	}
+	mpu.calTime, mpu.calSource = time.Now(), "full calibration with RunFullCalibration"
+	if err := mpu.mpuCalData.save(mpu.calPath); err != nil {
+		return r, fmt.Errorf("ICM20948 Error: couldn't save the calibration: %s", err.Error())
+	}
+	return r, nil
+}
+
+// fullCalGyro measures the change in gyro bias, in °/s in the chip's axes, that zeroes the still gyro, into
+// r.GyroBias, and the noise.
+func (mpu *ICM20948) fullCalGyro(r *FullCalReport) error {
+	var (
+		t0      time.Time
+		n       float64
+		sum, ss [3]float64
+	)
+	err := mpu.fullCalWait("gyro calibration", func(d *MPUData) bool {
+		if t0.IsZero() {
+			t0 = d.T
+		}
+		g1, g2, g3 := mpu.toChipAxes(d.G1, d.G2, d.G3)
+		for i, g := range [3]float64{g1, g2, g3} {
+			sum[i] += g
+			ss[i] += g * g
+		}
+		n++
+		return d.T.Sub(t0) >= fullCalGyroTime
+	})
+	if err != nil {
+		return err
+	}
+
+	var variance float64
+	for i := range sum {
+		r.GyroBias[i] = sum[i] / n
+		variance += ss[i]/n - r.GyroBias[i]*r.GyroBias[i]
+	}
+	r.GyroNoise = math.Sqrt(math.Max(variance/3, 0))
+	if r.GyroNoise > fullCalMaxGyroStdDev {
+		return fmt.Errorf("ICM20948 Error: sensor moved during the gyro calibration (noise %.2f °/s)", r.GyroNoise)
+	}
+	return nil
+}
+
+// fullCalMag fits the hard- and soft-iron calibration to magnetometer readings taken with the correction off,
+// into r.
+func (mpu *ICM20948) fullCalMag(r *FullCalReport) error {
+	mpu.mu.Lock()
+	mpu.skipHardIron, mpu.skipSoftIron = true, true
+	mpu.mu.Unlock()
+
+	var (
+		mag    passiveCal // For its spacing of the recorded points
+		lastTM time.Time
+	)
+	err := mpu.fullCalWait("magnetometer calibration", func(d *MPUData) bool {
+		if d.MagError != nil || d.TM.IsZero() || d.TM == lastTM {
+			return false
+		}
+		lastTM = d.TM
+		// Back to the AK09916's axes, which the calibration is in.
+		m1, m2, m3 := d.M1, d.M2, d.M3
+		if mpu.axisMap != nil {
+			m1, m2, m3 = flipMag.apply(mpu.toChipAxes(m1, m2, m3))
+		}
+		if !mag.addMag(m1, m2, m3) {
+			return false
+		}
+		n := len(mag.magPoints)
+		if n < passiveCalMinMagPoints || n%10 != 0 {
+			return false
+		}
+		c, radii, resid, err := fitEllipsoid(mag.magPoints)
+		if err != nil {
+			return false
+		}
+		r.MagResid, r.MagPoints = resid, n
+		if resid >= passiveCalMaxMagResid || !coverage(mag.magPoints, c, radii) {
+			return false
+		}
+		rMean := (radii[0] + radii[1] + radii[2]) / 3
+		r.MagHardIron = c
+		r.MagScale = [3]float64{rMean / radii[0], rMean / radii[1], rMean / radii[2]}
+		r.MagField = rMean
+		r.MagDone = true
+		return true
+	})
+	if err != nil && r.MagPoints > 0 {
+		return fmt.Errorf("%s (%d readings, fit residual %.1f%%)", err.Error(), r.MagPoints, 100*r.MagResid)
+	}
+	return err
+}
+
+// fullCalWait calls f with each new sample that has gyro/accel values until it returns true, or fails after
+// fullCalStepTimeout or if the driver is closed.  Samples are polled, so some may be missed at high rates.
+func (mpu *ICM20948) fullCalWait(step string, f func(d *MPUData) bool) error {
+	var lastSeq uint64
+	timeout := time.NewTimer(fullCalStepTimeout)
+	defer timeout.Stop()
+	tick := time.NewTicker(fullCalPoll)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-timeout.C:
+			return fmt.Errorf("ICM20948 Error: timed out waiting for %s", strings.ToLower(step[:1])+step[1:])
+		case <-mpu.cDone:
+			return errors.New("ICM20948 Error: driver closed during calibration")
+		}
+		d := mpu.latestData()
+		if d == nil || d.GAError != nil || d.Seq == lastSeq {
+			continue
+		}
+		lastSeq = d.Seq
+		if f(d) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const groupBufSize = bufSize // Size of the channel from Group.Merge
+
+// GroupData is a sample from one of the devices of a Group, tagged with the name it was added under.
+type GroupData struct {
+	Source string
+	*MPUData
+}
+
+/*
+Group coordinates several ICM20948s, e.g. redundant IMUs on different buses, so they can be started, stopped and
+monitored together.  Devices are started in the order they were added and closed in the reverse order.  A Group
+only coordinates: each device keeps its own channels and settings.
+*/
+type Group struct {
+	mu      sync.Mutex
+	names   []string
+	devices []*ICM20948
+}
+
+// NewGroup returns an empty Group.
+func NewGroup() *Group {
+	return new(Group)
+}
+
+// Add adds mpu to the group under name, which identifies its samples from Merge and its Stats.  Names must be
+// unique.
+func (g *Group) Add(name string, mpu *ICM20948) error {
+	if mpu == nil {
+		return fmt.Errorf("ICM20948 Error: no device to add to the group as %q", name)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, n := range g.names {
+		if n == name {
+			return fmt.Errorf("ICM20948 Error: the group already has a device named %q", name)
+		}
+	}
+	g.names = append(g.names, name)
+	g.devices = append(g.devices, mpu)
+	return nil
+}
+
+// members returns the names and devices of the group, in the order they were added.
+func (g *Group) members() ([]string, []*ICM20948) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.names...), append([]*ICM20948(nil), g.devices...)
+}
+
+/*
+StartAll resumes reading on every device, in the order they were added.  The devices start reading when they
+are created, so to start them together, Pause each one before adding it.  Devices that have already stopped,
+e.g. after a failure or CloseMPU, are reported in the error, which names each of them; the others are still
+started.
+*/
+func (g *Group) StartAll() error {
+	names, devices := g.members()
+	var problems []string
+	for i, mpu := range devices {
+		if mpu.closed() {
+			problems = append(problems, fmt.Sprintf("%s: driver closed", names[i]))
+			continue
+		}
+		mpu.Resume()
+	}
+	return groupError(problems)
+}
+
+// CloseAll closes every device, in the reverse of the order they were added, waiting for each to stop before
+// closing the next.  It is safe to call when some devices have already failed or been closed, and more than once.
+func (g *Group) CloseAll() {
+	_, devices := g.members()
+	for i := len(devices) - 1; i >= 0; i-- {
+		devices[i].CloseMPU()
+	}
+}
+
+// StatsAll returns the Stats of every device, by name.
+func (g *Group) StatsAll() map[string]Stats {
+	names, devices := g.members()
+	stats := make(map[string]Stats, len(devices))
+	for i, mpu := range devices {
+		stats[names[i]] = mpu.Stats()
+	}
+	return stats
+}
+
+/*
+Merge returns a channel carrying the samples of every device's CBuf, each tagged with the name of its device.
+The samples of each device stay in order, but those of different devices are interleaved as they arrive.  The
+channel is closed once every device has been closed.  Merge consumes CBuf, so it must be called at most once and
+nothing else may read the devices' CBuf; if the merged channel isn't read, the devices' buffer policies apply.
+*/
+func (g *Group) Merge() <-chan GroupData {
+	names, devices := g.members()
+	c := make(chan GroupData, groupBufSize)
+	var wg sync.WaitGroup
+	for i, mpu := range devices {
+		wg.Add(1)
+		go func(name string, cBuf <-chan *MPUData) {
+			defer wg.Done()
+			for d := range cBuf {
+				c <- GroupData{Source: name, MPUData: d}
+			}
+		}(names[i], mpu.CBuf)
+	}
+	go func() {
+		wg.Wait()
+		close(c)
+	}()
+	return c
+}
+
+// closed reports whether the driver has stopped reading, after CloseMPU or a failure.
+func (mpu *ICM20948) closed() bool {
+	if mpu.cDone == nil {
+		return true
+	}
+	select {
+	case <-mpu.cDone:
+		return true
+	default:
+		return false
+	}
+}
+
+// groupError combines the problems found across a Group into one error, or nil if there were none.
+func groupError(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New("ICM20948 Error: " + strings.Join(problems, "; "))
+}
@@ -0,0 +1,174 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	gSensMinAccelStdDev = 0.1 // Accel variation needed on each axis to fit the g-sensitivity, G
+	gSensMinSamples     = 100 // Samples needed to fit the g-sensitivity
+)
+
+// GSensitivityResult describes the gyro g-sensitivity measured by CalibrateGSensitivity.
+type GSensitivityResult struct {
+	Coef    [3][3]float64 // Gyro response to acceleration, °/s per G: Coef[i][j] is gyro axis i's to accel axis j
+	Resid   float64       // RMS gyro residual after the fit, °/s; large if the device rotated while shaken
+	Samples int           // Number of samples fitted
+}
+
+/*
+CalibrateGSensitivity measures the gyro's sensitivity to linear acceleration (g-sensitivity), which the datasheet
+gives as typically 0.1 °/s/G, and from then on removes it from the gyro readings.  It collects samples for
+duration while the device is shaken along all three axes without rotating, e.g. on a shaker or by hand on a
+linear guide, and fits each gyro axis as a bias plus a linear function of the three accel axes.  Each accel axis
+must vary by at least 0.1 G (standard deviation) or an error is returned.
+
+The coefficients are stored in the calibration (Gs11-Gs33) and saved to the calibration file.  The gyro biases
+are adjusted so that the readings at the average acceleration during the shaking are unchanged; only changes in
+acceleration are corrected for.  The correction is opt-in: it does nothing until CalibrateGSensitivity has been
+run.  Readings are fitted in the chip's axes, whatever axis map is set.
+*/
+func (mpu *ICM20948) CalibrateGSensitivity(duration time.Duration) (GSensitivityResult, error) {
+	var res GSensitivityResult
+	if duration <= 0 {
+		return res, errors.New("ICM20948 Error: g-sensitivity calibration duration must be positive")
+	}
+
+	var (
+		gs, as  [][3]float64
+		lastSeq uint64
+	)
+	done := time.NewTimer(duration)
+	defer done.Stop()
+	tick := time.NewTicker(tickerPeriod(mpu.SampleRate()) / 2)
+	defer tick.Stop()
+loop:
+	for {
+		select {
+		case <-tick.C:
+		case <-done.C:
+			break loop
+		case <-mpu.cDone:
+			return res, errors.New("ICM20948 Error: driver closed during g-sensitivity calibration")
+		}
+		d := mpu.latestData()
+		if d == nil || d.GAError != nil || d.Seq == lastSeq {
+			continue
+		}
+		lastSeq = d.Seq
+		mpu.mu.Lock()
+		g, a := mpu.uncorrectedGyro(d)
+		mpu.mu.Unlock()
+		gs, as = append(gs, g), append(as, a)
+	}
+
+	coef, _, resid, err := fitGSensitivity(gs, as)
+	if err != nil {
+		return res, err
+	}
+	res.Coef, res.Resid, res.Samples = coef, resid, len(gs)
+
+	var aMean [3]float64
+	for _, a := range as {
+		for j := range aMean {
+			aMean[j] += a[j] / float64(len(as))
+		}
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	// Keep the readings at the mean acceleration as they were.
+	o1, o2, o3 := mulVec(mpu.gSensitivity(), aMean[0], aMean[1], aMean[2])
+	n1, n2, n3 := mulVec(coef, aMean[0], aMean[1], aMean[2])
+	mpu.G01 -= (n1 - o1) / mpu.scaleGyro
+	mpu.G02 -= (n2 - o2) / mpu.scaleGyro
+	mpu.G03 -= (n3 - o3) / mpu.scaleGyro
+	mpu.Gs11, mpu.Gs12, mpu.Gs13 = coef[0][0], coef[0][1], coef[0][2]
+	mpu.Gs21, mpu.Gs22, mpu.Gs23 = coef[1][0], coef[1][1], coef[1][2]
+	mpu.Gs31, mpu.Gs32, mpu.Gs33 = coef[2][0], coef[2][1], coef[2][2]
+	mpu.calTime, mpu.calSource = time.Now(), "g-sensitivity measured with CalibrateGSensitivity"
+	if err := mpu.mpuCalData.save(mpu.calPath); err != nil {
+		return res, fmt.Errorf("ICM20948 Error: couldn't save the g-sensitivity: %s", err.Error())
+	}
+	return res, nil
+}
+
+// gSensitivity returns the g-sensitivity coefficients as a matrix.  The caller must hold mpu.mu.
+func (mpu *ICM20948) gSensitivity() [3][3]float64 {
+	return [3][3]float64{
+		{mpu.Gs11, mpu.Gs12, mpu.Gs13},
+		{mpu.Gs21, mpu.Gs22, mpu.Gs23},
+		{mpu.Gs31, mpu.Gs32, mpu.Gs33},
+	}
+}
+
+// correctGSensitivity removes the gyro's response to the acceleration a1-a3 (G) from the gyro readings g1-g3
+// (°/s), all in the chip's axes.  The caller must hold mpu.mu.
+func (mpu *ICM20948) correctGSensitivity(g1, g2, g3, a1, a2, a3 float64) (float64, float64, float64) {
+	gs := mpu.gSensitivity()
+	if gs == ([3][3]float64{}) {
+		return g1, g2, g3
+	}
+	c1, c2, c3 := mulVec(gs, a1, a2, a3)
+	return g1 - c1, g2 - c2, g3 - c3
+}
+
+// uncorrectedGyro returns the gyro and accel readings of d in the chip's axes, with the g-sensitivity correction
+// undone.  The caller must hold mpu.mu.
+func (mpu *ICM20948) uncorrectedGyro(d *MPUData) (g, a [3]float64) {
+	a[0], a[1], a[2] = mpu.toChipAxes(d.A1, d.A2, d.A3)
+	g[0], g[1], g[2] = mpu.toChipAxes(d.G1, d.G2, d.G3)
+	c1, c2, c3 := mulVec(mpu.gSensitivity(), a[0], a[1], a[2])
+	g[0], g[1], g[2] = g[0]+c1, g[1]+c2, g[2]+c3
+	return
+}
+
+// mulVec returns m times the vector v1, v2, v3.
+func mulVec(m [3][3]float64, v1, v2, v3 float64) (float64, float64, float64) {
+	return m[0][0]*v1 + m[0][1]*v2 + m[0][2]*v3,
+		m[1][0]*v1 + m[1][1]*v2 + m[1][2]*v3,
+		m[2][0]*v1 + m[2][1]*v2 + m[2][2]*v3
+}
+
+// fitGSensitivity fits each gyro axis of gs as a bias plus a linear function of the accel readings as, returning
+// the coefficients, the biases and the RMS residual over all axes.
+func fitGSensitivity(gs, as [][3]float64) (coef [3][3]float64, bias [3]float64, resid float64, err error) {
+	if len(gs) < gSensMinSamples {
+		return coef, bias, 0, fmt.Errorf("ICM20948 Error: only %d samples to fit the g-sensitivity", len(gs))
+	}
+	for j := 0; j < 3; j++ {
+		var s, ss float64
+		for _, a := range as {
+			s += a[j]
+			ss += a[j] * a[j]
+		}
+		n := float64(len(as))
+		if sd := math.Sqrt(math.Max(0, ss/n-(s/n)*(s/n))); sd < gSensMinAccelStdDev {
+			return coef, bias, 0, fmt.Errorf("ICM20948 Error: accel axis %d only varied by %.2f G, shake harder", j+1, sd)
+		}
+	}
+
+	rows := make([][]float64, len(as))
+	for k, a := range as {
+		rows[k] = []float64{1, a[0], a[1], a[2]}
+	}
+	rhs := make([]float64, len(gs))
+	for i := 0; i < 3; i++ {
+		for k, g := range gs {
+			rhs[k] = g[i]
+		}
+		x, err := leastSquares(rows, rhs)
+		if err != nil {
+			return coef, bias, 0, err
+		}
+		bias[i] = x[0]
+		coef[i] = [3]float64{x[1], x[2], x[3]}
+		for k, a := range as {
+			r := gs[k][i] - x[0] - x[1]*a[0] - x[2]*a[1] - x[3]*a[2]
+			resid += r * r
+		}
+	}
+	return coef, bias, math.Sqrt(resid / float64(3*len(gs))), nil
+}
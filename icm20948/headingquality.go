@@ -0,0 +1,56 @@
+package icm20948
+
+import (
+	"errors"
+	"math"
+)
+
+const headingMaxTilt = 60.0 // Tilt (°) beyond which HeadingQuality.Reliable is false
+
+/*
+HeadingQuality is a heading together with indicators of how far to trust it, for navigation displays that gray
+out or de-emphasize a doubtful heading.  FieldRatio compares the measured field with the expected one (see
+ExpectedField): well away from 1, the field is disturbed by local interference and the heading is likely wrong.
+Tilt is the angle of axis 3 from the vertical: the horizontal part of the field that the heading comes from
+shrinks as the tilt grows, so errors in the magnetometer and in the accelerometer's idea of the vertical matter
+more and more.
+*/
+type HeadingQuality struct {
+	Heading    float64 // Magnetic heading of the nose, 0-360° clockwise from north, as from Heading
+	Degraded   bool    // The heading is dead-reckoned from the gyro; see HorizonData
+	Field      float64 // Magnitude of the latest calibrated magnetometer reading, µT; 0 if there is none
+	FieldRatio float64 // Field as a fraction of the expected field; 0 if either isn't known
+	Anomaly    bool    // The latest reading was flagged with MagAnomaly
+	Tilt       float64 // Angle between axis 3 and the vertical, from the horizon's pitch and roll, °
+}
+
+// Reliable reports whether none of the indicators casts doubt on the heading: it isn't degraded, the field isn't
+// flagged as anomalous and the tilt is at most 60°.
+func (q HeadingQuality) Reliable() bool {
+	return !q.Degraded && !q.Anomaly && q.Tilt <= headingMaxTilt
+}
+
+// HeadingWithQuality returns the heading from the filter started by EnableHorizon, as Heading does, along with
+// its quality indicators.
+func (mpu *ICM20948) HeadingWithQuality() (HeadingQuality, error) {
+	var q HeadingQuality
+	h := mpu.Horizon()
+	if !h.HeadingValid {
+		return q, errors.New("ICM20948 Error: no heading, the horizon filter isn't enabled or has no magnetometer reading")
+	}
+	q.Heading, q.Degraded = h.Heading, h.HeadingDegraded
+	q.Tilt = math.Acos(math.Max(-1, math.Min(1, math.Cos(h.Pitch*deg)*math.Cos(h.Roll*deg)))) / deg
+
+	mpu.mu.Lock()
+	d := mpu.latest
+	expected, _ := mpu.expectedMagField()
+	mpu.mu.Unlock()
+	if d != nil && !d.TM.IsZero() {
+		q.Field = math.Sqrt(d.M1*d.M1 + d.M2*d.M2 + d.M3*d.M3)
+		q.Anomaly = d.MagAnomaly
+		if expected > 0 {
+			q.FieldRatio = q.Field / expected
+		}
+	}
+	return q, nil
+}
@@ -0,0 +1,104 @@
+package icm20948
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+const highPassMaxStep = 100 * time.Millisecond // Longest interval the high-pass filter advances by in one sample
+
+// gyroHighPass is a first-order high-pass filter on the gyro outputs: it tracks the slowly varying part of each
+// axis, the drift, with an exponential average and subtracts it.
+type gyroHighPass struct {
+	tau   float64    // Time constant, s
+	drift [3]float64 // Low-passed gyro, °/s, which is removed
+	prev  time.Time  // Time of the previous sample
+}
+
+func newGyroHighPass(tau time.Duration) *gyroHighPass {
+	return &gyroHighPass{tau: tau.Seconds()}
+}
+
+// update feeds the gyro values g taken at t to the filter and returns them with the drift removed.  The drift
+// starts at zero, so the rates of the first samples pass as they are; a sample at the same time as the previous
+// one, e.g. an accel-only read, doesn't advance the filter.  After a gap, e.g. while paused, the filter only
+// advances by highPassMaxStep, so that a turn in progress when reading resumes isn't taken for drift.
+func (f *gyroHighPass) update(t time.Time, g [3]float64) [3]float64 {
+	if !f.prev.IsZero() {
+		dt := t.Sub(f.prev)
+		if dt > highPassMaxStep {
+			dt = highPassMaxStep
+		}
+		if dt > 0 {
+			alpha := 1 - math.Exp(-dt.Seconds()/f.tau)
+			for i := range g {
+				f.drift[i] += alpha * (g[i] - f.drift[i])
+			}
+		}
+	}
+	f.prev = t
+	return f.remove(g)
+}
+
+// remove returns g with the current drift removed, without advancing the filter.
+func (f *gyroHighPass) remove(g [3]float64) [3]float64 {
+	for i := range g {
+		g[i] -= f.drift[i]
+	}
+	return g
+}
+
+// WithGyroHighPass turns on the gyro high-pass filter from the first sample; see SetGyroHighPass.
+func WithGyroHighPass(tau time.Duration) Option {
+	return func(mpu *ICM20948) {
+		mpu.gyroHighPass = nil
+		if tau != 0 {
+			mpu.gyroHighPass = newGyroHighPass(tau)
+		}
+	}
+}
+
+/*
+SetGyroHighPass turns on a first-order high-pass filter with time constant tau on each gyro axis, which removes
+the slow drift of the gyro biases between calibrations so that it doesn't build up in integrated angles such as
+IntegratedAngle and the horizon.  Tau should be long, e.g. 30 s, giving a cutoff of 1/(2π tau) Hz (about
+0.005 Hz).  The trade-off is that genuine slow or sustained rotation is removed as well: a constant turn rate
+decays away with time constant tau, so with tau 30 s a 3 °/s turn reads only 1.1 °/s after 30 s, and however long
+it lasts adds at most 90° (rate × tau) to the integrated angle.  It suits platforms that never turn steadily for
+long; leave it off where they do.
+
+The filter applies to all the outputs, including the averages, which have the drift as of their end removed.
+It starts with no drift, and restarts when called again.  A tau of 0, the default, turns it off.
+*/
+func (mpu *ICM20948) SetGyroHighPass(tau time.Duration) error {
+	if tau < 0 {
+		return errors.New("ICM20948 Error: gyro high-pass time constant must not be negative")
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.gyroHighPass = nil
+	if tau != 0 {
+		mpu.gyroHighPass = newGyroHighPass(tau)
+	}
+	return nil
+}
+
+// highPassGyro feeds the gyro values of d, if it has them, to the high-pass filter, if enabled, and replaces them
+// with the filtered values.  The caller must hold mpu.mu.
+func (mpu *ICM20948) highPassGyro(d *MPUData) {
+	if mpu.gyroHighPass == nil || d.GAError != nil {
+		return
+	}
+	g := mpu.gyroHighPass.update(d.T, [3]float64{d.G1, d.G2, d.G3})
+	d.G1, d.G2, d.G3 = g[0], g[1], g[2]
+}
+
+// highPassAvgGyro removes the current drift from the averaged gyro values of d.  The caller must hold mpu.mu.
+func (mpu *ICM20948) highPassAvgGyro(d *MPUData) {
+	if mpu.gyroHighPass == nil || d.GAError != nil {
+		return
+	}
+	g := mpu.gyroHighPass.remove([3]float64{d.G1, d.G2, d.G3})
+	d.G1, d.G2, d.G3 = g[0], g[1], g[2]
+}
@@ -0,0 +1,207 @@
+package icm20948
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	deg                   = math.Pi / 180
+	defaultHorizonTimeout = 500 * time.Millisecond // Accel/gyro gap after which the horizon filter restarts
+	horizonMagStale       = time.Second            // Age of the mag reading after which the heading is degraded
+	horizonBufSize        = 100                    // Size of the CHorizon buffer
+)
+
+/*
+HorizonData holds a simple attitude estimate suitable for an artificial horizon display.
+Angles are in degrees.  The sensor is assumed to be mounted with axis 1 to the nose, 2 to the left wing and 3 up,
+as in the ahrs package and as WithBoardPreset gives for known boards.  Pitch is positive nose up, roll is
+positive right wing down and heading is the magnetic heading of the nose, 0-360° clockwise from magnetic north.
+
+If the magnetometer fails or is flagged unhealthy after giving a heading, the heading carries on from the last
+good one by integrating the gyro yaw rate, like a directional gyro, and HeadingDegraded is set.  It then drifts
+with the gyro bias, so consumers should warn when it is degraded.  When the magnetometer recovers the heading is
+pulled back to the magnetic heading over the filter's time constant rather than jumping.
+*/
+type HorizonData struct {
+	Pitch, Roll, Heading float64
+	AttitudeValid        bool // Pitch and Roll are valid
+	HeadingValid         bool // Heading is valid; it needs a working magnetometer, at least at first
+	HeadingDegraded      bool // Heading is dead-reckoned from the gyro since the magnetometer was lost
+	T                    time.Time
+}
+
+// horizonFilter is a complementary filter that blends the gyro (short term) with the accelerometer tilt and
+// tilt-compensated magnetometer heading (long term).
+type horizonFilter struct {
+	tau        float64 // Time constant, s
+	magAligned bool    // The magnetometer readings are already in the accel/gyro axes; see WithAxisMap
+	h          HorizonData
+	last       time.Time
+}
+
+func newHorizonFilter(tau time.Duration, magAligned bool) *horizonFilter {
+	return &horizonFilter{tau: tau.Seconds(), magAligned: magAligned}
+}
+
+// update feeds one sample into the filter and returns whether it gave a new estimate.  magHealthy is false if the
+// magnetometer has been flagged unhealthy.
+func (f *horizonFilter) update(d *MPUData, magHealthy bool) bool {
+	if d.GAError != nil {
+		return false
+	}
+	roll, pitch, err := accelTilt(d.A1, d.A2, d.A3)
+	if err != nil {
+		return false
+	}
+	m1, m2, m3 := d.M1, d.M2, d.M3
+	if !f.magAligned {
+		// The AK09916 axes are rotated relative to the accel/gyro: X is shared but Y and Z point the opposite way.
+		m2, m3 = -m2, -m3
+	}
+	heading, headingErr := tiltCompensatedHeading(d.A1, d.A2, d.A3, m1, m2, m3)
+	headingOK := d.MagError == nil && headingErr == nil && magHealthy && !d.MagAnomaly && d.T.Sub(d.TM) < horizonMagStale
+
+	dt := d.T.Sub(f.last).Seconds()
+	if !f.h.AttitudeValid || dt <= 0 || dt > defaultHorizonTimeout.Seconds() {
+		// (Re)start from the accelerometer and magnetometer alone.
+		f.h = HorizonData{Pitch: pitch, Roll: roll, Heading: heading, AttitudeValid: true, HeadingValid: headingOK}
+	} else {
+		alpha := f.tau / (f.tau + dt)
+		// Small-angle body rates: G1 rolls the right wing down, G2 pitches the nose down and G3 yaws left.
+		f.h.Roll = alpha*(f.h.Roll+d.G1*dt) + (1-alpha)*roll
+		f.h.Pitch = alpha*(f.h.Pitch-d.G2*dt) + (1-alpha)*pitch
+		gyroHeading := f.h.Heading - d.G3*dt
+		switch {
+		case headingOK && f.h.HeadingValid:
+			f.h.Heading = gyroHeading + (1-alpha)*angleDiff(heading, gyroHeading)
+		case headingOK:
+			f.h.Heading = heading
+		default:
+			f.h.Heading = gyroHeading
+		}
+		f.h.Heading = normalizeHeading(f.h.Heading)
+		// Once there has been a magnetic heading, losing the magnetometer only degrades it.
+		f.h.HeadingDegraded = !headingOK && f.h.HeadingValid
+		f.h.HeadingValid = headingOK || f.h.HeadingValid
+	}
+	f.h.T = d.T
+	f.last = d.T
+	return true
+}
+
+// WithHorizon turns on the horizon filter from the first sample; see EnableHorizon.
+func WithHorizon(tau time.Duration) Option {
+	return func(mpu *ICM20948) {
+		mpu.horizon = nil
+		if tau != 0 {
+			mpu.horizon = newHorizonFilter(tau, false)
+		}
+	}
+}
+
+/*
+EnableHorizon turns on a lightweight complementary filter, run on every sample, whose output is available
+from Horizon and is sent on CHorizon, one estimate for each accel/gyro sample.  The time constant tau sets how
+long the gyro is trusted before the accelerometer and magnetometer pull the estimate back: longer is smoother but
+slower to correct for gyro drift.  Noise in the accelerometer tilt and magnetometer heading is smoothed over
+about tau, and a gyro bias of b °/s leaves an error of about b·tau degrees.  One second suits most uses.
+A tau of 0 disables the filter; CHorizon is then no longer sent to but isn't closed until CloseMPU.  If CHorizon
+isn't read fast enough, the oldest estimates are dropped.
+*/
+func (mpu *ICM20948) EnableHorizon(tau time.Duration) error {
+	if tau < 0 {
+		return errors.New("ICM20948 Error: horizon time constant must not be negative")
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	if tau == 0 {
+		mpu.horizon = nil
+	} else {
+		mpu.horizon = newHorizonFilter(tau, mpu.axisMap != nil)
+	}
+	return nil
+}
+
+// Horizon returns the latest pitch, roll and heading from the filter started by EnableHorizon.
+// Both valid flags are false if the filter isn't enabled or hasn't seen any data yet.
+func (mpu *ICM20948) Horizon() HorizonData {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	if mpu.horizon == nil {
+		return HorizonData{}
+	}
+	return mpu.horizon.h
+}
+
+// Heading returns the magnetic heading of the nose, 0-360° clockwise from north, from the filter started by
+// EnableHorizon, and whether it is degraded to dead reckoning from the gyro; see HorizonData.  HeadingWithQuality
+// also says how far to trust it.
+func (mpu *ICM20948) Heading() (heading float64, degraded bool, err error) {
+	h := mpu.Horizon()
+	if !h.HeadingValid {
+		return 0, false, errors.New("ICM20948 Error: no heading, the horizon filter isn't enabled or has no magnetometer reading")
+	}
+	return h.Heading, h.HeadingDegraded, nil
+}
+
+// sendHorizon sends the latest estimate of the horizon filter on CHorizon, dropping the oldest if it is full.
+// The caller must hold mpu.mu.
+func (mpu *ICM20948) sendHorizon() {
+	h := mpu.horizon.h
+	select {
+	case mpu.cHorizon <- h:
+	default:
+		select {
+		case <-mpu.cHorizon:
+		default:
+		}
+		mpu.cHorizon <- h
+	}
+}
+
+// accelTilt returns the roll and pitch in degrees implied by an accelerometer reading, assuming the only
+// acceleration is gravity.
+func accelTilt(a1, a2, a3 float64) (roll, pitch float64, err error) {
+	if a1*a1+a2*a2+a3*a3 < 1e-12 {
+		return 0, 0, errors.New("ICM20948 Error: accel reading too small to compute tilt")
+	}
+	roll = math.Atan2(a2, a3) / deg
+	pitch = math.Atan2(a1, math.Hypot(a2, a3)) / deg
+	return
+}
+
+// tiltCompensatedHeading returns the magnetic heading of the nose in degrees, 0-360° clockwise from north, using
+// the accelerometer to find the horizontal plane.  The magnetometer reading must be in the accel axes.
+func tiltCompensatedHeading(a1, a2, a3, m1, m2, m3 float64) (float64, error) {
+	a := math.Sqrt(a1*a1 + a2*a2 + a3*a3)
+	if a < 1e-6 {
+		return 0, errors.New("ICM20948 Error: accel reading too small to compute heading")
+	}
+	u1, u2, u3 := a1/a, a2/a, a3/a // Up
+
+	// Horizontal components of the field and of the nose and left wing directions.
+	mu := m1*u1 + m2*u2 + m3*u3
+	h1, h2, h3 := m1-mu*u1, m2-mu*u2, m3-mu*u3
+	x1, x2, x3 := 1-u1*u1, -u1*u2, -u1*u3
+	y1, y2, y3 := u2*x3-u3*x2, u3*x1-u1*x3, u1*x2-u2*x1 // Up × nose = left
+
+	hx := h1*x1 + h2*x2 + h3*x3
+	hy := h1*y1 + h2*y2 + h3*y3
+	if math.Hypot(hx, hy) < 1e-6 {
+		return 0, errors.New("ICM20948 Error: no horizontal field to compute heading")
+	}
+	// North is atan2(hy, hx) to the left of the nose, so the nose is that far clockwise from north.
+	return normalizeHeading(math.Atan2(hy, hx) / deg), nil
+}
+
+// angleDiff returns a-b in degrees, wrapped to [-180, 180).
+func angleDiff(a, b float64) float64 {
+	return math.Mod(math.Mod(a-b+180, 360)+360, 360) - 180
+}
+
+// normalizeHeading wraps a heading in degrees to [0, 360).
+func normalizeHeading(h float64) float64 {
+	return math.Mod(math.Mod(h, 360)+360, 360)
+}
@@ -0,0 +1,11 @@
+//go:build !nohost
+// +build !nohost
+
+package icm20948
+
+// The embd hosts register themselves when imported, which the hardware needs but the math, types and
+// ReplayFromCSV don't.  Build with -tags nohost to leave them out, e.g. to run the package on a laptop or in CI.
+import (
+	_ "github.com/kidoman/embd/host/all" // Empty import needed to initialize embd library.
+	_ "github.com/kidoman/embd/host/rpi" // Empty import needed to initialize embd library.
+)
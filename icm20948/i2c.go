@@ -0,0 +1,14 @@
+package icm20948
+
+/*
+I2C is the bus the driver talks to the ICM20948 through.  It is the part of embd.I2CBus the driver uses, so an
+embd bus can be passed as it is (see NewWithOptions), while other stacks, e.g. periph.io, need only a small
+wrapper to be passed to NewWithBus.  addr is the 7-bit device address; ReadFromReg and WriteToReg transfer
+len(value) bytes starting at reg in one transaction.
+*/
+type I2C interface {
+	ReadByteFromReg(addr, reg byte) (byte, error)
+	WriteByteToReg(addr, reg, value byte) error
+	ReadFromReg(addr, reg byte, value []byte) error
+	WriteToReg(addr, reg byte, value []byte) error
+}
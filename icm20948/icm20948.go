@@ -4,27 +4,43 @@ package icm20948
 // Also referenced https://github.com/brianc118/ICM20948/blob/master/ICM20948.cpp
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"math"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/kidoman/embd"
-	_ "github.com/kidoman/embd/host/all" // Empty import needed to initialize embd library.
-	_ "github.com/kidoman/embd/host/rpi" // Empty import needed to initialize embd library.
 )
 
 const (
-	bufSize          = 250                // Size of buffer storing instantaneous sensor values
-	scaleMagAK8963   = 9830.0 / 65536
-	scaleMagAK09916  = 4912.0 / 32752     // AK09916: ±4912 µT range, 16-bit
-	calDataLocation = "/etc/icm20948cal.json"
+	bufSize         = 250 // Size of buffer storing instantaneous sensor values
+	scaleMagAK8963  = 9830.0 / 65536
+	scaleMagAK09916 = 4912.0 / 32752          // AK09916: ±4912 µT range, 16-bit
+	calDataLocation = "/etc/icm20948cal.json" // Default calibration file
+
+	defaultConfigCheckInterval = 10 * time.Second // How often readSensors verifies the chip still holds our config
+	defaultWarmupReads         = 1                // Number of averaged reads discarded before the driver is ready
+	warmupReadInterval         = 500 * time.Millisecond
+	warmupWindow               = 250 * time.Millisecond // Window over which gyro noise is measured during warm-up
+
+	maxGyroDivider  = 0xFF  // GYRO_SMPLRT_DIV is 8 bits
+	maxAccelDivider = 0xFFF // ACCEL_SMPLRT_DIV_1 and _2 hold a 12-bit divider
 )
 
-// MPUData contains all the values measured by an ICM20948.
+/*
+MPUData contains all the values measured by an ICM20948.
+T is when the values were read and TM when the magnetometer values were, so stale data can be spotted with Age.
+When the gyro and accelerometer run at different rates (see SetGyroSampleRate), a sample is emitted each time
+either one is read and T is the time of that read.  The other sensor's values are carried over from its last
+read, i.e. held until it is next read, so integrating any value over DT between samples remains correct.
+Likewise Temp is the last die temperature read, which may be from an earlier sample; see SetTempEvery.
+Every sample is a new MPUData that the driver never modifies once it has been sent, so it can be read without
+locking, unless WithPreallocatedSamples is given.  The same value may be handed to several consumers (e.g. on C and CBuf), so they must not modify it either.
+*/
 type MPUData struct {
 	G1, G2, G3        float64
 	A1, A2, A3        float64
@@ -34,6 +50,27 @@ type MPUData struct {
 	N, NM             int
 	T, TM             time.Time
 	DT, DTM           time.Duration
+	Saturated         uint8         // Bitmask of SaturatedG1... flags for axes whose raw reading hit full scale
+	Jitter            time.Duration // Deviation of the interval since the previous read of this sensor from nominal
+	MagAnomaly        bool          // The mag field magnitude is far from expected, likely interference; see SetMagNoiseModel
+	MagOverrun        bool          // A magnetometer measurement was lost before this one was read; see Stats.MagOverruns
+	Seq               uint64        // Number of the sample, counting from 1; a gap means samples were missed
+}
+
+// Flags for MPUData.Saturated.  An axis is saturated when its raw reading is at or next to the int16 limit for
+// the configured range, so the true value may be larger than reported.
+const (
+	SaturatedG1 uint8 = 1 << iota
+	SaturatedG2
+	SaturatedG3
+	SaturatedA1
+	SaturatedA2
+	SaturatedA3
+)
+
+// saturated reports whether a raw reading is at (or adjacent to) full scale.
+func saturated(v int16) bool {
+	return v >= math.MaxInt16-1 || v <= math.MinInt16+1
 }
 
 type mpuCalData struct {
@@ -43,6 +80,11 @@ type mpuCalData struct {
 	Ms11, Ms12, Ms13 float64 // Magnetometer rescaling matrix
 	Ms21, Ms22, Ms23 float64 // (Only diagonal is used currently)
 	Ms31, Ms32, Ms33 float64
+	MagField         float64 // Magnitude of the calibrated magnetometer field, µT; 0 if not known
+	MagNoise         float64 // RMS scatter of the calibrated field about MagField, as a fraction of it; 0 if not known
+	Gs11, Gs12, Gs13 float64 // Gyro g-sensitivity, °/s per G: row i is the response of gyro axis i to accel axes 1-3
+	Gs21, Gs22, Gs23 float64 // (All zero unless measured with CalibrateGSensitivity)
+	Gs31, Gs32, Gs33 float64
 }
 
 func (d *mpuCalData) reset() {
@@ -51,98 +93,455 @@ func (d *mpuCalData) reset() {
 	d.Ms33 = 1
 }
 
-func (d *mpuCalData) save() {
-	fd, err := os.OpenFile(calDataLocation, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0644))
+func (d *mpuCalData) save(path string) error {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0644))
 	if err != nil {
-		log.Printf("ICM20948: Error saving calibration data to %s: %s", calDataLocation, err.Error())
-		return
+		log.Printf("ICM20948: Error saving calibration data to %s: %s", path, err.Error())
+		return err
 	}
 	defer fd.Close()
 	calData, err := json.Marshal(d)
 	if err != nil {
 		log.Printf("ICM20948: Error marshaling calibration data: %s", err)
-		return
+		return err
 	}
-	fd.Write(calData)
+	_, err = fd.Write(calData)
+	return err
 }
 
-func (d *mpuCalData) load() (err error) {
+func (d *mpuCalData) load(path string) (err error) {
 	//d.M01 = 1638.0
 	//d.M02 = -589.0
 	//d.M03 = -2153.0
 	//d.Ms11 = 0.00031969309462915601
 	//d.Ms22 = 0.00035149384885764499
 	//d.Ms33 = 0.00028752156411730879
-	//d.save()
+	//d.save(calDataLocation)
 	//return
 	errstr := "ICM20948: Error reading calibration data from %s: %s"
-	fd, rerr := os.Open(calDataLocation)
-	if rerr != nil {
-		err = fmt.Errorf(errstr, calDataLocation, rerr.Error())
-		return
-	}
-	defer fd.Close()
-	buf := make([]byte, 1024)
-	count, rerr := fd.Read(buf)
+	buf, rerr := os.ReadFile(path)
 	if rerr != nil {
-		err = fmt.Errorf(errstr, calDataLocation, rerr.Error())
+		err = fmt.Errorf(errstr, path, rerr.Error())
 		return
 	}
-	rerr = json.Unmarshal(buf[0:count], d)
+	rerr = json.Unmarshal(buf, d)
 	if rerr != nil {
-		err = fmt.Errorf(errstr, calDataLocation, rerr.Error())
+		err = fmt.Errorf(errstr, path, rerr.Error())
 		return
 	}
 	return
 }
 
+// Stats holds counters describing the health of the running driver.
+type Stats struct {
+	ConfigChecks       int           // Number of times the chip configuration was verified
+	ConfigMismatches   int           // Number of times the chip configuration didn't match (e.g. after a brownout)
+	ConfigRecoveries   int           // Number of times the configuration was successfully re-applied
+	LastConfigMismatch time.Time     // Time of the most recent configuration mismatch
+	WatchdogFaults     int           // Number of times the sensor went silent for longer than the watchdog timeout
+	Resets             int           // Number of times the chip was reset and reconfigured while running
+	Saturations        int           // Number of accel/gyro samples with at least one saturated axis
+	MagOverflows       int           // Number of magnetometer reads discarded because the field saturated the sensor
+	MagOverruns        int           // Number of magnetometer reads that found a measurement lost, unread (ST1 DOR)
+	BufDrops           int           // Number of samples dropped because CBuf was full
+	JitterRMS          time.Duration // RMS of MPUData.Jitter over all accel/gyro reads
+	JitterMax          time.Duration // Largest MPUData.Jitter seen, in magnitude
+	BusTimeouts        int           // Number of I2C transactions abandoned after the bus timeout
+	Samples            uint64        // Number of accel/gyro samples produced, i.e. the latest MPUData.Seq
+	MagResyncs         int           // Number of times the magnetometer was re-initialized after repeated failed reads
+	AccelReadCount     uint64        // Number of reads of the accelerometer, successful or not
+	MagReadCount       uint64        // Number of new, valid magnetometer readings
+	MagNotReadyCount   uint64        // Number of magnetometer polls that found no new data ready
+	GyroAccelErrors    uint64        // Number of failed gyro/accel register reads; see SetOnError
+	MagErrors          uint64        // Number of failed magnetometer reads and triggers
+	BusErrors          uint64        // Number of other failed bus accesses of the read loop
+	StuckAxes          uint16        // Flags (StuckG1 etc.) of the axes currently stuck; see SetStuckAxisCheck
+	StuckAxisFaults    int           // Number of times an axis was found stuck
+	RateShortfalls     int           // Number of seconds the gyro was polled at under 90% of its tick rate; see AchievedRate
+	BusFaults          int           // Number of gyro/accel samples rejected as a likely bus fault; see ErrBusFault
+}
+
 /*
 ICM20948 represents an InvenSense ICM20948 9DoF chip.
 All communication is via channels.
 */
 type ICM20948 struct {
-	i2cbus                embd.I2CBus
-	scaleGyro, scaleAccel float64 // Max sensor reading for value 2**15-1
-	sampleRate            int
-	enableMag             bool
+	// Accessed atomically since they are used with or without mu; first to be 64-bit aligned on 32-bit ARM.
+	busTimeout  int64 // Bus timeout (time.Duration)
+	busTimeouts int64 // Number of bus timeouts
+
+	i2cbus                            I2C
+	address                           byte    // I2C address of the ICM20948
+	calPath                           string  // Calibration file
+	scaleGyro, scaleAccel             float64 // Max sensor reading for value 2**15-1
+	sensitivityGyro, sensitivityAccel int
+	sampleRate                        int // Output rate: the faster of gyroRate and accelRate, Hz
+	enableMag                         bool
+	pwrMgmt1, gyroConfig              byte    // Register values expected while running, for brownout detection
+	i2cMasterODR                      float64 // Rate of the internal I2C master, Hz
 	mpuCalData
-	mcal1, mcal2, mcal3 float64         // Hardware magnetometer calibration values, uT
-	C                   <-chan *MPUData // Current instantaneous sensor values
-	CAvg                <-chan *MPUData // Average sensor values (since CAvg last read)
-	CBuf                <-chan *MPUData // Buffer of instantaneous sensor values
-	cClose              chan bool       // Turn off MPU polling
+	mcal1, mcal2, mcal3 float64            // Hardware magnetometer calibration values, uT
+	magModel            string             // Magnetometer the mcal values are for, e.g. "AK09916"
+	C                   <-chan *MPUData    // Current instantaneous sensor values
+	CAvg                <-chan *MPUData    // Average sensor values (since CAvg last read); see AverageSince
+	CExpAvg             <-chan *MPUData    // Exponential average of the sensor values, never reset
+	CBuf                <-chan *MPUData    // Buffer of instantaneous sensor values
+	CResampled          <-chan *MPUData    // Sensor values at a fixed rate, when enabled; see SetResampling
+	CFiltered           <-chan *MPUData    // Low-pass filtered sensor values, when enabled; see SetBiquad
+	CHorizon            <-chan HorizonData // Pitch, roll and heading for each sample, when enabled; see EnableHorizon
+	Faults              <-chan error       // Health problems detected while running, e.g. the sensor going silent
+	cClose              chan bool          // Closed to turn off MPU polling
+	closeOnce           sync.Once          // Makes CloseMPU idempotent
+	cDone               chan bool          // Closed when readSensors has stopped
+	cC, cAvg, cBuf      chan *MPUData      // Sending ends of C, CAvg and CBuf
+	cExpAvg             chan *MPUData      // Sending end of CExpAvg
+	cResampled          chan *MPUData      // Sending end of CResampled
+	cFiltered           chan *MPUData      // Sending end of CFiltered
+	cHorizon            chan HorizonData   // Sending end of CHorizon
+	cAvgReq             chan avgRequest    // Requests from AverageSince
+	cFaults             chan error         // Sending end of Faults
+	cMagFix             chan bool          // Closed when the first good magnetometer sample has been read
+	cPause              chan bool          // Pause and Resume requests to readSensors
+	pauseMu             sync.Mutex         // Serializes Pause and Resume
+
+	busMu sync.Mutex // Serializes register access between readSensors and one-off transactions like AuxRead
+
+	mu                  sync.Mutex    // Protects the runtime settings and stats below
+	configCheckInterval time.Duration // How often to verify the chip configuration; 0 disables the check
+	configAutoRecover   bool          // Whether to re-apply the configuration when a mismatch is found
+	stats               Stats
+	lastGoodRead        time.Time              // Time of the last accel/gyro read without error
+	lastSample          time.Time              // As lastGoodRead, but not reset on Resume; see Age
+	watchdogTimeout     time.Duration          // How long without a good read before a fault is raised; 0 disables the watchdog
+	watchdogAutoReset   bool                   // Whether to Reset the chip when the watchdog fires
+	latest              *MPUData               // Most recent instantaneous sensor values
+	gyroRate, accelRate int                    // Requested gyro and accel sample rates, Hz
+	odo                 odometer               // Integrated rotation, when enabled
+	horizon             *horizonFilter         // Pitch/roll/heading filter, when enabled
+	skipHardIron        bool                   // Don't subtract the magnetometer hard-iron offsets
+	skipSoftIron        bool                   // Don't apply the magnetometer soft-iron matrix
+	magSingle           bool                   // Trigger single AK09916 measurements rather than running it continuously
+	magOff              bool                   // The magnetometer is powered down; see SetMagEnabled
+	paused              bool                   // Reads are paused; see Pause
+	asleep              bool                   // The chip is asleep; see Sleep
+	sleepPaused         bool                   // Reads were already paused when Sleep was called
+	pwrMgmt2            byte                   // PWR_MGMT_2 before Sleep, restored by Wake
+	gyroDLPFBypass      bool                   // Gyro DLPF is bypassed; see SetGyroDLPFBypass
+	accelDLPFBypass     bool                   // Accel DLPF is bypassed; see SetAccelDLPFBypass
+	expAvg              expAvg                 // Exponential average sent on CExpAvg
+	resampler           *resampler             // Resampling to a fixed rate for CResampled, when enabled
+	biquad              *biquadFilter          // Low-pass filter for CFiltered, when enabled
+	gyroHighPass        *gyroHighPass          // Gyro drift filter, when enabled; see SetGyroHighPass
+	preallocSamples     int                    // Reused samples beyond those CBuf holds; see WithPreallocatedSamples
+	samples             *sampleRing            // Reused samples, when enabled
+	decimators          []*decimator           // Streams from DecimatedStream
+	fastInit            bool                   // Configure with the fast init; see SetFastInit
+	memVerify           bool                   // Read back DMP memory writes; see WithMemVerify
+	hwBias              bool                   // Remove the biases with the offset registers; see SetHWBiasRemoval
+	accelTrimRead       bool                   // accelTrim has been read
+	accelTrim           [3]int16               // Factory accel offsets (XA_OFFS[14:0] etc.)
+	gyroHWOffset        [3]float64             // Gyro bias removed by the offset registers, °/s
+	accelHWOffset       [3]float64             // Accel bias removed by the offset registers, G
+	stuckAxisSamples    int                    // Identical readings after which an axis is stuck; 0 disables
+	stuck               stuckDetector          // Runs of identical readings, for SetStuckAxisCheck
+	busFault            busFaultDetector       // Runs of gyro/accel words that look like a bus fault
+	initRetries         int                    // Times the constructor retries a failed bring-up
+	initBackoff         time.Duration          // Wait before each retry of the bring-up
+	magOverflow         magOverflowTracker     // Rate of magnetometer overflows, for MagHealthy
+	calTime             time.Time              // When the calibration was loaded or last changed
+	calSource           string                 // How the calibration was loaded or last changed
+	magField            float64                // Expected mag field magnitude, µT; 0 to use the calibrated MagField
+	magFieldTol         float64                // Tolerance on magField, µT; 0 for the default
+	latitude            float64                // Latitude for the model field, °, if latitudeSet
+	latitudeSet         bool                   // latitude has been set with SetLatitude
+	magResyncFailures   int                    // Consecutive failed mag reads before re-initializing the mag; 0 disables
+	temp                tempReader             // When the die temperature is read, and its last reading; see SetTempEvery
+	magST1, magST2      byte                   // AK09916 status registers as last read; see MagStatus
+	axisMap             *AxisMap               // Rotation from the chip's axes to the output axes; nil for the chip's
+	logThrottle         logThrottle            // How often routine messages are logged; see SetLogThrottle
+	onError             func(err error)        // Receives the read loop's errors; see SetOnError
+	pendingErrors       []*ReadError           // Errors queued for onError
+	auxSlaves           [numAuxSlaves]auxSlave // Reads set up with ConfigureAuxSlave
+	auxDataFunc         AuxDataFunc            // Receives the aux slave bytes; see SetAuxDataFunc
+	initTrace           *InitTrace             // Records the constructor's bring-up, when enabled; see WithInitTrace
+	rateCheck           bool                   // Check the rates can be read, and log shortfalls; see WithRateCheck
+	rateCheckStrict     bool                   // Fail the constructor if the rates can't be read
+	threadPinned        bool                   // Run the read loop on its own OS thread; see WithPinnedThread
+	threadNice          int                    // Nice value of the read loop's thread, if not 0
+
+	cfg         Config             // Settings from the constructor options
+	bufPolicy   BufferPolicy       // What to do when CBuf is full
+	jitter      jitterStats        // Accumulated sample interval jitter, for Stats
+	rate        rateMeter          // Rate of the gyro reads, for AchievedRate
+	passiveCal  *passiveCal        // Running passive calibration, if any
+	stationary  stationaryDetector // Whether the sensor is stationary, for IsStationary and bias tracking
+	biasGain    float64            // Gain of the gyro bias tracking; 0 when off
+	replaySpeed float64            // Playback speed of ReplayFromCSV; 0 for as fast as possible
+	diag        Diagnostics        // What was found when the chip was last configured
+
+	warmupReads         int           // Number of averaged reads to discard at startup
+	warmupMaxGyroStdDev float64       // Gyro noise (°/s) below which the data is considered stable; 0 skips the check
+	warmupTimeout       time.Duration // How long to wait for the data to become stable
 }
 
+// Option configures optional behavior of an ICM20948 at construction.
+type Option func(*ICM20948)
+
+// WithWarmup sets how the constructor waits for the first usable samples.  It discards reads averaged reads
+// (each spanning about half a second) and then, if maxGyroStdDev is positive, waits until the standard deviation
+// of each gyro axis over a short window is below maxGyroStdDev °/s.  If the data doesn't settle within timeout,
+// the constructor returns an error.  The default is to discard a single averaged read with no stability check.
+func WithWarmup(reads int, maxGyroStdDev float64, timeout time.Duration) Option {
+	return func(mpu *ICM20948) {
+		mpu.warmupReads = reads
+		mpu.warmupMaxGyroStdDev = maxGyroStdDev
+		mpu.warmupTimeout = timeout
+	}
+}
+
+// BufferPolicy says what readSensors does with a new sample when CBuf is full.
+type BufferPolicy int
+
+const (
+	DropOldest    BufferPolicy = iota // Discard the oldest buffered sample to make room (the default)
+	DropNewest                        // Discard the new sample
+	BlockProducer                     // Wait until the consumer makes room
+)
+
 /*
-NewICM20948 creates a new ICM20948 object according to the supplied parameters.  If there is no ICM20948 available or there
-is an error creating the object, an error is returned.
+WithBufferPolicy sets what happens when CBuf is full: DropOldest suits real-time displays, which want the
+latest data, while BlockProducer suits loggers that must not lose samples.
+With BlockProducer a consumer that stops reading CBuf stalls readSensors entirely: C, CAvg and the other
+outputs stop updating, the watchdog fires and, if it is set to auto-reset, resets the chip.  Only use it when
+CBuf is always drained promptly.
 */
-func NewICM20948(i2cbus *embd.I2CBus, sensitivityGyro, sensitivityAccel, sampleRate int, enableMag bool, applyHWOffsets bool) (*ICM20948, error) {
+func WithBufferPolicy(p BufferPolicy) Option {
+	return func(mpu *ICM20948) {
+		mpu.bufPolicy = p
+	}
+}
+
+/*
+NewWithBus creates a new ICM20948 object on bus configured by opts, for I2C implementations other than embd, e.g.
+one backed by periph.io; NewWithOptions is the same for an embd bus.  Anything not set defaults as described for
+Config.  If the options are invalid, there is no ICM20948 available or there is an error creating the object, an
+error is returned.
+*/
+func NewWithBus(bus I2C, opts ...Option) (*ICM20948, error) {
 	var mpu = new(ICM20948)
-	if err := mpu.mpuCalData.load(); err != nil {
+	mpu.pwrMgmt1 = INV_CLK_PLL
+	mpu.configCheckInterval = defaultConfigCheckInterval
+	mpu.watchdogTimeout = defaultWatchdogTimeout
+	mpu.busTimeout = int64(defaultBusTimeout)
+	mpu.warmupReads = defaultWarmupReads
+	mpu.magResyncFailures = defaultMagResyncFailures
+	mpu.temp.every = 1
+	mpu.stuckAxisSamples = defaultStuckAxisSamples
+	mpu.logThrottle = logThrottle{first: defaultLogThrottleFirst, every: defaultLogThrottleEvery}
+	mpu.expAvg = expAvg{tau: defaultExpAvgTau.Seconds()}
+	mpu.stationary = stationaryDetector{maxGyro: defaultStationaryMaxGyro, maxAccel: defaultStationaryMaxAccel,
+		window: defaultStationaryWindow}
+	for _, opt := range opts {
+		opt(mpu)
+	}
+
+	cfg := mpu.cfg.withDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if mpu.busTimeout < 0 {
+		return nil, errors.New("ICM20948 Error: bus timeout must not be negative")
+	}
+	if mpu.magResyncFailures < 0 {
+		return nil, errors.New("ICM20948 Error: magnetometer resync failures must not be negative")
+	}
+	if mpu.threadNice < -20 || mpu.threadNice > 19 {
+		return nil, fmt.Errorf("ICM20948 Error: %d is not a valid nice value, use -20 to 19", mpu.threadNice)
+	}
+	if mpu.temp.every < 0 {
+		return nil, errors.New("ICM20948 Error: temperature read interval must not be negative")
+	}
+	if mpu.stuckAxisSamples < 0 {
+		return nil, errors.New("ICM20948 Error: stuck axis samples must not be negative")
+	}
+	if mpu.resampler != nil && mpu.resampler.period <= 0 {
+		return nil, errors.New("ICM20948 Error: resampling rate must not be negative")
+	}
+	if mpu.biquad != nil && (mpu.biquad.cutoff < 0 || !finite(mpu.biquad.cutoff)) {
+		return nil, fmt.Errorf("ICM20948 Error: %g Hz is not a valid filter cutoff", mpu.biquad.cutoff)
+	}
+	if mpu.gyroHighPass != nil && mpu.gyroHighPass.tau < 0 {
+		return nil, errors.New("ICM20948 Error: gyro high-pass time constant must not be negative")
+	}
+	s := mpu.stationary
+	if err := checkStationaryThresholds(s.maxGyro, s.maxAccel, s.window); err != nil {
+		return nil, err
+	}
+	if !(mpu.biasGain >= 0 && mpu.biasGain <= 1) {
+		return nil, errors.New("ICM20948 Error: bias tracking gain must be between 0 and 1")
+	}
+	if err := mpu.makeSamples(); err != nil {
+		return nil, err
+	}
+	if mpu.initRetries < 0 || mpu.initBackoff < 0 {
+		return nil, errors.New("ICM20948 Error: init retries and backoff must not be negative")
+	}
+	if mpu.logThrottle.first < 0 || mpu.logThrottle.every < 0 {
+		return nil, errors.New("ICM20948 Error: log throttle settings must not be negative")
+	}
+	if mpu.axisMap != nil {
+		if err := mpu.axisMap.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if mpu.horizon != nil {
+		if mpu.horizon.tau < 0 {
+			return nil, errors.New("ICM20948 Error: horizon time constant must not be negative")
+		}
+		mpu.horizon.magAligned = mpu.axisMap != nil
+	}
+	mpu.cfg = cfg
+	mpu.sampleRate = cfg.SampleRate
+	mpu.gyroRate, mpu.accelRate = cfg.SampleRate, cfg.AccelSampleRate
+	if mpu.accelRate > mpu.sampleRate {
+		mpu.sampleRate = mpu.accelRate
+	}
+	mpu.enableMag = cfg.EnableMag
+	mpu.sensitivityGyro = cfg.SensitivityGyro
+	mpu.sensitivityAccel = cfg.SensitivityAccel
+	mpu.address = cfg.Address
+	mpu.calPath = cfg.CalibrationPath
+
+	if err := mpu.mpuCalData.load(mpu.calPath); err != nil {
 		mpu.mpuCalData.reset()
+		mpu.calibrationChanged("defaults, as " + mpu.calPath + " couldn't be loaded")
+	} else {
+		mpu.calibrationChanged("loaded from " + mpu.calPath)
+	}
+
+	mpu.i2cbus = bus
+
+	if err := mpu.configureWithRetries(); err != nil {
+		return nil, err
+	}
+
+	// Set clock source to PLL. Not necessary - default "auto select" (PLL when ready).
+
+	mpu.traceStep("hardware offsets")
+	if cfg.ApplyHWOffsets {
+		if err := mpu.ReadAccelBias(cfg.SensitivityAccel); err != nil {
+			mpu.initTrace.fail(err)
+			return nil, err
+		}
+		if err := mpu.ReadGyroBias(cfg.SensitivityGyro); err != nil {
+			mpu.initTrace.fail(err)
+			return nil, err
+		}
+	}
+	if mpu.hwBias {
+		if err := mpu.applyHWBias(); err != nil {
+			mpu.initTrace.fail(err)
+			return nil, err
+		}
+	}
+	if mpu.rateCheck {
+		if err := mpu.checkRate(); err != nil {
+			return nil, err
+		}
+	}
+	// Later writes, e.g. by the watchdog's recovery, aren't part of the bring-up.
+	mpu.traceStep("warm-up")
+	trace := mpu.initTrace
+	mpu.initTrace = nil
+
+	// Usually we don't want the automatic gyro bias compensation - it pollutes the gyro in a non-inertial frame.
+	/*	if err := mpu.EnableGyroBiasCal(false); err != nil {
+			return nil, err
+		}
+	*/
+	mpu.makeChannels()
+	go mpu.readSensors()
+	go mpu.watchdog()
+
+	if err := mpu.warmUp(); err != nil {
+		trace.fail(err)
+		mpu.CloseMPU()
+		return nil, err
 	}
 
-	mpu.sampleRate = sampleRate
-	mpu.enableMag = enableMag // Enable magnetometer based on parameter
+	return mpu, nil
+}
+
+// warmUp gives the IMU time to fully initialize, clears out any bad values from the averages and optionally
+// waits until the gyro noise has settled.
+func (mpu *ICM20948) warmUp() error {
+	for i := 0; i < mpu.warmupReads; i++ {
+		time.Sleep(warmupReadInterval) // Make sure it's ready
+		<-mpu.CAvg                     // Discard the first readings.
+	}
+
+	if mpu.warmupMaxGyroStdDev <= 0 {
+		return nil
+	}
+
+	var sd1, sd2, sd3 float64
+	deadline := time.Now().Add(mpu.warmupTimeout)
+	for time.Now().Before(deadline) {
+		var (
+			n             float64
+			s1, s2, s3    float64
+			ss1, ss2, ss3 float64
+			windowEnd     = time.Now().Add(warmupWindow)
+		)
+		for time.Now().Before(windowEnd) {
+			d := <-mpu.CBuf
+			if d.GAError != nil {
+				continue
+			}
+			n++
+			s1, s2, s3 = s1+d.G1, s2+d.G2, s3+d.G3
+			ss1, ss2, ss3 = ss1+d.G1*d.G1, ss2+d.G2*d.G2, ss3+d.G3*d.G3
+		}
+		if n < 2 {
+			continue
+		}
+		sd1 = math.Sqrt(math.Max(0, (ss1-s1*s1/n)/(n-1)))
+		sd2 = math.Sqrt(math.Max(0, (ss2-s2*s2/n)/(n-1)))
+		sd3 = math.Sqrt(math.Max(0, (ss3-s3*s3/n)/(n-1)))
+		if sd1 < mpu.warmupMaxGyroStdDev && sd2 < mpu.warmupMaxGyroStdDev && sd3 < mpu.warmupMaxGyroStdDev {
+			return nil
+		}
+	}
+	return fmt.Errorf("ICM20948 Error: gyro didn't stabilize within %s (std dev %.3f, %.3f, %.3f °/s)",
+		mpu.warmupTimeout, sd1, sd2, sd3)
+}
 
-	mpu.i2cbus = *i2cbus
+// configure resets the ICM20948 and applies the sensitivities, filters, sample rates and magnetometer setup
+// stored in mpu.  It is used both at startup and to recover from a brownout.
+func (mpu *ICM20948) configure() error {
+	mpu.mu.Lock()
+	fast := mpu.fastInit
+	mpu.mu.Unlock()
 
+	mpu.traceStep("reset")
 	mpu.setRegBank(0)
 
 	// Initialization of MPU
 	// Reset device.
 	if err := mpu.i2cWrite(ICMREG_PWR_MGMT_1, BIT_H_RESET); err != nil {
-		return nil, errors.New("Error resetting ICM20948")
+		return errors.New("Error resetting ICM20948")
 	}
 
 	// Wake up chip.
-	time.Sleep(100 * time.Millisecond)
-	// CLKSEL = 1.
+	mpu.traceStep("wake")
+	if err := mpu.waitForReset(fast); err != nil {
+		return err
+	}
+	// CLKSEL = 1 unless changed with SetClockSource.
 	// From ICM-20948 register map (PWR_MGMT_1):
 	//  "NOTE: CLKSEL[2:0] should be set to 1~5 to achieve full gyroscope performance."
-	if err := mpu.i2cWrite(ICMREG_PWR_MGMT_1, 0x01); err != nil {
-		return nil, errors.New("Error waking ICM20948")
+	if err := mpu.i2cWrite(ICMREG_PWR_MGMT_1, mpu.pwrMgmt1); err != nil {
+		return errors.New("Error waking ICM20948")
 	}
 
 	// Note: inv_mpu.c sets some registers here to allocate 1kB to the FIFO buffer and 3kB to the DMP.
@@ -150,37 +549,67 @@ func NewICM20948(i2cbus *embd.I2CBus, sensitivityGyro, sensitivityAccel, sampleR
 	// so we skip this.
 	// Don't let FIFO overwrite DMP data
 	//if err := mpu.i2cWrite(ICMREG_ACCEL_CONFIG_2, BIT_FIFO_SIZE_1024|0x8); err != nil {
-	//	return nil, errors.New("Error setting up ICM20948")
+	//	return errors.New("Error setting up ICM20948")
 	//}
 
 	// Set Gyro and Accel sensitivities
-	if err := mpu.SetGyroSensitivity(sensitivityGyro); err != nil {
+	mpu.traceStep("sensitivity")
+	if err := mpu.setGyroSensitivity(mpu.sensitivityGyro); err != nil {
 		log.Println(err)
 	}
 
-	if err := mpu.SetAccelSensitivity(sensitivityAccel); err != nil {
+	if err := mpu.setAccelSensitivity(mpu.sensitivityAccel); err != nil {
 		log.Println(err)
 	}
 
-	sampRate := byte(1125/mpu.sampleRate - 1)
+	mpu.mu.Lock()
+	gyroRate, accelRate := mpu.gyroRate, mpu.accelRate
+	mpu.mu.Unlock()
+	gyroDiv, err := sampleRateDivider(gyroRate, maxGyroDivider)
+	if err != nil {
+		return err
+	}
+	accelDiv, err := sampleRateDivider(accelRate, maxAccelDivider)
+	if err != nil {
+		return err
+	}
+
 	// Default: Set Gyro LPF to half of sample rate
-	if err := mpu.SetGyroLPF(sampRate >> 1); err != nil {
-		return nil, err
+	mpu.traceStep("filters")
+	if err := mpu.setGyroLPF(byte(gyroDiv >> 1)); err != nil {
+		return err
 	}
 
 	// Default: Set Accel LPF to half of sample rate
-	if err := mpu.SetAccelLPF(sampRate >> 1); err != nil {
-		return nil, err
+	accelLPF := accelDiv >> 1
+	if accelLPF > 0xFF {
+		accelLPF = 0xFF // The accel divider has 12 bits
+	}
+	if err := mpu.setAccelDLPFConfig(accelDLPFConfig(byte(accelLPF))); err != nil {
+		return err
 	}
 
 	// Set sample rate to chosen
-	if err := mpu.SetGyroSampleRate(sampRate); err != nil {
-		return nil, err
+	mpu.traceStep("sample rates")
+	if err := mpu.setGyroSampleRate(gyroRate); err != nil {
+		return err
 	}
 
-	if err := mpu.SetAccelSampleRate(sampRate); err != nil {
-		return nil, err
+	if err := mpu.setAccelSampleRate(accelRate); err != nil {
+		return err
+	}
+
+	// Remember the resulting gyro config so that readSensors can detect a brownout.
+	mpu.traceStep("gyro config")
+	if err := mpu.setRegBank(2); err != nil {
+		return errors.New("Error setting register bank 2")
+	}
+	gyroConfig, err := mpu.i2cRead(ICMREG_GYRO_CONFIG)
+	mpu.setRegBank(0)
+	if err != nil {
+		return errors.New("Error reading back ICM20948 gyro config")
 	}
+	mpu.gyroConfig = gyroConfig
 
 	// Turn off FIFO buffer. Not necessary - default off.
 
@@ -189,132 +618,292 @@ func NewICM20948(i2cbus *embd.I2CBus, sensitivityGyro, sensitivityAccel, sampleR
 	// Set up magnetometer (AK09916)
 	if mpu.enableMag {
 		log.Println("ICM20948: Initializing AK09916 magnetometer...")
+		mpu.traceStep("magnetometer")
 
 		// Switch to register bank 0
 		if err := mpu.setRegBank(0); err != nil {
-			return nil, errors.New("Error setting register bank")
+			return errors.New("Error setting register bank")
 		}
 
 		// Enable I2C master mode
 		if err := mpu.i2cWrite(ICMREG_USER_CTRL, BIT_AUX_IF_EN); err != nil {
-			return nil, errors.New("Error enabling I2C master mode")
+			return errors.New("Error enabling I2C master mode")
 		}
 		log.Println("ICM20948: I2C master mode enabled")
 		time.Sleep(10 * time.Millisecond)
 
+		// Run the I2C master at least as fast as the magnetometer produces data.
+		sampleRate := mpu.SampleRate()
+		_, magRate := ak09916Mode(sampleRate)
+		if err := mpu.setI2CMasterODR(magRate); err != nil {
+			return err
+		}
+
 		// Switch to register bank 3 for I2C master configuration
 		if err := mpu.setRegBank(3); err != nil {
-			return nil, errors.New("Error setting register bank 3")
+			return errors.New("Error setting register bank 3")
 		}
 
 		// Set I2C master clock to 400 kHz
 		if err := mpu.i2cWrite(ICMREG_I2C_MST_CTRL, 0x07); err != nil {
-			return nil, errors.New("Error setting up I2C master clock")
+			return errors.New("Error setting up I2C master clock")
 		}
 
 		// Configure I2C Slave 0 to read from AK09916
-		// Set slave 0 address to AK09916 with read bit
-		if err := mpu.i2cWrite(ICMREG_I2C_SLV0_ADDR, BIT_I2C_READ|AK09916_I2C_ADDR); err != nil {
-			return nil, errors.New("Error setting up AK09916 slave address")
-		}
-
-		// Start reading from ST1 register
-		if err := mpu.i2cWrite(ICMREG_I2C_SLV0_REG, AK09916_ST1); err != nil {
-			return nil, errors.New("Error setting up AK09916 read register")
-		}
-
-		// Enable 9-byte reads on slave 0 (ST1 + 6 bytes mag data + ST2 + 1 reserved)
-		if err := mpu.i2cWrite(ICMREG_I2C_SLV0_CTRL, BIT_SLAVE_EN|9); err != nil {
-			return nil, errors.New("Error setting up AK09916 read control")
+		if err := mpu.armMagSlave0(); err != nil {
+			return err
 		}
 
 		// Configure I2C Slave 1 to write to AK09916 control register
 		// Set slave 1 address to AK09916 (write mode)
 		if err := mpu.i2cWrite(ICMREG_I2C_SLV1_ADDR, AK09916_I2C_ADDR); err != nil {
-			return nil, errors.New("Error setting up AK09916 slave 1 address")
+			return errors.New("Error setting up AK09916 slave 1 address")
 		}
 
 		// Write to CNTL2 register
 		if err := mpu.i2cWrite(ICMREG_I2C_SLV1_REG, AK09916_CNTL2); err != nil {
-			return nil, errors.New("Error setting up AK09916 control register")
+			return errors.New("Error setting up AK09916 control register")
 		}
 
 		// Enable 1-byte writes on slave 1
 		if err := mpu.i2cWrite(ICMREG_I2C_SLV1_CTRL, BIT_SLAVE_EN|1); err != nil {
-			return nil, errors.New("Error enabling AK09916 slave 1")
+			return errors.New("Error enabling AK09916 slave 1")
 		}
 
 		// Set continuous measurement mode based on sample rate
-		var magMode byte
-		if mpu.sampleRate >= 100 {
-			magMode = AK09916_MODE_CONT4 // 100 Hz
-		} else if mpu.sampleRate >= 50 {
-			magMode = AK09916_MODE_CONT3 // 50 Hz
-		} else if mpu.sampleRate >= 20 {
-			magMode = AK09916_MODE_CONT2 // 20 Hz
-		} else {
-			magMode = AK09916_MODE_CONT1 // 10 Hz
-		}
+		magMode, _ := ak09916Mode(sampleRate)
 
-		log.Printf("ICM20948: Setting AK09916 to continuous mode 0x%02X (sample rate: %d Hz)\n", magMode, mpu.sampleRate)
+		log.Printf("ICM20948: Setting AK09916 to continuous mode 0x%02X (sample rate: %d Hz)\n", magMode, sampleRate)
 
 		// Set the measurement mode via slave 1
 		if err := mpu.i2cWrite(ICMREG_I2C_SLV1_DO, magMode); err != nil {
-			return nil, errors.New("Error setting AK09916 measurement mode")
+			return errors.New("Error setting AK09916 measurement mode")
 		}
 
 		// Set magnetometer hardware calibration values (AK09916 doesn't have sensitivity adjustment like AK8963)
 		// Using default scale factor
-		mpu.mpuCalData.M01 = scaleMagAK09916
-		mpu.mpuCalData.M02 = scaleMagAK09916
-		mpu.mpuCalData.M03 = scaleMagAK09916
+		mpu.mu.Lock()
+		mpu.mcal1 = scaleMagAK09916
+		mpu.mcal2 = scaleMagAK09916
+		mpu.mcal3 = scaleMagAK09916
+		mpu.magModel = "AK09916"
+		mpu.mu.Unlock()
 
 		// Switch back to register bank 0
 		if err := mpu.setRegBank(0); err != nil {
-			return nil, errors.New("Error setting register bank 0")
+			return errors.New("Error setting register bank 0")
+		}
+
+		if fast {
+			if err := mpu.checkMagWhoAmI(); err != nil {
+				return err
+			}
+		} else {
+			time.Sleep(100 * time.Millisecond) // Give magnetometer time to initialize
 		}
 
-		time.Sleep(100 * time.Millisecond) // Give magnetometer time to initialize
+		if mpu.magSingle {
+			if err := mpu.setMagSingle(true); err != nil {
+				return err
+			}
+		}
+
+		mpu.mu.Lock()
+		magOff := mpu.magOff
+		mpu.mu.Unlock()
+		if magOff {
+			if err := mpu.setMagPower(false); err != nil {
+				return err
+			}
+		}
 
 		log.Println("ICM20948: AK09916 magnetometer initialization complete")
 	}
-	// Set clock source to PLL. Not necessary - default "auto select" (PLL when ready).
 
-	if applyHWOffsets {
-		if err := mpu.ReadAccelBias(sensitivityAccel); err != nil {
-			return nil, err
-		}
-		if err := mpu.ReadGyroBias(sensitivityGyro); err != nil {
-			return nil, err
-		}
+	mpu.traceStep("aux slaves")
+	if err := mpu.rearmAuxSlaves(); err != nil {
+		return err
 	}
 
-	// Usually we don't want the automatic gyro bias compensation - it pollutes the gyro in a non-inertial frame.
-	/*	if err := mpu.EnableGyroBiasCal(false); err != nil {
-			return nil, err
+	// The reset cleared the offset registers; reprogram them if the driver has done so before.
+	mpu.mu.Lock()
+	hwBias := mpu.hwBias && mpu.accelTrimRead
+	mpu.mu.Unlock()
+	if hwBias {
+		mpu.traceStep("hardware offsets")
+		if err := mpu.applyHWBias(); err != nil {
+			return err
 		}
-	*/
-	go mpu.readSensors()
+	}
 
-	// Give the IMU time to fully initialize and then clear out any bad values from the averages.
-	time.Sleep(500 * time.Millisecond) // Make sure it's ready
-	<-mpu.CAvg                         // Discard the first readings.
+	if !fast {
+		mpu.traceStep("diagnostics")
+		mpu.diagnose()
+	}
+	return nil
+}
 
-	return mpu, nil
+// ak09916Mode returns the AK09916 continuous measurement mode to use for the given sample rate, and its rate in Hz.
+func ak09916Mode(sampleRate int) (mode byte, hz int) {
+	switch {
+	case sampleRate >= 100:
+		return AK09916_MODE_CONT4, 100
+	case sampleRate >= 50:
+		return AK09916_MODE_CONT3, 50
+	case sampleRate >= 20:
+		return AK09916_MODE_CONT2, 20
+	default:
+		return AK09916_MODE_CONT1, 10
+	}
+}
+
+/*
+SetI2CMasterODR sets the rate at which the internal I2C master polls its slaves (e.g. the magnetometer) to the
+slowest available rate that is at least hz.  The available rates are 1100/2^n Hz for n = 0..15, i.e.
+1100, 550, 275, 137.5, 68.75, 34.4, 17.2, 8.6 Hz and so on; hz must be between 1 and 1100.
+Note that I2C_MST_ODR_CONFIG only takes effect while the gyro and accel are duty-cycled or off; otherwise the
+I2C master runs at the gyro sample rate.
+*/
+func (mpu *ICM20948) SetI2CMasterODR(hz int) error {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+	return mpu.setI2CMasterODR(hz)
+}
+
+// setI2CMasterODR is SetI2CMasterODR for callers that hold mpu.busMu, such as configure.
+func (mpu *ICM20948) setI2CMasterODR(hz int) error {
+	if hz < 1 || hz > 1100 {
+		return fmt.Errorf("ICM20948 Error: %d Hz is not a valid I2C master rate", hz)
+	}
+
+	var odrConfig byte
+	for odrConfig < 15 && 1100.0/float64(int(1)<<(odrConfig+1)) >= float64(hz) {
+		odrConfig++
+	}
+
+	if errWrite := mpu.setRegBank(3); errWrite != nil {
+		return errors.New("ICM20948 Error: change register bank.")
+	}
+	defer mpu.setRegBank(0)
+
+	if errWrite := mpu.i2cWrite(ICMREG_I2C_MST_ODR_CONFIG, odrConfig); errWrite != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't set I2C master rate: %s", errWrite.Error())
+	}
+	mpu.i2cMasterODR = 1100.0 / float64(int(1)<<odrConfig)
+	log.Printf("ICM20948: I2C master rate set to %.2f Hz (I2C_MST_ODR_CONFIG=0x%02X)\n", mpu.i2cMasterODR, odrConfig)
+	return nil
+}
+
+// calibrateGyro converts raw (or averaged raw) gyro readings to °/s, removing the gyro bias, less any part of it
+// already removed by the offset registers.
+func (mpu *ICM20948) calibrateGyro(r1, r2, r3 float64) (g1, g2, g3 float64) {
+	g1 = (r1-mpu.G01)*mpu.scaleGyro + mpu.gyroHWOffset[0]
+	g2 = (r2-mpu.G02)*mpu.scaleGyro + mpu.gyroHWOffset[1]
+	g3 = (r3-mpu.G03)*mpu.scaleGyro + mpu.gyroHWOffset[2]
+	return
+}
+
+// calibrateAccel converts raw (or averaged raw) accelerometer readings to G, removing the accelerometer bias, less
+// any part of it already removed by the offset registers.
+func (mpu *ICM20948) calibrateAccel(r1, r2, r3 float64) (a1, a2, a3 float64) {
+	a1 = (r1-mpu.A01)*mpu.scaleAccel + mpu.accelHWOffset[0]
+	a2 = (r2-mpu.A02)*mpu.scaleAccel + mpu.accelHWOffset[1]
+	a3 = (r3-mpu.A03)*mpu.scaleAccel + mpu.accelHWOffset[2]
+	return
+}
+
+// calibrateMag converts raw (or averaged raw) magnetometer readings to µT, removing the hard-iron offsets and
+// applying the soft-iron matrix unless disabled with SetMagCorrection.
+func (mpu *ICM20948) calibrateMag(r1, r2, r3 float64) (m1, m2, m3 float64) {
+	mm1 := r1 * mpu.mcal1
+	mm2 := r2 * mpu.mcal2
+	mm3 := r3 * mpu.mcal3
+	if !mpu.skipHardIron {
+		mm1 -= mpu.M01
+		mm2 -= mpu.M02
+		mm3 -= mpu.M03
+	}
+	if mpu.skipSoftIron {
+		return mm1, mm2, mm3
+	}
+	m1 = mpu.Ms11*mm1 + mpu.Ms12*mm2 + mpu.Ms13*mm3
+	m2 = mpu.Ms21*mm1 + mpu.Ms22*mm2 + mpu.Ms23*mm3
+	m3 = mpu.Ms31*mm1 + mpu.Ms32*mm2 + mpu.Ms33*mm3
+	return
+}
+
+/*
+SetMagCorrection chooses whether the hard-iron offsets (M01-M03) and the soft-iron matrix (Ms) are applied to
+the magnetometer output.  Both are applied by default.  Turning them off one at a time, together with
+Inclination and the heading outputs, helps isolate whether a bad heading comes from the hard-iron calibration,
+the soft-iron calibration or from interference.
+*/
+func (mpu *ICM20948) SetMagCorrection(hardIron, softIron bool) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.skipHardIron = !hardIron
+	mpu.skipSoftIron = !softIron
+}
+
+// tempValue converts a raw (or averaged raw) die temperature reading to °C.
+func tempValue(raw float64) float64 {
+	return raw/333.87 + 21.0
+}
+
+// tickerPeriod returns the polling period readSensors uses for a sensor sampled at rate Hz.
+func tickerPeriod(rate int) time.Duration {
+	return time.Duration(int(1125.0/float32(rate)+0.5)) * time.Millisecond
+}
+
+// makeChannels creates the channels readSensors communicates over.  They are created before readSensors starts
+// so that consumers never see nil channels; readSensors closes them when it stops.
+func (mpu *ICM20948) makeChannels() {
+	mpu.cC = make(chan *MPUData)
+	mpu.C = mpu.cC
+	mpu.cAvg = make(chan *MPUData)
+	mpu.CAvg = mpu.cAvg
+	mpu.cExpAvg = make(chan *MPUData)
+	mpu.CExpAvg = mpu.cExpAvg
+	mpu.cAvgReq = make(chan avgRequest)
+	mpu.cBuf = make(chan *MPUData, bufSize)
+	mpu.CBuf = mpu.cBuf
+	mpu.cResampled = make(chan *MPUData, resampledBufSize)
+	mpu.CResampled = mpu.cResampled
+	mpu.cFiltered = make(chan *MPUData, filteredBufSize)
+	mpu.CFiltered = mpu.cFiltered
+	mpu.cHorizon = make(chan HorizonData, horizonBufSize)
+	mpu.CHorizon = mpu.cHorizon
+	mpu.cClose = make(chan bool)
+	mpu.cDone = make(chan bool)
+	mpu.cFaults = make(chan error, faultsBufSize)
+	mpu.Faults = mpu.cFaults
+	mpu.cMagFix = make(chan bool)
+	mpu.cPause = make(chan bool)
 }
 
 // readSensors polls the gyro, accelerometer and magnetometer sensors as well as the die temperature.
 // Communication is via channels.
 func (mpu *ICM20948) readSensors() {
+	defer mpu.pinThread()() // First, so the thread is released last
+
 	var (
-		g1, g2, g3, a1, a2, a3, m1, m2, m3, tmp int16   // Current values
-		avg1, avg2, avg3, ava1, ava2, ava3, avtmp   float64 // Accumulators for averages
-		avm1, avm2, avm3                            int32
-		n, nm                                       float64
-		gaError, magError                           error
-		t0, t, t0m, tm                              time.Time
-		magSampleRate                               int
-		curdata                                     *MPUData
+		g1, g2, g3, a1, a2, a3, m1, m2, m3, tmp   int16   // Current values
+		avg1, avg2, avg3, ava1, ava2, ava3, avtmp float64 // Accumulators for averages
+		avm1, avm2, avm3                          int32
+		n, nm                                     float64
+		gaError, magError                         error
+		t0, t, t0m, tm                            time.Time
+		magSampleRate                             int
+		curdata                                   *MPUData
+		avSaturated                               uint8     // Saturated flags of all samples in the current average
+		magTriggered                              time.Time // When the pending single mag measurement was triggered
+		expAvgData                                *MPUData  // Latest exponential average
+		lastGyroRead, lastAccelRead               time.Time // When the gyro and accel were last read, for jitter
+		magFixed                                  bool      // Whether cMagFix has been closed
+		seq                                       uint64    // Seq of the latest sample
+		magFailures                               int       // Consecutive failed magnetometer reads
+		magOverrun, avMagOverrun                  bool      // The latest mag reading, or one in the average, followed an overrun
+		tempRead                                  bool      // The latest gyro/accel read also read the temperature
 	)
 
 	//FIXME: Temporary (testing).
@@ -325,7 +914,12 @@ func (mpu *ICM20948) readSensors() {
 	acRegMap := map[*int16]byte{
 		&g1: ICMREG_GYRO_XOUT_H, &g2: ICMREG_GYRO_YOUT_H, &g3: ICMREG_GYRO_ZOUT_H,
 		&a1: ICMREG_ACCEL_XOUT_H, &a2: ICMREG_ACCEL_YOUT_H, &a3: ICMREG_ACCEL_ZOUT_H,
-		&tmp: ICMREG_TEMP_OUT_H,
+	}
+	gyroRegMap := map[*int16]byte{
+		&g1: ICMREG_GYRO_XOUT_H, &g2: ICMREG_GYRO_YOUT_H, &g3: ICMREG_GYRO_ZOUT_H,
+	}
+	accelRegMap := map[*int16]byte{
+		&a1: ICMREG_ACCEL_XOUT_H, &a2: ICMREG_ACCEL_YOUT_H, &a3: ICMREG_ACCEL_ZOUT_H,
 	}
 	magRegMap := map[*int16]byte{
 		// AK09916 data starts at EXT_SENS_DATA_01 (after ST1 at _00)
@@ -333,199 +927,651 @@ func (mpu *ICM20948) readSensors() {
 		&m1: ICMREG_EXT_SENS_DATA_01, &m2: ICMREG_EXT_SENS_DATA_03, &m3: ICMREG_EXT_SENS_DATA_05,
 	}
 
-	if mpu.sampleRate > 100 {
+	if sampleRate := mpu.SampleRate(); sampleRate > 100 {
 		magSampleRate = 100
 	} else {
-		magSampleRate = mpu.sampleRate
+		magSampleRate = sampleRate
 	}
 
-	cC := make(chan *MPUData)
+	cC, cAvg, cBuf, cExpAvg := mpu.cC, mpu.cAvg, mpu.cBuf, mpu.cExpAvg
 	defer close(cC)
-	mpu.C = cC
-	cAvg := make(chan *MPUData)
 	defer close(cAvg)
-	mpu.CAvg = cAvg
-	cBuf := make(chan *MPUData, bufSize)
+	defer close(cExpAvg)
 	defer close(cBuf)
-	mpu.CBuf = cBuf
-	mpu.cClose = make(chan bool)
-	defer close(mpu.cClose)
-
-	clock := time.NewTicker(time.Duration(int(1125.0/float32(mpu.sampleRate)+0.5)) * time.Millisecond)
-	//TODO westphae: use the clock to record actual time instead of a timer
-	defer clock.Stop()
+	defer close(mpu.cResampled)
+	defer close(mpu.cFiltered)
+	defer close(mpu.cHorizon)
+	defer mpu.closeDecimators() // After cDone, so DecimatedStream can't add a stream that is never closed
+	defer close(mpu.cDone)
+
+	// The gyro clock reads the gyro and, as often as SetTempEvery says, the temperature, and the accel too when both run at the same rate.
+	// Otherwise the accel has its own clock.
+	var (
+		clock, clockAccel   *time.Ticker
+		clockAccelC         <-chan time.Time
+		gyroRate, accelRate int
+	)
+	startClocks := func() {
+		mpu.mu.Lock()
+		gyroRate, accelRate = mpu.gyroRate, mpu.accelRate
+		mpu.mu.Unlock()
+		clock = time.NewTicker(tickerPeriod(gyroRate))
+		//TODO westphae: use the clock to record actual time instead of a timer
+		clockAccel, clockAccelC = nil, nil
+		if accelRate != gyroRate {
+			clockAccel = time.NewTicker(tickerPeriod(accelRate))
+			clockAccelC = clockAccel.C
+		}
+	}
+	stopClocks := func() {
+		clock.Stop()
+		if clockAccel != nil {
+			clockAccel.Stop()
+		}
+	}
+	startClocks()
+	defer func() { stopClocks() }()
 
-	clockMag := time.NewTicker(time.Duration(int(1125.0/float32(magSampleRate)+0.5)) * time.Millisecond)
+	clockMag := time.NewTicker(tickerPeriod(magSampleRate))
+	defer clockMag.Stop()
 	t0 = time.Now()
 	t0m = time.Now()
+	lastConfigCheck := t0
 
 	makeMPUData := func() *MPUData {
-		mm1 := float64(m1)*mpu.mcal1 - mpu.M01
-		mm2 := float64(m2)*mpu.mcal2 - mpu.M02
-		mm3 := float64(m3)*mpu.mcal3 - mpu.M03
-		//		fmt.Printf("a1=%d,a2=%d,a3=%d\n", a1, a2, a3)
-		d := MPUData{
-			G1:      (float64(g1) - mpu.G01) * mpu.scaleGyro,
-			G2:      (float64(g2) - mpu.G02) * mpu.scaleGyro,
-			G3:      (float64(g3) - mpu.G03) * mpu.scaleGyro,
-			A1:      (float64(a1) - mpu.A01) * mpu.scaleAccel,
-			A2:      (float64(a2) - mpu.A02) * mpu.scaleAccel,
-			A3:      (float64(a3) - mpu.A03) * mpu.scaleAccel,
-			M1:      mpu.Ms11*mm1 + mpu.Ms12*mm2 + mpu.Ms13*mm3,
-			M2:      mpu.Ms21*mm1 + mpu.Ms22*mm2 + mpu.Ms23*mm3,
-			M3:      mpu.Ms31*mm1 + mpu.Ms32*mm2 + mpu.Ms33*mm3,
-			Temp:    float64(tmp)/333.87 + 21.0,
+		mpu.mu.Lock()
+		defer mpu.mu.Unlock()
+		if tempRead {
+			mpu.temp.raw = tmp
+		} else {
+			tmp = mpu.temp.raw
+		}
+		d := mpu.newSample()
+		*d = MPUData{
+			Temp:    tempValue(float64(tmp)),
 			GAError: gaError, MagError: magError,
 			N: 1, NM: 1,
 			T: t, TM: tm,
 			DT: time.Duration(0), DTM: time.Duration(0),
 		}
+		d.G1, d.G2, d.G3 = mpu.calibrateGyro(float64(g1), float64(g2), float64(g3))
+		d.A1, d.A2, d.A3 = mpu.calibrateAccel(float64(a1), float64(a2), float64(a3))
+		d.G1, d.G2, d.G3 = mpu.correctGSensitivity(d.G1, d.G2, d.G3, d.A1, d.A2, d.A3)
+		mpu.highPassGyro(d)
+		d.M1, d.M2, d.M3 = mpu.calibrateMag(float64(m1), float64(m2), float64(m3))
+		d.MagAnomaly = magError == nil && mpu.magAnomaly(d.M1, d.M2, d.M3)
+		d.MagOverrun = magOverrun
+		mpu.remap(d)
 		if gaError != nil {
 			d.N = 0
 		}
 		if magError != nil {
 			d.NM = 0
 		}
-		return &d
+		for i, v := range []int16{g1, g2, g3, a1, a2, a3} {
+			if saturated(v) {
+				d.Saturated |= 1 << uint(i)
+			}
+		}
+		return d
 	}
 
-	makeAvgMPUData := func() *MPUData {
-		mm1 := float64(avm1)*mpu.mcal1/nm - mpu.M01
-		mm2 := float64(avm2)*mpu.mcal2/nm - mpu.M02
-		mm3 := float64(avm3)*mpu.mcal3/nm - mpu.M03
-		d := MPUData{}
+	// makeAvgMPUData fills in d, or a new MPUData if d is nil, with the averages since resetAvg.
+	makeAvgMPUData := func(d *MPUData) *MPUData {
+		mpu.mu.Lock()
+		defer mpu.mu.Unlock()
+		if d == nil {
+			d = new(MPUData)
+		}
+		*d = MPUData{}
 		if n > 0.5 {
-			d.G1 = (avg1/n - mpu.G01) * mpu.scaleGyro
-			d.G2 = (avg2/n - mpu.G02) * mpu.scaleGyro
-			d.G3 = (avg3/n - mpu.G03) * mpu.scaleGyro
-			d.A1 = (ava1/n - mpu.A01) * mpu.scaleAccel
-			d.A2 = (ava2/n - mpu.A02) * mpu.scaleAccel
-			d.A3 = (ava3/n - mpu.A03) * mpu.scaleAccel
-			d.Temp = (float64(avtmp)/n)/333.87 + 21.0
+			d.G1, d.G2, d.G3 = mpu.calibrateGyro(avg1/n, avg2/n, avg3/n)
+			d.A1, d.A2, d.A3 = mpu.calibrateAccel(ava1/n, ava2/n, ava3/n)
+			d.G1, d.G2, d.G3 = mpu.correctGSensitivity(d.G1, d.G2, d.G3, d.A1, d.A2, d.A3)
+			mpu.highPassAvgGyro(d)
+			d.Temp = tempValue(avtmp / n)
 			d.N = int(n + 0.5)
+			d.Saturated = avSaturated
+			d.Seq = seq
 			d.T = t
 			d.DT = t.Sub(t0)
 		} else {
-			d.GAError = errors.New("ICM20948 Error: No new accel/gyro values")
+			d.GAError = errNoGAValues
 		}
 		if nm > 0 {
-			d.M1 = mpu.Ms11*mm1 + mpu.Ms12*mm2 + mpu.Ms13*mm3
-			d.M2 = mpu.Ms21*mm1 + mpu.Ms22*mm2 + mpu.Ms23*mm3
-			d.M3 = mpu.Ms31*mm1 + mpu.Ms32*mm2 + mpu.Ms33*mm3
+			d.M1, d.M2, d.M3 = mpu.calibrateMag(float64(avm1)/nm, float64(avm2)/nm, float64(avm3)/nm)
+			d.MagAnomaly = mpu.magAnomaly(d.M1, d.M2, d.M3)
+			d.MagOverrun = avMagOverrun
 			d.NM = int(nm + 0.5)
 			d.TM = tm
-			d.DTM = t.Sub(t0m)
+			d.DTM = tm.Sub(t0m)
 		} else {
-			d.MagError = errors.New("ICM20948 Error: No new magnetometer values")
+			d.MagError = errNoMagValues
+		}
+		mpu.remap(d)
+		return d
+	}
+
+	resetAvg := func() {
+		avg1, avg2, avg3 = 0, 0, 0
+		ava1, ava2, ava3 = 0, 0, 0
+		avm1, avm2, avm3 = 0, 0, 0
+		avtmp = 0
+		avSaturated = 0
+		avMagOverrun = false
+		n, nm = 0, 0
+		t0, t0m = t, tm
+	}
+
+	// readMag reads the AK09916 status and data registers mirrored into EXT_SENS_DATA by the I2C master.
+	// ok is false if there was no new, valid magnetometer reading.  If checkDRDY is false the data is taken to be
+	// new regardless of ST1, for triggered measurements which the I2C master's read of ST2 may already have
+	// marked as read.
+	readMag := func(checkDRDY bool) (st1, st2 byte, ok bool) {
+		mpu.busMu.Lock()
+		defer mpu.busMu.Unlock()
+
+		// Read ST1 status register
+		st1, magError = mpu.i2cRead(ICMREG_EXT_SENS_DATA_00)
+		if magError != nil {
+			mpu.readError(SourceMag, fmt.Errorf("error reading magnetometer ST1: %w", magError))
+			return st1, st2, false
+		}
+		notReady := checkDRDY && (st1&AK09916_ST1_DRDY) == 0
+		// DOR means a measurement was overwritten before it was read: the mag is polled too slowly for its mode.
+		overrun := !notReady && (st1&AK09916_ST1_DOR) != 0
+		mpu.mu.Lock()
+		mpu.magST1 = st1
+		if notReady {
+			mpu.stats.MagNotReadyCount++
+		}
+		logNotReady := notReady && mpu.logThrottle.allow(mpu.stats.MagNotReadyCount)
+		if overrun {
+			mpu.stats.MagOverruns++
+		}
+		overruns := mpu.stats.MagOverruns
+		logOverrun := overrun && mpu.logThrottle.allow(uint64(overruns))
+		mpu.mu.Unlock()
+		if logOverrun {
+			log.Printf("ICM20948 Warning: magnetometer data overrun (%d so far), read it faster or lower its rate\n", overruns)
+		}
+
+		// Check if data is ready
+		if notReady {
+			// Log occasionally when data is not ready
+			if logNotReady {
+				log.Printf("ICM20948: Magnetometer data not ready (ST1=0x%02X)\n", st1)
+			}
+			return st1, st2, false // Data not ready yet
+		}
+
+		// Read magnetometer data
+		for p, reg := range magRegMap {
+			*p, magError = mpu.i2cRead2LE(reg)
+			if magError != nil {
+				mpu.readError(SourceMag, fmt.Errorf("error reading magnetometer data: %w", magError))
+				continue
+			}
 		}
-		return &d
-	}
 
+		// Read ST2 status register (at offset +8 from ST1)
+		st2, magError = mpu.i2cRead(ICMREG_EXT_SENS_DATA_00 + 8)
+		if magError != nil {
+			mpu.readError(SourceMag, fmt.Errorf("error reading magnetometer ST2: %w", magError))
+			return st1, st2, false
+		}
+		mpu.mu.Lock()
+		mpu.magST2 = st2
+		mpu.mu.Unlock()
+
+		// Check for data overflow
+		overflow := (st2 & AK09916_ST2_HOFL) != 0
+		mpu.recordMagRead(tm, overflow)
+		return st1, st2, !overflow
+	}
+
+	// readGA reads the given gyro/accel registers, then records and buffers a new sample holding the latest
+	// values of all of them.
+	// last is the time regMap was last read and nominal the period it should be read at, for measuring jitter.
+	readGA := func(regMap map[*int16]byte, last *time.Time, nominal time.Duration) {
+		tempRead = false
+		if _, ok := regMap[&g1]; ok {
+			mpu.mu.Lock()
+			tempRead = mpu.temp.due()
+			mpu.mu.Unlock()
+		}
+		mpu.busMu.Lock()
+		for p, reg := range regMap {
+			*p, gaError = mpu.i2cRead2(reg)
+			if gaError != nil {
+				mpu.readError(SourceGyroAccel, fmt.Errorf("error reading gyro/accel: %w", gaError))
+			}
+		}
+		if tempRead {
+			// A failed temperature read keeps the last temperature rather than failing the sample.
+			var err error
+			if tmp, err = mpu.i2cRead2(ICMREG_TEMP_OUT_H); err != nil {
+				mpu.readError(SourceGyroAccel, fmt.Errorf("error reading temperature: %w", err))
+				tempRead = false
+			}
+		}
+		mpu.busMu.Unlock()
+		if gaError == nil {
+			// Words a working chip can't return fail the sample, so the watchdog sees the sensor as silent.
+			if gaError = mpu.checkBusFault(g1, g2, g3, a1, a2, a3); gaError != nil {
+				mpu.readError(SourceGyroAccel, gaError)
+			}
+		}
+		if gaError == nil {
+			if _, ok := regMap[&g1]; ok {
+				mpu.checkStuck(0, g1, g2, g3)
+			}
+			if _, ok := regMap[&a1]; ok {
+				mpu.checkStuck(3, a1, a2, a3)
+			}
+		}
+		// curdata is new (or, with WithPreallocatedSamples, reused) for each sample and is only filled in here,
+		// before it is published.
+		curdata = makeMPUData()
+		seq++
+		curdata.Seq = seq
+		readTime := time.Now()
+		if !last.IsZero() {
+			curdata.Jitter = readTime.Sub(*last) - nominal
+		}
+		*last = readTime
+		avSaturated |= curdata.Saturated
+		mpu.mu.Lock()
+		mpu.latest = curdata
+		mpu.stats.Samples = seq
+		if _, ok := regMap[&a1]; ok {
+			mpu.stats.AccelReadCount++
+		}
+		if gaError == nil {
+			mpu.lastGoodRead, mpu.lastSample = t, t
+		}
+		if curdata.Saturated != 0 {
+			mpu.stats.Saturations++
+		}
+		var rateWarning string
+		if _, ok := regMap[&g1]; ok && mpu.rate.update(t) {
+			rateWarning = mpu.rateShort(gyroRate)
+		}
+		mpu.odo.update(curdata)
+		mpu.jitter.update(curdata.Jitter)
+		mpu.updatePassiveCal(curdata, float64(m1)*mpu.mcal1, float64(m2)*mpu.mcal2, float64(m3)*mpu.mcal3)
+		mpu.trackBias(curdata)
+		if mpu.horizon != nil && mpu.horizon.update(curdata, !mpu.magOverflow.unhealthy) {
+			mpu.sendHorizon()
+		}
+		mpu.expAvg.update(curdata)
+		expAvgData = mpu.expAvg.d
+		mpu.resample(curdata)
+		mpu.filter(curdata)
+		mpu.decimate(curdata)
+		checkInterval := mpu.configCheckInterval
+		ratesChanged := mpu.gyroRate != gyroRate || mpu.accelRate != accelRate
+		if ratesChanged {
+			mpu.rate.restart()
+		}
+		mpu.mu.Unlock()
+		if rateWarning != "" {
+			log.Print(rateWarning)
+		}
+		if checkInterval > 0 && t.Sub(lastConfigCheck) >= checkInterval {
+			mpu.busMu.Lock()
+			mpu.checkConfig()
+			mpu.busMu.Unlock()
+			lastConfigCheck = t
+		}
+		if ratesChanged {
+			stopClocks()
+			startClocks()
+			lastGyroRead, lastAccelRead = time.Time{}, time.Time{}
+		}
+		// Update accumulated values and increment count of gyro/accel readings
+		avg1 += float64(g1)
+		avg2 += float64(g2)
+		avg3 += float64(g3)
+		ava1 += float64(a1)
+		ava2 += float64(a2)
+		ava3 += float64(a3)
+		avtmp += float64(tmp)
+		n++
+		// We update the buffer every time we read a new value.  Consumers see any drop as a gap in Seq.
+		mpu.buffer(curdata, mpu.bufPolicy)
+	}
+
+	// The averages are offered on cAvg on each pass of the loop, so they are built into the same MPUData until it
+	// is sent, rather than into a new one each time.
+	var avgData *MPUData
 	for {
+		mpu.reportErrors()
+		avgData = makeAvgMPUData(avgData)
 		select {
-		case t = <-clock.C: // Read accel/gyro data:
-			for p, reg := range acRegMap {
-				*p, gaError = mpu.i2cRead2(reg)
-				if gaError != nil {
-					log.Println("ICM20948 Warning: error reading gyro/accel")
-				}
+		case t = <-clock.C: // Read gyro (and accel) data:
+			regMap := acRegMap
+			if clockAccel != nil {
+				regMap = gyroRegMap
 			}
-			curdata = makeMPUData()
-			// Update accumulated values and increment count of gyro/accel readings
-			avg1 += float64(g1)
-			avg2 += float64(g2)
-			avg3 += float64(g3)
-			ava1 += float64(a1)
-			ava2 += float64(a2)
-			ava3 += float64(a3)
-			avtmp += float64(tmp)
-			avm1 += int32(m1)
-			avm2 += int32(m2)
-			avm3 += int32(m3)
-			n++
-			select {
-			case cBuf <- curdata: // We update the buffer every time we read a new value.
-			default: // If buffer is full, remove oldest value and put in newest.
-				<-cBuf
-				cBuf <- curdata
-			}
-		case tm = <-clockMag.C: // Read magnetometer data:
+			readGA(regMap, &lastGyroRead, tickerPeriod(gyroRate))
+		case t = <-clockAccelC: // Read accel data, when at a different rate from the gyro:
+			readGA(accelRegMap, &lastAccelRead, tickerPeriod(accelRate))
+		case tm = <-clockMag.C: // Read magnetometer and other aux slave data:
+			mpu.readAux(tm)
 			if mpu.enableMag {
-				// Read magnetometer data from external sensor data registers
-				var st1, st2 byte
-
-				// Read ST1 status register
-				st1, magError = mpu.i2cRead(ICMREG_EXT_SENS_DATA_00)
-				if magError != nil {
-					log.Println("ICM20948 Warning: error reading magnetometer ST1")
+				mpu.mu.Lock()
+				single, gyroPeriod, off := mpu.magSingle, time.Second/time.Duration(mpu.gyroRate), mpu.magOff
+				mpu.mu.Unlock()
+				if off {
+					// Powered down with SetMagEnabled: samples carry no mag values until it is back up.
+					magError, magTriggered, magFailures = errMagOff, time.Time{}, 0
 					continue
 				}
-
-				// Check if data is ready
-				if (st1 & AK09916_ST1_DRDY) == 0 {
-					// Log occasionally when data is not ready
-					if nm%100 == 0 {
-						log.Printf("ICM20948: Magnetometer data not ready (ST1=0x%02X)\n", st1)
+				if single {
+					// Read the previous triggered measurement once it is done and the I2C master has mirrored it,
+					// then trigger the next.
+					if !magTriggered.IsZero() && tm.Sub(magTriggered) < ak09916MeasureTime+gyroPeriod {
+						continue
 					}
-					continue // Data not ready yet
-				}
-
-				// Read magnetometer data
-				for p, reg := range magRegMap {
-					*p, magError = mpu.i2cRead2(reg)
-					if magError != nil {
-						log.Println("ICM20948 Warning: error reading magnetometer data")
+					triggered := magTriggered
+					magTriggered = time.Time{}
+					if err := mpu.triggerMag(); err != nil {
+						mpu.readError(SourceMag, fmt.Errorf("couldn't trigger magnetometer measurement: %w", err))
+					} else {
+						magTriggered = tm
+					}
+					if triggered.IsZero() {
 						continue
 					}
+					tm = triggered
 				}
-
-				// Read ST2 status register (at offset +8 from ST1)
-				st2, magError = mpu.i2cRead(ICMREG_EXT_SENS_DATA_00 + 8)
-				if magError != nil {
-					log.Println("ICM20948 Warning: error reading magnetometer ST2")
+				st1, st2, ok := readMag(!single)
+				if !ok {
+					magFailures++
+					mpu.mu.Lock()
+					resyncFailures := mpu.magResyncFailures
+					mpu.mu.Unlock()
+					if resyncFailures > 0 && magFailures >= resyncFailures {
+						mpu.resyncMag(magFailures, single)
+						magFailures = 0
+						magTriggered = time.Time{}
+					}
 					continue
 				}
-
-				// Check for data overflow
-				if (st2 & AK09916_ST2_HOFL) != 0 {
-					log.Println("ICM20948 mag data overflow")
-					continue
+				magFailures = 0
+				if !magFixed {
+					close(mpu.cMagFix)
+					magFixed = true
 				}
 
+				mpu.checkStuck(6, m1, m2, m3)
+				magOverrun = st1&AK09916_ST1_DOR != 0
+				avMagOverrun = avMagOverrun || magOverrun
+
 				// Update values and increment count of magnetometer readings
 				avm1 += int32(m1)
 				avm2 += int32(m2)
 				avm3 += int32(m3)
 				nm++
 
-				// Log first successful read and every 100th read
-				if nm == 1 || nm%100 == 0 {
-					log.Printf("ICM20948: Magnetometer read #%d: M1=%d, M2=%d, M3=%d (ST1=0x%02X, ST2=0x%02X)\n", nm, m1, m2, m3, st1, st2)
+				// Log the first successful reads and then occasionally
+				mpu.mu.Lock()
+				mpu.stats.MagReadCount++
+				reads := mpu.stats.MagReadCount
+				logRead := mpu.logThrottle.allow(reads)
+				mpu.mu.Unlock()
+				if logRead {
+					log.Printf("ICM20948: Magnetometer read #%d: M1=%d, M2=%d, M3=%d (ST1=0x%02X, ST2=0x%02X)\n", reads, m1, m2, m3, st1, st2)
 				}
 			}
 		case cC <- curdata: // Send the latest values
-		case cAvg <- makeAvgMPUData(): // Send the averages
-			avg1, avg2, avg3 = 0, 0, 0
-			ava1, ava2, ava3 = 0, 0, 0
-			avm1, avm2, avm3 = 0, 0, 0
-			avtmp = 0
-			n, nm = 0, 0
-			t0, t0m = t, tm
+		case cAvg <- avgData: // Send the averages
+			avgData = nil
+			resetAvg()
+		case req := <-mpu.cAvgReq: // Send the averages to AverageSince
+			req.c <- makeAvgMPUData(nil)
+			if req.reset {
+				resetAvg()
+			}
+		case cExpAvg <- expAvgData: // Send the exponential average
+		case pause := <-mpu.cPause: // Stop or restart reading; the last values are still sent
+			if pause {
+				stopClocks()
+				clockMag.Stop()
+			} else {
+				startClocks()
+				clockMag.Reset(tickerPeriod(magSampleRate))
+				lastGyroRead, lastAccelRead = time.Time{}, time.Time{}
+				mpu.mu.Lock()
+				mpu.rate.restart()
+				mpu.mu.Unlock()
+			}
 		case <-mpu.cClose: // Stop the goroutine, ease up on the CPU
-			break
+			return
+		}
+	}
+}
+
+// buffer sends d on CBuf, handling a full buffer according to policy.
+func (mpu *ICM20948) buffer(d *MPUData, policy BufferPolicy) {
+	bufDropped := func() {
+		mpu.mu.Lock()
+		mpu.stats.BufDrops++
+		mpu.mu.Unlock()
+	}
+
+	switch policy {
+	case DropNewest:
+		select {
+		case mpu.cBuf <- d:
+		default: // If buffer is full, discard the new value.
+			bufDropped()
+		}
+	case BlockProducer:
+		select {
+		case mpu.cBuf <- d:
+		case <-mpu.cClose:
+		}
+	default:
+		select {
+		case mpu.cBuf <- d:
+		default: // If buffer is full, remove oldest value and put in newest.
+			<-mpu.cBuf
+			mpu.cBuf <- d
+			bufDropped()
+		}
+	}
+}
+
+// checkConfig re-reads PWR_MGMT_1 and GYRO_CONFIG and compares them with the values written at startup.
+// A supply brownout silently resets the chip to its defaults, after which it keeps streaming data in the wrong
+// range; if that happens the mismatch is counted in Stats and, if enabled, the configuration is re-applied.
+func (mpu *ICM20948) checkConfig() {
+	var ok = true
+
+	pwrMgmt1, err := mpu.i2cRead(ICMREG_PWR_MGMT_1)
+	if err != nil {
+		mpu.readError(SourceBus, fmt.Errorf("error reading PWR_MGMT_1 for config check: %w", err))
+		return
+	}
+	if pwrMgmt1 != mpu.pwrMgmt1 {
+		log.Printf("ICM20948 Warning: PWR_MGMT_1 is 0x%02X, expected 0x%02X\n", pwrMgmt1, mpu.pwrMgmt1)
+		ok = false
+	}
+
+	if err := mpu.setRegBank(2); err != nil {
+		mpu.readError(SourceBus, fmt.Errorf("error changing register bank for config check: %w", err))
+		return
+	}
+	gyroConfig, err := mpu.i2cRead(ICMREG_GYRO_CONFIG)
+	mpu.setRegBank(0)
+	if err != nil {
+		mpu.readError(SourceBus, fmt.Errorf("error reading GYRO_CONFIG for config check: %w", err))
+		return
+	}
+	if gyroConfig != mpu.gyroConfig {
+		log.Printf("ICM20948 Warning: GYRO_CONFIG is 0x%02X, expected 0x%02X\n", gyroConfig, mpu.gyroConfig)
+		ok = false
+	}
+
+	mpu.mu.Lock()
+	mpu.stats.ConfigChecks++
+	if !ok {
+		mpu.stats.ConfigMismatches++
+		mpu.stats.LastConfigMismatch = time.Now()
+	}
+	autoRecover := mpu.configAutoRecover
+	mpu.mu.Unlock()
+
+	if ok || !autoRecover {
+		return
+	}
+
+	log.Println("ICM20948: Configuration lost (brownout?), re-applying")
+	if err := mpu.configure(); err != nil {
+		mpu.readError(SourceBus, fmt.Errorf("couldn't re-apply configuration: %w", err))
+		return
+	}
+	mpu.mu.Lock()
+	mpu.stats.ConfigRecoveries++
+	mpu.mu.Unlock()
+}
+
+// SetConfigCheck sets how often the driver verifies that the chip still holds its configuration, and whether
+// it re-applies the configuration when it doesn't.  An interval of 0 disables the check.
+func (mpu *ICM20948) SetConfigCheck(interval time.Duration, autoRecover bool) error {
+	if interval < 0 {
+		return fmt.Errorf("ICM20948 Error: %s is not a valid config check interval", interval)
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.configCheckInterval = interval
+	mpu.configAutoRecover = autoRecover
+	return nil
+}
+
+// latestData returns the most recent instantaneous sensor values, or nil if there are none yet.
+func (mpu *ICM20948) latestData() *MPUData {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return mpu.latest
+}
+
+// Stats returns a snapshot of the driver health counters.
+func (mpu *ICM20948) Stats() Stats {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	stats := mpu.stats
+	stats.JitterRMS, stats.JitterMax = mpu.jitter.rms(), mpu.jitter.max
+	stats.BusTimeouts = int(atomic.LoadInt64(&mpu.busTimeouts))
+	return stats
+}
+
+/*
+Drain returns all the samples currently waiting in CBuf, oldest first, without blocking.
+It is intended for shutdown handlers that want to flush the last buffered samples to a log: call CloseMPU and
+then Drain to get everything that was buffered when polling stopped.
+*/
+func (mpu *ICM20948) Drain() []*MPUData {
+	var data []*MPUData
+	for {
+		select {
+		case d, ok := <-mpu.CBuf:
+			if !ok {
+				return data
+			}
+			data = append(data, d)
+		default:
+			return data
 		}
 	}
 }
 
-// CloseMPU stops the driver from reading the MPU.
-//TODO westphae: need a way to start it going again!
+// CloseMPU stops the driver from reading the MPU and waits for polling to stop.  It is safe to call more than
+// once, e.g. from a defer after an explicit close, and on a driver that was never started.
+// TODO westphae: need a way to start it going again!
 func (mpu *ICM20948) CloseMPU() {
-	// Nothing to do bitwise for the 9250?
-	mpu.cClose <- true
+	mpu.closeOnce.Do(func() {
+		if mpu.cClose == nil {
+			return
+		}
+		close(mpu.cClose)
+		<-mpu.cDone
+	})
+}
+
+/*
+SetClockSource selects the ICM20948 clock source (PWR_MGMT_1 CLKSEL); sel must be 0-7:
+
+	0, 6: internal 20 MHz oscillator.  The gyro is noisier and drifts more with temperature.
+	1-5:  auto-select the gyro PLL when it is ready, else the internal oscillator.  This is the default and is
+	      needed for full gyro performance.
+	7:    stop the clock and keep the timing generator in reset; no data is produced.
+*/
+func (mpu *ICM20948) SetClockSource(sel byte) error {
+	if sel > BITS_CLKSEL {
+		return fmt.Errorf("ICM20948 Error: %d is not a valid clock source", sel)
+	}
+
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	cfg, err := mpu.i2cRead(ICMREG_PWR_MGMT_1)
+	if err != nil {
+		return errors.New("ICM20948 Error: SetClockSource error reading chip")
+	}
+	cfg = cfg&^BITS_CLKSEL | sel
+	if errWrite := mpu.i2cWrite(ICMREG_PWR_MGMT_1, cfg); errWrite != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't set clock source: %s", errWrite.Error())
+	}
+	mpu.pwrMgmt1 = cfg
+	return nil
+}
+
+// ClockSource returns the clock source (CLKSEL) currently selected on the chip; see SetClockSource.
+func (mpu *ICM20948) ClockSource() (byte, error) {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	cfg, err := mpu.i2cRead(ICMREG_PWR_MGMT_1)
+	if err != nil {
+		return 0, errors.New("ICM20948 Error: ClockSource error reading chip")
+	}
+	return cfg & BITS_CLKSEL, nil
+}
+
+// sampleRateDivider returns the sample rate divider giving the slowest rate 1125/(1+div) Hz that is at least hz,
+// e.g. 10 (102.3 Hz) for 100 Hz, checking that it fits in maxDiv.
+func sampleRateDivider(hz, maxDiv int) (int, error) {
+	if hz < 1 || hz > 1125 {
+		return 0, fmt.Errorf("ICM20948 Error: %d Hz is not a valid sample rate", hz)
+	}
+	div := 1125/hz - 1
+	if div > maxDiv {
+		return 0, fmt.Errorf("ICM20948 Error: %d Hz is too slow a sample rate, the minimum is %d Hz", hz, (1125+maxDiv)/(maxDiv+1))
+	}
+	return div, nil
+}
+
+/*
+SetGyroSampleRate changes the sampling rate of the gyro on the MPU to hz, which must be between 5 and 1125 Hz.
+The gyro and accelerometer rates are independent: readSensors reads each on its own ticker and emits a sample
+whenever either is read, so the output rate is the faster of the two.  See MPUData for what such samples hold.
+*/
+func (mpu *ICM20948) SetGyroSampleRate(hz int) error {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+	return mpu.setGyroSampleRate(hz)
 }
 
-// SetGyroSampleRate changes the sampling rate of the gyro on the MPU.
-func (mpu *ICM20948) SetGyroSampleRate(rate byte) (err error) {
+// setGyroSampleRate is SetGyroSampleRate for callers that hold mpu.busMu, such as configure.
+func (mpu *ICM20948) setGyroSampleRate(hz int) (err error) {
+	div, err := sampleRateDivider(hz, maxGyroDivider)
+	if err != nil {
+		return err
+	}
+
 	// Gyro config registers on Bank 2.
 	if errWrite := mpu.setRegBank(2); errWrite != nil {
 		return errors.New("ICM20948 Error: change register bank.")
@@ -533,15 +1579,29 @@ func (mpu *ICM20948) SetGyroSampleRate(rate byte) (err error) {
 
 	defer mpu.setRegBank(0)
 
-	errWrite := mpu.i2cWrite(ICMREG_GYRO_SMPLRT_DIV, byte(rate)) // Set sample rate to chosen
+	errWrite := mpu.i2cWrite(ICMREG_GYRO_SMPLRT_DIV, byte(div)) // Set sample rate to chosen
 	if errWrite != nil {
-		err = fmt.Errorf("ICM20948 Error: Couldn't set sample rate: %s", errWrite.Error())
+		return fmt.Errorf("ICM20948 Error: Couldn't set sample rate: %s", errWrite.Error())
 	}
+	mpu.setRates(hz, 0)
 	return
 }
 
-// SetAccelSampleRate changes the sampling rate of the accelerometer on the MPU.
-func (mpu *ICM20948) SetAccelSampleRate(rate byte) (err error) {
+// SetAccelSampleRate changes the sampling rate of the accelerometer on the MPU to hz, which must be between
+// 1 and 1125 Hz; unlike the gyro's, the accel divider has 12 bits.  See SetGyroSampleRate.
+func (mpu *ICM20948) SetAccelSampleRate(hz int) error {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+	return mpu.setAccelSampleRate(hz)
+}
+
+// setAccelSampleRate is SetAccelSampleRate for callers that hold mpu.busMu, such as configure.
+func (mpu *ICM20948) setAccelSampleRate(hz int) (err error) {
+	div, err := sampleRateDivider(hz, maxAccelDivider)
+	if err != nil {
+		return err
+	}
+
 	// Gyro config registers on Bank 2.
 	if errWrite := mpu.setRegBank(2); errWrite != nil {
 		return errors.New("ICM20948 Error: change register bank.")
@@ -549,15 +1609,43 @@ func (mpu *ICM20948) SetAccelSampleRate(rate byte) (err error) {
 
 	defer mpu.setRegBank(0)
 
-	errWrite := mpu.i2cWrite(ICMREG_ACCEL_SMPLRT_DIV_2, byte(rate)) // Set sample rate to chosen
-	if errWrite != nil {
-		err = fmt.Errorf("ICM20948 Error: Couldn't set sample rate: %s", errWrite.Error())
+	// Set sample rate to chosen: the high 4 bits of the divider in DIV_1, the low byte in DIV_2
+	if errWrite := mpu.i2cWrite(ICMREG_ACCEL_SMPLRT_DIV_1, byte(div>>8)); errWrite != nil {
+		return fmt.Errorf("ICM20948 Error: Couldn't set sample rate: %s", errWrite.Error())
 	}
+	if errWrite := mpu.i2cWrite(ICMREG_ACCEL_SMPLRT_DIV_2, byte(div)); errWrite != nil {
+		return fmt.Errorf("ICM20948 Error: Couldn't set sample rate: %s", errWrite.Error())
+	}
+	mpu.setRates(0, hz)
 	return
 }
 
+// setRates records new gyro and/or accel sample rates (0 leaves a rate unchanged); readSensors picks them up
+// on its next read.
+func (mpu *ICM20948) setRates(gyroRate, accelRate int) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	if gyroRate > 0 {
+		mpu.gyroRate = gyroRate
+	}
+	if accelRate > 0 {
+		mpu.accelRate = accelRate
+	}
+	mpu.sampleRate = mpu.gyroRate
+	if mpu.accelRate > mpu.sampleRate {
+		mpu.sampleRate = mpu.accelRate
+	}
+}
+
 // SetGyroLPF sets the low pass filter for the gyro.
-func (mpu *ICM20948) SetGyroLPF(rate byte) (err error) {
+func (mpu *ICM20948) SetGyroLPF(rate byte) error {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+	return mpu.setGyroLPF(rate)
+}
+
+// setGyroLPF is SetGyroLPF for callers that hold mpu.busMu, such as configure.
+func (mpu *ICM20948) setGyroLPF(rate byte) (err error) {
 	var r byte
 
 	// Gyro config registers on Bank 2.
@@ -589,31 +1677,29 @@ func (mpu *ICM20948) SetGyroLPF(rate byte) (err error) {
 		r = BITS_DLPF_GYRO_CFG_6HZ
 	}
 
-	cfg |= 0x01
-	cfg |= r
+	cfg = cfg&^BITS_DLPFCFG_MASK | r
+	if mpu.gyroDLPFBypass {
+		cfg &^= BITS_FCHOICE
+	}
 
 	errWrite := mpu.i2cWrite(ICMREG_GYRO_CONFIG, cfg)
 	if errWrite != nil {
 		err = fmt.Errorf("ICM20948 Error: couldn't set Gyro LPF: %s", errWrite.Error())
+	} else {
+		mpu.gyroConfig = cfg
 	}
 	return
 }
 
-// SetAccelLPF sets the low pass filter for the accelerometer.
-func (mpu *ICM20948) SetAccelLPF(rate byte) (err error) {
-	var r byte
-
-	// Accel config registers on Bank 2.
-	if errWrite := mpu.setRegBank(2); errWrite != nil {
-		return errors.New("ICM20948 Error: change register bank.")
-	}
-
-	defer mpu.setRegBank(0)
+// SetAccelLPF sets the low pass filter for the accelerometer to the nearest available bandwidth at or below
+// rate Hz.  To choose a filter directly, use SetAccelDLPFConfig.
+func (mpu *ICM20948) SetAccelLPF(rate byte) error {
+	return mpu.SetAccelDLPFConfig(accelDLPFConfig(rate))
+}
 
-	cfg, err := mpu.i2cRead(ICMREG_ACCEL_CONFIG)
-	if err != nil {
-		return errors.New("ICM20948 Error: SetGyroLPF error reading chip")
-	}
+// accelDLPFConfig returns the ACCEL_DLPFCFG value of the nearest accel DLPF bandwidth at or below rate Hz.
+func accelDLPFConfig(rate byte) byte {
+	var r byte
 
 	switch {
 	case rate >= 246:
@@ -630,79 +1716,243 @@ func (mpu *ICM20948) SetAccelLPF(rate byte) (err error) {
 		r = BITS_DLPF_ACCEL_CFG_5HZ
 	}
 
-	cfg |= 0x01
-	cfg |= r
+	return (r & BITS_DLPFCFG_MASK) >> 3
+}
 
-	errWrite := mpu.i2cWrite(ICMREG_ACCEL_CONFIG, cfg)
-	if errWrite != nil {
-		err = fmt.Errorf("ICM20948 Error: couldn't set Accel LPF: %s", errWrite.Error())
+// SetGyroAveraging sets how many gyro samples the ICM20948 averages in hardware; it must be one of
+// 1, 2, 4, 8, 16, 32, 64 or 128.
+// Averaging only applies when the gyro is duty-cycled in low-power mode; in the normal low-noise mode the
+// DLPF set by SetGyroLPF determines the filtering.  Averaging more samples lowers noise but increases the time
+// the gyro is awake per sample, which limits the achievable sample rate.
+func (mpu *ICM20948) SetGyroAveraging(n int) error {
+	var avgCfg byte
+
+	switch n {
+	case 1, 2, 4, 8, 16, 32, 64, 128:
+		for 1<<avgCfg < n {
+			avgCfg++
+		}
+	default:
+		return fmt.Errorf("ICM20948 Error: %d is not a valid gyro averaging count", n)
 	}
-	return
+
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	// Gyro config registers on Bank 2.
+	if errWrite := mpu.setRegBank(2); errWrite != nil {
+		return errors.New("ICM20948 Error: change register bank.")
+	}
+
+	defer mpu.setRegBank(0)
+
+	cfg, err := mpu.i2cRead(ICMREG_GYRO_CONFIG_2)
+	if err != nil {
+		return errors.New("ICM20948 Error: SetGyroAveraging error reading chip")
+	}
+
+	if errWrite := mpu.i2cWrite(ICMREG_GYRO_CONFIG_2, cfg&^BITS_GYRO_AVGCFG_MASK|avgCfg); errWrite != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't set gyro averaging: %s", errWrite.Error())
+	}
+	return nil
+}
+
+// SetAccelAveraging sets how many accelerometer samples the ICM20948 averages in hardware (DEC3); it must be
+// one of 4, 8, 16 or 32.  A value of 1 is also accepted: the chip then averages 1 or 4 samples depending on
+// whether the accel DLPF is enabled.
+// As for the gyro, this only applies in low-power mode; in low-noise mode the DLPF set by SetAccelLPF
+// determines the filtering, and higher averaging counts limit the achievable sample rate.
+func (mpu *ICM20948) SetAccelAveraging(n int) error {
+	var dec3Cfg byte
+
+	switch n {
+	case 1, 4:
+		dec3Cfg = 0
+	case 8:
+		dec3Cfg = 1
+	case 16:
+		dec3Cfg = 2
+	case 32:
+		dec3Cfg = 3
+	default:
+		return fmt.Errorf("ICM20948 Error: %d is not a valid accel averaging count", n)
+	}
+
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	// Accel config registers on Bank 2.
+	if errWrite := mpu.setRegBank(2); errWrite != nil {
+		return errors.New("ICM20948 Error: change register bank.")
+	}
+
+	defer mpu.setRegBank(0)
+
+	cfg, err := mpu.i2cRead(ICMREG_ACCEL_CONFIG_2)
+	if err != nil {
+		return errors.New("ICM20948 Error: SetAccelAveraging error reading chip")
+	}
+
+	if errWrite := mpu.i2cWrite(ICMREG_ACCEL_CONFIG_2, cfg&^BITS_ACCEL_DEC3_MASK|dec3Cfg); errWrite != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't set accel averaging: %s", errWrite.Error())
+	}
+	return nil
 }
 
-// EnableGyroBiasCal enables or disables motion bias compensation for the gyro.
+// The errors of averages without new readings, shared as they are made on every pass of the read loop.
+var (
+	errNoGAValues  = errors.New("ICM20948 Error: No new accel/gyro values")
+	errNoMagValues = errors.New("ICM20948 Error: No new magnetometer values")
+)
+
+// DMP code written at CFG_MOTION_BIAS to turn motion bias compensation on and off.
+var (
+	gyroBiasCalEnableRegs  = []byte{0xb8, 0xaa, 0xb3, 0x8d, 0xb4, 0x98, 0x0d, 0x35, 0x5d}
+	gyroBiasCalDisableRegs = []byte{0xb8, 0xaa, 0xaa, 0xaa, 0xb0, 0x88, 0xc3, 0xc5, 0xc7}
+)
+
+// EnableGyroBiasCal enables or disables motion bias compensation for the gyro, and reads the setting back to
+// check that it took.
 // For flying we generally do not want this!
 func (mpu *ICM20948) EnableGyroBiasCal(enable bool) error {
-	enableRegs := []byte{0xb8, 0xaa, 0xb3, 0x8d, 0xb4, 0x98, 0x0d, 0x35, 0x5d}
-	disableRegs := []byte{0xb8, 0xaa, 0xaa, 0xaa, 0xb0, 0x88, 0xc3, 0xc5, 0xc7}
-
+	regs := gyroBiasCalDisableRegs
 	if enable {
-		if err := mpu.memWrite(CFG_MOTION_BIAS, &enableRegs); err != nil {
-			return errors.New("Unable to enable motion bias compensation")
-		}
-	} else {
-		if err := mpu.memWrite(CFG_MOTION_BIAS, &disableRegs); err != nil {
-			return errors.New("Unable to disable motion bias compensation")
+		regs = gyroBiasCalEnableRegs
+	}
+
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	if err := mpu.memWrite(CFG_MOTION_BIAS, &regs); err != nil {
+		if enable {
+			return fmt.Errorf("Unable to enable motion bias compensation: %s", err.Error())
 		}
+		return fmt.Errorf("Unable to disable motion bias compensation: %s", err.Error())
 	}
 
+	enabled, err := mpu.gyroBiasCalEnabled()
+	if err != nil {
+		return err
+	}
+	if enabled != enable {
+		return fmt.Errorf("ICM20948 Error: motion bias compensation still %s after writing it", onOff(enabled))
+	}
 	return nil
 }
 
-// SampleRate returns the current sample rate of the ICM20948, in Hz.
+// GyroBiasCalEnabled reads back whether motion bias compensation is enabled for the gyro.
+func (mpu *ICM20948) GyroBiasCalEnabled() (bool, error) {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+	return mpu.gyroBiasCalEnabled()
+}
+
+func (mpu *ICM20948) gyroBiasCalEnabled() (bool, error) {
+	regs, err := mpu.memRead(CFG_MOTION_BIAS, len(gyroBiasCalEnableRegs))
+	if err != nil {
+		return false, errors.New("ICM20948 Error: couldn't read motion bias compensation setting")
+	}
+	switch {
+	case bytes.Equal(regs, gyroBiasCalEnableRegs):
+		return true, nil
+	case bytes.Equal(regs, gyroBiasCalDisableRegs):
+		return false, nil
+	}
+	return false, fmt.Errorf("ICM20948 Error: unrecognized motion bias compensation setting % x", regs)
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// SampleRate returns the current output sample rate of the ICM20948, in Hz: the faster of the gyro and
+// accelerometer rates.
 func (mpu *ICM20948) SampleRate() int {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
 	return mpu.sampleRate
 }
 
-// MagEnabled returns whether or not the magnetometer is being read.
+/*
+MagSensitivity returns the per-axis scale, in µT per raw count, currently applied to the magnetometer readings
+before the hard- and soft-iron calibration, and the magnetometer model it corresponds to: "AK09916" (a fixed
+scale) or "AK8963" (the fuse ROM sensitivity adjustment read by ReadMagCalibration).  The model is empty if the
+magnetometer hasn't been set up.  A mag magnitude that is off by a constant factor usually shows up here.
+*/
+func (mpu *ICM20948) MagSensitivity() (x, y, z float64, model string) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return mpu.mcal1, mpu.mcal2, mpu.mcal3, mpu.magModel
+}
+
+// MagEnabled returns whether or not the magnetometer is being read: it was enabled when the driver was created
+// and isn't powered down with SetMagEnabled.
 func (mpu *ICM20948) MagEnabled() bool {
-	return mpu.enableMag
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return mpu.enableMag && !mpu.magOff
 }
 
 // SetGyroSensitivity sets the gyro sensitivity of the ICM20948; it must be one of the following values:
 // 250, 500, 1000, 2000 (all in deg/s).
-func (mpu *ICM20948) SetGyroSensitivity(sensitivityGyro int) (err error) {
-	var sensGyro byte
-
-	// Gyro config registers on Bank 2.
-	if errWrite := mpu.setRegBank(2); errWrite != nil {
-		return errors.New("ICM20948 Error: change register bank.")
-	}
+func (mpu *ICM20948) SetGyroSensitivity(sensitivityGyro int) error {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+	return mpu.setGyroSensitivity(sensitivityGyro)
+}
 
-	defer mpu.setRegBank(0)
+// setGyroSensitivity is SetGyroSensitivity for callers that hold mpu.busMu, such as configure.
+func (mpu *ICM20948) setGyroSensitivity(sensitivityGyro int) error {
+	var sensGyro byte
 
 	switch sensitivityGyro {
 	case 2000:
 		sensGyro = BITS_FS_2000DPS
-		mpu.scaleGyro = 2000.0 / float64(math.MaxInt16)
 	case 1000:
 		sensGyro = BITS_FS_1000DPS
-		mpu.scaleGyro = 1000.0 / float64(math.MaxInt16)
 	case 500:
 		sensGyro = BITS_FS_500DPS
-		mpu.scaleGyro = 500.0 / float64(math.MaxInt16)
 	case 250:
 		sensGyro = BITS_FS_250DPS
-		mpu.scaleGyro = 250.0 / float64(math.MaxInt16)
 	default:
-		err = fmt.Errorf("ICM20948 Error: %d is not a valid gyro sensitivity", sensitivityGyro)
+		return fmt.Errorf("ICM20948 Error: %d is not a valid gyro sensitivity", sensitivityGyro)
 	}
 
-	if errWrite := mpu.i2cWrite(ICMREG_GYRO_CONFIG, sensGyro); errWrite != nil {
-		err = errors.New("ICM20948 Error: couldn't set gyro sensitivity")
+	// Gyro config registers on Bank 2.
+	if errWrite := mpu.setRegBank(2); errWrite != nil {
+		return errors.New("ICM20948 Error: change register bank.")
 	}
 
-	return
+	defer mpu.setRegBank(0)
+
+	// Preserve the DLPF settings.
+	cfg, errRead := mpu.i2cRead(ICMREG_GYRO_CONFIG)
+	if errRead != nil {
+		return errors.New("ICM20948 Error: SetGyroSensitivity error reading chip")
+	}
+	cfg = cfg&^BITS_FS_SEL_MASK | sensGyro
+
+	if errWrite := mpu.i2cWrite(ICMREG_GYRO_CONFIG, cfg); errWrite != nil {
+		return errors.New("ICM20948 Error: couldn't set gyro sensitivity")
+	}
+	mpu.gyroConfig = cfg
+
+	// Only rescale once the chip has the new range, so a failed write leaves the scale matching the readings.
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	oldScale := mpu.scaleGyro
+	mpu.scaleGyro = float64(sensitivityGyro) / float64(math.MaxInt16)
+	mpu.sensitivityGyro = sensitivityGyro
+
+	// Keep the biases (stored in raw units) the same in physical units when the range changes at runtime.
+	if oldScale != 0 && oldScale != mpu.scaleGyro {
+		r := oldScale / mpu.scaleGyro
+		mpu.G01, mpu.G02, mpu.G03 = mpu.G01*r, mpu.G02*r, mpu.G03*r
+	}
+	return nil
 }
 
 func (mpu *ICM20948) setRegBank(bank byte) error {
@@ -712,39 +1962,76 @@ func (mpu *ICM20948) setRegBank(bank byte) error {
 // SetAccelSensitivity sets the accelerometer sensitivity of the ICM20948; it must be one of the following values:
 // 2, 4, 8, 16, all in G (gravity).
 func (mpu *ICM20948) SetAccelSensitivity(sensitivityAccel int) error {
-	var sensAccel byte
-
-	// Accel config registers on Bank 2.
-	if errWrite := mpu.setRegBank(2); errWrite != nil {
-		return errors.New("ICM20948 Error: change register bank.")
-	}
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+	return mpu.setAccelSensitivity(sensitivityAccel)
+}
 
-	defer mpu.setRegBank(0)
+// setAccelSensitivity is SetAccelSensitivity for callers that hold mpu.busMu, such as configure.
+func (mpu *ICM20948) setAccelSensitivity(sensitivityAccel int) error {
+	var sensAccel byte
 
 	switch sensitivityAccel {
 	case 16:
 		sensAccel = BITS_FS_16G
-		mpu.scaleAccel = 16.0 / float64(math.MaxInt16)
 	case 8:
 		sensAccel = BITS_FS_8G
-		mpu.scaleAccel = 8.0 / float64(math.MaxInt16)
 	case 4:
 		sensAccel = BITS_FS_4G
-		mpu.scaleAccel = 4.0 / float64(math.MaxInt16)
 	case 2:
 		sensAccel = BITS_FS_2G
-		mpu.scaleAccel = 2.0 / float64(math.MaxInt16)
 	default:
 		return fmt.Errorf("ICM20948 Error: %d is not a valid accel sensitivity", sensitivityAccel)
 	}
 
-	if errWrite := mpu.i2cWrite(ICMREG_ACCEL_CONFIG, sensAccel); errWrite != nil {
+	// Accel config registers on Bank 2.
+	if errWrite := mpu.setRegBank(2); errWrite != nil {
+		return errors.New("ICM20948 Error: change register bank.")
+	}
+
+	defer mpu.setRegBank(0)
+
+	// Preserve the DLPF settings.
+	cfg, err := mpu.i2cRead(ICMREG_ACCEL_CONFIG)
+	if err != nil {
+		return errors.New("ICM20948 Error: SetAccelSensitivity error reading chip")
+	}
+
+	if errWrite := mpu.i2cWrite(ICMREG_ACCEL_CONFIG, cfg&^BITS_FS_SEL_MASK|sensAccel); errWrite != nil {
 		return errors.New("ICM20948 Error: couldn't set accel sensitivity")
 	}
 
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	oldScale := mpu.scaleAccel
+	mpu.scaleAccel = float64(sensitivityAccel) / float64(math.MaxInt16)
+	mpu.sensitivityAccel = sensitivityAccel
+
+	// Keep the biases (stored in raw units) the same in physical units when the range changes at runtime.
+	if oldScale != 0 && oldScale != mpu.scaleAccel {
+		r := oldScale / mpu.scaleAccel
+		mpu.A01, mpu.A02, mpu.A03 = mpu.A01*r, mpu.A02*r, mpu.A03*r
+	}
 	return nil
 }
 
+// offsetToBias converts a factory offset register value, which is in the units of the offsetRange full-scale
+// range, to a bias in the raw units of the given sensitivity.  Sensitivities are allowed from offsetRange/4 to
+// 2*offsetRange, matching the ranges of the ICM20948.
+func offsetToBias(offset int16, sensitivity, offsetRange int) (float64, error) {
+	switch sensitivity {
+	case 2 * offsetRange:
+		return float64(offset >> 1), nil
+	case offsetRange:
+		return float64(offset), nil
+	case offsetRange / 2:
+		return float64(offset << 1), nil
+	case offsetRange / 4:
+		return float64(offset << 2), nil
+	}
+	return 0, fmt.Errorf("ICM20948 Error: %d is not a valid sensitivity", sensitivity)
+}
+
 // ReadAccelBias reads the bias accelerometer value stored on the chip.
 // These values are set at the factory.
 func (mpu *ICM20948) ReadAccelBias(sensitivityAccel int) error {
@@ -766,26 +2053,12 @@ func (mpu *ICM20948) ReadAccelBias(sensitivityAccel int) error {
 		return errors.New("ICM20948 Error: ReadAccelBias error reading chip")
 	}
 
-	switch sensitivityAccel {
-	case 16:
-		mpu.A01 = float64(a0x >> 1)
-		mpu.A02 = float64(a0y >> 1)
-		mpu.A03 = float64(a0z >> 1)
-	case 8:
-		mpu.A01 = float64(a0x)
-		mpu.A02 = float64(a0y)
-		mpu.A03 = float64(a0z)
-	case 4:
-		mpu.A01 = float64(a0x << 1)
-		mpu.A02 = float64(a0y << 1)
-		mpu.A03 = float64(a0z << 1)
-	case 2:
-		mpu.A01 = float64(a0x << 2)
-		mpu.A02 = float64(a0y << 2)
-		mpu.A03 = float64(a0z << 2)
-	default:
+	if mpu.A01, err = offsetToBias(a0x, sensitivityAccel, 8); err != nil {
 		return fmt.Errorf("ICM20948 Error: %d is not a valid acceleration sensitivity", sensitivityAccel)
 	}
+	mpu.A02, _ = offsetToBias(a0y, sensitivityAccel, 8)
+	mpu.A03, _ = offsetToBias(a0z, sensitivityAccel, 8)
+	mpu.calibrationChanged("factory accel offsets read from the chip")
 
 	return nil
 }
@@ -811,26 +2084,12 @@ func (mpu *ICM20948) ReadGyroBias(sensitivityGyro int) error {
 		return errors.New("ICM20948 Error: ReadGyroBias error reading chip")
 	}
 
-	switch sensitivityGyro {
-	case 2000:
-		mpu.G01 = float64(g0x >> 1)
-		mpu.G02 = float64(g0y >> 1)
-		mpu.G03 = float64(g0z >> 1)
-	case 1000:
-		mpu.G01 = float64(g0x)
-		mpu.G02 = float64(g0y)
-		mpu.G03 = float64(g0z)
-	case 500:
-		mpu.G01 = float64(g0x << 1)
-		mpu.G02 = float64(g0y << 1)
-		mpu.G03 = float64(g0z << 1)
-	case 250:
-		mpu.G01 = float64(g0x << 2)
-		mpu.G02 = float64(g0y << 2)
-		mpu.G03 = float64(g0z << 2)
-	default:
+	if mpu.G01, err = offsetToBias(g0x, sensitivityGyro, 1000); err != nil {
 		return fmt.Errorf("ICM20948 Error: %d is not a valid gyro sensitivity", sensitivityGyro)
 	}
+	mpu.G02, _ = offsetToBias(g0y, sensitivityGyro, 1000)
+	mpu.G03, _ = offsetToBias(g0z, sensitivityGyro, 1000)
+	mpu.calibrationChanged("factory gyro offsets read from the chip")
 
 	return nil
 }
@@ -887,9 +2146,12 @@ func (mpu *ICM20948) ReadMagCalibration() error {
 		return errors.New("ReadMagCalibration error reading chip")
 	}
 
+	mpu.mu.Lock()
 	mpu.mcal1 = float64(int16(mcal1)+128) / 256 * scaleMagAK8963
 	mpu.mcal2 = float64(int16(mcal2)+128) / 256 * scaleMagAK8963
 	mpu.mcal3 = float64(int16(mcal3)+128) / 256 * scaleMagAK8963
+	mpu.magModel = "AK8963"
+	mpu.mu.Unlock()
 
 	// Clean up from getting sensitivity data from AK8963
 	// Fuse AK8963 ROM access
@@ -916,10 +2178,17 @@ func (mpu *ICM20948) ReadMagCalibration() error {
 }
 
 func (mpu *ICM20948) i2cWrite(register, value byte) (err error) {
+	if mpu.initTrace != nil {
+		start := time.Now()
+		defer func() { mpu.traceWrite(register, value, start, err) }()
+	}
 
-	if errWrite := mpu.i2cbus.WriteByteToReg(MPU_ADDRESS, register, value); errWrite != nil {
-		err = fmt.Errorf("ICM20948 Error writing %X to %X: %s\n",
-			value, register, errWrite.Error())
+	_, errWrite := mpu.busOp(func() (uint16, error) {
+		return 0, mpu.i2cbus.WriteByteToReg(mpu.address, register, value)
+	})
+	if errWrite != nil {
+		err = fmt.Errorf("ICM20948 Error writing %X to %X: %w\n",
+			value, register, errWrite)
 	} else {
 		time.Sleep(time.Millisecond)
 	}
@@ -927,44 +2196,97 @@ func (mpu *ICM20948) i2cWrite(register, value byte) (err error) {
 }
 
 func (mpu *ICM20948) i2cRead(register byte) (value uint8, err error) {
-	value, errWrite := mpu.i2cbus.ReadByteFromReg(MPU_ADDRESS, register)
+	v, errWrite := mpu.busOp(func() (uint16, error) {
+		v, err := mpu.i2cbus.ReadByteFromReg(mpu.address, register)
+		return uint16(v), err
+	})
 	if errWrite != nil {
-		err = fmt.Errorf("i2cRead error: %s", errWrite.Error())
+		err = fmt.Errorf("i2cRead error: %w", errWrite)
+	} else {
+		value = uint8(v)
 	}
 	return
 }
 
+// i2cRead2 reads a 16-bit value stored big-endian, high byte first, as in the ICM20948's own registers.
 func (mpu *ICM20948) i2cRead2(register byte) (value int16, err error) {
+	b, err := mpu.i2cReadPair(register)
+	return int16(uint16(b[0])<<8 | uint16(b[1])), err
+}
 
-	v, errWrite := mpu.i2cbus.ReadWordFromReg(MPU_ADDRESS, register)
-	if errWrite != nil {
-		err = fmt.Errorf("ICM20948 Error reading %x: %s\n", register, errWrite.Error())
-	} else {
-		value = int16(v)
-	}
-	return
+// i2cRead2LE reads a 16-bit value stored little-endian, low byte first, as in the AK09916 data mirrored into
+// EXT_SENS_DATA.
+func (mpu *ICM20948) i2cRead2LE(register byte) (value int16, err error) {
+	b, err := mpu.i2cReadPair(register)
+	return int16(uint16(b[1])<<8 | uint16(b[0])), err
+}
+
+// i2cReadPair reads register and register+1 in one transaction.  The bytes are combined by the caller rather
+// than with ReadWordFromReg, whose byte order depends on the bus implementation.
+func (mpu *ICM20948) i2cReadPair(register byte) (b [2]byte, err error) {
+	buf := make([]byte, 2)
+	_, errRead := mpu.busOp(func() (uint16, error) {
+		return 0, mpu.i2cbus.ReadFromReg(mpu.address, register, buf)
+	})
+	if errRead != nil {
+		return b, fmt.Errorf("ICM20948 Error reading %x: %w\n", register, errRead)
+	}
+	copy(b[:], buf)
+	return b, nil
 }
 
 func (mpu *ICM20948) memWrite(addr uint16, data *[]byte) error {
-	var err error
-	var tmp = make([]byte, 2)
+	if err := mpu.memSelect(addr, len(*data)); err != nil {
+		return err
+	}
 
-	tmp[0] = byte(addr >> 8)
-	tmp[1] = byte(addr & 0xFF)
+	_, err := mpu.busOp(func() (uint16, error) {
+		return 0, mpu.i2cbus.WriteToReg(mpu.address, ICMREG_MEM_R_W, *data)
+	})
+	if err != nil {
+		return fmt.Errorf("ICM20948 Error writing to the memory bank: %w\n", err)
+	}
 
-	// Check memory bank boundaries
-	if tmp[1]+byte(len(*data)) > MPU_BANK_SIZE {
-		return errors.New("Bad address: writing outside of memory bank boundaries")
+	mpu.mu.Lock()
+	verify := mpu.memVerify
+	mpu.mu.Unlock()
+	if verify {
+		return mpu.verifyMem(addr, *data)
 	}
+	return nil
+}
 
-	err = mpu.i2cbus.WriteToReg(MPU_ADDRESS, ICMREG_BANK_SEL, tmp)
-	if err != nil {
-		return fmt.Errorf("ICM20948 Error selecting memory bank: %s\n", err.Error())
+func (mpu *ICM20948) memRead(addr uint16, n int) ([]byte, error) {
+	if err := mpu.memSelect(addr, n); err != nil {
+		return nil, err
 	}
 
-	err = mpu.i2cbus.WriteToReg(MPU_ADDRESS, ICMREG_MEM_R_W, *data)
+	data := make([]byte, n)
+	_, err := mpu.busOp(func() (uint16, error) {
+		return 0, mpu.i2cbus.ReadFromReg(mpu.address, ICMREG_MEM_R_W, data)
+	})
 	if err != nil {
-		return fmt.Errorf("ICM20948 Error writing to the memory bank: %s\n", err.Error())
+		return nil, fmt.Errorf("ICM20948 Error reading from the memory bank: %w\n", err)
+	}
+
+	return data, nil
+}
+
+// memSelect points MEM_R_W at addr in the DMP memory, checking that n bytes from there fit in the memory bank.
+func (mpu *ICM20948) memSelect(addr uint16, n int) error {
+	bank := byte(addr >> 8)
+	start := byte(addr & 0xFF)
+
+	// Check memory bank boundaries: MEM_START_ADDR doesn't carry into MEM_BANK_SEL.
+	if end := int(addr) + n - 1; n < 1 || end>>8 != int(bank) {
+		return fmt.Errorf("ICM20948 Error: %d bytes at 0x%04X are outside memory bank %d", n, addr, bank)
+	}
+
+	if err := mpu.i2cWrite(ICMREG_MEM_BANK_SEL, bank); err != nil {
+		return fmt.Errorf("ICM20948 Error selecting memory bank: %s\n", err.Error())
+	}
+	if err := mpu.i2cWrite(ICMREG_MEM_START_ADDR, start); err != nil {
+		return fmt.Errorf("ICM20948 Error selecting memory address: %s\n", err.Error())
 	}
 
 	return nil
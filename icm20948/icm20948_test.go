@@ -0,0 +1,3848 @@
+package icm20948
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kidoman/embd"
+)
+
+const tolerance = 1e-9
+
+func TestCalibrateGyro(t *testing.T) {
+	for _, tc := range []struct {
+		sensitivity int
+		raw, bias   float64
+		want        float64
+	}{
+		{250, 32767, 0, 250},
+		{250, -16384, 0, -16384 * 250.0 / 32767},
+		{500, 1000, 10, 990 * 500.0 / 32767},
+		{1000, -1000, -10, -990 * 1000.0 / 32767},
+		{2000, 32767, 32767, 0},
+	} {
+		mpu := new(ICM20948)
+		setScales(mpu, tc.sensitivity, 2)
+		mpu.G01, mpu.G02, mpu.G03 = tc.bias, -tc.bias, 0
+
+		g1, g2, g3 := mpu.calibrateGyro(tc.raw, -tc.raw, tc.raw)
+		if math.Abs(g1-tc.want) > tolerance || math.Abs(g2+tc.want) > tolerance {
+			t.Errorf("%d°/s: raw %v bias %v gave %v, %v, want %v, %v", tc.sensitivity, tc.raw, tc.bias, g1, g2, tc.want, -tc.want)
+		}
+		if want3 := tc.raw * float64(tc.sensitivity) / 32767; math.Abs(g3-want3) > tolerance {
+			t.Errorf("%d°/s: unbiased axis gave %v, want %v", tc.sensitivity, g3, want3)
+		}
+	}
+}
+
+func TestCalibrateAccel(t *testing.T) {
+	for _, tc := range []struct {
+		sensitivity int
+		raw, bias   float64
+		want        float64
+	}{
+		{2, 16384, 0, 16384 * 2.0 / 32767},
+		{4, 8192 + 50, 50, 8192 * 4.0 / 32767},
+		{8, -4096, 0, -4096 * 8.0 / 32767},
+		{16, 2048, -2048, 4096 * 16.0 / 32767},
+	} {
+		mpu := new(ICM20948)
+		setScales(mpu, 250, tc.sensitivity)
+		mpu.A01, mpu.A02, mpu.A03 = tc.bias, tc.bias, tc.bias
+
+		a1, a2, a3 := mpu.calibrateAccel(tc.raw, tc.raw, tc.raw)
+		for _, a := range []float64{a1, a2, a3} {
+			if math.Abs(a-tc.want) > tolerance {
+				t.Errorf("%dG: raw %v bias %v gave %v, want %v", tc.sensitivity, tc.raw, tc.bias, a, tc.want)
+			}
+		}
+	}
+}
+
+func TestCalibrateMag(t *testing.T) {
+	mpu := new(ICM20948)
+	mpu.mpuCalData.reset()
+	mpu.mcal1, mpu.mcal2, mpu.mcal3 = scaleMagAK09916, scaleMagAK09916, scaleMagAK09916
+
+	// With no calibration, full scale should read as the AK09916's ±4912µT.
+	m1, m2, m3 := mpu.calibrateMag(32752, -32752, 0)
+	if math.Abs(m1-4912) > tolerance || math.Abs(m2+4912) > tolerance || m3 != 0 {
+		t.Errorf("uncalibrated full scale gave %v, %v, %v", m1, m2, m3)
+	}
+
+	// Hard-iron offsets are subtracted in µT, then the soft-iron matrix is applied.
+	mpu.M01, mpu.M02, mpu.M03 = 10, -20, 5
+	mpu.Ms11, mpu.Ms12, mpu.Ms13 = 2, 0, 0
+	mpu.Ms21, mpu.Ms22, mpu.Ms23 = 0, 1, 1
+	mpu.Ms31, mpu.Ms32, mpu.Ms33 = 0, 0, 0.5
+	raw := 30 / scaleMagAK09916
+	m1, m2, m3 = mpu.calibrateMag(raw, raw, raw)
+	if math.Abs(m1-40) > 1e-6 || math.Abs(m2-75) > 1e-6 || math.Abs(m3-12.5) > 1e-6 {
+		t.Errorf("calibrated reading gave %v, %v, %v, want 40, 75, 12.5", m1, m2, m3)
+	}
+
+	for _, tc := range []struct {
+		hardIron, softIron  bool
+		want1, want2, want3 float64
+	}{
+		{false, true, 60, 60, 15},
+		{true, false, 20, 50, 25},
+		{false, false, 30, 30, 30},
+	} {
+		mpu.SetMagCorrection(tc.hardIron, tc.softIron)
+		m1, m2, m3 = mpu.calibrateMag(raw, raw, raw)
+		if math.Abs(m1-tc.want1) > 1e-6 || math.Abs(m2-tc.want2) > 1e-6 || math.Abs(m3-tc.want3) > 1e-6 {
+			t.Errorf("hard iron %v, soft iron %v gave %v, %v, %v, want %v, %v, %v",
+				tc.hardIron, tc.softIron, m1, m2, m3, tc.want1, tc.want2, tc.want3)
+		}
+	}
+}
+
+func TestTempValue(t *testing.T) {
+	if v := tempValue(0); v != 21 {
+		t.Errorf("raw 0 gave %v°C, want 21°C", v)
+	}
+	if v := tempValue(333.87 * 4); math.Abs(v-25) > tolerance {
+		t.Errorf("raw 1335.48 gave %v°C, want 25°C", v)
+	}
+}
+
+func TestOffsetToBias(t *testing.T) {
+	for _, tc := range []struct {
+		offset      int16
+		sensitivity int
+		offsetRange int
+		want        float64
+	}{
+		{100, 16, 8, 50},
+		{100, 8, 8, 100},
+		{100, 4, 8, 200},
+		{100, 2, 8, 400},
+		{-100, 2000, 1000, -50},
+		{-100, 1000, 1000, -100},
+		{-100, 500, 1000, -200},
+		{-100, 250, 1000, -400},
+	} {
+		got, err := offsetToBias(tc.offset, tc.sensitivity, tc.offsetRange)
+		if err != nil || got != tc.want {
+			t.Errorf("offset %d at sensitivity %d gave %v, %v, want %v", tc.offset, tc.sensitivity, got, err, tc.want)
+		}
+	}
+
+	if _, err := offsetToBias(100, 3, 8); err == nil {
+		t.Error("invalid sensitivity didn't return an error")
+	}
+}
+
+// setScales sets the scale factors as SetGyroSensitivity and SetAccelSensitivity would, without a chip.
+func setScales(mpu *ICM20948, sensitivityGyro, sensitivityAccel int) {
+	mpu.sensitivityGyro, mpu.sensitivityAccel = sensitivityGyro, sensitivityAccel
+	mpu.scaleGyro = float64(sensitivityGyro) / float64(math.MaxInt16)
+	mpu.scaleAccel = float64(sensitivityAccel) / float64(math.MaxInt16)
+}
+
+func TestClockSource(t *testing.T) {
+	// The other PWR_MGMT_1 bits (here SLEEP and TEMP_DIS) are kept.
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_PWR_MGMT_1: BIT_SLEEP | 0x08 | MPU_CLK_SEL_PLLGYROX}}
+	var bus embd.I2CBus = fb
+	mpu := &ICM20948{i2cbus: bus}
+
+	if err := mpu.SetClockSource(6); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := fb.regs[ICMREG_PWR_MGMT_1]; cfg != BIT_SLEEP|0x08|6 || mpu.pwrMgmt1 != cfg {
+		t.Errorf("PWR_MGMT_1 0x%02X, recorded as 0x%02X, after SetClockSource(6)", cfg, mpu.pwrMgmt1)
+	}
+	if sel, err := mpu.ClockSource(); sel != 6 || err != nil {
+		t.Errorf("ClockSource() = %d, %v", sel, err)
+	}
+
+	for _, sel := range []byte{8, 0x41, 0xFF} {
+		if err := mpu.SetClockSource(sel); err == nil {
+			t.Errorf("clock source 0x%02X accepted", sel)
+		}
+	}
+	if cfg := fb.regs[ICMREG_PWR_MGMT_1]; cfg != BIT_SLEEP|0x08|6 {
+		t.Errorf("PWR_MGMT_1 0x%02X after invalid clock sources", cfg)
+	}
+
+	fb.fail = true
+	if _, err := mpu.ClockSource(); err == nil {
+		t.Error("ClockSource succeeded on a failing bus")
+	}
+}
+
+func TestSampleRateDivider(t *testing.T) {
+	for _, tc := range []struct {
+		hz, maxDiv int
+		want       int
+		ok         bool
+	}{
+		{1125, 0xFF, 0, true},
+		{100, 0xFF, 10, true}, // 102.3 Hz: 11 would give 93.75 Hz, slower than asked for
+		{400, 0xFF, 1, true},  // 562.5 Hz, not 375 Hz
+		{50, 0xFF, 21, true},
+		{5, 0xFF, 224, true},
+		{4, 0xFF, 0, false},
+		{0, 0xFF, 0, false},
+		{1126, 0xFF, 0, false},
+		{4, maxAccelDivider, 280, true},
+		{1, maxAccelDivider, 1124, true},
+	} {
+		got, err := sampleRateDivider(tc.hz, tc.maxDiv)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("%d Hz gave divider %d, %v, want %d, ok %v", tc.hz, got, err, tc.want, tc.ok)
+		}
+		if tc.ok && (1125/(1+got) < tc.hz || 1125/(2+got) >= tc.hz) {
+			t.Errorf("%d Hz gave divider %d, not the slowest rate at least as fast", tc.hz, got)
+		}
+	}
+}
+
+func TestCloseMPU(t *testing.T) {
+	// Never started, e.g. after a failed init.
+	mpu := new(ICM20948)
+	mpu.CloseMPU()
+	mpu.CloseMPU()
+
+	var bus embd.I2CBus = &fakeBus{fail: true}
+	if _, err := NewICM20948(&bus, 250, 2, 50, false, false); err == nil {
+		t.Fatal("init on a failing bus didn't return an error")
+	}
+
+	bus = &fakeBus{}
+	mpu, err := NewICM20948(&bus, 250, 2, 50, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		mpu.CloseMPU()
+		mpu.CloseMPU()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("CloseMPU blocked")
+	}
+	if _, ok := <-mpu.C; ok {
+		t.Error("C still open after CloseMPU")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	mpu, err := NewWithBus(&fakeBus{regs: map[byte]byte{ICMREG_ACCEL_ZOUT_H: 0x40}}, WithSampleRate(1000),
+		WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	for deadline := time.Now().Add(5 * time.Second); len(mpu.CBuf) < cap(mpu.CBuf); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("CBuf holds %d samples after 5s", len(mpu.CBuf))
+		}
+	}
+
+	mpu.CloseMPU()
+	samples := mpu.Stats().Samples
+	data := mpu.Drain()
+	if len(data) != bufSize {
+		t.Errorf("drained %d samples from a full CBuf, want %d", len(data), bufSize)
+	}
+	for i := 1; i < len(data); i++ {
+		if data[i].Seq <= data[i-1].Seq {
+			t.Fatalf("drained sample %d has Seq %d after %d", i, data[i].Seq, data[i-1].Seq)
+		}
+	}
+
+	// The loop has exited: CBuf is closed and no more samples are read.
+	if _, ok := <-mpu.CBuf; ok {
+		t.Error("CBuf still open after CloseMPU")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := mpu.Stats().Samples; n != samples {
+		t.Errorf("%d samples read after CloseMPU", n-samples)
+	}
+	if data := mpu.Drain(); len(data) != 0 {
+		t.Errorf("second Drain returned %d samples", len(data))
+	}
+}
+
+func TestConfig(t *testing.T) {
+	cfg := Config{}.withDefaults()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SensitivityGyro != 250 || cfg.SensitivityAccel != 4 || cfg.SampleRate != 50 ||
+		cfg.AccelSampleRate != 50 || cfg.Address != MPU_ADDRESS || cfg.CalibrationPath != calDataLocation {
+		t.Errorf("wrong defaults: %+v", cfg)
+	}
+
+	for _, bad := range []Config{
+		{SensitivityGyro: 300},
+		{SensitivityAccel: 3},
+		{SampleRate: 2000},
+		{AccelSampleRate: -1},
+		{Address: 0x6A},
+		{BusClock: -1},
+	} {
+		if err := bad.withDefaults().validate(); err == nil {
+			t.Errorf("%+v validated", bad)
+		}
+	}
+
+	var bus embd.I2CBus = &fakeBus{}
+	if _, err := NewWithOptions(&bus, WithGyroSensitivity(300)); err == nil {
+		t.Error("NewWithOptions accepted an invalid gyro sensitivity")
+	}
+
+	fb := &fakeBus{}
+	bus = fb
+	mpu, err := NewWithOptions(&bus, WithConfig(Config{SampleRate: 100}), WithAccelSampleRate(25), WithAddress(0x69),
+		WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	fb.mu.Lock()
+	addr := fb.addr
+	fb.mu.Unlock()
+	if mpu.SampleRate() != 100 || mpu.accelRate != 25 || addr != 0x69 {
+		t.Errorf("options not applied: rate %d, accel rate %d, address 0x%02X", mpu.SampleRate(), mpu.accelRate, addr)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	cal := filepath.Join(dir, "cal.json")
+	if err := (Config{EnableMag: true, CalibrationPath: cal}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cal); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Validate left a calibration file behind: %v", err)
+	}
+
+	// All the problems are reported together.
+	err := Config{SensitivityGyro: 300, SampleRate: 2000, CalibrationPath: filepath.Join(dir, "no", "cal.json")}.Validate()
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 4 {
+		t.Errorf("got %v, expected the gyro sensitivity, both rates and the calibration path", err)
+	}
+
+	for _, bad := range []Config{
+		{SampleRate: 5, EnableMag: true, CalibrationPath: cal},
+		{SampleRate: 1000, CalibrationPath: cal},
+		{CalibrationPath: dir},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("%+v validated", bad)
+		}
+	}
+	if err := (Config{SampleRate: 1000, BusClock: 400000, CalibrationPath: cal}).Validate(); err != nil {
+		t.Errorf("1000 Hz on a 400 kHz bus: %v", err)
+	}
+}
+
+func TestExpAvg(t *testing.T) {
+	e := expAvg{tau: 1}
+	t0 := time.Now()
+	e.update(&MPUData{G1: 10, A3: 1, T: t0, MagError: errors.New("no mag")})
+	if e.d.G1 != 10 || e.d.MagError == nil {
+		t.Fatalf("first sample not taken as is: %+v", e.d)
+	}
+	first := e.d
+
+	// With dt equal to tau, the average moves halfway to the new value.
+	e.update(&MPUData{G1: 20, A3: 3, M1: 40, T: t0.Add(time.Second)})
+	if math.Abs(e.d.G1-15) > tolerance || math.Abs(e.d.A3-2) > tolerance {
+		t.Errorf("average gave G1 %v, A3 %v, want 15, 2", e.d.G1, e.d.A3)
+	}
+	if e.d.M1 != 40 || e.d.MagError != nil {
+		t.Errorf("first mag sample not taken as is: %v, %v", e.d.M1, e.d.MagError)
+	}
+	if first.G1 != 10 {
+		t.Error("update modified a previously returned average")
+	}
+
+	// Samples with errors are ignored.
+	e.update(&MPUData{G1: 1000, T: t0.Add(2 * time.Second), GAError: errors.New("bad read")})
+	if math.Abs(e.d.G1-15) > tolerance {
+		t.Errorf("sample with error changed the average to %v", e.d.G1)
+	}
+}
+
+func TestMagOverflowTracker(t *testing.T) {
+	var o magOverflowTracker
+	t0 := time.Now()
+	feed := func(start time.Time, reads, overflows int) (changed bool) {
+		dt := (magOverflowWindow + time.Millisecond) / time.Duration(reads-1)
+		for i := 0; i < reads; i++ {
+			if o.update(start.Add(time.Duration(i)*dt), i < overflows) {
+				changed = true
+			}
+		}
+		return
+	}
+
+	if feed(t0, 100, 5) || o.unhealthy {
+		t.Error("5% overflows marked the mag unhealthy")
+	}
+	t1 := t0.Add(3 * magOverflowWindow)
+	if !feed(t1, 100, 50) || !o.unhealthy || math.Abs(o.rate-0.5) > 0.02 {
+		t.Errorf("50%% overflows gave unhealthy %v, rate %v", o.unhealthy, o.rate)
+	}
+	if feed(t1.Add(3*magOverflowWindow), 100, 60) {
+		t.Error("continued overflows reported the change again")
+	}
+	if !feed(t1.Add(6*magOverflowWindow), 100, 0) || o.unhealthy {
+		t.Error("recovery not detected")
+	}
+}
+
+func TestGyroBiasCal(t *testing.T) {
+	bus := &fakeBus{}
+	mpu := &ICM20948{i2cbus: bus}
+	for _, enable := range []bool{true, false} {
+		if err := mpu.EnableGyroBiasCal(enable); err != nil {
+			t.Fatal(err)
+		}
+		if enabled, err := mpu.GyroBiasCalEnabled(); err != nil || enabled != enable {
+			t.Errorf("GyroBiasCalEnabled gave %v, %v after setting it to %v", enabled, err, enable)
+		}
+	}
+
+	bus.readOnly = true
+	if err := mpu.EnableGyroBiasCal(true); err == nil {
+		t.Error("a write that didn't take wasn't reported")
+	}
+
+	if _, err := (&ICM20948{i2cbus: &fakeBus{}}).GyroBiasCalEnabled(); err == nil {
+		t.Error("unrecognized DMP memory contents weren't reported")
+	}
+}
+
+func TestJitterStats(t *testing.T) {
+	var j jitterStats
+	if j.rms() != 0 {
+		t.Errorf("empty stats gave RMS %s", j.rms())
+	}
+	for _, d := range []time.Duration{0, 3 * time.Millisecond, -4 * time.Millisecond} {
+		j.update(d)
+	}
+	if j.n != 2 || j.max != 4*time.Millisecond {
+		t.Errorf("got %d reads, max %s, want 2, 4ms", j.n, j.max)
+	}
+	if want := time.Duration(math.Sqrt(12.5) * float64(time.Millisecond)); j.rms()-want > time.Microsecond || want-j.rms() > time.Microsecond {
+		t.Errorf("RMS %s, want %s", j.rms(), want)
+	}
+}
+
+func TestCalibrationFits(t *testing.T) {
+	var orients, mags [][3]float64
+	bias, center, radii := [3]float64{0.05, -0.03, 0.1}, [3]float64{20, -35, 10}, [3]float64{45, 50, 55}
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 5; j++ {
+			az, el := float64(i)*45*deg, (float64(j)*40-80)*deg
+			u := [3]float64{math.Cos(el) * math.Cos(az), math.Cos(el) * math.Sin(az), math.Sin(el)}
+			orients = append(orients, [3]float64{u[0] + bias[0], u[1] + bias[1], u[2] + bias[2]})
+			mags = append(mags, [3]float64{center[0] + radii[0]*u[0], center[1] + radii[1]*u[1], center[2] + radii[2]*u[2]})
+		}
+	}
+
+	b, resid, err := fitSphere(orients)
+	if err != nil || resid > 1e-6 {
+		t.Fatalf("sphere fit gave residual %v, %v", resid, err)
+	}
+	for i := range b {
+		if math.Abs(b[i]-bias[i]) > 1e-6 {
+			t.Errorf("sphere fit gave center %v, want %v", b, bias)
+		}
+	}
+	if !coverage(orients, b, [3]float64{1, 1, 1}) {
+		t.Error("orientations all round the sphere didn't give full coverage")
+	}
+	if coverage(orients[:5], b, [3]float64{1, 1, 1}) {
+		t.Error("orientations in one plane gave full coverage")
+	}
+
+	c, r, resid, err := fitEllipsoid(mags)
+	if err != nil || resid > 1e-6 {
+		t.Fatalf("ellipsoid fit gave residual %v, %v", resid, err)
+	}
+	for i := range c {
+		if math.Abs(c[i]-center[i]) > 1e-6 || math.Abs(r[i]-radii[i]) > 1e-6 {
+			t.Errorf("ellipsoid fit gave center %v, radii %v, want %v, %v", c, r, center, radii)
+		}
+	}
+
+	if _, _, err := fitSphere(orients[:1]); err == nil {
+		t.Error("fitting a single point didn't return an error")
+	}
+}
+
+func TestEstimateBusLoad(t *testing.T) {
+	// 50 Hz: 7 word reads per sample, and at 50 Hz mag polling an ST1 read, 3 word reads and an ST2 read.
+	load := EstimateBusLoad(Config{SampleRate: 50, EnableMag: true, BusClock: 400000})
+	if want := 50.0*7 + 50*5; load.Transactions != want {
+		t.Errorf("got %v transactions/s, want %v", load.Transactions, want)
+	}
+	if want := 50.0*7*5 + 50*(2*4+3*5); load.Bytes != want {
+		t.Errorf("got %v bytes/s, want %v", load.Bytes, want)
+	}
+	if load.Warning != "" {
+		t.Errorf("50 Hz at 400 kHz warned: %s", load.Warning)
+	}
+
+	// Separate accel and gyro reads add up to the same register reads.
+	split := EstimateBusLoad(Config{SampleRate: 50, AccelSampleRate: 50, BusClock: 400000})
+	if same := EstimateBusLoad(Config{SampleRate: 50, BusClock: 400000}); split != same {
+		t.Errorf("equal rates gave %+v, want %+v", split, same)
+	}
+
+	if load := EstimateBusLoad(Config{SampleRate: 1125, EnableMag: true}); load.Warning == "" || load.Utilization < 0.8 {
+		t.Errorf("1125 Hz at 100 kHz didn't warn: %+v", load)
+	}
+}
+
+func TestMagAnomaly(t *testing.T) {
+	mpu := new(ICM20948)
+	if mpu.magAnomaly(500, 0, 0) {
+		t.Error("flagged an anomaly with no expected field")
+	}
+
+	mpu.MagField = 50 // Learned during calibration
+	for _, tc := range []struct {
+		m    float64
+		want bool
+	}{{50, false}, {56, false}, {44, false}, {58, true}, {40, true}} {
+		if got := mpu.magAnomaly(0, tc.m*0.6, tc.m*0.8); got != tc.want {
+			t.Errorf("learned field 50µT, |m| %gµT: anomaly %t, want %t", tc.m, got, tc.want)
+		}
+	}
+
+	if err := mpu.SetExpectedMagField(45, 2); err != nil {
+		t.Fatal(err)
+	}
+	if field, tol := mpu.ExpectedMagField(); field != 45 || tol != 2 {
+		t.Errorf("expected field %g±%g, want 45±2", field, tol)
+	}
+	if !mpu.magAnomaly(0, 0, 48) || mpu.magAnomaly(0, 0, -46) {
+		t.Error("supplied field 45±2µT not used")
+	}
+	if err := mpu.SetExpectedMagField(-1, 0); err == nil {
+		t.Error("negative field accepted")
+	}
+}
+
+func TestExpectedField(t *testing.T) {
+	for _, tc := range []struct{ lat, want float64 }{{0, 30}, {90, 60}, {-90, 60}, {30, 30 * math.Sqrt(1.75)}} {
+		if got := ExpectedFieldStrength(tc.lat); math.Abs(got-tc.want) > tolerance {
+			t.Errorf("field at latitude %g is %g µT, expected %g", tc.lat, got, tc.want)
+		}
+	}
+
+	mpu := new(ICM20948)
+	if f := mpu.ExpectedField(); f != 0 {
+		t.Errorf("expected field %g with nothing known", f)
+	}
+	if err := mpu.SetLatitude(90); err != nil {
+		t.Fatal(err)
+	}
+	if field, tol := mpu.ExpectedMagField(); field != 60 || math.Abs(tol-18) > tolerance {
+		t.Errorf("model field %g±%g, expected 60±18", field, tol)
+	}
+	mpu.MagField = 50 // Learned during calibration, which takes precedence
+	if f := mpu.ExpectedField(); f != 50 {
+		t.Errorf("expected field %g, want the calibrated 50", f)
+	}
+	if err := mpu.SetExpectedField(45); err != nil {
+		t.Fatal(err)
+	}
+	if field, tol := mpu.ExpectedMagField(); field != 45 || math.Abs(tol-6.75) > tolerance {
+		t.Errorf("expected field %g±%g, want 45±6.75", field, tol)
+	}
+	if mpu.SetExpectedField(-1) == nil || mpu.SetExpectedField(math.NaN()) == nil || mpu.SetLatitude(91) == nil {
+		t.Error("invalid field or latitude accepted")
+	}
+}
+
+func TestMagNoiseModel(t *testing.T) {
+	mpu := new(ICM20948)
+	mpu.MagField, mpu.MagNoise = 50, 0.02 // Learned during calibration
+	if field, tol := mpu.ExpectedMagField(); field != 50 || math.Abs(tol-7.5) > tolerance {
+		t.Errorf("quiet calibration gave %g±%g, want the default 50±7.5", field, tol)
+	}
+	mpu.MagNoise = 0.1
+	if field, tol := mpu.ExpectedMagField(); field != 50 || math.Abs(tol-15) > tolerance {
+		t.Errorf("noisy calibration gave %g±%g, want 50±15", field, tol)
+	}
+	if mpu.magAnomaly(0, 0, 62) || !mpu.magAnomaly(0, 0, 66) {
+		t.Error("anomaly band not widened by the learned noise")
+	}
+
+	if err := mpu.SetMagNoiseModel(48, 3); err != nil {
+		t.Fatal(err)
+	}
+	if field, tol := mpu.ExpectedMagField(); field != 48 || tol != 3 {
+		t.Errorf("noise model %g±%g, want 48±3", field, tol)
+	}
+	if !mpu.magAnomaly(0, 0, 52) || mpu.magAnomaly(0, 0, 46) {
+		t.Error("supplied noise model not used for anomalies")
+	}
+	for _, v := range []float64{-1, math.NaN(), math.Inf(1)} {
+		if mpu.SetMagNoiseModel(v, 0) == nil || mpu.SetMagNoiseModel(50, v) == nil {
+			t.Errorf("noise model with %g accepted", v)
+		}
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_ACCEL_ZOUT_H: 0x40}}
+	mpu, err := NewWithBus(fb, WithSampleRate(100), WithStuckAxisCheck(0), WithBusTimeout(10*time.Millisecond),
+		WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	if err := mpu.SetWatchdog(200*time.Millisecond, true); err != nil {
+		t.Fatal(err)
+	}
+	<-mpu.C
+
+	// Stall the sensor reads; the register writes configure makes still go through, so the reset succeeds.
+	stall := make(chan bool)
+	fb.mu.Lock()
+	fb.stall = stall
+	fb.mu.Unlock()
+	select {
+	case err := <-mpu.Faults:
+		if !strings.Contains(err.Error(), "no sensor data") {
+			t.Errorf("fault %v, want no sensor data", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no watchdog fault after the sensor stalled")
+	}
+	for deadline := time.Now().Add(time.Second); mpu.Stats().Resets == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("watchdog didn't reset the sensor")
+		}
+	}
+	if s := mpu.Stats(); s.WatchdogFaults != 1 || s.Resets != 1 {
+		t.Errorf("%d watchdog faults, %d resets after one stall", s.WatchdogFaults, s.Resets)
+	}
+
+	// The watchdog is quiet again once data flows.
+	fb.mu.Lock()
+	fb.stall = nil
+	fb.mu.Unlock()
+	close(stall)
+	time.Sleep(500 * time.Millisecond)
+	if s := mpu.Stats(); s.WatchdogFaults != 1 {
+		t.Errorf("%d watchdog faults after the sensor recovered", s.WatchdogFaults)
+	}
+}
+
+func TestBusTimeout(t *testing.T) {
+	stall := make(chan bool)
+	defer close(stall)
+	var bus embd.I2CBus = &fakeBus{stall: stall}
+	mpu := &ICM20948{i2cbus: bus}
+	if err := mpu.SetBusTimeout(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := mpu.i2cRead2(ICMREG_GYRO_XOUT_H); !errors.Is(err, ErrBusTimeout) {
+		t.Errorf("stalled read returned %v, want a bus timeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("stalled read took %s", d)
+	}
+	if _, err := mpu.i2cRead(ICMREG_WHOAMI); err != nil {
+		t.Errorf("byte read failed: %v", err)
+	}
+	if n := mpu.Stats().BusTimeouts; n != 1 {
+		t.Errorf("%d bus timeouts counted, want 1", n)
+	}
+	if err := mpu.SetBusTimeout(-time.Second); err == nil {
+		t.Error("negative bus timeout accepted")
+	}
+}
+
+func TestDLPFBypass(t *testing.T) {
+	fb := &fakeBus{}
+	var bus embd.I2CBus = fb
+	mpu := &ICM20948{i2cbus: bus}
+	if err := mpu.SetGyroLPF(51); err != nil {
+		t.Fatal(err)
+	}
+	if err := mpu.SetGyroDLPFBypass(true); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := fb.regs[ICMREG_GYRO_CONFIG]; cfg != BITS_DLPF_GYRO_CFG_51HZ&^BITS_FCHOICE {
+		t.Errorf("GYRO_CONFIG 0x%02X with the DLPF bypassed", cfg)
+	}
+	// Reconfiguring the LPF, e.g. on Reset, keeps the bypass.
+	if err := mpu.SetGyroLPF(51); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := fb.regs[ICMREG_GYRO_CONFIG]; cfg&BITS_FCHOICE != 0 {
+		t.Errorf("GYRO_CONFIG 0x%02X: DLPF re-enabled by SetGyroLPF", cfg)
+	}
+	if err := mpu.SetGyroDLPFBypass(false); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := fb.regs[ICMREG_GYRO_CONFIG]; cfg != BITS_DLPF_GYRO_CFG_51HZ || mpu.gyroConfig != cfg {
+		t.Errorf("GYRO_CONFIG 0x%02X (expected by the config check 0x%02X) with the DLPF on", cfg, mpu.gyroConfig)
+	}
+
+	if err := mpu.SetAccelDLPFBypass(true); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := fb.regs[ICMREG_ACCEL_CONFIG]; cfg&BITS_FCHOICE != 0 {
+		t.Errorf("ACCEL_CONFIG 0x%02X with the DLPF bypassed", cfg)
+	}
+}
+
+// regWrite is a register write seen by writeLog, with the register bank it went to.
+type regWrite struct{ bank, reg, value byte }
+
+// writeLog is a fakeBus that also records the register writes made through it.  It isn't locked, so the writes
+// may only be looked at once the driver is closed.
+type writeLog struct {
+	*fakeBus
+	bank   byte
+	writes []regWrite
+}
+
+func (b *writeLog) WriteByteToReg(addr, reg, value byte) error {
+	if reg == ICMREG_BANK_SEL {
+		b.bank = value >> 4
+	}
+	b.writes = append(b.writes, regWrite{b.bank, reg, value})
+	return b.fakeBus.WriteByteToReg(addr, reg, value)
+}
+
+func TestConfigureRegisters(t *testing.T) {
+	// The bank 0 registers that moved from their MPU9250 addresses.
+	for _, tc := range []struct {
+		name      string
+		reg, want byte
+	}{
+		{"USER_CTRL", ICMREG_USER_CTRL, 0x03},
+		{"INT_PIN_CFG", ICMREG_INT_PIN_CFG, 0x0F},
+		{"PWR_MGMT_2", ICMREG_PWR_MGMT_2, 0x07},
+		{"WHO_AM_I", ICMREG_WHOAMI, 0x00},
+	} {
+		if tc.reg != tc.want {
+			t.Errorf("%s at 0x%02X, expected 0x%02X", tc.name, tc.reg, tc.want)
+		}
+	}
+
+	wl := &writeLog{fakeBus: &fakeBus{regs: map[byte]byte{ICMREG_I2C_MST_STATUS: BIT_I2C_SLV4_DONE}}}
+	var bus embd.I2CBus = wl
+	mpu, err := NewWithOptions(&bus, WithMagnetometer(true),
+		WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpu.CloseMPU()
+
+	var masterOn bool
+	for _, w := range wl.writes {
+		if w.bank != 0 {
+			continue
+		}
+		switch w.reg {
+		case 0x03: // USER_CTRL
+			masterOn = masterOn || w.value&BIT_AUX_IF_EN != 0
+		case 0x37, 0x6A, 0x6C: // INT_PIN_CFG, USER_CTRL and PWR_MGMT_2 on the MPU9250; unused on the ICM20948
+			t.Errorf("configure wrote 0x%02X to bank 0 register 0x%02X", w.value, w.reg)
+		}
+	}
+	if !masterOn {
+		t.Error("configure didn't turn on the I2C master for the magnetometer")
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_WHOAMI: ICM20948_WHOAMI, ICMREG_USER_CTRL: BIT_AUX_IF_EN}}
+	var bus embd.I2CBus = fb
+	mpu := &ICM20948{i2cbus: bus}
+	mpu.diagnose()
+	d := mpu.Diagnostics()
+	if d.WhoAmI != ICM20948_WHOAMI || !d.I2CMasterEnabled || !d.BypassDisabled || len(d.Problems) != 0 {
+		t.Errorf("healthy chip diagnosed as %+v", d)
+	}
+
+	// The fake bus has a single register map, so the aux device ID read from I2C_SLV4_DI is the DONE flag
+	// set in I2C_MST_STATUS at the same address.
+	fb.regs[ICMREG_WHOAMI] = 0x71
+	fb.regs[ICMREG_I2C_MST_STATUS] = BIT_I2C_SLV4_DONE
+	mpu.enableMag = true
+	mpu.diagnose()
+	d = mpu.Diagnostics()
+	if d.MagDetected || d.MagWhoAmI != BIT_I2C_SLV4_DONE || len(d.Problems) != 3 {
+		t.Errorf("wrong chip and magnetometer diagnosed as %+v", d)
+	}
+}
+
+func TestPause(t *testing.T) {
+	fb := &fakeBus{}
+	var bus embd.I2CBus = fb
+	mpu, err := NewICM20948(&bus, 250, 2, 50, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	wordReads := func() int {
+		fb.mu.Lock()
+		defer fb.mu.Unlock()
+		return fb.wordReads
+	}
+
+	mpu.Pause()
+	mpu.Pause()
+	if !mpu.Paused() {
+		t.Fatal("not Paused after Pause")
+	}
+	n := wordReads()
+	time.Sleep(100 * time.Millisecond)
+	if wordReads() != n {
+		t.Error("sensors read while paused")
+	}
+	select {
+	case <-mpu.C:
+	case <-time.After(time.Second):
+		t.Error("C not served while paused")
+	}
+
+	mpu.Resume()
+	time.Sleep(100 * time.Millisecond)
+	if mpu.Paused() || wordReads() == n {
+		t.Error("sensors not read after Resume")
+	}
+}
+
+func TestBufferPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy BufferPolicy
+		want   []uint64
+	}{
+		{DropOldest, []uint64{3, 4, 5}},
+		{DropNewest, []uint64{1, 2, 3}},
+	} {
+		mpu := &ICM20948{cBuf: make(chan *MPUData, 3)}
+		for seq := uint64(1); seq <= 5; seq++ {
+			mpu.buffer(&MPUData{Seq: seq}, tc.policy)
+		}
+		var got []uint64
+		for len(mpu.cBuf) > 0 {
+			got = append(got, (<-mpu.cBuf).Seq)
+		}
+		if !reflect.DeepEqual(got, tc.want) || mpu.Stats().BufDrops != 2 {
+			t.Errorf("policy %d kept samples %v with %d drops, expected %v with 2", tc.policy, got,
+				mpu.Stats().BufDrops, tc.want)
+		}
+	}
+
+	// With BlockProducer a full CBuf stalls readSensors, which CloseMPU must still stop.
+	mpu, err := NewWithBus(&fakeBus{regs: map[byte]byte{ICMREG_ACCEL_ZOUT_H: 0x40}}, WithSampleRate(1000),
+		WithWarmup(0, 0, 0), WithBufferPolicy(BlockProducer), WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mpu.CBuf) < cap(mpu.CBuf) {
+		if time.Now().After(deadline) {
+			t.Fatalf("CBuf only filled to %d of %d", len(mpu.CBuf), cap(mpu.CBuf))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := mpu.Stats().BufDrops; n != 0 {
+		t.Errorf("%d samples dropped with BlockProducer", n)
+	}
+	closed := make(chan struct{})
+	go func() {
+		mpu.CloseMPU()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("CloseMPU didn't stop readSensors blocked on a full CBuf")
+	}
+	for i := uint64(1); i <= bufSize; i++ {
+		if d := <-mpu.CBuf; d.Seq != i {
+			t.Fatalf("sample %d on CBuf has Seq %d", i, d.Seq)
+		}
+	}
+}
+
+func TestMPUDataImmutable(t *testing.T) {
+	var bus embd.I2CBus = &fakeBus{}
+	mpu, err := NewICM20948(&bus, 250, 2, 200, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+
+	// Hold on to the samples from C and CBuf while the loop keeps producing, and check they never change.
+	// Run with -race to also catch unsynchronized writes.
+	var (
+		received []*MPUData
+		values   []MPUData
+		bufSeqs  []uint64
+	)
+	deadline := time.After(200 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case d := <-mpu.C:
+			received, values = append(received, d), append(values, *d)
+		case d := <-mpu.CBuf:
+			received, values = append(received, d), append(values, *d)
+			bufSeqs = append(bufSeqs, d.Seq)
+		case <-deadline:
+			done = true
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	for i, d := range received {
+		if *d != values[i] {
+			t.Fatalf("sample modified after it was sent: %+v became %+v", values[i], *d)
+		}
+	}
+	if len(received) < 10 {
+		t.Errorf("only %d samples received", len(received))
+	}
+	// CBuf is drained promptly, so nothing is dropped and Seq has no gaps.
+	var last uint64
+	for _, seq := range bufSeqs {
+		if last > 0 && seq != last+1 {
+			t.Fatalf("Seq on CBuf went from %d to %d", last, seq)
+		}
+		last = seq
+	}
+	if n := mpu.Stats().Samples; n < last {
+		t.Errorf("%d samples in Stats, but received Seq %d", n, last)
+	}
+}
+
+func TestAccelDLPFConfig(t *testing.T) {
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_ACCEL_CONFIG: BITS_FS_8G}}
+	var bus embd.I2CBus = fb
+	mpu := &ICM20948{i2cbus: bus}
+
+	if err := mpu.SetAccelLPF(111); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := fb.regs[ICMREG_ACCEL_CONFIG]; cfg != BITS_DLPF_ACCEL_CFG_111HZ|BITS_FS_8G {
+		t.Errorf("ACCEL_CONFIG 0x%02X after SetAccelLPF(111)", cfg)
+	}
+	if err := mpu.SetAccelDLPFConfig(5); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := fb.regs[ICMREG_ACCEL_CONFIG]; cfg != 5<<3|BITS_FS_8G|BITS_FCHOICE {
+		t.Errorf("ACCEL_CONFIG 0x%02X after SetAccelDLPFConfig(5)", cfg)
+	}
+	if err := mpu.SetAccelDLPFConfig(8); err == nil {
+		t.Error("DLPF configuration 8 accepted")
+	}
+}
+
+func TestGyroLPF(t *testing.T) {
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_GYRO_CONFIG: BITS_FS_500DPS}}
+	var bus embd.I2CBus = fb
+	mpu := &ICM20948{i2cbus: bus}
+
+	// Changing the bandwidth replaces the DLPF setting rather than ORing the two, keeping the range.
+	for _, tc := range []struct {
+		rate byte
+		want byte
+	}{
+		{6, BITS_DLPF_GYRO_CFG_6HZ},
+		{51, BITS_DLPF_GYRO_CFG_51HZ},
+		{200, BITS_DLPF_GYRO_CFG_197HZ},
+		{12, BITS_DLPF_GYRO_CFG_12HZ},
+	} {
+		if err := mpu.SetGyroLPF(tc.rate); err != nil {
+			t.Fatal(err)
+		}
+		if cfg := fb.regs[ICMREG_GYRO_CONFIG]; cfg != tc.want|BITS_FS_500DPS || mpu.gyroConfig != cfg {
+			t.Errorf("GYRO_CONFIG 0x%02X, recorded as 0x%02X, after SetGyroLPF(%d)", cfg, mpu.gyroConfig, tc.rate)
+		}
+	}
+}
+
+func TestAveraging(t *testing.T) {
+	// The other bits of the registers must be kept.
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_GYRO_CONFIG_2: 0x38, ICMREG_ACCEL_CONFIG_2: 0x1C}}
+	var bus embd.I2CBus = fb
+	mpu := &ICM20948{i2cbus: bus}
+
+	for n, want := range map[int]byte{1: 0, 2: 1, 4: 2, 8: 3, 16: 4, 32: 5, 64: 6, 128: 7} {
+		if err := mpu.SetGyroAveraging(n); err != nil {
+			t.Fatal(err)
+		}
+		if cfg := fb.regs[ICMREG_GYRO_CONFIG_2]; cfg != 0x38|want {
+			t.Errorf("GYRO_CONFIG_2 0x%02X after SetGyroAveraging(%d)", cfg, n)
+		}
+	}
+	for n, want := range map[int]byte{1: 0, 4: 0, 8: 1, 16: 2, 32: 3} {
+		if err := mpu.SetAccelAveraging(n); err != nil {
+			t.Fatal(err)
+		}
+		if cfg := fb.regs[ICMREG_ACCEL_CONFIG_2]; cfg != 0x1C|want {
+			t.Errorf("ACCEL_CONFIG_2 0x%02X after SetAccelAveraging(%d)", cfg, n)
+		}
+	}
+
+	gyroCfg, accelCfg := fb.regs[ICMREG_GYRO_CONFIG_2], fb.regs[ICMREG_ACCEL_CONFIG_2]
+	for _, n := range []int{-1, 0, 3, 256} {
+		if err := mpu.SetGyroAveraging(n); err == nil {
+			t.Errorf("gyro averaging count %d accepted", n)
+		}
+	}
+	for _, n := range []int{0, 2, 64} {
+		if err := mpu.SetAccelAveraging(n); err == nil {
+			t.Errorf("accel averaging count %d accepted", n)
+		}
+	}
+	if fb.regs[ICMREG_GYRO_CONFIG_2] != gyroCfg || fb.regs[ICMREG_ACCEL_CONFIG_2] != accelCfg {
+		t.Error("invalid averaging count written")
+	}
+}
+
+func TestSetSensitivity(t *testing.T) {
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_GYRO_CONFIG: BITS_DLPF_GYRO_CFG_51HZ}}
+	var bus embd.I2CBus = fb
+	mpu := &ICM20948{i2cbus: bus}
+
+	if err := mpu.SetGyroSensitivity(500); err != nil {
+		t.Fatal(err)
+	}
+	mpu.G01 = 100
+	if err := mpu.SetGyroSensitivity(1000); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := fb.regs[ICMREG_GYRO_CONFIG]; cfg != BITS_DLPF_GYRO_CFG_51HZ|BITS_FS_1000DPS || mpu.gyroConfig != cfg {
+		t.Errorf("GYRO_CONFIG 0x%02X, recorded as 0x%02X, after SetGyroSensitivity(1000)", cfg, mpu.gyroConfig)
+	}
+	if mpu.sensitivityGyro != 1000 || mpu.G01 != 50 {
+		t.Errorf("sensitivity %d, bias %g after changing from 500 to 1000", mpu.sensitivityGyro, mpu.G01)
+	}
+
+	// An invalid range changes nothing.
+	scale := mpu.scaleGyro
+	if err := mpu.SetGyroSensitivity(300); err == nil {
+		t.Error("gyro sensitivity 300 accepted")
+	}
+	if cfg := fb.regs[ICMREG_GYRO_CONFIG]; cfg != BITS_DLPF_GYRO_CFG_51HZ|BITS_FS_1000DPS {
+		t.Errorf("GYRO_CONFIG 0x%02X after an invalid sensitivity", cfg)
+	}
+	if mpu.sensitivityGyro != 1000 || mpu.scaleGyro != scale || mpu.G01 != 50 {
+		t.Errorf("sensitivity %d, scale %g, bias %g after an invalid sensitivity", mpu.sensitivityGyro, mpu.scaleGyro,
+			mpu.G01)
+	}
+	if err := mpu.SetAccelSensitivity(3); err == nil || mpu.sensitivityAccel != 0 || mpu.scaleAccel != 0 {
+		t.Errorf("accel sensitivity 3 gave %v, sensitivity %d", err, mpu.sensitivityAccel)
+	}
+
+	// A failed register write leaves the scale and biases matching the range the chip is still on.
+	mpu.i2cbus = &failWrite{fb, ICMREG_GYRO_CONFIG}
+	if err := mpu.SetGyroSensitivity(2000); err == nil {
+		t.Error("SetGyroSensitivity succeeded with GYRO_CONFIG unwritable")
+	}
+	if mpu.sensitivityGyro != 1000 || mpu.scaleGyro != scale || mpu.G01 != 50 {
+		t.Errorf("sensitivity %d, scale %g, bias %g after a failed write", mpu.sensitivityGyro, mpu.scaleGyro, mpu.G01)
+	}
+	mpu.i2cbus = &failWrite{fb, ICMREG_ACCEL_CONFIG}
+	if err := mpu.SetAccelSensitivity(4); err == nil || mpu.sensitivityAccel != 0 || mpu.scaleAccel != 0 {
+		t.Errorf("accel sensitivity 4 with ACCEL_CONFIG unwritable gave %v, sensitivity %d", err, mpu.sensitivityAccel)
+	}
+}
+
+// failWrite is a fakeBus whose writes to one register fail.
+type failWrite struct {
+	*fakeBus
+	reg byte
+}
+
+func (b *failWrite) WriteByteToReg(addr, reg, value byte) error {
+	if reg == b.reg {
+		return errFakeBus
+	}
+	return b.fakeBus.WriteByteToReg(addr, reg, value)
+}
+
+func TestAutoRange(t *testing.T) {
+	// Accel Z reads 0x2800, 5G at 16G; gyro X reads 0x1333, 300°/s at 2000°/s.
+	fb := &fakeBus{regs: map[byte]byte{
+		ICMREG_ACCEL_ZOUT_H: 0x28,
+		ICMREG_GYRO_XOUT_H:  0x13, ICMREG_GYRO_XOUT_H + 1: 0x33,
+	}}
+	mpu, err := NewWithBus(fb, WithSampleRate(100), WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+
+	mpu.mu.Lock()
+	mpu.A03, mpu.G01 = 100, 100
+	accelBias, gyroBias := mpu.A03*mpu.scaleAccel, mpu.G01*mpu.scaleGyro
+	mpu.mu.Unlock()
+
+	// 8G is the tightest range with 5G under 80% of full scale; 500°/s is for 300°/s.
+	if r, err := mpu.AutoRange(100 * time.Millisecond); r != 8 || err != nil {
+		t.Errorf("AutoRange chose %dG, %v", r, err)
+	}
+	if r, err := mpu.AutoRangeGyro(100 * time.Millisecond); r != 500 || err != nil {
+		t.Errorf("AutoRangeGyro chose %d°/s, %v", r, err)
+	}
+	if c, err := mpu.Configuration(); err != nil || c.AccelSensitivity != 8 || c.GyroSensitivity != 500 {
+		t.Errorf("chip set to %dG, %d°/s after auto-ranging (%v)", c.AccelSensitivity, c.GyroSensitivity, err)
+	}
+
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	if a := mpu.A03 * mpu.scaleAccel; math.Abs(a-accelBias) > 1e-9 {
+		t.Errorf("accel bias %gG after auto-ranging, was %gG", a, accelBias)
+	}
+	if g := mpu.G01 * mpu.scaleGyro; math.Abs(g-gyroBias) > 1e-9 {
+		t.Errorf("gyro bias %g°/s after auto-ranging, was %g°/s", g, gyroBias)
+	}
+}
+
+func TestReadInterruptStatus(t *testing.T) {
+	fb := &fakeBus{regs: make(map[byte]byte)}
+	var bus embd.I2CBus = fb
+	mpu := &ICM20948{i2cbus: bus}
+
+	for _, tc := range []struct {
+		reg, v byte
+		want   InterruptStatus
+	}{
+		{ICMREG_INT_STATUS, 0x01, InterruptStatus{I2CMaster: true}},
+		{ICMREG_INT_STATUS, 0x02, InterruptStatus{DMP: true}},
+		{ICMREG_INT_STATUS, 0x04, InterruptStatus{PLLReady: true}},
+		{ICMREG_INT_STATUS, 0x08, InterruptStatus{WakeOnMotion: true}},
+		{ICMREG_INT_STATUS_1, 0x01, InterruptStatus{DataReady: true}},
+		{ICMREG_INT_STATUS_2, 0x01, InterruptStatus{FIFOOverflow: true}},
+		{ICMREG_INT_STATUS_3, 0x10, InterruptStatus{FIFOWatermark: true}},
+	} {
+		fb.regs = map[byte]byte{tc.reg: tc.v}
+		st, err := mpu.ReadInterruptStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st != tc.want {
+			t.Errorf("register 0x%02X = 0x%02X decoded as %+v, expected %+v", tc.reg, tc.v, st, tc.want)
+		}
+	}
+}
+
+func TestSetI2CMasterODR(t *testing.T) {
+	fb := &fakeBus{regs: make(map[byte]byte)}
+	var bus embd.I2CBus = fb
+	mpu := &ICM20948{i2cbus: bus}
+
+	for _, tc := range []struct {
+		hz   int
+		want byte // I2C_MST_ODR_CONFIG: 1100/2^want Hz, the slowest rate at least hz
+	}{
+		{1100, 0}, {1000, 0}, {551, 0}, {550, 1}, {100, 3}, {69, 3}, {68, 4}, {10, 6}, {2, 9}, {1, 10},
+	} {
+		if err := mpu.SetI2CMasterODR(tc.hz); err != nil {
+			t.Fatal(err)
+		}
+		if r := fb.regs[ICMREG_I2C_MST_ODR_CONFIG]; r != tc.want {
+			t.Errorf("I2C_MST_ODR_CONFIG 0x%02X for %d Hz, expected 0x%02X", r, tc.hz, tc.want)
+		}
+		if odr := 1100 / float64(int(1)<<tc.want); mpu.i2cMasterODR != odr {
+			t.Errorf("I2C master rate %g Hz for %d Hz, expected %g", mpu.i2cMasterODR, tc.hz, odr)
+		}
+	}
+
+	for _, hz := range []int{-1, 0, 1101} {
+		if err := mpu.SetI2CMasterODR(hz); err == nil {
+			t.Errorf("I2C master rate %d Hz accepted", hz)
+		}
+	}
+	if r := fb.regs[ICMREG_I2C_MST_ODR_CONFIG]; r != 10 {
+		t.Errorf("I2C_MST_ODR_CONFIG 0x%02X after invalid rates", r)
+	}
+}
+
+func TestMagSensitivity(t *testing.T) {
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_I2C_MST_STATUS: BIT_I2C_SLV4_DONE}}
+	fb.onRead = func(reg, v byte) byte {
+		switch reg {
+		case ICMREG_EXT_SENS_DATA_00:
+			return AK09916_ST1_DRDY
+		case ICMREG_EXT_SENS_DATA_00 + 8:
+			return 0
+		}
+		return v
+	}
+	mpu, err := NewWithBus(fb, WithMagnetometer(true), WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	if x, y, z, model := mpu.MagSensitivity(); x != scaleMagAK09916 || y != scaleMagAK09916 ||
+		z != scaleMagAK09916 || model != "AK09916" {
+		t.Errorf("AK09916 sensitivity %g, %g, %g, model %q", x, y, z, model)
+	}
+
+	// The AK8963 scale is adjusted by the fuse ROM: (ASA+128)/256.
+	var bus embd.I2CBus = &fakeBus{regs: map[byte]byte{AK8963_ASAX: 0x80, AK8963_ASAY: 0xA0, AK8963_ASAZ: 0x60}}
+	mpu = &ICM20948{i2cbus: bus}
+	if _, _, _, model := mpu.MagSensitivity(); model != "" {
+		t.Errorf("model %q before the magnetometer was set up", model)
+	}
+	if err := mpu.ReadMagCalibration(); err != nil {
+		t.Fatal(err)
+	}
+	if x, y, z, model := mpu.MagSensitivity(); x != scaleMagAK8963 || y != 1.125*scaleMagAK8963 ||
+		z != 0.875*scaleMagAK8963 || model != "AK8963" {
+		t.Errorf("AK8963 sensitivity %g, %g, %g, model %q", x, y, z, model)
+	}
+}
+
+func TestMagSingleMeasurement(t *testing.T) {
+	var bus embd.I2CBus = &fakeBus{}
+	if err := (&ICM20948{i2cbus: bus}).SetMagSingleMeasurement(true); err == nil {
+		t.Error("single-measurement mode accepted without a magnetometer")
+	}
+
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_I2C_MST_STATUS: BIT_I2C_SLV4_DONE, ICMREG_ACCEL_ZOUT_H: 0x40}}
+	fb.onRead = func(reg, v byte) byte {
+		switch reg {
+		case ICMREG_EXT_SENS_DATA_00:
+			return AK09916_ST1_DRDY
+		case ICMREG_EXT_SENS_DATA_00 + 8:
+			return 0
+		}
+		return v
+	}
+	wl := &writeLog{fakeBus: fb}
+	mpu, err := NewWithBus(wl, WithSampleRate(100), WithMagnetometer(true),
+		WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	if err := mpu.SetMagSingleMeasurement(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// readSensors triggers each measurement and reads it on a later magnetometer tick.
+	reads := mpu.Stats().MagReadCount
+	for deadline := time.Now().Add(2 * time.Second); mpu.Stats().MagReadCount < reads+3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d magnetometer reads in single-measurement mode", mpu.Stats().MagReadCount-reads)
+		}
+	}
+	mpu.CloseMPU()
+
+	// Slave 1 stops writing the continuous mode, the AK09916 is powered down and then measurements are triggered
+	// through Slave 4.
+	var slv1Off, poweredDown bool
+	var triggers int
+	for _, w := range wl.writes {
+		switch {
+		case w.bank == 3 && w.reg == ICMREG_I2C_SLV1_CTRL:
+			if slv1Off = w.value == 0; !slv1Off && poweredDown {
+				t.Errorf("Slave 1 re-enabled (0x%02X) in single-measurement mode", w.value)
+			}
+		case w.bank == 3 && w.reg == ICMREG_I2C_SLV1_DO && slv1Off:
+			t.Errorf("AK09916 mode 0x%02X written by Slave 1 in single-measurement mode", w.value)
+		case w.bank == 3 && w.reg == ICMREG_I2C_SLV4_DO && slv1Off:
+			switch w.value {
+			case AK09916_MODE_POWER_DOWN:
+				poweredDown = true
+			case AK09916_MODE_SINGLE:
+				if !poweredDown {
+					t.Error("single measurement triggered before the AK09916 was powered down")
+				}
+				triggers++
+			}
+		}
+	}
+	if !slv1Off || !poweredDown || triggers < 3 {
+		t.Errorf("Slave 1 disabled %t, AK09916 powered down %t, %d measurements triggered", slv1Off, poweredDown,
+			triggers)
+	}
+}
+
+func TestI2CRead2ByteOrder(t *testing.T) {
+	fb := &fakeBus{regs: map[byte]byte{
+		ICMREG_GYRO_XOUT_H: 0xFF, ICMREG_GYRO_XOUT_H + 1: 0x38, // Big-endian -200
+		ICMREG_EXT_SENS_DATA_01: 0x38, ICMREG_EXT_SENS_DATA_01 + 1: 0xFF, // AK09916 little-endian -200
+		ICMREG_ACCEL_XOUT_H: 0x12, ICMREG_ACCEL_XOUT_H + 1: 0x34,
+	}}
+	var bus embd.I2CBus = fb
+	mpu := &ICM20948{i2cbus: bus}
+
+	for _, tc := range []struct {
+		read func(byte) (int16, error)
+		reg  byte
+		want int16
+	}{
+		{mpu.i2cRead2, ICMREG_GYRO_XOUT_H, -200},
+		{mpu.i2cRead2, ICMREG_ACCEL_XOUT_H, 0x1234},
+		{mpu.i2cRead2LE, ICMREG_EXT_SENS_DATA_01, -200},
+	} {
+		if v, err := tc.read(tc.reg); err != nil || v != tc.want {
+			t.Errorf("register 0x%02X read as %d (%v), want %d", tc.reg, v, err, tc.want)
+		}
+	}
+}
+
+func TestMagResync(t *testing.T) {
+	// Slave 4 transactions complete at once; the fake bus shares I2C_MST_STATUS with I2C_SLV4_DI.
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_USER_CTRL: BIT_AUX_IF_EN, ICMREG_I2C_MST_STATUS: BIT_I2C_SLV4_DONE}}
+	var bus embd.I2CBus = fb
+	mpu := &ICM20948{i2cbus: bus, enableMag: true, sampleRate: 100}
+	if err := mpu.SetMagResync(-1); err == nil {
+		t.Error("negative resync failures accepted")
+	}
+
+	mpu.resyncMag(defaultMagResyncFailures, false)
+	if n := mpu.Stats().MagResyncs; n != 1 {
+		t.Errorf("%d resyncs counted, expected 1", n)
+	}
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	if fb.regs[ICMREG_I2C_SLV0_REG] != AK09916_ST1 || fb.regs[ICMREG_I2C_SLV0_CTRL] != BIT_SLAVE_EN|9 {
+		t.Errorf("Slave 0 not re-armed: REG 0x%02X, CTRL 0x%02X",
+			fb.regs[ICMREG_I2C_SLV0_REG], fb.regs[ICMREG_I2C_SLV0_CTRL])
+	}
+	if fb.regs[ICMREG_I2C_SLV1_CTRL] != BIT_SLAVE_EN|1 {
+		t.Errorf("Slave 1 not re-enabled: CTRL 0x%02X", fb.regs[ICMREG_I2C_SLV1_CTRL])
+	}
+	if mode, _ := ak09916Mode(100); fb.regs[ICMREG_I2C_SLV1_DO] != mode {
+		t.Errorf("AK09916 mode 0x%02X, expected 0x%02X", fb.regs[ICMREG_I2C_SLV1_DO], mode)
+	}
+}
+
+func TestScan(t *testing.T) {
+	// The fake bus answers on every address, with the same registers.
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_WHOAMI: ICM20948_WHOAMI, AK09916_WIA2: 0x42}}
+	devices := ScanDevices(fb)
+	if len(devices) != 3 {
+		t.Fatalf("found %d devices, expected 3", len(devices))
+	}
+	for i, expected := range []ScannedDevice{
+		{MPU_ADDRESS, ICM20948_WHOAMI, "ICM20948"},
+		{MPU_ADDRESS + 1, ICM20948_WHOAMI, "ICM20948"},
+		{AK09916_I2C_ADDR, 0x42, ""},
+	} {
+		if devices[i] != expected {
+			t.Errorf("device %d is %+v, expected %+v", i, devices[i], expected)
+		}
+	}
+	if addrs := Scan(fb); !bytes.Equal(addrs, []byte{MPU_ADDRESS, MPU_ADDRESS + 1, AK09916_I2C_ADDR}) {
+		t.Errorf("Scan returned % X", addrs)
+	}
+	if len(fb.regs) != 2 {
+		t.Error("Scan wrote to the bus")
+	}
+
+	fb.fail = true
+	if addrs := Scan(fb); len(addrs) != 0 {
+		t.Errorf("Scan of an empty bus returned % X", addrs)
+	}
+}
+
+func TestFitLine(t *testing.T) {
+	temps := []float64{20, 25, 30, 35}
+	bias := []float64{1.2, 1.0, 0.8, 0.6}
+	slope, b, ref := fitLine(temps, bias)
+	if math.Abs(slope+0.04) > tolerance || math.Abs(b-0.9) > tolerance || math.Abs(ref-27.5) > tolerance {
+		t.Errorf("fitLine gave slope %g, bias %g at %g°C, expected -0.04, 0.9 at 27.5°C", slope, b, ref)
+	}
+}
+
+func TestTempStable(t *testing.T) {
+	t0 := time.Now()
+	var times []time.Time
+	for i := 0; i < 7; i++ {
+		times = append(times, t0.Add(time.Duration(i)*time.Minute))
+	}
+	if tempStable(times[:3], []float64{20, 20, 20}, 5*time.Minute, 0.2) {
+		t.Error("stable before the stable time")
+	}
+	if !tempStable(times, []float64{15, 20, 20.1, 20.1, 20.1, 20.15, 20.1}, 5*time.Minute, 0.2) {
+		t.Error("not stable after settling")
+	}
+	if tempStable(times, []float64{15, 16, 17, 18, 19, 20, 21}, 5*time.Minute, 0.2) {
+		t.Error("stable while warming")
+	}
+}
+
+func TestCalibrateGyroTemperatureRamp(t *testing.T) {
+	var bus embd.I2CBus = &fakeBus{}
+	mpu, err := NewICM20948(&bus, 250, 2, 50, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+
+	path := filepath.Join(t.TempDir(), "ramp.csv")
+	res, err := mpu.CalibrateGyroTemperatureRamp(path, TempRampConfig{
+		Interval: 50 * time.Millisecond, StableTime: 200 * time.Millisecond, Timeout: 5 * time.Second, Fit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fake die temperature is constant, so the ramp stops at once and there is nothing to fit.
+	if !res.Stable || res.Rows < 5 || res.Fitted {
+		t.Errorf("ramp result %+v", res)
+	}
+	data, err := readMPUDataCSV(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != res.Rows {
+		t.Errorf("%d rows logged, expected %d", len(data), res.Rows)
+	}
+}
+
+func TestSetAccelSampleRate(t *testing.T) {
+	fb := &fakeBus{}
+	var bus embd.I2CBus = fb
+	mpu := &ICM20948{i2cbus: bus}
+	for _, tc := range []struct {
+		hz         int
+		div1, div2 byte
+	}{
+		{1, 0x04, 0x64}, // Divider 1124
+		{4, 0x01, 0x18}, // Divider 280
+		{100, 0x00, 0x0A},
+	} {
+		if err := mpu.SetAccelSampleRate(tc.hz); err != nil {
+			t.Fatal(err)
+		}
+		if div1, div2 := fb.regs[ICMREG_ACCEL_SMPLRT_DIV_1], fb.regs[ICMREG_ACCEL_SMPLRT_DIV_2]; div1 != tc.div1 || div2 != tc.div2 {
+			t.Errorf("%d Hz set divider 0x%02X%02X, expected 0x%02X%02X", tc.hz, div1, div2, tc.div1, tc.div2)
+		}
+	}
+}
+
+func TestFIFO(t *testing.T) {
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_FIFO_COUNTH: 0xE3, ICMREG_FIFO_COUNTL: 0x45, ICMREG_INT_STATUS_2: 0x01}}
+	var bus embd.I2CBus = fb
+	mpu := &ICM20948{i2cbus: bus}
+	if n, err := mpu.FIFOCount(); err != nil || n != 0x345 {
+		t.Errorf("FIFOCount returned 0x%X, %v, expected 0x345", n, err)
+	}
+	if overflow, err := mpu.FIFOOverflow(); err != nil || !overflow {
+		t.Errorf("FIFOOverflow returned %v, %v, expected true", overflow, err)
+	}
+
+	fb.regs = nil
+	if n, _ := mpu.FIFOCount(); n != 0 {
+		t.Errorf("FIFOCount of an unused FIFO is %d", n)
+	}
+	if overflow, _ := mpu.FIFOOverflow(); overflow {
+		t.Error("unused FIFO overflowed")
+	}
+}
+
+func TestSleep(t *testing.T) {
+	fb := &fakeBus{}
+	var bus embd.I2CBus = fb
+	mpu, err := NewICM20948(&bus, 250, 2, 50, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	reg := func(r byte) byte {
+		fb.mu.Lock()
+		defer fb.mu.Unlock()
+		return fb.regs[r]
+	}
+
+	if err := mpu.Sleep(true); err != nil {
+		t.Fatal(err)
+	}
+	if !mpu.Asleep() || !mpu.Paused() {
+		t.Error("not asleep and paused after Sleep")
+	}
+	if reg(ICMREG_PWR_MGMT_1)&BIT_SLEEP == 0 || reg(ICMREG_PWR_MGMT_2) != BITS_DISABLE_ACCEL|BITS_DISABLE_GYRO {
+		t.Errorf("PWR_MGMT_1 0x%02X, PWR_MGMT_2 0x%02X after Sleep", reg(ICMREG_PWR_MGMT_1), reg(ICMREG_PWR_MGMT_2))
+	}
+
+	if err := mpu.Wake(); err != nil {
+		t.Fatal(err)
+	}
+	if mpu.Asleep() || mpu.Paused() {
+		t.Error("still asleep or paused after Wake")
+	}
+	if reg(ICMREG_PWR_MGMT_1)&BIT_SLEEP != 0 || reg(ICMREG_PWR_MGMT_2) != 0 {
+		t.Errorf("PWR_MGMT_1 0x%02X, PWR_MGMT_2 0x%02X after Wake", reg(ICMREG_PWR_MGMT_1), reg(ICMREG_PWR_MGMT_2))
+	}
+
+	// Reads paused before Sleep stay paused after Wake.
+	mpu.Pause()
+	if err := mpu.Sleep(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := mpu.Wake(); err != nil {
+		t.Fatal(err)
+	}
+	if !mpu.Paused() {
+		t.Error("Wake resumed reads paused before Sleep")
+	}
+}
+
+func TestMagStatus(t *testing.T) {
+	mpu := &ICM20948{magST1: AK09916_ST1_DRDY | AK09916_ST1_DOR, magST2: AK09916_ST2_HOFL}
+	if st1, st2 := mpu.MagStatus(); st1 != 0x03 || st2 != 0x08 {
+		t.Errorf("MagStatus returned 0x%02X, 0x%02X", st1, st2)
+	}
+	if ready, overrun, overflow := mpu.MagStatusFlags(); !ready || !overrun || !overflow {
+		t.Errorf("MagStatusFlags returned %v, %v, %v, expected all true", ready, overrun, overflow)
+	}
+	mpu.magST1, mpu.magST2 = 0, 0
+	if ready, overrun, overflow := mpu.MagStatusFlags(); ready || overrun || overflow {
+		t.Errorf("MagStatusFlags returned %v, %v, %v, expected all false", ready, overrun, overflow)
+	}
+}
+
+func TestMagAverageCounts(t *testing.T) {
+	// The accel/gyro run at 100 Hz and the magnetometer, polled at 100 Hz, has new data on every 10th poll.
+	var st1Reads int
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_I2C_MST_STATUS: BIT_I2C_SLV4_DONE}}
+	fb.onRead = func(reg, v byte) byte {
+		switch reg {
+		case ICMREG_EXT_SENS_DATA_00:
+			st1Reads++
+			if st1Reads%10 == 0 {
+				return AK09916_ST1_DRDY
+			}
+			return 0
+		case ICMREG_EXT_SENS_DATA_00 + 8:
+			return 0
+		}
+		return v
+	}
+	var bus embd.I2CBus = fb
+	mpu, err := NewWithOptions(&bus, WithSampleRate(100), WithMagnetometer(true),
+		WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	fb.mu.Lock()
+	fb.regs[ICMREG_EXT_SENS_DATA_01], fb.regs[ICMREG_EXT_SENS_DATA_01+1] = 100, 0
+	fb.regs[ICMREG_EXT_SENS_DATA_03], fb.regs[ICMREG_EXT_SENS_DATA_03+1] = 0x38, 0xFF // -200
+	fb.regs[ICMREG_EXT_SENS_DATA_05], fb.regs[ICMREG_EXT_SENS_DATA_05+1] = 0x2C, 0x01 // 300
+	fb.mu.Unlock()
+
+	time.Sleep(200 * time.Millisecond) // Let the new values be read
+	mpu.AverageSince(true)
+	time.Sleep(time.Second)
+	d := mpu.AverageSince(false)
+	if d.N < 80 || d.N > 120 || d.NM < 7 || d.NM > 13 {
+		t.Errorf("averaged %d accel/gyro and %d mag samples, expected about 100 and 10", d.N, d.NM)
+	}
+	if d.DTM < 800*time.Millisecond || d.DTM > 1200*time.Millisecond {
+		t.Errorf("mag window DTM %s, expected about 1s", d.DTM)
+	}
+	if st := mpu.Stats(); st.MagReadCount == 0 || st.MagNotReadyCount < 5*st.MagReadCount || st.AccelReadCount < 100 {
+		t.Errorf("counted %d mag reads, %d not ready and %d accel reads, expected about 9 times as many not ready",
+			st.MagReadCount, st.MagNotReadyCount, st.AccelReadCount)
+	}
+	mpu.mu.Lock()
+	m1, m2, m3 := mpu.calibrateMag(100, -200, 300)
+	mpu.mu.Unlock()
+	if math.Abs(d.M1-m1) > tolerance || math.Abs(d.M2-m2) > tolerance || math.Abs(d.M3-m3) > tolerance {
+		t.Errorf("mag average %g, %g, %g, expected %g, %g, %g", d.M1, d.M2, d.M3, m1, m2, m3)
+	}
+}
+
+func TestAxisMap(t *testing.T) {
+	for _, name := range []string{"sparkfun", "Adafruit", "waveshare-ned"} {
+		m, ok := DetectBoard(name)
+		if !ok {
+			t.Errorf("DetectBoard(%q) didn't find the board", name)
+		}
+		if err := m.validate(); err != nil {
+			t.Errorf("preset %q: %s", name, err)
+		}
+	}
+	if m, ok := DetectBoard("unknown"); ok || m != IdentityAxisMap {
+		t.Errorf("DetectBoard of an unknown board returned %v, %v, expected the identity and false", m, ok)
+	}
+	if err := (AxisMap{{1, 0, 0}, {0, 1, 0}, {0, 0, -1}}).validate(); err == nil {
+		t.Error("a reflection was accepted as an axis map")
+	}
+	if err := (AxisMap{{1, 0, 0}, {0, 2, 0}, {0, 0, 1}}).validate(); err == nil {
+		t.Error("a scaling was accepted as an axis map")
+	}
+
+	// The Adafruit board has the chip's Y axis to the nose and X to the right wing; NED then has X to the right.
+	mpu := new(ICM20948)
+	WithBoardPreset("adafruit-ned")(mpu)
+	d := MPUData{G1: 1, G2: 2, G3: 3, A1: 0, A2: 0.5, A3: 1, M1: 10, M2: 20, M3: 30}
+	mpu.remap(&d)
+	if d.G1 != 2 || d.G2 != 1 || d.G3 != -3 {
+		t.Errorf("gyro remapped to %g, %g, %g, expected 2, 1, -3", d.G1, d.G2, d.G3)
+	}
+	if d.A1 != 0.5 || d.A2 != 0 || d.A3 != -1 {
+		t.Errorf("accel remapped to %g, %g, %g, expected 0.5, 0, -1", d.A1, d.A2, d.A3)
+	}
+	// The magnetometer is first turned into the accel axes: 10, -20, -30.
+	if d.M1 != -20 || d.M2 != 10 || d.M3 != 30 {
+		t.Errorf("mag remapped to %g, %g, %g, expected -20, 10, 30", d.M1, d.M2, d.M3)
+	}
+	if a1, a2, a3 := mpu.toChipAxes(d.A1, d.A2, d.A3); a1 != 0 || a2 != 0.5 || a3 != 1 {
+		t.Errorf("accel rotated back to %g, %g, %g, expected 0, 0.5, 1", a1, a2, a3)
+	}
+
+	WithBoardPreset("unknown")(mpu)
+	if mpu.axisMap != nil {
+		t.Error("an unknown board preset set an axis map")
+	}
+	var bus embd.I2CBus = &fakeBus{}
+	if _, err := NewWithOptions(&bus, WithAxisMap(AxisMap{{0, 1, 0}, {1, 0, 0}, {0, 0, 1}}),
+		WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json"))); err == nil {
+		t.Error("NewWithOptions accepted a reflection as an axis map")
+	}
+}
+
+func TestLogThrottle(t *testing.T) {
+	l := logThrottle{first: 3, every: 10}
+	var logged []uint64
+	for i := uint64(1); i <= 30; i++ {
+		if l.allow(i) {
+			logged = append(logged, i)
+		}
+	}
+	if !reflect.DeepEqual(logged, []uint64{1, 2, 3, 10, 20, 30}) {
+		t.Errorf("logged %v, expected 1, 2, 3, 10, 20, 30", logged)
+	}
+	if (logThrottle{first: 1}).allow(2) {
+		t.Error("logged after the first with every 0")
+	}
+}
+
+func TestMagCalResidual(t *testing.T) {
+	// Points spread evenly over a sphere of 50 µT, optionally off center.
+	sphere := func(n int, r float64, off [3]float64) [][3]float64 {
+		points := make([][3]float64, n)
+		for i := range points {
+			z := 1 - (2*float64(i)+1)/float64(n)
+			az := float64(i) * math.Pi * (3 - math.Sqrt(5))
+			h := math.Sqrt(1 - z*z)
+			points[i] = [3]float64{r*h*math.Cos(az) + off[0], r*h*math.Sin(az) + off[1], r*z + off[2]}
+		}
+		return points
+	}
+
+	for _, field := range []float64{50, 0} {
+		ok, resid, err := magCalResidual(sphere(100, 50, [3]float64{}), field, 0.05)
+		if err != nil || !ok || resid > 1e-3 {
+			t.Errorf("field %g: good calibration gave %v, %g, %v", field, ok, resid, err)
+		}
+	}
+	if ok, resid, err := magCalResidual(sphere(100, 50, [3]float64{}), 40, 0.05); err != nil || ok || math.Abs(resid-0.25) > 1e-3 {
+		t.Errorf("wrong field gave %v, %g, %v, expected a residual of 0.25", ok, resid, err)
+	}
+	if ok, resid, err := magCalResidual(sphere(100, 50, [3]float64{10, 0, 0}), 50, 0.05); err != nil || ok || resid < 0.1 {
+		t.Errorf("new hard-iron offset gave %v, %g, %v, expected a residual above 0.1", ok, resid, err)
+	}
+	if _, _, err := magCalResidual(sphere(10, 50, [3]float64{}), 50, 0.05); err == nil {
+		t.Error("too few points were accepted")
+	}
+	if _, _, err := magCalResidual(sphere(100, 50, [3]float64{})[:50], 50, 0.05); err == nil {
+		t.Error("points from one hemisphere were accepted")
+	}
+}
+
+func TestAuxTransactions(t *testing.T) {
+	// I2C_MST_STATUS in bank 0 and I2C_SLV4_DI in bank 3 share an address, and so the fake bus register.
+	var status byte
+	fb := &fakeBus{regs: make(map[byte]byte)}
+	fb.onRead = func(reg, v byte) byte {
+		if reg != ICMREG_I2C_MST_STATUS {
+			return v
+		}
+		if fb.regs[ICMREG_BANK_SEL] == 3<<4 {
+			return 0x5A // Slave 4 data
+		}
+		return status
+	}
+	var bus embd.I2CBus = fb
+	mpu := &ICM20948{i2cbus: bus}
+
+	status = BIT_I2C_SLV4_DONE
+	data, err := mpu.AuxRead(0x0C, 0x01, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte{0x5A, 0x5A}) {
+		t.Errorf("read % x, expected 5a 5a", data)
+	}
+	if fb.regs[ICMREG_USER_CTRL]&BIT_AUX_IF_EN == 0 {
+		t.Error("I2C master not enabled")
+	}
+	if fb.regs[ICMREG_I2C_SLV4_ADDR] != BIT_I2C_READ|0x0C || fb.regs[ICMREG_I2C_SLV4_REG] != 0x02 ||
+		fb.regs[ICMREG_I2C_SLV4_CTRL] != BIT_SLAVE_EN {
+		t.Errorf("last read set up as SLV4_ADDR 0x%02X, SLV4_REG 0x%02X, SLV4_CTRL 0x%02X",
+			fb.regs[ICMREG_I2C_SLV4_ADDR], fb.regs[ICMREG_I2C_SLV4_REG], fb.regs[ICMREG_I2C_SLV4_CTRL])
+	}
+	if err := mpu.AuxWrite(0x0C, 0x31, 0x08); err != nil {
+		t.Fatal(err)
+	}
+	if fb.regs[ICMREG_I2C_SLV4_ADDR] != 0x0C || fb.regs[ICMREG_I2C_SLV4_REG] != 0x31 ||
+		fb.regs[ICMREG_I2C_SLV4_DO] != 0x08 {
+		t.Errorf("write set up as SLV4_ADDR 0x%02X, SLV4_REG 0x%02X, SLV4_DO 0x%02X",
+			fb.regs[ICMREG_I2C_SLV4_ADDR], fb.regs[ICMREG_I2C_SLV4_REG], fb.regs[ICMREG_I2C_SLV4_DO])
+	}
+	if fb.regs[ICMREG_BANK_SEL] != 0 {
+		t.Errorf("left on register bank %d", fb.regs[ICMREG_BANK_SEL]>>4)
+	}
+	if _, err := mpu.AuxRead(0x0C, 0x01, 0); err == nil {
+		t.Error("read of 0 bytes accepted")
+	}
+
+	status = BIT_I2C_SLV4_NACK
+	if _, err := mpu.AuxRead(0x0D, 0x00, 1); err == nil || !strings.Contains(err.Error(), "acknowledge") {
+		t.Errorf("NACK gave %v", err)
+	}
+	if err := mpu.AuxWrite(0x0D, 0x00, 0); err == nil || !strings.Contains(err.Error(), "acknowledge") {
+		t.Errorf("NACK gave %v", err)
+	}
+
+	status = 0
+	start := time.Now()
+	if _, err := mpu.AuxRead(0x0C, 0x01, 1); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("transaction that never finished gave %v", err)
+	}
+	if d := time.Since(start); d < auxTimeout {
+		t.Errorf("timed out after %s, expected at least %s", d, auxTimeout)
+	}
+	if fb.regs[ICMREG_BANK_SEL] != 0 {
+		t.Errorf("left on register bank %d after a timeout", fb.regs[ICMREG_BANK_SEL]>>4)
+	}
+}
+
+func TestAuxSlaves(t *testing.T) {
+	var slaves [numAuxSlaves]auxSlave
+	slaves[2], slaves[3] = auxSlave{n: 6}, auxSlave{n: 3}
+	if offsets, total := auxOffsets(slaves, true); offsets != [4]int{0, 9, 9, 15} || total != 18 {
+		t.Errorf("with the mag, offsets %v and total %d, expected [0 9 9 15] and 18", offsets, total)
+	}
+	if offsets, total := auxOffsets(slaves, false); offsets != [4]int{0, 0, 0, 6} || total != 9 {
+		t.Errorf("without the mag, offsets %v and total %d, expected [0 0 0 6] and 9", offsets, total)
+	}
+
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_I2C_MST_STATUS: BIT_I2C_SLV4_DONE}}
+	var bus embd.I2CBus = fb
+	mpu, err := NewWithOptions(&bus, WithSampleRate(100), WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+
+	if used, total := mpu.AuxDataBudget(); used != 0 || total != 24 {
+		t.Errorf("EXT_SENS_DATA budget %d of %d before any slave, expected 0 of 24", used, total)
+	}
+	if err := mpu.ConfigureAuxSlave(4, 0x77, 0xF7, 6); err == nil {
+		t.Error("aux slave 4 was accepted")
+	}
+	if err := mpu.ConfigureAuxSlave(2, 0x77, 0xF7, 16); err == nil {
+		t.Error("a 16-byte aux read was accepted")
+	}
+	if err := mpu.ConfigureAuxSlave(2, 0x77, 0xF7, 6); err != nil {
+		t.Fatal(err)
+	}
+	fb.mu.Lock()
+	if fb.regs[ICMREG_I2C_SLV2_ADDR] != BIT_I2C_READ|0x77 || fb.regs[ICMREG_I2C_SLV2_REG] != 0xF7 ||
+		fb.regs[ICMREG_I2C_SLV2_CTRL] != BIT_SLAVE_EN|6 {
+		t.Errorf("slave 2 set to %02X, %02X, %02X", fb.regs[ICMREG_I2C_SLV2_ADDR], fb.regs[ICMREG_I2C_SLV2_REG],
+			fb.regs[ICMREG_I2C_SLV2_CTRL])
+	}
+	for i := byte(0); i < 6; i++ {
+		fb.regs[ICMREG_EXT_SENS_DATA_00+i] = 10 + i
+	}
+	fb.mu.Unlock()
+
+	got := make(chan []byte, 1)
+	mpu.SetAuxDataFunc(func(idx int, data []byte, t time.Time) {
+		if idx == 2 {
+			select {
+			case got <- append([]byte(nil), data...):
+			default:
+			}
+		}
+	})
+	select {
+	case data := <-got:
+		if !bytes.Equal(data, []byte{10, 11, 12, 13, 14, 15}) {
+			t.Errorf("aux slave 2 read %v, expected 10-15", data)
+		}
+	case <-time.After(time.Second):
+		t.Error("no aux data received")
+	}
+
+	if err := mpu.ConfigureAuxSlave(3, 0x1E, 0x03, 15); err != nil {
+		t.Fatal(err)
+	}
+	if err := mpu.ConfigureAuxSlave(1, 0x1E, 0x03, 4); err == nil {
+		t.Error("aux slave overflowing EXT_SENS_DATA was accepted")
+	}
+	if used, total := mpu.AuxDataBudget(); used != 21 || total != 24 {
+		t.Errorf("EXT_SENS_DATA budget %d of %d, expected 21 of 24", used, total)
+	}
+}
+
+func TestHorizonHeadingDegraded(t *testing.T) {
+	f := newHorizonFilter(time.Second, true)
+	t0 := time.Now()
+	var i int
+	// Level, with the nose to magnetic north, yawing right at rate °/s.
+	feed := func(n int, rate float64, magHealthy bool) {
+		for ; n > 0; n-- {
+			i++
+			ti := t0.Add(time.Duration(i) * 10 * time.Millisecond)
+			f.update(&MPUData{A3: 1, G3: -rate, M1: 20, M3: -40, T: ti, TM: ti}, magHealthy)
+		}
+	}
+
+	feed(10, 0, true)
+	if h := f.h; !h.HeadingValid || h.HeadingDegraded || math.Abs(angleDiff(h.Heading, 0)) > 0.1 {
+		t.Fatalf("with a good magnetometer, heading %g, valid %v, degraded %v", h.Heading, h.HeadingValid, h.HeadingDegraded)
+	}
+	feed(100, 10, false)
+	if h := f.h; !h.HeadingValid || !h.HeadingDegraded || math.Abs(h.Heading-10) > 0.5 {
+		t.Errorf("after losing the magnetometer, heading %g, valid %v, degraded %v, expected 10° degraded",
+			h.Heading, h.HeadingValid, h.HeadingDegraded)
+	}
+	feed(1, 0, true)
+	if h := f.h; h.HeadingDegraded || math.Abs(h.Heading-10) > 0.5 {
+		t.Errorf("on recovery, heading %g, degraded %v, expected about 10° without a jump", h.Heading, h.HeadingDegraded)
+	}
+	feed(500, 0, true)
+	if h := f.h; math.Abs(angleDiff(h.Heading, 0)) > 0.1 {
+		t.Errorf("after recovery, heading %g, expected to settle back to 0°", h.Heading)
+	}
+
+	// A heading never had from the magnetometer isn't made valid by the gyro.
+	f = newHorizonFilter(time.Second, true)
+	feed(10, 0, false)
+	if f.h.HeadingValid || f.h.HeadingDegraded {
+		t.Errorf("without a magnetometer, heading valid %v, degraded %v, expected neither", f.h.HeadingValid, f.h.HeadingDegraded)
+	}
+}
+
+func TestNewWithBus(t *testing.T) {
+	// fakeBus only needs the I2C methods to stand in for a non-embd bus.  The accelerometer reads gravity, so the
+	// samples don't look like a bus fault.
+	var bus I2C = &fakeBus{regs: map[byte]byte{ICMREG_ACCEL_ZOUT_H: 0x40}}
+	mpu, err := NewWithBus(bus, WithSampleRate(100), WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	if d := <-mpu.C; d.GAError != nil {
+		t.Errorf("reading through NewWithBus failed: %s", d.GAError)
+	}
+}
+
+func TestResampler(t *testing.T) {
+	// 100 Hz input with up to ±3 ms of jitter, and values that ramp linearly with time.
+	rng := rand.New(rand.NewSource(1))
+	t0 := time.Now()
+	value := func(ti time.Time) float64 { return 2 * ti.Sub(t0).Seconds() }
+	var in []*MPUData
+	for i := 0; i < 200; i++ {
+		ti := t0.Add(time.Duration(i)*10*time.Millisecond + time.Duration(rng.Intn(6000)-3000)*time.Microsecond)
+		if i == 0 {
+			ti = t0
+		}
+		in = append(in, &MPUData{G1: value(ti), A3: 1, T: ti})
+	}
+
+	for _, interp := range []Interpolation{Linear, ZeroOrderHold} {
+		r := newResampler(100, interp)
+		var out []*MPUData
+		for i, d := range in {
+			for _, v := range r.push(d) {
+				if v.T.After(d.T) {
+					t.Fatalf("output at %s sent before input %d at %s", v.T, i, d.T)
+				}
+				out = append(out, v)
+			}
+		}
+		if len(out) < 195 || len(out) > 200 {
+			t.Fatalf("interpolation %d: %d samples out, expected about 200", interp, len(out))
+		}
+		for k, v := range out {
+			if want := t0.Add(time.Duration(k) * 10 * time.Millisecond); !v.T.Equal(want) || v.DT != 10*time.Millisecond ||
+				v.Seq != uint64(k+1) {
+				t.Fatalf("interpolation %d: sample %d at %s, DT %s, Seq %d, expected %s, 10ms, %d",
+					interp, k, v.T, v.DT, v.Seq, want, k+1)
+			}
+			switch interp {
+			case Linear:
+				if math.Abs(v.G1-value(v.T)) > 1e-9 {
+					t.Errorf("linear sample %d is %g, expected %g", k, v.G1, value(v.T))
+				}
+			case ZeroOrderHold:
+				// The held value is that of the latest input at or before the output time, up to 13 ms earlier.
+				if lag := value(v.T) - v.G1; lag < -1e-9 || lag > 2*0.013 {
+					t.Errorf("held sample %d is %g, expected up to 13 ms behind %g", k, v.G1, value(v.T))
+				}
+			}
+			if v.A3 != 1 {
+				t.Errorf("sample %d has A3 %g, expected 1", k, v.A3)
+			}
+		}
+	}
+
+	// A gap restarts the grid at the next sample.
+	r := newResampler(100, Linear)
+	r.push(&MPUData{T: t0})
+	later := t0.Add(time.Second + 3*time.Millisecond)
+	if out := r.push(&MPUData{T: later}); len(out) != 1 || !out[0].T.Equal(later) {
+		t.Errorf("after a gap, got %d samples, expected one at the new input", len(out))
+	}
+}
+
+func TestMagOverrun(t *testing.T) {
+	// Every other magnetometer reading follows an overrun.
+	var st1Reads int
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_I2C_MST_STATUS: BIT_I2C_SLV4_DONE}}
+	fb.onRead = func(reg, v byte) byte {
+		switch reg {
+		case ICMREG_EXT_SENS_DATA_00:
+			st1Reads++
+			if st1Reads%2 == 0 {
+				return AK09916_ST1_DRDY | AK09916_ST1_DOR
+			}
+			return AK09916_ST1_DRDY
+		case ICMREG_EXT_SENS_DATA_00 + 8:
+			return 0
+		}
+		return v
+	}
+	var bus embd.I2CBus = fb
+	mpu, err := NewWithOptions(&bus, WithSampleRate(100), WithMagnetometer(true),
+		WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+
+	mpu.AverageSince(true)
+	time.Sleep(300 * time.Millisecond)
+	st := mpu.Stats()
+	if st.MagOverruns == 0 || uint64(st.MagOverruns) > st.MagReadCount/2+1 {
+		t.Errorf("counted %d overruns in %d mag reads, expected about half", st.MagOverruns, st.MagReadCount)
+	}
+	if d := mpu.AverageSince(true); !d.MagOverrun {
+		t.Error("the average of readings with overruns isn't flagged")
+	}
+	overrun := map[bool]bool{}
+	for i := 0; i < 20; i++ {
+		overrun[(<-mpu.CBuf).MagOverrun] = true
+	}
+	if !overrun[true] || !overrun[false] {
+		t.Errorf("samples flagged %v, expected some with and some without an overrun", overrun)
+	}
+}
+
+func TestGSensitivity(t *testing.T) {
+	// Shaking along all axes about 1 G up, with a known g-sensitivity, gyro bias and noise.
+	rng := rand.New(rand.NewSource(1))
+	coef := [3][3]float64{{0.1, -0.02, 0.05}, {0.03, 0.08, -0.01}, {-0.04, 0.02, 0.12}}
+	bias := [3]float64{0.5, -0.3, 0.2}
+	var gs, as [][3]float64
+	for k := 0; k < 2000; k++ {
+		a := [3]float64{0.5 * rng.NormFloat64(), 0.5 * rng.NormFloat64(), 1 + 0.5*rng.NormFloat64()}
+		var g [3]float64
+		for i := range g {
+			g[i] = bias[i] + coef[i][0]*a[0] + coef[i][1]*a[1] + coef[i][2]*a[2] + 0.01*rng.NormFloat64()
+		}
+		gs, as = append(gs, g), append(as, a)
+	}
+
+	c, b, resid, err := fitGSensitivity(gs, as)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if math.Abs(b[i]-bias[i]) > 0.005 {
+			t.Errorf("bias %d fitted as %g, expected %g", i+1, b[i], bias[i])
+		}
+		for j := 0; j < 3; j++ {
+			if math.Abs(c[i][j]-coef[i][j]) > 0.005 {
+				t.Errorf("coefficient %d%d fitted as %g, expected %g", i+1, j+1, c[i][j], coef[i][j])
+			}
+		}
+	}
+	if math.Abs(resid-0.01) > 0.002 {
+		t.Errorf("residual %g, expected the noise of 0.01", resid)
+	}
+
+	// Correcting with the fitted coefficients leaves only the bias and the noise.
+	mpu := &ICM20948{}
+	mpu.Gs11, mpu.Gs12, mpu.Gs13 = c[0][0], c[0][1], c[0][2]
+	mpu.Gs21, mpu.Gs22, mpu.Gs23 = c[1][0], c[1][1], c[1][2]
+	mpu.Gs31, mpu.Gs32, mpu.Gs33 = c[2][0], c[2][1], c[2][2]
+	a := as[0]
+	g1, g2, g3 := mpu.correctGSensitivity(gs[0][0], gs[0][1], gs[0][2], a[0], a[1], a[2])
+	if math.Abs(g1-bias[0]) > 0.05 || math.Abs(g2-bias[1]) > 0.05 || math.Abs(g3-bias[2]) > 0.05 {
+		t.Errorf("corrected gyro %g, %g, %g, expected about the bias %v", g1, g2, g3, bias)
+	}
+	d := &MPUData{G1: g1, G2: g2, G3: g3, A1: a[0], A2: a[1], A3: a[2]}
+	if g, _ := mpu.uncorrectedGyro(d); math.Abs(g[0]-gs[0][0]) > tolerance || math.Abs(g[2]-gs[0][2]) > tolerance {
+		t.Errorf("uncorrected gyro %v, expected %v", g, gs[0])
+	}
+
+	// Too little shaking on one axis is refused.
+	for k := range as {
+		as[k][1] = 0.01 * rng.NormFloat64()
+	}
+	if _, _, _, err := fitGSensitivity(gs, as); err == nil {
+		t.Error("fitted the g-sensitivity without shaking along axis 2")
+	}
+	if _, _, _, err := fitGSensitivity(gs[:10], as[:10]); err == nil {
+		t.Error("fitted the g-sensitivity from 10 samples")
+	}
+
+	// A calibration file with the coefficients, now longer than 1 kB, reads back.
+	path := filepath.Join(t.TempDir(), "cal.json")
+	mpu.G01, mpu.A01, mpu.M01 = 1.2345678901234567, -2.3456789012345678, 3.4567890123456789
+	if err := mpu.mpuCalData.save(path); err != nil {
+		t.Fatal(err)
+	}
+	var loaded mpuCalData
+	if err := loaded.load(path); err != nil || loaded != mpu.mpuCalData {
+		t.Errorf("calibration read back as %+v, %v", loaded, err)
+	}
+}
+
+func TestDecimator(t *testing.T) {
+	// 100 Hz input with the magnetometer read every fourth sample and one accel/gyro error.
+	t0 := time.Now()
+	dc := &decimator{factor: 10}
+	var out []*MPUData
+	for i := 0; i < 30; i++ {
+		d := &MPUData{G1: float64(i), A3: 1, Temp: 20, T: t0.Add(time.Duration(i) * 10 * time.Millisecond)}
+		if i == 5 {
+			d.GAError = errors.New("read failed")
+			d.G1 = 1000
+		}
+		d.TM = t0.Add(time.Duration(i/4*4) * 10 * time.Millisecond)
+		d.M1 = float64(i / 4 * 4)
+		if i == 13 {
+			d.MagOverrun = true
+		}
+		if v := dc.add(d); v != nil {
+			out = append(out, v)
+		}
+	}
+
+	if len(out) != 3 {
+		t.Fatalf("%d outputs from 30 samples, expected 3", len(out))
+	}
+	// Means of 0-9 without 5, 10-19 and 20-29; mag readings at 0, 4, 8; 12, 16; 20, 24, 28.
+	wantG := []float64{40.0 / 9, 14.5, 24.5}
+	wantM := []float64{4, 14, 24}
+	wantN := []int{9, 10, 10}
+	wantNM := []int{3, 2, 3}
+	for k, v := range out {
+		if math.Abs(v.G1-wantG[k]) > 1e-9 || v.A3 != 1 || v.Temp != 20 || v.M1 != wantM[k] ||
+			v.N != wantN[k] || v.NM != wantNM[k] {
+			t.Errorf("output %d: G1 %g, A3 %g, Temp %g, M1 %g, N %d, NM %d, expected %g, 1, 20, %g, %d, %d",
+				k, v.G1, v.A3, v.Temp, v.M1, v.N, v.NM, wantG[k], wantM[k], wantN[k], wantNM[k])
+		}
+		wantT := t0.Add(time.Duration(10*k+9) * 10 * time.Millisecond)
+		if !v.T.Equal(wantT) || v.Seq != uint64(k+1) || v.GAError != nil || v.MagError != nil {
+			t.Errorf("output %d: T %s, Seq %d, errors %v %v, expected %s, %d", k, v.T, v.Seq, v.GAError,
+				v.MagError, wantT, k+1)
+		}
+		if k > 0 && v.DT != 100*time.Millisecond {
+			t.Errorf("output %d: DT %s, expected 100ms", k, v.DT)
+		}
+		if v.MagOverrun != (k == 1) {
+			t.Errorf("output %d: MagOverrun %v", k, v.MagOverrun)
+		}
+	}
+
+	mpu := &ICM20948{cDone: make(chan bool)}
+	if _, err := mpu.DecimatedStream(0); err == nil {
+		t.Error("DecimatedStream accepted a factor of 0")
+	}
+	c, err := mpu.DecimatedStream(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpu.decimate(&MPUData{G1: 1, T: t0})
+	mpu.decimate(&MPUData{G1: 3, T: t0.Add(10 * time.Millisecond)})
+	if v := <-c; v.G1 != 2 || v.N != 2 {
+		t.Errorf("stream sent G1 %g, N %d, expected 2, 2", v.G1, v.N)
+	}
+	close(mpu.cDone)
+	mpu.closeDecimators()
+	if _, ok := <-c; ok {
+		t.Error("stream not closed")
+	}
+	if _, err := mpu.DecimatedStream(2); err == nil {
+		t.Error("DecimatedStream accepted after close")
+	}
+}
+
+func TestSetBiases(t *testing.T) {
+	mpu := &ICM20948{calPath: filepath.Join(t.TempDir(), "cal.json")}
+	mpu.mpuCalData.reset()
+	setScales(mpu, 500, 4)
+	mpu.mcal1, mpu.mcal2, mpu.mcal3 = scaleMagAK09916, scaleMagAK09916, scaleMagAK09916
+
+	if err := mpu.SetGyroBias(1, -2, math.NaN()); err == nil {
+		t.Error("SetGyroBias accepted NaN")
+	}
+	if err := mpu.SetAccelBias(math.Inf(1), 0, 0); err == nil {
+		t.Error("SetAccelBias accepted Inf")
+	}
+	if mpu.mpuCalData != (mpuCalData{Ms11: 1, Ms22: 1, Ms33: 1}) {
+		t.Errorf("rejected biases changed the calibration: %+v", mpu.mpuCalData)
+	}
+
+	if err := mpu.SetGyroBias(1, -2, 0.5); err != nil {
+		t.Fatal(err)
+	}
+	if err := mpu.SetAccelBias(0.01, 0, -0.02); err != nil {
+		t.Fatal(err)
+	}
+	if err := mpu.SetMagHardIron(10, -20, 30); err != nil {
+		t.Fatal(err)
+	}
+	if g1, g2, g3 := mpu.calibrateGyro(0, 0, 0); math.Abs(g1+1) > tolerance || math.Abs(g2-2) > tolerance ||
+		math.Abs(g3+0.5) > tolerance {
+		t.Errorf("zero gyro reading gave %v, %v, %v, expected -1, 2, -0.5", g1, g2, g3)
+	}
+	if a1, a2, a3 := mpu.calibrateAccel(0, 0, 0); math.Abs(a1+0.01) > tolerance || a2 != 0 ||
+		math.Abs(a3-0.02) > tolerance {
+		t.Errorf("zero accel reading gave %v, %v, %v, expected -0.01, 0, 0.02", a1, a2, a3)
+	}
+	if m1, m2, m3 := mpu.calibrateMag(0, 0, 0); m1 != -10 || m2 != 20 || m3 != -30 {
+		t.Errorf("zero mag reading gave %v, %v, %v, expected -10, 20, -30", m1, m2, m3)
+	}
+
+	if err := mpu.SaveCalibration(); err != nil {
+		t.Fatal(err)
+	}
+	var loaded mpuCalData
+	if err := loaded.load(mpu.calPath); err != nil {
+		t.Fatal(err)
+	}
+	if loaded != mpu.mpuCalData {
+		t.Errorf("saved calibration %+v, expected %+v", loaded, mpu.mpuCalData)
+	}
+}
+
+func TestSyntheticSamples(t *testing.T) {
+	tr := Trajectory{Heading: 70, Pitch: 10, Roll: -20, Inclination: 60, GyroBias: [3]float64{0.5, 0, 0},
+		Segments: []TrajectorySegment{{Duration: time.Second, Rate: [3]float64{0, 0, 10}}}}
+	data, err := tr.samples(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 101 || !data[100].T.Equal(time.Time{}.Add(time.Second)) {
+		t.Fatalf("%d samples ending at %s, expected 101 ending at 1s", len(data), data[len(data)-1].T)
+	}
+	d := data[0]
+	roll, pitch, _ := accelTilt(d.A1, d.A2, d.A3)
+	heading, _ := tiltCompensatedHeading(d.A1, d.A2, d.A3, d.M1, d.M2, d.M3)
+	dip, _ := inclination(d.A1, d.A2, d.A3, d.M1, d.M2, d.M3)
+	if math.Abs(roll+20) > 1e-9 || math.Abs(pitch-10) > 1e-9 || math.Abs(heading-70) > 1e-9 || math.Abs(dip-60) > 1e-9 {
+		t.Errorf("initial roll %g, pitch %g, heading %g, dip %g, expected -20, 10, 70, 60", roll, pitch, heading, dip)
+	}
+	if d.G1 != 0.5 || d.G3 != 10 || math.Abs(math.Sqrt(d.M1*d.M1+d.M2*d.M2+d.M3*d.M3)-50) > 1e-9 {
+		t.Errorf("initial gyro %g, %g, %g, field %g, %g, %g", d.G1, d.G2, d.G3, d.M1, d.M2, d.M3)
+	}
+
+	// A yaw left of 10° about the body's up axis for a second tilts that axis, so compare with a level start.
+	tr.Pitch, tr.Roll = 0, 0
+	data, _ = tr.samples(false)
+	d = data[100]
+	heading, _ = tiltCompensatedHeading(d.A1, d.A2, d.A3, d.M1, -d.M2, -d.M3)
+	if math.Abs(heading-60) > 1e-9 || math.Abs(d.A3-1) > 1e-9 {
+		t.Errorf("after yawing 10° left heading is %g, A3 %g, expected 60, 1", heading, d.A3)
+	}
+
+	for _, bad := range []Trajectory{
+		{},
+		{SampleRate: -1, Segments: tr.Segments},
+		{Heading: math.NaN(), Segments: tr.Segments},
+		{Segments: []TrajectorySegment{{Duration: 0}}},
+	} {
+		if _, err := NewSynthetic(bad); err == nil {
+			t.Errorf("NewSynthetic accepted %+v", bad)
+		}
+	}
+}
+
+func TestSyntheticHeadingSweep(t *testing.T) {
+	// Face north, then yaw right at 30°/s for 6 s to face south.
+	mpu, err := NewSynthetic(Trajectory{
+		Inclination: 60,
+		Segments: []TrajectorySegment{
+			{Duration: time.Second},
+			{Duration: 6 * time.Second, Rate: [3]float64{0, 0, -30}},
+			{Duration: time.Second},
+		},
+	}, WithReplaySpeed(0), WithBufferPolicy(BlockProducer), WithHorizon(time.Second), WithOdometer(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var t0 time.Time
+	for d := range mpu.CBuf {
+		if t0.IsZero() {
+			t0 = d.T
+		}
+		h := mpu.Horizon()
+		if !h.HeadingValid || h.HeadingDegraded {
+			t.Fatalf("heading valid %v, degraded %v at %s", h.HeadingValid, h.HeadingDegraded, h.T.Sub(t0))
+		}
+		want := 30 * math.Min(math.Max(h.T.Sub(t0).Seconds()-1, 0), 6)
+		if math.Abs(angleDiff(h.Heading, want)) > 0.1 || math.Abs(h.Pitch) > 0.1 || math.Abs(h.Roll) > 0.1 {
+			t.Fatalf("at %s heading %g, pitch %g, roll %g, expected %g, 0, 0", h.T.Sub(t0), h.Heading, h.Pitch,
+				h.Roll, want)
+		}
+	}
+	if h := mpu.Horizon(); math.Abs(h.Heading-180) > 0.1 {
+		t.Errorf("final heading %g, expected 180", h.Heading)
+	}
+	if x, y, z := mpu.IntegratedAngle(); math.Abs(z+180) > 1e-6 || x != 0 || y != 0 {
+		t.Errorf("integrated angles %g, %g, %g, expected 0, 0, -180", x, y, z)
+	}
+}
+
+func TestFastInit(t *testing.T) {
+	// Bank 0 answers WHO_AM_I with whoAmI and Slave 4 reads complete at once with magID: the fake bus shares its
+	// registers between banks, so I2C_MST_STATUS (bank 0) is also I2C_SLV4_DI (bank 3).
+	whoAmI, magID := byte(ICM20948_WHOAMI), byte(AK09916_Device_ID)
+	fb := &fakeBus{}
+	fb.onRead = func(reg, v byte) byte {
+		bank0 := fb.regs[ICMREG_BANK_SEL] == 0
+		switch {
+		case reg == ICMREG_WHOAMI && bank0:
+			return whoAmI
+		case reg == ICMREG_I2C_MST_STATUS && bank0:
+			return BIT_I2C_SLV4_DONE
+		case reg == ICMREG_I2C_SLV4_DI:
+			return magID
+		}
+		return v
+	}
+	mpu, err := NewWithBus(fb, WithSampleRate(100), WithMagnetometer(true), WithFastInit(true),
+		WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	start := time.Now()
+	if err := mpu.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("fast reset took %s", d)
+	}
+
+	fb.mu.Lock()
+	whoAmI = 0x71
+	fb.mu.Unlock()
+	if err := mpu.Reset(); err == nil || !strings.Contains(err.Error(), "WHO_AM_I") {
+		t.Errorf("reset with the wrong WHO_AM_I gave %v", err)
+	}
+	fb.mu.Lock()
+	whoAmI, magID = ICM20948_WHOAMI, 0x42
+	fb.mu.Unlock()
+	if err := mpu.Reset(); err == nil || !strings.Contains(err.Error(), "device ID") {
+		t.Errorf("reset with the wrong magnetometer ID gave %v", err)
+	}
+}
+
+func TestAccelRMS(t *testing.T) {
+	// 0.1 G peak sinusoidal vibration along axis 3 on top of gravity, 1000 samples.
+	cBuf := make(chan *MPUData, 1001)
+	for i := 0; i < 1000; i++ {
+		cBuf <- &MPUData{A3: 1 + 0.1*math.Sin(2*math.Pi*float64(i)/20)}
+	}
+	cBuf <- &MPUData{A3: 5, GAError: errors.New("read failed")}
+	mpu := &ICM20948{CBuf: cBuf}
+	rms, err := mpu.AccelRMS(50 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 0.1 / math.Sqrt2; math.Abs(rms-want) > 1e-9 {
+		t.Errorf("RMS %g, expected %g", rms, want)
+	}
+
+	if _, err := mpu.AccelRMS(10 * time.Millisecond); err == nil {
+		t.Error("no error without samples")
+	}
+	close(cBuf)
+	if _, err := mpu.AccelRMS(10 * time.Millisecond); err == nil {
+		t.Error("no error after close")
+	}
+	if _, err := mpu.AccelRMS(0); err == nil {
+		t.Error("zero window accepted")
+	}
+}
+
+// flakyBus is a fakeBus whose first failWrites register writes fail.
+type flakyBus struct {
+	*fakeBus
+	failWrites int
+}
+
+func (b *flakyBus) WriteByteToReg(addr, reg, value byte) error {
+	if b.failWrites > 0 {
+		b.failWrites--
+		return errFakeBus
+	}
+	return b.fakeBus.WriteByteToReg(addr, reg, value)
+}
+
+func TestInitRetries(t *testing.T) {
+	// Each failed bring-up makes two writes: the register bank, whose error is ignored, and the reset.
+	path := filepath.Join(t.TempDir(), "cal.json")
+	if _, err := NewWithBus(&flakyBus{&fakeBus{}, 4}, WithCalibrationPath(path),
+		WithInitRetries(1, time.Millisecond)); err == nil {
+		t.Error("two failed bring-ups with one retry succeeded")
+	}
+	mpu, err := NewWithBus(&flakyBus{&fakeBus{}, 4}, WithCalibrationPath(path), WithInitRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatalf("two failed bring-ups with two retries: %s", err)
+	}
+	mpu.CloseMPU()
+	if _, err := NewWithBus(&fakeBus{}, WithCalibrationPath(path), WithInitRetries(-1, 0)); err == nil {
+		t.Error("negative retries accepted")
+	}
+}
+
+func TestConfiguration(t *testing.T) {
+	// The fake bus shares registers between banks: GYRO_SMPLRT_DIV (bank 2) is also I2C_MST_ODR_CONFIG (bank 3),
+	// and I2C_MST_STATUS (bank 0) is I2C_SLV4_DI (bank 3).
+	fb := &fakeBus{regs: map[byte]byte{
+		ICMREG_GYRO_SMPLRT_DIV:    10,
+		ICMREG_GYRO_CONFIG:        BITS_DLPF_GYRO_CFG_51HZ | BITS_FS_1000DPS,
+		ICMREG_ACCEL_SMPLRT_DIV_1: 0x01,
+		ICMREG_ACCEL_SMPLRT_DIV_2: 0x18,
+		ICMREG_ACCEL_CONFIG:       BITS_FS_8G,
+	}}
+	fb.onRead = func(reg, v byte) byte {
+		if reg == ICMREG_I2C_MST_STATUS {
+			if fb.regs[ICMREG_BANK_SEL] == 0 {
+				return BIT_I2C_SLV4_DONE
+			}
+			return AK09916_MODE_CONT3
+		}
+		return v
+	}
+	mpu := &ICM20948{i2cbus: fb, enableMag: true}
+	c, err := mpu.Configuration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Configuration{
+		GyroRate: 1125.0 / 11, AccelRate: accelBypassRate,
+		GyroDLPF: true, GyroDLPFCfg: 3, GyroBandwidth: 51.2, AccelBandwidth: accelBypassBandwidth,
+		GyroSensitivity: 1000, AccelSensitivity: 8,
+		I2CMasterRate: 1100.0 / 1024,
+		MagEnabled:    true, MagMode: AK09916_MODE_CONT3, MagRate: 50,
+	}
+	if c != want {
+		t.Errorf("configuration %+v, expected %+v", c, want)
+	}
+
+	// Reading the magnetometer mode wrote I2C_SLV4_REG, which is also ACCEL_CONFIG.
+	fb.mu.Lock()
+	fb.regs[ICMREG_ACCEL_CONFIG] = BITS_FS_8G | BITS_FCHOICE
+	fb.mu.Unlock()
+	if c, _ = mpu.Configuration(); c.AccelRate != 1125.0/281 || c.AccelBandwidth != 246 {
+		t.Errorf("accel rate %g Hz, bandwidth %g Hz, expected %g, 246", c.AccelRate, c.AccelBandwidth, 1125.0/281)
+	}
+	if s := c.String(); !strings.Contains(s, "gyro 102.3 Hz, DLPFCFG 3, 51.2 Hz bandwidth, 1000 °/s") ||
+		!strings.Contains(s, "mag mode 0x06, 50 Hz") {
+		t.Errorf("String gave %q", s)
+	}
+
+	fb.mu.Lock()
+	fb.fail = true
+	fb.mu.Unlock()
+	if _, err := mpu.Configuration(); err == nil {
+		t.Error("no error from a failing bus")
+	}
+}
+
+func TestGroup(t *testing.T) {
+	tr := Trajectory{Segments: []TrajectorySegment{{Duration: 500 * time.Millisecond}}}
+	g := NewGroup()
+	for _, name := range []string{"left", "right"} {
+		mpu, err := NewSynthetic(tr, WithReplaySpeed(0), WithBufferPolicy(BlockProducer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Add(name, mpu); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Add("left", &ICM20948{}); err == nil {
+		t.Error("duplicate name accepted")
+	}
+
+	counts := make(map[string]int)
+	for d := range g.Merge() {
+		counts[d.Source]++
+		if d.Seq != uint64(counts[d.Source]) {
+			t.Errorf("%s sample %d has Seq %d", d.Source, counts[d.Source], d.Seq)
+		}
+	}
+	if counts["left"] != 51 || counts["right"] != 51 {
+		t.Errorf("merged %v samples, expected 51 from each", counts)
+	}
+	if stats := g.StatsAll(); len(stats) != 2 || stats["right"].Samples != 51 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	// Both replays have finished, as if the devices had failed.
+	if err := g.StartAll(); err == nil || !strings.Contains(err.Error(), "left") || !strings.Contains(err.Error(), "right") {
+		t.Errorf("StartAll on stopped devices gave %v", err)
+	}
+	g.CloseAll()
+	g.CloseAll()
+}
+
+// corruptingBus is a fakeBus that flips the bits of one byte of each DMP memory write.
+type corruptingBus struct {
+	*fakeBus
+	index int
+}
+
+func (b *corruptingBus) WriteToReg(addr, reg byte, value []byte) error {
+	v := append([]byte(nil), value...)
+	if reg == ICMREG_MEM_R_W && b.index < len(v) {
+		v[b.index] ^= 0xFF
+	}
+	return b.fakeBus.WriteToReg(addr, reg, v)
+}
+
+func TestMemVerify(t *testing.T) {
+	data := []byte{1, 2, 3, 4}
+	bus := &corruptingBus{&fakeBus{}, 2}
+	mpu := &ICM20948{i2cbus: bus}
+	if err := mpu.memWrite(0x4B8, &data); err != nil {
+		t.Errorf("unverified write failed: %s", err)
+	}
+	WithMemVerify(true)(mpu)
+	if err := mpu.memWrite(0x4B8, &data); err == nil || !strings.Contains(err.Error(), "0x04BA") {
+		t.Errorf("corrupted write gave %v", err)
+	}
+	bus.index = len(data)
+	if err := mpu.memWrite(0x4B8, &data); err != nil {
+		t.Errorf("verified write failed: %s", err)
+	}
+
+	for _, tc := range []struct {
+		addr uint16
+		n    int
+		ok   bool
+	}{
+		{0x4F0, 16, true},
+		{0x400, 256, true},
+		{0x4F0, 17, false},
+		{0xFFF0, 32, false},
+		{0x4F0, 0, false},
+	} {
+		if err := mpu.memSelect(tc.addr, tc.n); (err == nil) != tc.ok {
+			t.Errorf("%d bytes at 0x%04X gave %v", tc.n, tc.addr, err)
+		}
+	}
+}
+
+func TestOnError(t *testing.T) {
+	mpu := &ICM20948{logThrottle: logThrottle{first: 2, every: 3}}
+	var got []*ReadError
+	WithOnError(func(err error) {
+		var re *ReadError
+		if !errors.As(err, &re) {
+			t.Fatalf("%v is not a ReadError", err)
+		}
+		got = append(got, re)
+	})(mpu)
+	for i := 0; i < 6; i++ {
+		mpu.readError(SourceGyroAccel, errFakeBus)
+	}
+	mpu.readError(SourceMag, fmt.Errorf("error reading magnetometer ST1: %w", ErrBusTimeout))
+	mpu.reportErrors()
+
+	// Gyro/accel errors 1, 2, 3 and 6, then the first mag error.
+	if len(got) != 5 {
+		t.Fatalf("reported %d errors, expected 5", len(got))
+	}
+	for i, count := range []uint64{1, 2, 3, 6} {
+		if got[i].Source != SourceGyroAccel || got[i].Count != count || !errors.Is(got[i], errFakeBus) {
+			t.Errorf("error %d is %+v", i, got[i])
+		}
+	}
+	if got[4].Source != SourceMag || got[4].Count != 1 || !errors.Is(got[4], ErrBusTimeout) {
+		t.Errorf("mag error is %+v", got[4])
+	}
+	if s := mpu.Stats(); s.GyroAccelErrors != 6 || s.MagErrors != 1 || s.BusErrors != 0 {
+		t.Errorf("stats %+v", s)
+	}
+
+	got = nil
+	mpu.reportErrors()
+	if len(got) != 0 {
+		t.Errorf("reported %d errors twice", len(got))
+	}
+	mpu.SetOnError(nil)
+	mpu.readError(SourceBus, errFakeBus)
+	mpu.reportErrors()
+	if len(got) != 0 {
+		t.Errorf("errors reported after SetOnError(nil)")
+	}
+}
+
+func TestBootCheck(t *testing.T) {
+	// Bank 2's GYRO_CONFIG_2 shares the fake register of bank 1's SELF_TEST_X_GYRO, so the X gyro has no factory
+	// response; the accel has factory responses but, with the fake bus, no self-test response.
+	bus := &fakeBus{regs: map[byte]byte{
+		ICMREG_WHOAMI:            ICM20948_WHOAMI,
+		ICMREG_GYRO_CONFIG:       BITS_DLPF_GYRO_CFG_51HZ | BITS_FS_2000DPS,
+		ICMREG_ACCEL_CONFIG:      BITS_DLPF_ACCEL_CFG_50HZ | BITS_FS_16G,
+		ICMREG_SELF_TEST_X_ACCEL: 1,
+		ICMREG_SELF_TEST_Y_ACCEL: 1,
+		ICMREG_SELF_TEST_Z_ACCEL: 1,
+	}}
+	mpu := &ICM20948{i2cbus: bus, gyroRate: 1000, scaleGyro: 2000.0 / math.MaxInt16, scaleAccel: 16.0 / math.MaxInt16}
+	r, err := mpu.BootCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.WhoAmI.Passed || !r.GyroSelfTest.Run || r.GyroSelfTest.Passed || !r.AccelSelfTest.Run ||
+		r.AccelSelfTest.Passed || r.MagWhoAmI.Run || r.MagSelfTest.Run || !r.Noise.Passed || r.Passed() {
+		t.Errorf("report:\n%s", r)
+	}
+	if !strings.Contains(r.GyroSelfTest.Detail, "no factory response") {
+		t.Errorf("gyro self-test detail %q", r.GyroSelfTest.Detail)
+	}
+	if bus.regs[ICMREG_GYRO_CONFIG] != BITS_DLPF_GYRO_CFG_51HZ|BITS_FS_2000DPS ||
+		bus.regs[ICMREG_ACCEL_CONFIG] != BITS_DLPF_ACCEL_CFG_50HZ|BITS_FS_16G ||
+		bus.regs[ICMREG_GYRO_CONFIG_2] != 0 || bus.regs[ICMREG_ACCEL_CONFIG_2] != 0 || bus.regs[ICMREG_BANK_SEL] != 0 {
+		t.Errorf("configuration not restored: %v", bus.regs)
+	}
+
+	bus.regs[ICMREG_WHOAMI] = 0x71
+	if r, err = mpu.BootCheck(); err != nil || r.WhoAmI.Passed || r.GyroSelfTest.Run || r.Noise.Run || r.Passed() {
+		t.Errorf("wrong WHO_AM_I gave %v, report:\n%s", err, r)
+	}
+	mpu.asleep = true
+	if _, err := mpu.BootCheck(); err == nil {
+		t.Error("boot check ran while asleep")
+	}
+}
+
+func TestHWBiasRemoval(t *testing.T) {
+	// Data sheet: the gyro offsets are in steps of 4/131 °/s (0.0305) and the accel offsets in 0.98 mG.
+	scale := 2000.0 / math.MaxInt16
+	regs, applied := gyroOffsets([3]float64{1 / scale, -0.5 / scale, 0}, scale)
+	if regs != [3]int16{-33, 16, 0} || math.Abs(applied[0]-1.0076) > 1e-4 || math.Abs(applied[1]+0.4885) > 1e-4 {
+		t.Errorf("gyro offsets %v remove %v", regs, applied)
+	}
+	regs, applied = accelOffsets([3]float64{0.098 / (2.0 / math.MaxInt16), 0, -100}, 2.0/math.MaxInt16, [3]int16{100, 0, 16383})
+	if regs != [3]int16{0, 0, 16383} || math.Abs(applied[0]-0.098) > 1e-9 || applied[2] != 0 {
+		t.Errorf("accel offsets %v remove %v", regs, applied)
+	}
+
+	bus := &fakeBus{regs: map[byte]byte{ICMREG_XA_OFFSET_H: 0x00, ICMREG_XA_OFFSET_L: 0xC9}} // X trim 100
+	mpu := &ICM20948{i2cbus: bus, scaleGyro: 250.0 / math.MaxInt16, scaleAccel: 4.0 / math.MaxInt16}
+	if err := mpu.SetGyroBias(1, 2, -3); err != nil {
+		t.Fatal(err)
+	}
+	if err := mpu.SetAccelBias(0.05, 0, -0.02); err != nil {
+		t.Fatal(err)
+	}
+	trueG, trueA := [3]float64{10, 20, 30}, [3]float64{0, 0, 1}
+	want1, want2, want3 := mpu.calibrateGyro((trueG[0]+1)/mpu.scaleGyro, (trueG[1]+2)/mpu.scaleGyro, (trueG[2]-3)/mpu.scaleGyro)
+
+	if err := mpu.SetHWBiasRemoval(true); err != nil {
+		t.Fatal(err)
+	}
+	if bus.regs[ICMREG_XG_OFFS_USRH] != 0xFF || bus.regs[ICMREG_XG_OFFS_USRL] != byte(-33&0xFF) ||
+		bus.regs[ICMREG_ZG_OFFS_USRH] != 0 || bus.regs[ICMREG_ZG_OFFS_USRL] != 98 {
+		t.Errorf("gyro offset registers % X", []byte{bus.regs[3], bus.regs[4], bus.regs[5], bus.regs[6], bus.regs[7], bus.regs[8]})
+	}
+	// X: trim 100 - round(0.05/0.00098) = 49, shifted above the reserved bit, which is kept.
+	if x := int16(bus.regs[ICMREG_XA_OFFSET_H])<<8 | int16(bus.regs[ICMREG_XA_OFFSET_L]); x != 49<<1|1 {
+		t.Errorf("accel X offset register 0x%04X", x)
+	}
+
+	// The chip now outputs the true rates plus what is left of the bias; the output is unchanged.
+	var raw [3]float64
+	for i, b := range [3]float64{1, 2, -3} {
+		raw[i] = (trueG[i] + b - mpu.gyroHWOffset[i]) / mpu.scaleGyro
+	}
+	if g1, g2, g3 := mpu.calibrateGyro(raw[0], raw[1], raw[2]); math.Abs(g1-want1) > 1e-9 || math.Abs(g2-want2) > 1e-9 ||
+		math.Abs(g3-want3) > 1e-9 {
+		t.Errorf("gyro %.4f, %.4f, %.4f with hardware bias removal, expected %.4f, %.4f, %.4f", g1, g2, g3, want1, want2, want3)
+	}
+	for i, b := range [3]float64{0.05, 0, -0.02} {
+		raw[i] = (trueA[i] + b - mpu.accelHWOffset[i]) / mpu.scaleAccel
+	}
+	if a1, a2, a3 := mpu.calibrateAccel(raw[0], raw[1], raw[2]); math.Abs(a1) > 1e-9 || math.Abs(a2) > 1e-9 ||
+		math.Abs(a3-1) > 1e-9 {
+		t.Errorf("accel %.4f, %.4f, %.4f with hardware bias removal", a1, a2, a3)
+	}
+
+	if err := mpu.SetHWBiasRemoval(false); err != nil {
+		t.Fatal(err)
+	}
+	if bus.regs[ICMREG_XG_OFFS_USRL] != 0 || bus.regs[ICMREG_XA_OFFSET_L] != 0xC9 || mpu.gyroHWOffset != [3]float64{} {
+		t.Errorf("offsets not cleared: %v", bus.regs)
+	}
+
+	if err := mpu.WriteAccelOffsets(1<<14, 0, 0); err == nil {
+		t.Error("out of range accel offset accepted")
+	}
+	if err := mpu.WriteGyroOffsets(-1, 0, 0); err != nil || bus.regs[ICMREG_XG_OFFS_USRH] != 0xFF {
+		t.Errorf("WriteGyroOffsets gave %v, %v", err, bus.regs)
+	}
+}
+
+func TestCalibrationReport(t *testing.T) {
+	mpu := &ICM20948{scaleGyro: 250.0 / math.MaxInt16, scaleAccel: 2.0 / math.MaxInt16, skipSoftIron: true}
+	mpu.mpuCalData.reset()
+	var b bytes.Buffer
+	mpu.CalibrationReport(&b)
+	if !strings.Contains(b.String(), "never loaded") || !strings.Contains(b.String(), "g-sensitivity: none") {
+		t.Errorf("report of an unloaded calibration:\n%s", b.String())
+	}
+
+	if err := mpu.SetGyroBias(1.5, 0, -0.25); err != nil {
+		t.Fatal(err)
+	}
+	mpu.Ms11, mpu.Ms22, mpu.Ms33, mpu.Gs13 = 2, 1, 0.25, 0.1
+	b.Reset()
+	mpu.CalibrationReport(&b)
+	for _, want := range []string{
+		"Gyro bias:             1.500    0.000   -0.250 °/s",
+		"determinant 0.5000 (not applied",
+		"Mag field:          unknown",
+		"0.1000 °/s per G",
+		"gyro bias set with SetGyroBias",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("report doesn't contain %q:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestStuckAxis(t *testing.T) {
+	mpu := &ICM20948{stuckAxisSamples: 5, cFaults: make(chan error, faultsBufSize)}
+	for i := 0; i < 10; i++ {
+		mpu.checkStuck(0, int16(i), 7, math.MaxInt16) // Gyro Y stuck; Z saturated
+		mpu.checkStuck(6, int16(i%2), int16(-i), 3)   // Mag Z stuck
+	}
+	if s := mpu.Stats(); s.StuckAxes != StuckG2|StuckM3 || s.StuckAxisFaults != 2 {
+		t.Errorf("stuck axes 0x%03X, %d faults", s.StuckAxes, s.StuckAxisFaults)
+	}
+	for _, axis := range []string{"gyro Y read 7", "mag Z read 3"} {
+		select {
+		case err := <-mpu.cFaults:
+			if !errors.Is(err, ErrStuckAxis) || !strings.Contains(err.Error(), axis) {
+				t.Errorf("fault %v, expected %s", err, axis)
+			}
+		default:
+			t.Errorf("no fault for %s", axis)
+		}
+	}
+
+	mpu.checkStuck(0, 10, 8, 0)
+	if s := mpu.Stats(); s.StuckAxes != StuckM3 || len(mpu.cFaults) != 0 {
+		t.Errorf("stuck axes 0x%03X after gyro Y changed", s.StuckAxes)
+	}
+	if err := mpu.SetStuckAxisCheck(-1); err == nil {
+		t.Error("negative stuck axis samples accepted")
+	}
+	if err := mpu.SetStuckAxisCheck(0); err != nil || mpu.Stats().StuckAxes != 0 {
+		t.Errorf("disabling the check gave %v, stuck axes 0x%03X", err, mpu.Stats().StuckAxes)
+	}
+}
+
+func TestBusFault(t *testing.T) {
+	mpu := new(ICM20948)
+	if err := mpu.checkBusFault(-1, -1, -1, -1, -1, -1); !errors.Is(err, ErrBusFault) {
+		t.Errorf("all 0xFFFF gave %v, want a bus fault", err)
+	}
+	if err := mpu.checkBusFault(-1, -1, -1, -1, -1, 16384); err != nil {
+		t.Errorf("gyro at -1 LSB with gravity gave %v", err)
+	}
+	for i := 1; i <= busFaultZeroSamples; i++ {
+		if err := mpu.checkBusFault(0, 0, 0, 0, 0, 0); (err != nil) != (i == busFaultZeroSamples) {
+			t.Errorf("all zero sample %d gave %v", i, err)
+		}
+	}
+	if mpu.checkBusFault(0, 0, 0, 0, 0, 1) != nil || mpu.checkBusFault(0, 0, 0, 0, 0, 0) != nil {
+		t.Error("zero run not restarted by a non-zero sample")
+	}
+	if n := mpu.Stats().BusFaults; n != 2 {
+		t.Errorf("%d bus faults counted, want 2", n)
+	}
+
+	// An open bus reading 0xFF fails the samples.
+	regs := make(map[byte]byte)
+	for r := byte(ICMREG_ACCEL_XOUT_H); r <= ICMREG_GYRO_ZOUT_L; r++ {
+		regs[r] = 0xFF
+	}
+	var bus embd.I2CBus = &fakeBus{regs: regs}
+	mpu, err := NewICM20948(&bus, 250, 2, 50, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	if d := <-mpu.C; !errors.Is(d.GAError, ErrBusFault) {
+		t.Errorf("open bus sample has GAError %v, want a bus fault", d.GAError)
+	}
+}
+
+func TestSaturation(t *testing.T) {
+	for v, want := range map[int16]bool{math.MaxInt16: true, math.MaxInt16 - 1: true, math.MaxInt16 - 2: false,
+		math.MinInt16: true, math.MinInt16 + 1: true, math.MinInt16 + 2: false, 0: false} {
+		if saturated(v) != want {
+			t.Errorf("saturated(%d) = %t", v, !want)
+		}
+	}
+
+	// Gyro X reads 0x8000 and accel Y 0x7FFF; accel Z reads gravity so the samples don't look like a bus fault.
+	fb := &fakeBus{regs: map[byte]byte{
+		ICMREG_GYRO_XOUT_H: 0x80, ICMREG_GYRO_XOUT_H + 1: 0x00,
+		ICMREG_ACCEL_XOUT_H + 2: 0x7F, ICMREG_ACCEL_XOUT_H + 3: 0xFF,
+		ICMREG_ACCEL_ZOUT_H: 0x40,
+	}}
+	mpu, err := NewWithBus(fb, WithSampleRate(100), WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	if d := <-mpu.C; d.Saturated != SaturatedG1|SaturatedA2 {
+		t.Errorf("saturated flags 0x%02X, want 0x%02X", d.Saturated, SaturatedG1|SaturatedA2)
+	}
+	if n := mpu.Stats().Saturations; n == 0 {
+		t.Error("no saturated samples counted")
+	}
+}
+
+func TestBiquad(t *testing.T) {
+	const rate, cutoff = 200, 20.0
+	// amplitude returns the steady-state gain of the filter for a sine wave at f Hz.
+	amplitude := func(f float64) float64 {
+		bf := &biquadFilter{cutoff: cutoff}
+		var peak float64
+		for i := 0; i < 20*rate; i++ {
+			x := math.Sin(2 * math.Pi * f * float64(i) / rate)
+			d := &MPUData{G1: x, A3: 1 + x, T: time.Time{}.Add(time.Duration(i) * time.Second / rate)}
+			v := bf.push(d, rate)
+			if math.Abs(v.A3-1-v.G1) > 1e-9 {
+				t.Fatalf("gyro and accel filtered differently: %g, %g", v.G1, v.A3-1)
+			}
+			if i >= 10*rate {
+				peak = math.Max(peak, math.Abs(v.G1))
+			}
+		}
+		return peak
+	}
+	bf := &biquadFilter{cutoff: cutoff}
+	for i := 0; i < rate; i++ {
+		d := &MPUData{G1: 3, T: time.Time{}.Add(time.Duration(i) * time.Second / rate)}
+		if v := bf.push(d, rate); math.Abs(v.G1-3) > 1e-9 {
+			t.Fatalf("DC gain %g", v.G1/3)
+		}
+	}
+	for _, f := range []float64{2, 10, 20, 40, 80} {
+		// The analog Butterworth response at the pre-warped frequency.
+		w := math.Tan(math.Pi*f/rate) / math.Tan(math.Pi*cutoff/rate)
+		want := 1 / math.Sqrt(1+w*w*w*w)
+		// Sampling the peak of a sine at 200 Hz can miss it by up to cos(π f/200).
+		if got := amplitude(f); got > want*1.001 || got < want*math.Cos(math.Pi*f/rate)*0.999 {
+			t.Errorf("gain at %g Hz is %.4f, expected %.4f", f, got, want)
+		}
+	}
+	if got := amplitude(cutoff); math.Abs(got-math.Sqrt(0.5)) > 0.03 {
+		t.Errorf("gain at the cutoff is %.4f, expected -3 dB", got)
+	}
+
+	// A new sample rate recomputes the coefficients; a cutoff above Nyquist passes samples through.
+	bf = &biquadFilter{cutoff: cutoff}
+	bf.push(&MPUData{G1: 1}, rate)
+	f := bf.f
+	bf.push(&MPUData{G1: 1}, 100)
+	if bf.f == f || !bf.ok {
+		t.Errorf("coefficients not recomputed for 100 Hz: %+v", bf.f)
+	}
+	if v := bf.push(&MPUData{G1: 5}, 40); bf.ok || v.G1 != 5 {
+		t.Errorf("cutoff at half the sample rate gave %g", v.G1)
+	}
+	if err := (&ICM20948{}).SetBiquad(-1); err == nil {
+		t.Error("negative cutoff accepted")
+	}
+}
+
+func TestBiquadStream(t *testing.T) {
+	tr := Trajectory{Segments: []TrajectorySegment{{Duration: time.Second, Rate: [3]float64{0, 0, 10}}}}
+	mpu, err := NewSynthetic(tr, WithReplaySpeed(0), WithBufferPolicy(BlockProducer), WithBiquad(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range mpu.CBuf {
+	}
+	var n int
+	for d := range mpu.CFiltered {
+		n++
+		if math.Abs(d.G3-10) > 1e-9 || math.Abs(d.A3-1) > 1e-9 {
+			t.Errorf("filtered sample %d: G3 %g, A3 %g", d.Seq, d.G3, d.A3)
+		}
+	}
+	if n != filteredBufSize { // 101 samples, the oldest dropped as nothing read CFiltered while they were sent
+		t.Errorf("%d filtered samples, expected %d", n, filteredBufSize)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	tr := Trajectory{Pitch: 10, Segments: []TrajectorySegment{{Duration: 10 * time.Second}}}
+	mpu, err := NewSynthetic(tr, WithHorizon(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	go func() {
+		for range mpu.CBuf {
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- mpu.serveWeb(ctx, ln)
+	}()
+	addr := ln.Addr().String()
+
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), webSocketPath) {
+		t.Errorf("page doesn't use the WebSocket:\n%s", page)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+webSocketPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg struct {
+		A1, A3  float64
+		N       int
+		Horizon *HorizonData
+	}
+	for i := 0; i < 3; i++ {
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msg.Horizon == nil || !msg.Horizon.AttitudeValid || math.Abs(msg.Horizon.Pitch-10) > 0.1 {
+		t.Errorf("horizon %+v, expected pitch 10", msg.Horizon)
+	}
+	if math.Abs(msg.A1-math.Sin(10*math.Pi/180)) > 1e-6 || msg.N == 0 {
+		t.Errorf("message %+v", msg)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serveWeb returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveWeb didn't stop on cancel")
+	}
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				t.Errorf("connection ended with %v, expected a going away close", err)
+			}
+			break
+		}
+	}
+}
+
+func TestAge(t *testing.T) {
+	if age := new(ICM20948).Age(); age != math.MaxInt64 {
+		t.Errorf("age %s before any read", age)
+	}
+
+	var bus embd.I2CBus = &fakeBus{regs: map[byte]byte{ICMREG_ACCEL_ZOUT_H: 0x40}} // Gravity, not a bus fault
+	mpu, err := NewICM20948(&bus, 250, 2, 50, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	time.Sleep(100 * time.Millisecond)
+	if age := mpu.Age(); age > 100*time.Millisecond {
+		t.Errorf("age %s while reading at 50 Hz", age)
+	}
+	d := <-mpu.C
+	if age := d.Age(); age < 0 || age > 100*time.Millisecond {
+		t.Errorf("sample age %s", age)
+	}
+
+	mpu.Pause()
+	time.Sleep(200 * time.Millisecond)
+	if age := mpu.Age(); age < 200*time.Millisecond {
+		t.Errorf("age %s after a 200 ms pause", age)
+	}
+	mpu.Resume()
+}
+
+func TestGyroHighPass(t *testing.T) {
+	const (
+		tau  = 10.0 // s
+		rate = 100  // Samples per second
+	)
+	// The gain for a sine of frequency f, after the filter has settled.
+	amplitude := func(f float64) float64 {
+		hp := newGyroHighPass(tau * time.Second)
+		var peak float64
+		t0 := time.Unix(0, 0)
+		for i := 0; i < 20*tau*rate; i++ {
+			x := math.Sin(2 * math.Pi * f * float64(i) / rate)
+			y := hp.update(t0.Add(time.Duration(i)*time.Second/rate), [3]float64{x, 0, 0})
+			if i > 10*tau*rate {
+				peak = math.Max(peak, math.Abs(y[0]))
+			}
+		}
+		return peak
+	}
+	fc := 1 / (2 * math.Pi * tau)
+	for _, f := range []float64{fc, 10 * fc, 1} {
+		want := 1 / math.Sqrt(1+fc*fc/(f*f))
+		if got := amplitude(f); math.Abs(got-want) > 0.01 {
+			t.Errorf("gain at %.4g Hz is %.4f, expected %.4f", f, got, want)
+		}
+	}
+
+	// A constant bias is removed from the synthetic gyro, leaving turns.
+	tr := Trajectory{
+		GyroBias: [3]float64{0.5, -0.3, 0.2},
+		Segments: []TrajectorySegment{
+			{Duration: 10 * time.Second},
+			{Duration: 100 * time.Millisecond, Rate: [3]float64{0, 0, 30}},
+		},
+	}
+	mpu, err := NewSynthetic(tr, WithReplaySpeed(0), WithBufferPolicy(BlockProducer), WithGyroHighPass(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last *MPUData
+	for d := range mpu.CBuf {
+		last = d
+		if d.Seq == 1000 { // The end of the still segment, after 10 time constants
+			if g := math.Sqrt(d.G1*d.G1 + d.G2*d.G2 + d.G3*d.G3); g > 0.001 {
+				t.Errorf("gyro %g, %g, %g after 10 s, expected the bias removed", d.G1, d.G2, d.G3)
+			}
+		}
+	}
+	if math.Abs(last.G3-30*math.Exp(-0.1)) > 0.5 {
+		t.Errorf("gyro Z %g at the end of the turn, expected about %g", last.G3, 30*math.Exp(-0.1))
+	}
+	if err := mpu.SetGyroHighPass(-time.Second); err == nil {
+		t.Error("negative time constant accepted")
+	}
+}
+
+func TestRunFullCalibration(t *testing.T) {
+	still := func(d time.Duration) TrajectorySegment { return TrajectorySegment{Duration: d} }
+	turn := func(d time.Duration, r1, r2, r3 float64) TrajectorySegment {
+		return TrajectorySegment{Duration: d, Rate: [3]float64{r1, r2, r3}}
+	}
+	tr := Trajectory{
+		GyroBias: [3]float64{0.5, -0.3, 0.2},
+		Segments: []TrajectorySegment{
+			still(4500 * time.Millisecond), // Gyro, then axis 3 up
+			turn(2*time.Second, 0, 90, 0), still(2500 * time.Millisecond),
+			turn(time.Second, 0, 90, 0), still(2500 * time.Millisecond),
+			turn(2*time.Second, 0, 90, 0), still(2500 * time.Millisecond),
+			turn(time.Second, 0, 90, 0),
+			turn(time.Second, 90, 0, 0), still(2500 * time.Millisecond),
+			turn(2*time.Second, 90, 0, 0), still(2500 * time.Millisecond),
+		},
+	}
+	for i := 0; i < 8; i++ { // Turn through all headings at pitches 45° apart for the magnetometer
+		tr.Segments = append(tr.Segments, turn(4*time.Second, 0, 0, 90), turn(500*time.Millisecond, 0, 90, 0))
+	}
+	tr.Segments = append(tr.Segments, still(time.Second))
+	mpu, err := NewSynthetic(tr, WithReplaySpeed(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	setScales(mpu, 250, 2)
+	mpu.calPath = filepath.Join(t.TempDir(), "cal.json")
+
+	var steps []string
+	r, err := mpu.RunFullCalibration(func(step string) error {
+		steps = append(steps, step)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 8 {
+		t.Errorf("%d prompts, expected 8: %q", len(steps), steps)
+	}
+	for i, want := range tr.GyroBias {
+		if math.Abs(r.GyroBias[i]-want) > 1e-6 || math.Abs(r.AccelBias[i]) > 1e-3 {
+			t.Errorf("axis %d: gyro bias %g, accel bias %g, expected %g, 0", i+1, r.GyroBias[i], r.AccelBias[i], want)
+		}
+		if math.Abs(r.MagHardIron[i]) > 1 || math.Abs(r.MagScale[i]-1) > 0.02 {
+			t.Errorf("axis %d: mag hard iron %g, scale %g, expected 0, 1", i+1, r.MagHardIron[i], r.MagScale[i])
+		}
+	}
+	if !r.MagDone || math.Abs(r.MagField-defaultSyntheticField) > 1 {
+		t.Errorf("mag field %g, expected %d", r.MagField, defaultSyntheticField)
+	}
+	if math.Abs(mpu.G01*mpu.scaleGyro-0.5) > 1e-6 || mpu.calSource != "full calibration with RunFullCalibration" {
+		t.Errorf("calibration not applied: G01 %g, source %q", mpu.G01, mpu.calSource)
+	}
+	if !strings.Contains(r.String(), "Mag field:") {
+		t.Errorf("report:\n%s", r)
+	}
+
+	// An error from the prompt aborts the calibration.
+	abort := errors.New("cancelled")
+	if _, err := mpu.RunFullCalibration(func(string) error { return abort }); err != abort {
+		t.Errorf("aborted calibration returned %v", err)
+	}
+}
+
+func TestPreallocatedSamples(t *testing.T) {
+	tr := Trajectory{Segments: []TrajectorySegment{{Duration: 10 * time.Second, Rate: [3]float64{0, 0, 10}}}}
+	mpu, err := NewSynthetic(tr, WithReplaySpeed(0), WithBufferPolicy(BlockProducer), WithPreallocatedSamples(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring := 10 + bufSize + 2
+	seen := make(map[*MPUData]uint64)
+	var n uint64
+	for d := range mpu.CBuf {
+		n++
+		if d.Seq != n || d.G3 != 10 {
+			t.Fatalf("sample %d: Seq %d, G3 %g", n, d.Seq, d.G3)
+		}
+		if prev, ok := seen[d]; ok && d.Seq-prev != uint64(ring) {
+			t.Fatalf("sample %d reused sample %d's struct", d.Seq, prev)
+		}
+		seen[d] = d.Seq
+	}
+	if len(seen) != ring {
+		t.Errorf("%d structs used, expected %d", len(seen), ring)
+	}
+
+	for _, opts := range [][]Option{
+		{WithPreallocatedSamples(-1)},
+		{WithPreallocatedSamples(10), WithBufferPolicy(DropNewest)},
+	} {
+		if _, err := NewSynthetic(tr, opts...); err == nil {
+			t.Errorf("NewSynthetic accepted %d options", len(opts))
+		}
+	}
+}
+
+// BenchmarkReadSensors reads samples from CBuf at 1 kHz; compare the allocations per sample with and without
+// preallocated samples.  The bus timeout is off, as its goroutine and timer for each transaction would otherwise
+// swamp the allocations of the samples.
+func BenchmarkReadSensors(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"alloc", nil},
+		{"preallocated", []Option{WithPreallocatedSamples(100)}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			opts := append([]Option{WithSampleRate(1000), WithBusTimeout(0), WithCalibrationPath(filepath.Join(b.TempDir(), "cal.json"))},
+				bc.opts...)
+			mpu, err := NewWithBus(&fakeBus{}, opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer mpu.CloseMPU()
+			<-mpu.CBuf
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				<-mpu.CBuf
+			}
+		})
+	}
+}
+
+func TestEulerRates(t *testing.T) {
+	// A coordinated level turn at 10°/s banked 60° right reads on the pitch and yaw gyros.
+	bank := 60 * deg
+	rollRate, pitchRate, headingRate, err := EulerRates(0, 60, 0, -10*math.Sin(bank), -10*math.Cos(bank))
+	if err != nil || math.Abs(rollRate) > tolerance || math.Abs(pitchRate) > tolerance || math.Abs(headingRate-10) > tolerance {
+		t.Errorf("banked turn gave %g, %g, %g, %v, expected 0, 0, 10", rollRate, pitchRate, headingRate, err)
+	}
+
+	// Check against the change in the Euler angles of the attitude after a small rotation about the body rates.
+	type matrix = [3][3]float64
+	mul := func(a, b matrix) (c matrix) {
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				for k := 0; k < 3; k++ {
+					c[i][j] += a[i][k] * b[k][j]
+				}
+			}
+		}
+		return
+	}
+	// attitude is the rotation from the nose-right wing-down axes to north-east-down.
+	attitude := func(heading, pitch, roll float64) matrix {
+		sh, ch := math.Sincos(heading * deg)
+		sp, cp := math.Sincos(pitch * deg)
+		sr, cr := math.Sincos(roll * deg)
+		return mul(mul(matrix{{ch, -sh, 0}, {sh, ch, 0}, {0, 0, 1}}, matrix{{cp, 0, sp}, {0, 1, 0}, {-sp, 0, cp}}),
+			matrix{{1, 0, 0}, {0, cr, -sr}, {0, sr, cr}})
+	}
+	angles := func(m matrix) (heading, pitch, roll float64) {
+		return math.Atan2(m[1][0], m[0][0]) / deg, -math.Asin(m[2][0]) / deg, math.Atan2(m[2][1], m[2][2]) / deg
+	}
+	// rotate returns m after rotating about the body rates w (°/s) for dt s.
+	rotate := func(m matrix, w [3]float64, dt float64) matrix {
+		x, y, z := w[0]*deg*dt, w[1]*deg*dt, w[2]*deg*dt
+		a := math.Sqrt(x*x + y*y + z*z)
+		k := matrix{{0, -z, y}, {z, 0, -x}, {-y, x, 0}}
+		k2 := mul(k, k)
+		var r matrix
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				r[i][j] = math.Sin(a)/a*k[i][j] + (1-math.Cos(a))/(a*a)*k2[i][j]
+			}
+			r[i][i]++
+		}
+		return mul(m, r)
+	}
+	const dt = 1e-6
+	for _, tc := range []struct{ heading, pitch, roll, g1, g2, g3 float64 }{
+		{30, 0, 0, 5, -7, 11},
+		{200, 45, 30, 0, 0, 20},
+		{80, -60, -120, 15, 10, -5},
+		{10, 85, 170, -3, 12, 8},
+	} {
+		rollRate, pitchRate, headingRate, err := EulerRates(tc.pitch, tc.roll, tc.g1, tc.g2, tc.g3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := attitude(tc.heading, tc.pitch, tc.roll)
+		w := [3]float64{tc.g1, -tc.g2, -tc.g3} // Nose, right wing, down
+		h0, p0, r0 := angles(rotate(m, w, -dt))
+		h1, p1, r1 := angles(rotate(m, w, dt))
+		want := [3]float64{angleDiff(r1, r0) / (2 * dt), (p1 - p0) / (2 * dt), angleDiff(h1, h0) / (2 * dt)}
+		for i, got := range [3]float64{rollRate, pitchRate, headingRate} {
+			if math.Abs(got-want[i]) > 1e-4*(1+math.Abs(want[i])) {
+				t.Errorf("%+v: rates %g, %g, %g, expected %g, %g, %g", tc, rollRate, pitchRate, headingRate,
+					want[0], want[1], want[2])
+				break
+			}
+		}
+	}
+
+	if _, _, _, err := EulerRates(89.5, 0, 1, 1, 1); err == nil {
+		t.Error("no error near 90° pitch")
+	}
+}
+
+func TestCalibrationSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cal.json")
+	var cal mpuCalData
+	cal.reset()
+	cal.G01, cal.A02, cal.M03, cal.Ms22, cal.MagField = 12.5, -3, 7.25, 1.05, 49
+	if err := cal.save(path); err != nil {
+		t.Fatal(err)
+	}
+	mpu, err := NewWithBus(&fakeBus{regs: map[byte]byte{ICMREG_ACCEL_ZOUT_H: 0x40}}, WithCalibrationPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+
+	buf, loaded := mpu.CalibrationSnapshot()
+	var snap mpuCalData
+	if err := json.Unmarshal(buf, &snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap != cal {
+		t.Errorf("snapshot %+v, expected the file's %+v", snap, cal)
+	}
+	if loaded.IsZero() || time.Since(loaded) > time.Minute {
+		t.Errorf("calibration loaded at %s", loaded)
+	}
+
+	if drift, err := mpu.CalibrationDrift(); err != nil || drift {
+		t.Errorf("drift %v, %v with the file as loaded", drift, err)
+	}
+	cal.G01 = 13
+	if err := cal.save(path); err != nil {
+		t.Fatal(err)
+	}
+	if drift, err := mpu.CalibrationDrift(); err != nil || !drift {
+		t.Errorf("drift %v, %v after the file was rewritten", drift, err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mpu.CalibrationDrift(); err == nil {
+		t.Error("no error without the calibration file")
+	}
+}
+
+func TestReloadCalibration(t *testing.T) {
+	mpu := &ICM20948{calPath: filepath.Join(t.TempDir(), "cal.json")}
+	setScales(mpu, 250, 2)
+	mpu.mpuCalData.reset()
+	if err := mpu.ReloadCalibration(); err == nil {
+		t.Error("reloaded a missing file")
+	}
+
+	cal := mpu.mpuCalData
+	cal.G01, cal.M02, cal.Ms33, cal.MagField = 100, -20, 1.1, 48
+	if err := cal.save(mpu.calPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := mpu.ReloadCalibration(); err != nil {
+		t.Fatal(err)
+	}
+	if mpu.mpuCalData != cal || mpu.calSource != "reloaded from "+mpu.calPath {
+		t.Errorf("reloaded %+v from %q, expected %+v", mpu.mpuCalData, mpu.calSource, cal)
+	}
+	if g1, _, _ := mpu.calibrateGyro(100, 0, 0); g1 != 0 {
+		t.Errorf("reloaded gyro bias not applied: %g", g1)
+	}
+	if changes := cal.diff(mpuCalData{Ms11: 1, Ms22: 1, Ms33: 1}); len(changes) != 4 || changes[0] != "G01 0 -> 100" {
+		t.Errorf("changes %q", changes)
+	}
+
+	for _, bad := range []string{
+		`{"G01": 1}`, // No soft-iron matrix
+		`{"Ms11": 1, "Ms22": 1, "Ms33": -1}`,
+		`{"Ms11": 1, "Ms22": 1, "Ms33": 1, "MagField": -5}`,
+		`{"Ms11": 1, "Ms22": 1, "Ms33": 1, "A01": 1e400}`,
+		`not json`,
+	} {
+		if err := mpu.ReloadCalibrationFrom(strings.NewReader(bad)); err == nil {
+			t.Errorf("reloaded %s", bad)
+		}
+	}
+	if mpu.mpuCalData != cal {
+		t.Errorf("calibration changed by a failed reload: %+v", mpu.mpuCalData)
+	}
+	if err := mpu.ReloadCalibrationFrom(strings.NewReader(`{"Ms11": 1, "Ms22": 1, "Ms33": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if mpu.G01 != 0 || mpu.calSource != "reloaded from reader" {
+		t.Errorf("reload from reader gave G01 %g from %q", mpu.G01, mpu.calSource)
+	}
+}
+
+func TestHeadingWithQuality(t *testing.T) {
+	tr := Trajectory{Heading: 90, Pitch: 30, Roll: 40, Inclination: 60, Segments: []TrajectorySegment{{Duration: time.Second}}}
+	mpu, err := NewSynthetic(tr, WithReplaySpeed(0), WithBufferPolicy(BlockProducer), WithHorizon(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mpu.SetExpectedField(40); err != nil {
+		t.Fatal(err)
+	}
+	for range mpu.CBuf {
+	}
+
+	q, err := mpu.HeadingWithQuality()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTilt := math.Acos(math.Cos(30*deg)*math.Cos(40*deg)) / deg
+	if math.Abs(q.Heading-90) > 0.01 || math.Abs(q.Tilt-wantTilt) > 0.01 || q.Degraded || q.Anomaly {
+		t.Errorf("quality %+v, expected heading 90, tilt %g", q, wantTilt)
+	}
+	if math.Abs(q.Field-defaultSyntheticField) > 1e-6 || math.Abs(q.FieldRatio-1.25) > 1e-6 {
+		t.Errorf("field %g, ratio %g, expected 50, 1.25", q.Field, q.FieldRatio)
+	}
+	if !q.Reliable() {
+		t.Error("not reliable at 49° tilt")
+	}
+	if q.Tilt = 70; q.Reliable() {
+		t.Error("reliable at 70° tilt")
+	}
+	if _, err := new(ICM20948).HeadingWithQuality(); err == nil {
+		t.Error("heading without the horizon filter")
+	}
+}
+
+func TestHorizonConvergence(t *testing.T) {
+	const rate = 100
+	f := newHorizonFilter(time.Second, true)
+	t0 := time.Now()
+	var i int
+	// feed feeds n samples with the given accel readings and no rotation.
+	feed := func(n int, a1, a2, a3 float64) {
+		for ; n > 0; n-- {
+			f.update(&MPUData{A1: a1, A2: a2, A3: a3, T: t0.Add(time.Duration(i) * time.Second / rate)}, true)
+			i++
+		}
+	}
+
+	// Starting level, the estimate follows a step to 30° of roll over the time constant.
+	feed(1, 0, 0, 1)
+	feed(rate, 0, math.Sin(30*deg), math.Cos(30*deg))
+	if want := 30 * (1 - math.Exp(-1)); math.Abs(f.h.Roll-want) > 0.5 {
+		t.Errorf("roll %g after one time constant, expected about %g", f.h.Roll, want)
+	}
+	feed(4*rate, 0, math.Sin(30*deg), math.Cos(30*deg))
+	if math.Abs(f.h.Roll-30) > 0.3 || math.Abs(f.h.Pitch) > 1e-9 {
+		t.Errorf("roll %g, pitch %g after five time constants, expected 30, 0", f.h.Roll, f.h.Pitch)
+	}
+
+	// Accelerometer noise is smoothed: compare the spread of the estimate with that of the raw tilt.
+	feed(5*rate, 0, 0, 1)
+	rng := rand.New(rand.NewSource(1))
+	var rawSq, filteredSq float64
+	var n int
+	for j := 0; j < 5*rate; j++ {
+		a1, a2, a3 := 0.05*rng.NormFloat64(), 0.05*rng.NormFloat64(), 1+0.05*rng.NormFloat64()
+		feed(1, a1, a2, a3)
+		roll, pitch, _ := accelTilt(a1, a2, a3)
+		rawSq += roll*roll + pitch*pitch
+		filteredSq += f.h.Roll*f.h.Roll + f.h.Pitch*f.h.Pitch
+		n++
+	}
+	raw, filtered := math.Sqrt(rawSq/float64(n)), math.Sqrt(filteredSq/float64(n))
+	if filtered > raw/5 {
+		t.Errorf("RMS tilt %g° from the filter, %g° raw, expected the noise reduced at least five times", filtered, raw)
+	}
+}
+
+func TestCHorizon(t *testing.T) {
+	// Held still for 1.5 s with a gyro roll bias of 5°/s, which a time constant of 0.2 s turns into 1° of error.
+	// The trajectory fits in the CHorizon buffer, so it can be read after the replay.
+	tr := Trajectory{SampleRate: 50, Pitch: 10, Roll: -20, Inclination: 60, GyroBias: [3]float64{5, 0, 0},
+		Segments: []TrajectorySegment{{Duration: 1500 * time.Millisecond}}}
+	mpu, err := NewSynthetic(tr, WithReplaySpeed(0), WithBufferPolicy(BlockProducer),
+		WithHorizon(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var times []time.Time
+	for d := range mpu.CBuf {
+		times = append(times, d.T)
+	}
+	var h HorizonData
+	n := 0
+	for h = range mpu.CHorizon {
+		if n >= len(times) || !h.T.Equal(times[n]) || !h.AttitudeValid || n > 0 && !h.HeadingValid {
+			t.Fatalf("estimate %d is %+v", n, h)
+		}
+		n++
+	}
+	if n != len(times) || n != 76 {
+		t.Errorf("%d estimates for %d samples, expected 76", n, len(times))
+	}
+	if math.Abs(h.Roll+19) > 0.05 || math.Abs(h.Pitch-10) > 0.05 || math.Abs(angleDiff(h.Heading, 0)) > 0.5 {
+		t.Errorf("final pitch %g, roll %g, heading %g, expected 10, -19, 0", h.Pitch, h.Roll, h.Heading)
+	}
+}
+
+func TestBiasTracking(t *testing.T) {
+	const rate, bias = 100, 0.3 // Hz, °/s on G1
+	mpu := &ICM20948{scaleGyro: 250.0 / math.MaxInt16,
+		stationary: stationaryDetector{maxGyro: defaultStationaryMaxGyro, maxAccel: defaultStationaryMaxAccel,
+			window: defaultStationaryWindow}}
+	if err := mpu.SetBiasTracking(0.01); err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Now()
+	var i int
+	// feed feeds n samples rotating at g3 °/s, with the gyro reading the true bias less the current estimate.
+	feed := func(n int, g3 float64) {
+		for ; n > 0; n-- {
+			b, _, _ := mpu.CurrentGyroBias()
+			mpu.trackBias(&MPUData{G1: bias - b, G3: g3, A3: 1, T: t0.Add(time.Duration(i) * time.Second / rate)})
+			i++
+		}
+	}
+
+	// A slow turn isn't stationary, so it never changes the bias.
+	feed(10*rate, 2)
+	if b, _, _ := mpu.CurrentGyroBias(); b != 0 || mpu.IsStationary() {
+		t.Errorf("bias %g, stationary %t while turning", b, mpu.IsStationary())
+	}
+	// Nor does the window after it.
+	feed(2*rate-1, 0)
+	if b, _, _ := mpu.CurrentGyroBias(); b != 0 || mpu.IsStationary() {
+		t.Errorf("bias %g, stationary %t before the window is up", b, mpu.IsStationary())
+	}
+	// Once stationary, the bias converges.
+	feed(5*rate, 0)
+	if b, _, _ := mpu.CurrentGyroBias(); math.Abs(b-bias) > 0.01*bias || !mpu.IsStationary() {
+		t.Errorf("bias %g, stationary %t, expected %g", b, mpu.IsStationary(), bias)
+	}
+	// A bump stops it at once.
+	b0, _, _ := mpu.CurrentGyroBias()
+	mpu.trackBias(&MPUData{G1: 5, A3: 1.2, T: t0.Add(time.Duration(i) * time.Second / rate)})
+	if b, _, _ := mpu.CurrentGyroBias(); b != b0 || mpu.IsStationary() {
+		t.Errorf("bias %g, stationary %t after a bump", b, mpu.IsStationary())
+	}
+
+	if mpu.SetBiasTracking(-0.1) == nil || mpu.SetBiasTracking(2) == nil || mpu.SetBiasTracking(math.NaN()) == nil {
+		t.Error("invalid gain accepted")
+	}
+	if mpu.SetStationaryThresholds(0, 0.05, time.Second) == nil || mpu.SetStationaryThresholds(1, 0.05, 0) == nil {
+		t.Error("invalid stationary thresholds accepted")
+	}
+	var bus embd.I2CBus = &fakeBus{}
+	if _, err := NewWithOptions(&bus, WithBiasTracking(-1)); err == nil {
+		t.Error("NewWithOptions accepted a negative bias tracking gain")
+	}
+}
+
+func TestTempEvery(t *testing.T) {
+	fb := &fakeBus{}
+	mpu, err := NewWithBus(fb, WithTempEvery(0), WithSampleRate(200), WithMagnetometer(false),
+		WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	setTemp := func(raw int16) {
+		fb.mu.Lock()
+		fb.regs[ICMREG_TEMP_OUT_H], fb.regs[ICMREG_TEMP_OUT_L] = byte(raw>>8), byte(raw)
+		fb.mu.Unlock()
+	}
+	// nextTemp returns the temperature of the first sample read after the call.
+	nextTemp := func() float64 {
+		var seq uint64
+		if d := mpu.latestData(); d != nil {
+			seq = d.Seq
+		}
+		for d := range mpu.C {
+			if d.Seq > seq+1 {
+				return d.Temp
+			}
+		}
+		t.Fatal("driver closed")
+		return 0
+	}
+
+	setTemp(3339)
+	if temp := nextTemp(); temp != tempValue(0) {
+		t.Errorf("temperature %g read with SetTempEvery(0)", temp)
+	}
+	temp, err := mpu.ReadTemperature()
+	if err != nil || math.Abs(temp-31) > 0.01 {
+		t.Errorf("ReadTemperature gave %g, %v, expected 31", temp, err)
+	}
+	if d := nextTemp(); d != temp {
+		t.Errorf("samples carry %g after ReadTemperature, expected %g", d, temp)
+	}
+
+	if err := mpu.SetTempEvery(3); err != nil {
+		t.Fatal(err)
+	}
+	setTemp(0)
+	for i := 0; i < 3; i++ {
+		nextTemp()
+	}
+	if temp := nextTemp(); temp != tempValue(0) {
+		t.Errorf("temperature %g not read with SetTempEvery(3)", temp)
+	}
+
+	if err := mpu.SetTempEvery(-1); err == nil {
+		t.Error("SetTempEvery accepted -1")
+	}
+	if _, err := NewWithBus(&fakeBus{}, WithTempEvery(-1)); err == nil {
+		t.Error("NewWithBus accepted WithTempEvery(-1)")
+	}
+}
+
+func TestInitTrace(t *testing.T) {
+	var tr InitTrace
+	mpu, err := NewWithBus(&fakeBus{}, WithInitTrace(&tr), WithMagnetometer(true),
+		WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	var reset, gyroConfig, mag bool
+	for _, e := range tr.Events {
+		if !e.Write || e.Err != nil || e.Attempt != 1 {
+			t.Fatalf("unexpected event %+v", e)
+		}
+		if e.Readback != e.Value {
+			t.Errorf("%s: register 0x%02X read back 0x%02X, wrote 0x%02X", e.Step, e.Register, e.Readback, e.Value)
+		}
+		switch {
+		case e.Register == ICMREG_PWR_MGMT_1 && e.Value == BIT_H_RESET:
+			reset = e.Step == "reset" && e.Bank == 0
+		case e.Register == ICMREG_GYRO_CONFIG && e.Step == "sensitivity":
+			gyroConfig = e.Bank == 2
+		case e.Register == ICMREG_USER_CTRL:
+			mag = mag || e.Step == "magnetometer"
+		}
+	}
+	if !reset || !gyroConfig || !mag {
+		t.Errorf("reset %t, gyro config %t, magnetometer %t traced", reset, gyroConfig, mag)
+	}
+	if s := tr.String(); !strings.Contains(s, "1 reset            bank 0 reg 0x06 <- 0x80") {
+		t.Errorf("trace doesn't show the reset:\n%s", s)
+	}
+	n := len(tr.Events)
+	if err := mpu.SetGyroSensitivity(500); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Events) != n {
+		t.Error("writes traced after the constructor")
+	}
+
+	// A failing bring-up leaves the failed writes and the error ending each attempt.
+	tr = InitTrace{}
+	if _, err := NewWithBus(&fakeBus{fail: true}, WithInitTrace(&tr), WithInitRetries(1, 0)); err == nil {
+		t.Fatal("bring-up succeeded on a failing bus")
+	}
+	var failures int
+	for _, e := range tr.Events {
+		if e.Err == nil {
+			t.Errorf("event %+v succeeded on a failing bus", e)
+		}
+		if !e.Write {
+			failures++
+			if e.Attempt != failures || e.Step != "reset" {
+				t.Errorf("attempt %d ended in %q, expected attempt %d in reset", e.Attempt, e.Step, failures)
+			}
+		}
+	}
+	if failures != 2 {
+		t.Errorf("%d failed attempts traced, expected 2", failures)
+	}
+}
+
+func TestReadRawBlock(t *testing.T) {
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_I2C_MST_STATUS: BIT_I2C_SLV4_DONE}}
+	mpu, err := NewWithBus(fb, WithSampleRate(100), WithMagnetometer(true),
+		WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	if err := mpu.ConfigureAuxSlave(2, 0x77, 0xF7, 6); err != nil {
+		t.Fatal(err)
+	}
+	fb.mu.Lock()
+	for i := byte(0); i < 40; i++ {
+		fb.regs[ICMREG_ACCEL_XOUT_H+i] = 100 + i
+	}
+	fb.mu.Unlock()
+
+	start := time.Now()
+	block, tr, err := mpu.ReadRawBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Accel, gyro and temperature, the magnetometer's 9 bytes and aux slave 2's 6.
+	if len(block) != 14+9+6 {
+		t.Fatalf("read %d bytes, expected 29", len(block))
+	}
+	for i, b := range block {
+		if b != 100+byte(i) {
+			t.Errorf("byte %d is %d, expected %d", i, b, 100+i)
+		}
+	}
+	if tr.Before(start) || time.Since(tr) > time.Second {
+		t.Errorf("read at %s, started at %s", tr, start)
+	}
+
+	fb.mu.Lock()
+	fb.fail = true
+	fb.mu.Unlock()
+	if _, _, err := mpu.ReadRawBlock(); !errors.Is(err, errFakeBus) {
+		t.Errorf("failed read returned %v", err)
+	}
+	fb.mu.Lock()
+	fb.fail = false
+	fb.mu.Unlock()
+}
+
+func TestSetMagEnabled(t *testing.T) {
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_I2C_MST_STATUS: BIT_I2C_SLV4_DONE}}
+	fb.onRead = func(reg, v byte) byte {
+		switch reg {
+		case ICMREG_EXT_SENS_DATA_00:
+			return AK09916_ST1_DRDY
+		case ICMREG_EXT_SENS_DATA_00 + 8:
+			return 0
+		}
+		return v
+	}
+	mpu, err := NewWithBus(fb, WithSampleRate(100), WithMagnetometer(true),
+		WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	reg := func(r byte) byte {
+		fb.mu.Lock()
+		defer fb.mu.Unlock()
+		return fb.regs[r]
+	}
+	// magError waits up to a second for a sample with MagError want.
+	magError := func(want error) {
+		deadline := time.Now().Add(time.Second)
+		for d := range mpu.C {
+			if d.MagError == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("MagError %v, expected %v", d.MagError, want)
+			}
+		}
+	}
+
+	magError(nil)
+	if err := mpu.SetMagEnabled(false); err != nil {
+		t.Fatal(err)
+	}
+	if mpu.MagEnabled() {
+		t.Error("MagEnabled after powering the magnetometer down")
+	}
+	if reg(ICMREG_I2C_SLV0_CTRL) != 0 || reg(ICMREG_I2C_SLV1_CTRL) != 0 ||
+		reg(ICMREG_I2C_SLV4_DO) != AK09916_MODE_POWER_DOWN {
+		t.Errorf("SLV0_CTRL 0x%02X, SLV1_CTRL 0x%02X, SLV4_DO 0x%02X after powering down", reg(ICMREG_I2C_SLV0_CTRL),
+			reg(ICMREG_I2C_SLV1_CTRL), reg(ICMREG_I2C_SLV4_DO))
+	}
+	magError(errMagOff)
+	reads := mpu.Stats().MagReadCount
+	time.Sleep(100 * time.Millisecond)
+	if n := mpu.Stats().MagReadCount; n != reads {
+		t.Errorf("%d magnetometer reads while powered down", n-reads)
+	}
+
+	if err := mpu.SetMagEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+	if !mpu.MagEnabled() {
+		t.Error("magnetometer not enabled after powering it up")
+	}
+	if reg(ICMREG_I2C_SLV0_CTRL) != BIT_SLAVE_EN|magSlaveLen || reg(ICMREG_I2C_SLV1_CTRL) != BIT_SLAVE_EN|1 {
+		t.Errorf("SLV0_CTRL 0x%02X, SLV1_CTRL 0x%02X after powering up", reg(ICMREG_I2C_SLV0_CTRL),
+			reg(ICMREG_I2C_SLV1_CTRL))
+	}
+	magError(nil)
+
+	noMag, err := NewWithBus(&fakeBus{}, WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer noMag.CloseMPU()
+	if err := noMag.SetMagEnabled(true); err == nil {
+		t.Error("powered up a magnetometer that wasn't enabled")
+	}
+	if err := noMag.SetMagEnabled(false); err != nil {
+		t.Errorf("powering down a magnetometer that wasn't enabled: %v", err)
+	}
+}
+
+func TestRateCheck(t *testing.T) {
+	// At 50 Hz the gyro is polled every 23 ms, 43.5 Hz; a perfect bus is not a shortfall.
+	var r rateMeter
+	t0, period := time.Unix(0, 0), tickerPeriod(50)
+	for i := 0; i < 44; i++ {
+		if r.update(t0.Add(time.Duration(i) * period)) {
+			t.Fatalf("window completed after %d reads", i+1)
+		}
+	}
+	if !r.update(t0.Add(44 * period)) {
+		t.Fatal("window not completed after a second of reads")
+	}
+	if want := tickRate(50); math.Abs(r.rate-want) > 0.01 {
+		t.Errorf("measured %g Hz polling every %s, want %g Hz", r.rate, period, want)
+	}
+	mpu := &ICM20948{rate: r, rateCheck: true, logThrottle: logThrottle{first: 1}}
+	if msg := mpu.rateShort(50); msg != "" || mpu.stats.RateShortfalls != 0 {
+		t.Errorf("full polling rate gave %d shortfalls, warning %q", mpu.stats.RateShortfalls, msg)
+	}
+
+	// Dropping every other tick halves the rate.
+	t1 := t0.Add(44 * period)
+	for i := 1; !mpu.rate.update(t1.Add(time.Duration(2*i) * period)); i++ {
+	}
+	if msg := mpu.rateShort(50); !strings.Contains(msg, "21.7 Hz") || mpu.stats.RateShortfalls != 1 {
+		t.Errorf("half polling rate gave %d shortfalls, warning %q", mpu.stats.RateShortfalls, msg)
+	}
+	mpu.rate.restart()
+	if mpu.rate.update(t1.Add(time.Hour)) {
+		t.Error("window completed by the first read after a restart")
+	}
+
+	// The live loop measures a rate once it has been reading for a second.
+	calPath := filepath.Join(t.TempDir(), "cal.json")
+	mpu, err := NewWithBus(&fakeBus{regs: map[byte]byte{ICMREG_ACCEL_ZOUT_H: 0x40}}, WithSampleRate(100),
+		WithRateCheck(true), WithCalibrationPath(calPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	if r := mpu.AchievedRate(); r != 0 {
+		t.Errorf("achieved %g Hz before a whole second of reads", r)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if r := mpu.AchievedRate(); r == 0 {
+		t.Error("no rate measured after 1.5s of reads")
+	}
+
+	// Seven 2 ms reads per sample can't keep up with 200 Hz.
+	slow := &fakeBus{delay: 2 * time.Millisecond}
+	if _, err := NewWithBus(slow, WithSampleRate(200), WithRateCheck(true), WithCalibrationPath(calPath)); err == nil {
+		t.Error("strict rate check passed a bus too slow for the rate")
+	}
+}
+
+func TestPinnedThread(t *testing.T) {
+	mpu, err := NewWithBus(&fakeBus{}, WithPinnedThread(1), WithBusTimeout(0),
+		WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-mpu.CBuf
+	mpu.CloseMPU()
+	if _, err := NewWithBus(&fakeBus{}, WithPinnedThread(20)); err == nil {
+		t.Error("nice value of 20 accepted")
+	}
+
+	// Raising the nice value (lowering the priority) needs no privileges.  The thread is left locked, so it ends
+	// with the goroutine.
+	errc := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		old, err := threadNice()
+		if err != nil {
+			errc <- err
+			return
+		}
+		if err := setThreadNice(old + 1); err != nil {
+			errc <- err
+			return
+		}
+		if nice, err := threadNice(); err != nil || nice != old+1 {
+			errc <- fmt.Errorf("nice value %d, %v after setting it to %d", nice, err, old+1)
+			return
+		}
+		errc <- nil
+	}()
+	if err := <-errc; err != nil {
+		if runtime.GOOS != "linux" {
+			t.Skip(err)
+		}
+		t.Error(err)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	fb := &fakeBus{regs: map[byte]byte{ICMREG_ACCEL_ZOUT_H: 0x40}}
+	mpu, err := NewWithBus(fb, WithSampleRate(100), WithCalibrationPath(filepath.Join(t.TempDir(), "cal.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	mpu.mu.Lock()
+	want := mpu.gyroConfig
+	mpu.mu.Unlock()
+	if want == 0 {
+		t.Fatal("GYRO_CONFIG configured as 0, the default a brownout leaves")
+	}
+	gyroConfig := func() byte {
+		fb.mu.Lock()
+		defer fb.mu.Unlock()
+		return fb.regs[ICMREG_GYRO_CONFIG]
+	}
+	// waitStats waits up to a second for ok to be true of the stats.
+	waitStats := func(ok func(Stats) bool) {
+		deadline := time.Now().Add(time.Second)
+		for range mpu.C {
+			if ok(mpu.Stats()) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("stats %+v not as expected", mpu.Stats())
+			}
+		}
+	}
+
+	// A brownout resets GYRO_CONFIG to its default.
+	if err := mpu.SetConfigCheck(20*time.Millisecond, false); err != nil {
+		t.Fatal(err)
+	}
+	fb.mu.Lock()
+	fb.regs[ICMREG_GYRO_CONFIG] = 0
+	fb.mu.Unlock()
+	waitStats(func(s Stats) bool { return s.ConfigMismatches > 0 })
+	if s := mpu.Stats(); s.ConfigRecoveries != 0 || gyroConfig() != 0 {
+		t.Errorf("%d recoveries, GYRO_CONFIG 0x%02X without auto-recovery", s.ConfigRecoveries, gyroConfig())
+	}
+
+	if err := mpu.SetConfigCheck(20*time.Millisecond, true); err != nil {
+		t.Fatal(err)
+	}
+	waitStats(func(s Stats) bool { return s.ConfigRecoveries > 0 })
+	if r := gyroConfig(); r != want {
+		t.Errorf("GYRO_CONFIG 0x%02X after recovery, want 0x%02X", r, want)
+	}
+	mismatches := mpu.Stats().ConfigMismatches
+	time.Sleep(100 * time.Millisecond)
+	if n := mpu.Stats().ConfigMismatches; n != mismatches {
+		t.Errorf("%d mismatches after the configuration was re-applied", n-mismatches)
+	}
+}
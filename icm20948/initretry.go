@@ -0,0 +1,41 @@
+package icm20948
+
+import (
+	"log"
+	"time"
+)
+
+/*
+WithInitRetries makes the constructor retry the bring-up of the chip (the reset and configuration) up to n more
+times, waiting backoff before each retry, if it fails, e.g. because the chip is still powering up or the bus
+glitched.  Each failed attempt is logged and the last error is returned if they all fail.  The default, n of 0,
+is a single attempt.
+*/
+func WithInitRetries(n int, backoff time.Duration) Option {
+	return func(mpu *ICM20948) {
+		mpu.initRetries = n
+		mpu.initBackoff = backoff
+	}
+}
+
+// configureWithRetries configures the chip, retrying as set with WithInitRetries.
+func (mpu *ICM20948) configureWithRetries() error {
+	attempt := func() error {
+		if mpu.initTrace != nil {
+			mpu.initTrace.attempt++
+		}
+		err := mpu.configure()
+		if err != nil {
+			mpu.initTrace.fail(err)
+		}
+		return err
+	}
+	err := attempt()
+	for i := 0; err != nil && i < mpu.initRetries; i++ {
+		log.Printf("ICM20948 Warning: bring-up attempt %d of %d failed, retrying in %s: %s\n",
+			i+1, mpu.initRetries+1, mpu.initBackoff, err)
+		time.Sleep(mpu.initBackoff)
+		err = attempt()
+	}
+	return err
+}
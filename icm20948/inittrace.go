@@ -0,0 +1,98 @@
+package icm20948
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// InitEvent is one register write of the bring-up recorded by WithInitTrace, or, if Write is false, the error
+// that ended a bring-up attempt.
+type InitEvent struct {
+	Attempt  int           // Bring-up attempt, counting from 1; see WithInitRetries
+	Step     string        // Part of the bring-up, e.g. "reset" or "magnetometer"
+	Write    bool          // The event is a register write
+	Bank     byte          // Register bank selected for the write
+	Register byte          // Register written
+	Value    byte          // Value written
+	Readback byte          // Value read back after the write; for the reset, which isn't read back, the value written
+	Duration time.Duration // Time taken by the write and the readback
+	Err      error         // Error from the write or readback, or the one that ended the attempt
+}
+
+// InitTrace is the record of the bring-up kept by WithInitTrace.
+type InitTrace struct {
+	Events []InitEvent
+
+	attempt int    // Current bring-up attempt
+	step    string // Current part of the bring-up
+	bank    byte   // Register bank selected
+}
+
+/*
+WithInitTrace makes the constructor record the bring-up of the chip into t: each register written during the
+reset and configuration, the hardware offset setup and any retries, with the part of the bring-up it belongs to,
+the value read back after it, how long it took and whether it failed, and the error that ended each failed
+attempt.  t is filled in even if the constructor fails, so a failing bring-up can be inspected, or dumped with
+String for a bug report, without scraping the log.  Only the constructor's bring-up is recorded, not later
+re-initializations.  Without it, the bring-up has no tracing overhead.
+*/
+func WithInitTrace(t *InitTrace) Option {
+	return func(mpu *ICM20948) {
+		mpu.initTrace = t
+	}
+}
+
+// String returns the trace compactly, one event per line, marking readbacks that differ from the value written.
+func (t *InitTrace) String() string {
+	var b strings.Builder
+	for _, e := range t.Events {
+		if !e.Write {
+			fmt.Fprintf(&b, "%d %-16s failed: %v\n", e.Attempt, e.Step, e.Err)
+			continue
+		}
+		fmt.Fprintf(&b, "%d %-16s bank %d reg 0x%02X <- 0x%02X", e.Attempt, e.Step, e.Bank, e.Register, e.Value)
+		if e.Err == nil && e.Readback != e.Value {
+			fmt.Fprintf(&b, " (reads 0x%02X)", e.Readback)
+		}
+		fmt.Fprintf(&b, " %s", e.Duration.Round(time.Microsecond))
+		if e.Err != nil {
+			fmt.Fprintf(&b, " error: %v", e.Err)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// traceStep starts the named part of the bring-up in the init trace, if there is one.
+func (mpu *ICM20948) traceStep(step string) {
+	if mpu.initTrace != nil {
+		mpu.initTrace.step = step
+	}
+}
+
+// traceWrite records a register write that took since start and returned err in the init trace, reading the
+// register back if the write succeeded.
+func (mpu *ICM20948) traceWrite(register, value byte, start time.Time, err error) {
+	t := mpu.initTrace
+	e := InitEvent{Attempt: t.attempt, Step: t.step, Write: true, Bank: t.bank, Register: register, Value: value, Err: err}
+	if err == nil {
+		if register == ICMREG_BANK_SEL {
+			t.bank = value >> 4
+		}
+		if register == ICMREG_PWR_MGMT_1 && value&BIT_H_RESET != 0 {
+			e.Readback = value
+		} else {
+			e.Readback, e.Err = mpu.i2cRead(register)
+		}
+	}
+	e.Duration = time.Since(start)
+	t.Events = append(t.Events, e)
+}
+
+// fail records err as ending the current bring-up attempt.  t may be nil.
+func (t *InitTrace) fail(err error) {
+	if t != nil {
+		t.Events = append(t.Events, InitEvent{Attempt: t.attempt, Step: t.step, Err: err})
+	}
+}
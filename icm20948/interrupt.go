@@ -0,0 +1,47 @@
+package icm20948
+
+import "errors"
+
+// InterruptStatus holds the decoded ICM20948 interrupt status registers.
+type InterruptStatus struct {
+	WakeOnMotion  bool // Wake on motion interrupt occurred (INT_STATUS)
+	PLLReady      bool // PLL enabled and ready (INT_STATUS)
+	DMP           bool // DMP interrupt 1 occurred (INT_STATUS)
+	I2CMaster     bool // I2C master interrupt occurred (INT_STATUS)
+	DataReady     bool // New accel/gyro/temperature data is ready (INT_STATUS_1)
+	FIFOOverflow  bool // A FIFO overflowed (INT_STATUS_2)
+	FIFOWatermark bool // A FIFO reached its watermark (INT_STATUS_3)
+}
+
+/*
+ReadInterruptStatus reads and decodes INT_STATUS and INT_STATUS_1/2/3.
+The chip clears each status register when it is read (the driver leaves INT_ANYRD_2CLEAR off), so calling
+this both reports and clears any pending interrupts.  It works whether or not interrupts are routed to the
+INT pin, which makes it useful for polling overflow and DMP events as well as for debugging why an interrupt fired.
+*/
+func (mpu *ICM20948) ReadInterruptStatus() (InterruptStatus, error) {
+	var (
+		st  InterruptStatus
+		reg [4]byte
+	)
+
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	for i, r := range []byte{ICMREG_INT_STATUS, ICMREG_INT_STATUS_1, ICMREG_INT_STATUS_2, ICMREG_INT_STATUS_3} {
+		v, err := mpu.i2cRead(r)
+		if err != nil {
+			return st, errors.New("ICM20948 Error: ReadInterruptStatus error reading chip")
+		}
+		reg[i] = v
+	}
+
+	st.WakeOnMotion = reg[0]&BIT_WOM_INT != 0
+	st.PLLReady = reg[0]&BIT_PLL_RDY_INT != 0
+	st.DMP = reg[0]&BIT_DMP_INT1 != 0
+	st.I2CMaster = reg[0]&BIT_I2C_MST_INT != 0
+	st.DataReady = reg[1]&BIT_RAW_DATA_0_RDY_INT != 0
+	st.FIFOOverflow = reg[2]&BITS_FIFO_INT_MASK != 0
+	st.FIFOWatermark = reg[3]&BITS_FIFO_INT_MASK != 0
+	return st, nil
+}
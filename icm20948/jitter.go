@@ -0,0 +1,41 @@
+package icm20948
+
+import (
+	"math"
+	"time"
+)
+
+/*
+jitterStats accumulates the jitter of the accel/gyro reads: how far the time between successive reads of a
+sensor differs from the polling period.  The reads are timed on the host when they complete, so this measures
+the timing of the samples as delivered, including scheduling and bus delays.  It assumes the chip's own output
+data rate is stable, as it is with the PLL clock source, so errors in the chip's timing are not included.
+A read that is a whole period late also shows up here, since the polling ticker then drops a tick.
+*/
+type jitterStats struct {
+	n     int
+	sumSq float64 // Sum of squared jitter, s²
+	max   time.Duration
+}
+
+// update adds the jitter of one read.  The caller must hold mpu.mu.
+func (j *jitterStats) update(jitter time.Duration) {
+	if jitter == 0 {
+		return // First read of a sensor: no interval yet.
+	}
+	j.n++
+	j.sumSq += jitter.Seconds() * jitter.Seconds()
+	if jitter < 0 {
+		jitter = -jitter
+	}
+	if jitter > j.max {
+		j.max = jitter
+	}
+}
+
+func (j *jitterStats) rms() time.Duration {
+	if j.n == 0 {
+		return 0
+	}
+	return time.Duration(math.Sqrt(j.sumSq/float64(j.n)) * float64(time.Second))
+}
@@ -0,0 +1,66 @@
+package icm20948
+
+import (
+	"time"
+
+	"github.com/b3nn0/goflying/ahrs"
+)
+
+// mpuDataLogMap defines the standard CSV columns for logging MPUData.  Times are in ms since t0.
+var mpuDataLogMap = map[string]func(t0 time.Time, m *MPUData) float64{
+	"T": func(t0 time.Time, m *MPUData) float64 { return float64(m.T.Sub(t0).Nanoseconds()/1000) / 1000 },
+	"TM": func(t0 time.Time, m *MPUData) float64 {
+		return float64(m.TM.Sub(t0).Nanoseconds()/1000) / 1000
+	},
+	"A1":   func(t0 time.Time, m *MPUData) float64 { return m.A1 },
+	"A2":   func(t0 time.Time, m *MPUData) float64 { return m.A2 },
+	"A3":   func(t0 time.Time, m *MPUData) float64 { return m.A3 },
+	"B1":   func(t0 time.Time, m *MPUData) float64 { return m.G1 },
+	"B2":   func(t0 time.Time, m *MPUData) float64 { return m.G2 },
+	"B3":   func(t0 time.Time, m *MPUData) float64 { return m.G3 },
+	"M1":   func(t0 time.Time, m *MPUData) float64 { return m.M1 },
+	"M2":   func(t0 time.Time, m *MPUData) float64 { return m.M2 },
+	"M3":   func(t0 time.Time, m *MPUData) float64 { return m.M3 },
+	"Temp": func(t0 time.Time, m *MPUData) float64 { return m.Temp },
+}
+
+// MPUDataLogger is an AHRSLogger that writes MPUData with the standard set of columns:
+// T, TM (ms), A1-A3 (G), B1-B3 (gyro, °/s), M1-M3 (µT) and Temp (°C).
+// For custom columns, use an ahrs.AHRSLogger with your own log map instead.
+type MPUDataLogger struct {
+	*ahrs.AHRSLogger
+	logMap map[string]interface{}
+}
+
+// NewMPUDataLogger creates a CSV log of MPUData at filename.
+func NewMPUDataLogger(filename string) *MPUDataLogger {
+	l := newMPUDataLogger()
+	l.AHRSLogger = ahrs.NewAHRSLogger(filename, l.logMap)
+	return l
+}
+
+// NewGzipMPUDataLogger creates a gzip-compressed CSV log of MPUData at filename + ".gz".
+// Close must be called to finish the gzip stream.
+func NewGzipMPUDataLogger(filename string) *MPUDataLogger {
+	l := newMPUDataLogger()
+	l.AHRSLogger = ahrs.NewGzipAHRSLogger(filename, l.logMap)
+	return l
+}
+
+func newMPUDataLogger() *MPUDataLogger {
+	l := &MPUDataLogger{logMap: make(map[string]interface{})}
+	l.updateLogMap(time.Time{}, new(MPUData))
+	return l
+}
+
+// LogMPUData writes m as a row of the log, with times relative to t0.
+func (l *MPUDataLogger) LogMPUData(t0 time.Time, m *MPUData) {
+	l.updateLogMap(t0, m)
+	l.Log()
+}
+
+func (l *MPUDataLogger) updateLogMap(t0 time.Time, m *MPUData) {
+	for k, f := range mpuDataLogMap {
+		l.logMap[k] = f(t0, m)
+	}
+}
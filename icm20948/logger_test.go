@@ -0,0 +1,211 @@
+package icm20948
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kidoman/embd"
+)
+
+func TestGzipMPUDataLogger(t *testing.T) {
+	dir, err := os.MkdirTemp("", "icm20948")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "log.csv")
+
+	t0 := time.Now()
+	data := []*MPUData{
+		{A1: 0.5, G2: -3, M3: 42, Temp: 25, T: t0.Add(10 * time.Millisecond)},
+		{A1: -0.25, G2: 7, M3: -12, Temp: 26, T: t0.Add(20 * time.Millisecond)},
+	}
+	l := NewGzipMPUDataLogger(filename)
+	for _, d := range data {
+		l.LogMPUData(t0, d)
+	}
+	l.Close()
+
+	f, err := os.Open(filename + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(gz).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(data)+1 {
+		t.Fatalf("got %d rows, want a header and %d rows", len(rows), len(data))
+	}
+
+	for i, d := range data {
+		for j, col := range rows[0] {
+			got, err := strconv.ParseFloat(rows[i+1][j], 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := mpuDataLogMap[col](t0, d); got != want {
+				t.Errorf("row %d column %s is %v, want %v", i, col, got, want)
+			}
+		}
+	}
+}
+
+func TestReplayFromCSV(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "mpudata.csv")
+	t0 := time.Now()
+	l := NewMPUDataLogger(filename)
+	for i := 0; i < 5; i++ {
+		l.LogMPUData(t0, &MPUData{
+			A1: float64(i), G2: -float64(i), M3: 40 + float64(i), Temp: 25,
+			T: t0.Add(time.Duration(i+1) * 10 * time.Millisecond), TM: t0.Add(time.Duration(i+1) * 10 * time.Millisecond),
+		})
+	}
+	l.Close()
+
+	if _, err := ReplayFromCSV(filename, WithReplaySpeed(-1)); err == nil {
+		t.Error("negative replay speed accepted")
+	}
+
+	mpu, err := ReplayFromCSV(filename, WithReplaySpeed(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	if mpu.SampleRate() != 100 || !mpu.MagEnabled() {
+		t.Errorf("sample rate %d Hz and mag enabled %t, want 100 Hz with the mag", mpu.SampleRate(), mpu.MagEnabled())
+	}
+	var i int
+	for d := range mpu.CBuf {
+		if d.A1 != float64(i) || d.G2 != -float64(i) || d.M3 != 40+float64(i) || d.Temp != 25 || d.MagError != nil {
+			t.Errorf("sample %d replayed as %+v", i, d)
+		}
+		if i > 0 && d.DT != 10*time.Millisecond {
+			t.Errorf("sample %d DT %s, want 10ms", i, d.DT)
+		}
+		if d.Seq != uint64(i+1) {
+			t.Errorf("sample %d Seq %d", i, d.Seq)
+		}
+		i++
+	}
+	if i != 5 || mpu.Stats().Samples != 5 {
+		t.Errorf("replayed %d samples, %d in Stats, want 5", i, mpu.Stats().Samples)
+	}
+	if _, ok := <-mpu.C; ok {
+		t.Error("C still open at the end of the log")
+	}
+}
+
+func TestWaitForMagFix(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "mpudata.csv")
+	t0 := time.Now()
+	l := NewMPUDataLogger(filename)
+	l.LogMPUData(t0, &MPUData{M1: 20, T: t0.Add(10 * time.Millisecond), TM: t0.Add(10 * time.Millisecond)})
+	l.Close()
+
+	mpu, err := ReplayFromCSV(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	if err := mpu.WaitForMagFix(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !mpu.MagReady() {
+		t.Error("not MagReady after a fix")
+	}
+
+	var bus embd.I2CBus = &fakeBus{}
+	mpu, err = NewICM20948(&bus, 250, 2, 50, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpu.CloseMPU()
+	if mpu.MagReady() || mpu.WaitForMagFix(time.Second) == nil {
+		t.Error("mag fix with the magnetometer disabled")
+	}
+}
+
+func TestParseMPUDataCSV(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "mpudata.csv")
+	t0 := time.Now()
+	var data []*MPUData
+	for i := 0; i < 20; i++ {
+		ti := time.Duration(i)*10123*time.Microsecond + time.Millisecond
+		data = append(data, &MPUData{
+			G1: 0.5 * float64(i), G2: -3.25, G3: 1e3, A1: 0.125, A2: -1, A3: float64(i) / 8,
+			M1: 20.5, M2: -40, M3: float64(i), Temp: 25.75,
+			T: t0.Add(ti), TM: t0.Add(ti - 3*time.Millisecond),
+		})
+	}
+	l := NewMPUDataLogger(filename)
+	for _, d := range data {
+		l.LogMPUData(t0, d)
+	}
+	l.Close()
+
+	// parse reads the log at filename.
+	parse := func() ([]*MPUData, time.Time) {
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		parsed, t1, err := ParseMPUDataCSV(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed, t1
+	}
+	parsed, t1 := parse()
+	if len(parsed) != len(data) {
+		t.Fatalf("parsed %d samples, logged %d", len(parsed), len(data))
+	}
+	for i, d := range data {
+		p := parsed[i]
+		if p.G1 != d.G1 || p.G2 != d.G2 || p.G3 != d.G3 || p.A1 != d.A1 || p.A2 != d.A2 || p.A3 != d.A3 ||
+			p.M1 != d.M1 || p.M2 != d.M2 || p.M3 != d.M3 || p.Temp != d.Temp || p.MagError != nil ||
+			p.N != 1 || p.NM != 1 {
+			t.Errorf("sample %d parsed as %+v, logged %+v", i, p, d)
+		}
+		if p.T.Sub(t1) != d.T.Sub(t0) || p.TM.Sub(t1) != d.TM.Sub(t0) {
+			t.Errorf("sample %d at %s, %s, logged at %s, %s", i, p.T.Sub(t1), p.TM.Sub(t1), d.T.Sub(t0), d.TM.Sub(t0))
+		}
+		if i > 0 && (p.DT != 10123*time.Microsecond || p.DTM != 10123*time.Microsecond) {
+			t.Errorf("sample %d DT %s, DTM %s, expected 10.123ms", i, p.DT, p.DTM)
+		}
+	}
+
+	// Logging the parsed samples again gives the same samples.
+	l = NewMPUDataLogger(filename)
+	for _, d := range parsed {
+		l.LogMPUData(t1, d)
+	}
+	l.Close()
+	if again, _ := parse(); !reflect.DeepEqual(again, parsed) {
+		t.Error("samples changed when logged again")
+	}
+
+	if d, _, err := ParseMPUDataCSV(strings.NewReader("T,A1\n1.5,0.25\n")); err != nil || len(d) != 1 ||
+		d[0].A1 != 0.25 || d[0].MagError == nil {
+		t.Errorf("log without magnetometer columns parsed as %v, %v", d, err)
+	}
+	if d, _, err := ParseMPUDataCSV(strings.NewReader("")); err != nil || d != nil {
+		t.Errorf("empty log parsed as %v, %v", d, err)
+	}
+	if _, _, err := ParseMPUDataCSV(strings.NewReader("T,A1\n1.5,x\n")); err == nil {
+		t.Error("bad value accepted")
+	}
+}
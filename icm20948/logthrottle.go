@@ -0,0 +1,45 @@
+package icm20948
+
+import "errors"
+
+const (
+	defaultLogThrottleFirst = 1   // Routine messages logged before throttling starts
+	defaultLogThrottleEvery = 100 // Then one routine message logged in this many
+)
+
+// logThrottle limits routine messages, e.g. each magnetometer read, to the first few and then one in every.
+type logThrottle struct {
+	first, every int
+}
+
+// allow returns whether the count'th occurrence (counting from 1) of a message should be logged.
+func (l logThrottle) allow(count uint64) bool {
+	if count <= uint64(l.first) {
+		return true
+	}
+	return l.every > 0 && count%uint64(l.every) == 0
+}
+
+// WithLogThrottle sets how often routine messages are logged; see SetLogThrottle.
+func WithLogThrottle(first, every int) Option {
+	return func(mpu *ICM20948) {
+		mpu.logThrottle = logThrottle{first: first, every: every}
+	}
+}
+
+/*
+SetLogThrottle sets how often the routine messages of the read loop are logged: magnetometer reads and
+magnetometer data not being ready, and the errors passed to the function set with SetOnError.  The first first
+of each are logged, then one in every every; an every of 0 logs no more after the first.  The default is 1 and
+100.  The counts these are based on are in Stats, as MagReadCount, MagNotReadyCount and the error counts, for
+callers who want their own displays rather than the log.
+*/
+func (mpu *ICM20948) SetLogThrottle(first, every int) error {
+	if first < 0 || every < 0 {
+		return errors.New("ICM20948 Error: log throttle settings must not be negative")
+	}
+	mpu.mu.Lock()
+	mpu.logThrottle = logThrottle{first: first, every: every}
+	mpu.mu.Unlock()
+	return nil
+}
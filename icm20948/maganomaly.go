@@ -0,0 +1,117 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	defaultMagFieldTolerance = 0.15 // Default tolerance on the field magnitude, as a fraction of the expected field
+	modelMagFieldTolerance   = 0.3  // Default tolerance on a field from ExpectedFieldStrength, which is coarser
+	magNoiseTolerances       = 3    // Default tolerance in multiples of the noise learned by calibration
+)
+
+/*
+SetMagNoiseModel sets the magnetometer noise model that the magnetometer checks share: the magnitude (µT) of the
+local Earth field expected from the calibrated magnetometer, and how far (µT) a reading's magnitude may be from it.
+A reading outside that band is most likely contaminated by local interference, e.g. a nearby motor or ferrous
+metal, so:
+  - the sample is flagged with MagAnomaly, and HeadingWithQuality reports it;
+  - the horizon filter doesn't use it, holding its heading on the gyro until the field is back in the band;
+  - ValidateMagCalibration accepts a calibration if its RMS residual is under a third of the tolerance.
+
+Raise the tolerance for a deliberately noisy installation rather than tuning each of these.
+
+If field is 0, the field learned by the last magnetometer calibration, which is stored in the calibration file,
+is used, or failing that the field modelled at the latitude given to SetLatitude; without either no samples are
+flagged.  If tolerance is 0, it defaults to 15% of the field, or three times the noise (the RMS scatter of the
+field magnitude) learned by the last magnetometer calibration if that is larger, or 30% of a modelled field.
+ExpectedMagField returns the model in use.
+*/
+func (mpu *ICM20948) SetMagNoiseModel(expectedField, tolerance float64) error {
+	if expectedField < 0 || tolerance < 0 || !finite(expectedField) || !finite(tolerance) {
+		return errors.New("ICM20948 Error: expected magnetic field and tolerance must not be negative")
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.magField, mpu.magFieldTol = expectedField, tolerance
+	return nil
+}
+
+// SetExpectedMagField sets the expected field (µT) and tolerance (µT) of the noise model; it is the same as
+// SetMagNoiseModel.
+func (mpu *ICM20948) SetExpectedMagField(field, tolerance float64) error {
+	return mpu.SetMagNoiseModel(field, tolerance)
+}
+
+// SetExpectedField sets the expected field magnitude (µT) as SetMagNoiseModel does, keeping the tolerance.
+// 0 goes back to the field learned by calibration.
+func (mpu *ICM20948) SetExpectedField(field float64) error {
+	if field < 0 || !finite(field) {
+		return fmt.Errorf("ICM20948 Error: %g µT is not a valid expected magnetic field", field)
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.magField = field
+	return nil
+}
+
+/*
+SetLatitude gives the latitude (°, positive north) the sensor is at, so that the expected field magnitude can be
+estimated with ExpectedFieldStrength when it hasn't been set or learned by a magnetometer calibration.  The model
+is coarse, so the field learned by calibration, or one set from a geomagnetic model for the site, is better.
+*/
+func (mpu *ICM20948) SetLatitude(latitude float64) error {
+	if math.Abs(latitude) > 90 || !finite(latitude) {
+		return errors.New("ICM20948 Error: latitude must be from -90 to 90°")
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.latitude, mpu.latitudeSet = latitude, true
+	return nil
+}
+
+// ExpectedField returns the field magnitude (µT) the magnetometer should read, which the anomaly check and the
+// calibration validation use: the field set with SetMagNoiseModel or SetExpectedField, or else learned during
+// calibration, or else modelled at the latitude given to SetLatitude.  It is 0 if none of these is known.
+func (mpu *ICM20948) ExpectedField() float64 {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	field, _ := mpu.expectedMagField()
+	return field
+}
+
+// ExpectedMagField returns the field magnitude (µT) and tolerance (µT) of the noise model in use; see
+// SetMagNoiseModel.  The field is 0 if it isn't known.
+func (mpu *ICM20948) ExpectedMagField() (field, tolerance float64) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return mpu.expectedMagField()
+}
+
+// expectedMagField returns the field and tolerance in use.  The caller must hold mpu.mu.
+func (mpu *ICM20948) expectedMagField() (field, tolerance float64) {
+	field, tolerance = mpu.magField, mpu.magFieldTol
+	defaultTolerance := math.Max(defaultMagFieldTolerance, magNoiseTolerances*mpu.MagNoise)
+	if field == 0 {
+		field = mpu.MagField
+	}
+	if field == 0 && mpu.latitudeSet {
+		field, defaultTolerance = ExpectedFieldStrength(mpu.latitude), modelMagFieldTolerance
+	}
+	if tolerance == 0 {
+		tolerance = defaultTolerance * field
+	}
+	return field, tolerance
+}
+
+// magAnomaly reports whether a calibrated magnetometer reading's magnitude is outside the expected band.
+// The caller must hold mpu.mu.
+func (mpu *ICM20948) magAnomaly(m1, m2, m3 float64) bool {
+	field, tolerance := mpu.expectedMagField()
+	if field == 0 {
+		return false
+	}
+	return math.Abs(math.Sqrt(m1*m1+m2*m2+m3*m3)-field) > tolerance
+}
@@ -0,0 +1,82 @@
+package icm20948
+
+import (
+	"errors"
+	"log"
+	"math"
+)
+
+const (
+	inclinationTolerance = 20.0 // How far (°) the measured dip angle may be from the dipole model before we warn
+	equatorialField      = 30.0 // Field at the magnetic equator in the dipole model, µT
+)
+
+// Inclination returns the magnetic inclination (dip angle) in degrees, computed from the most recent calibrated
+// magnetometer reading and the accelerometer's estimate of "down".  It is positive when the field points
+// below the horizon, as in the northern hemisphere.
+// If a latitude (°) is supplied, the result is compared against a simple dipole model of the Earth's field and
+// a warning is logged if it is far off, which usually means a bad magnetometer calibration or nearby ferrous
+// interference.  The dipole model is coarse, so only gross errors are flagged.
+func (mpu *ICM20948) Inclination(latitude ...float64) (float64, error) {
+	if !mpu.enableMag {
+		return 0, errors.New("ICM20948 Error: magnetometer is not enabled")
+	}
+	d := mpu.latestData()
+	if d == nil {
+		return 0, errors.New("ICM20948 Error: no sensor data yet")
+	}
+	if d.GAError != nil {
+		return 0, d.GAError
+	}
+	if d.MagError != nil {
+		return 0, d.MagError
+	}
+
+	m1, m2, m3 := d.M1, d.M2, d.M3
+	if mpu.axisMap == nil {
+		// The AK09916 axes are rotated relative to the accel/gyro: X is shared but Y and Z point the opposite way.
+		m2, m3 = -m2, -m3
+	}
+	dip, err := inclination(d.A1, d.A2, d.A3, m1, m2, m3)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(latitude) > 0 {
+		expected := ExpectedInclination(latitude[0])
+		if math.Abs(dip-expected) > inclinationTolerance {
+			log.Printf("ICM20948 Warning: magnetic inclination %.1f° is far from the %.1f° expected at latitude %.1f°, "+
+				"check the magnetometer calibration\n", dip, expected, latitude[0])
+		}
+	}
+	return dip, nil
+}
+
+// ExpectedInclination returns the magnetic inclination in degrees predicted by a dipole model of the Earth's
+// field at the given latitude (°).  This ignores the offset of the geomagnetic pole and local anomalies, so it is
+// only good to within 10-20°.
+func ExpectedInclination(latitude float64) float64 {
+	return math.Atan(2*math.Tan(latitude*math.Pi/180)) * 180 / math.Pi
+}
+
+// ExpectedFieldStrength returns the magnitude (µT) of the Earth's field predicted by a dipole model at the given
+// latitude (°): 30 µT at the equator, rising to 60 µT at the poles.  Like ExpectedInclination it ignores the offset
+// of the geomagnetic pole and regional anomalies, so it is only good to within about 30%.
+func ExpectedFieldStrength(latitude float64) float64 {
+	s := math.Sin(latitude * math.Pi / 180)
+	return equatorialField * math.Sqrt(1+3*s*s)
+}
+
+// inclination computes the dip angle in degrees from an accelerometer reading (which points up when at rest) and
+// a magnetometer reading, both in the same axes.
+func inclination(a1, a2, a3, m1, m2, m3 float64) (float64, error) {
+	a := math.Sqrt(a1*a1 + a2*a2 + a3*a3)
+	m := math.Sqrt(m1*m1 + m2*m2 + m3*m3)
+	if a < 1e-6 || m < 1e-6 {
+		return 0, errors.New("ICM20948 Error: accel or mag reading too small to compute inclination")
+	}
+
+	// Down is opposite to the measured acceleration.
+	sinDip := -(a1*m1 + a2*m2 + a3*m3) / (a * m)
+	return math.Asin(math.Max(-1, math.Min(1, sinDip))) * 180 / math.Pi, nil
+}
@@ -0,0 +1,73 @@
+package icm20948
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	magOverflowWindow    = 10 * time.Second // Window over which the magnetometer overflow rate is measured
+	magOverflowThreshold = 0.1              // Fraction of mag reads overflowing above which the mag is unhealthy
+	magOverflowMinReads  = 10               // Reads needed in a window before its overflow rate is judged
+)
+
+// magOverflowTracker measures how often the AK09916 reports a magnetic sensor overflow (ST2 HOFL).  An occasional
+// overflow is harmless, but a high rate means the field is saturating the sensor, e.g. near a magnet or motor.
+type magOverflowTracker struct {
+	start            time.Time // Start of the current window
+	reads, overflows int       // Counts in the current window
+	rate             float64   // Overflow fraction over the last complete window
+	unhealthy        bool      // rate is above magOverflowThreshold
+}
+
+// update records one magnetometer read at time t and returns whether the health changed at the end of a window.
+// The caller must hold mpu.mu.
+func (o *magOverflowTracker) update(t time.Time, overflow bool) (changed bool) {
+	if o.start.IsZero() {
+		o.start = t
+	}
+	o.reads++
+	if overflow {
+		o.overflows++
+	}
+	if t.Sub(o.start) < magOverflowWindow {
+		return false
+	}
+	if o.reads >= magOverflowMinReads {
+		o.rate = float64(o.overflows) / float64(o.reads)
+		unhealthy := o.rate > magOverflowThreshold
+		changed = unhealthy != o.unhealthy
+		o.unhealthy = unhealthy
+	}
+	o.start, o.reads, o.overflows = t, 0, 0
+	return changed
+}
+
+// recordMagRead counts a magnetometer read in Stats and the overflow tracker, and reports a fault (once) when
+// the overflow rate becomes too high.
+func (mpu *ICM20948) recordMagRead(t time.Time, overflow bool) {
+	mpu.mu.Lock()
+	if overflow {
+		mpu.stats.MagOverflows++
+	}
+	changed := mpu.magOverflow.update(t, overflow)
+	unhealthy, rate := mpu.magOverflow.unhealthy, mpu.magOverflow.rate
+	mpu.mu.Unlock()
+
+	switch {
+	case changed && unhealthy:
+		mpu.fault(fmt.Errorf("ICM20948 Error: magnetometer overflowing on %.0f%% of reads, check for magnets or motors nearby",
+			100*rate))
+	case changed:
+		log.Println("ICM20948: Magnetometer overflow rate back to normal")
+	}
+}
+
+// MagHealthy returns false if the magnetometer was overflowing on more than 10% of reads over the last 10
+// seconds, meaning the field there saturates the sensor and headings are unreliable.
+func (mpu *ICM20948) MagHealthy() bool {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return !mpu.magOverflow.unhealthy
+}
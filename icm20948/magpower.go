@@ -0,0 +1,83 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// errMagOff is the MagError of samples taken while the magnetometer is powered down with SetMagEnabled.
+var errMagOff = errors.New("ICM20948 Error: magnetometer powered down")
+
+/*
+SetMagEnabled powers the magnetometer down (enable false), or back up, while the driver runs, e.g. to stop
+reading it during aerobatics where heading is useless.  Powering it down puts the AK09916 into power-down mode
+(CNTL2), stops Slave 1 from rewriting its mode and, unless other aux slaves are set up with ConfigureAuxSlave
+(whose bytes would move in EXT_SENS_DATA), stops Slave 0 reading it on every I2C master cycle.  readSensors then
+skips the magnetometer on its clock, and samples have a MagError, so the horizon filter holds its heading.
+Powering it up restores the mode it was in, continuous or single measurement.  MagEnabled reports the current
+state.  The magnetometer must have been enabled when the driver was created.
+*/
+func (mpu *ICM20948) SetMagEnabled(enable bool) error {
+	if !mpu.enableMag {
+		if !enable {
+			return nil
+		}
+		return errors.New("ICM20948 Error: magnetometer wasn't enabled when the driver was created")
+	}
+
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	mpu.mu.Lock()
+	off := mpu.magOff
+	mpu.mu.Unlock()
+	if off != enable {
+		return nil
+	}
+	if err := mpu.setMagPower(enable); err != nil {
+		return err
+	}
+	mpu.mu.Lock()
+	mpu.magOff = !enable
+	mpu.mu.Unlock()
+	log.Printf("ICM20948: Magnetometer %s\n", onOff(enable))
+	return nil
+}
+
+// setMagPower powers the AK09916 down and stops the slaves that serve it, or re-arms them in the mode set with
+// SetMagSingleMeasurement.  The caller must hold busMu or be configuring the chip.
+func (mpu *ICM20948) setMagPower(on bool) error {
+	mpu.mu.Lock()
+	single, slaves := mpu.magSingle, mpu.auxSlaves
+	mpu.mu.Unlock()
+
+	if errWrite := mpu.setRegBank(3); errWrite != nil {
+		return errors.New("ICM20948 Error: change register bank.")
+	}
+	if on {
+		if err := mpu.armMagSlave0(); err != nil {
+			mpu.setRegBank(0)
+			return fmt.Errorf("ICM20948 Error: couldn't re-arm AK09916 slave 0: %s", err.Error())
+		}
+		return mpu.setMagSingle(single)
+	}
+
+	if err := mpu.i2cWrite(ICMREG_I2C_SLV1_CTRL, 0); err != nil {
+		mpu.setRegBank(0)
+		return errors.New("ICM20948 Error: couldn't disable AK09916 slave 1")
+	}
+	if _, total := auxOffsets(slaves, false); total == 0 {
+		if err := mpu.i2cWrite(ICMREG_I2C_SLV0_CTRL, 0); err != nil {
+			mpu.setRegBank(0)
+			return errors.New("ICM20948 Error: couldn't disable AK09916 slave 0")
+		}
+	}
+	if err := mpu.setRegBank(0); err != nil {
+		return errors.New("ICM20948 Error: change register bank.")
+	}
+	if _, err := mpu.auxTransaction(AK09916_I2C_ADDR, AK09916_CNTL2, AK09916_MODE_POWER_DOWN); err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't power down AK09916: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MagReady reports whether at least one good magnetometer sample, without an overflow, has been read.  Until
+// then the M values are 0.
+func (mpu *ICM20948) MagReady() bool {
+	if mpu.cMagFix == nil {
+		return false
+	}
+	select {
+	case <-mpu.cMagFix:
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitForMagFix waits until MagReady, e.g. before enabling heading-dependent features at startup.  It returns an
+// error at once if the magnetometer is disabled or the driver is closed, and after timeout if there is still no
+// good sample.
+func (mpu *ICM20948) WaitForMagFix(timeout time.Duration) error {
+	if !mpu.enableMag {
+		return errors.New("ICM20948 Error: magnetometer is not enabled")
+	}
+	if mpu.cMagFix == nil {
+		return errors.New("ICM20948 Error: driver is not running")
+	}
+	if mpu.MagReady() {
+		return nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-mpu.cMagFix:
+		return nil
+	case <-mpu.cDone:
+		return errors.New("ICM20948 Error: driver closed before a magnetometer fix")
+	case <-timer.C:
+		return fmt.Errorf("ICM20948 Error: no magnetometer fix after %s", timeout)
+	}
+}
@@ -0,0 +1,103 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+const defaultMagResyncFailures = 50 // Consecutive failed mag reads before the magnetometer is re-initialized
+
+// WithMagResync sets after how many consecutive failed magnetometer reads the magnetometer is re-initialized;
+// see SetMagResync.
+func WithMagResync(failures int) Option {
+	return func(mpu *ICM20948) {
+		mpu.magResyncFailures = failures
+	}
+}
+
+/*
+SetMagResync sets after how many consecutive failed magnetometer reads (errors, data never ready or overflows)
+readSensors re-initializes the magnetometer, as configure does at startup: the AK09916 is powered down and put
+back into its measurement mode, and Slave 0 is re-armed to read it.  This recovers a magnetometer that dropped
+out, e.g. with ST1 stuck or overflowing after a glitch on the aux bus, without resetting the whole chip.
+Re-initializations are counted in Stats.  The default is 50; 0 disables it.
+*/
+func (mpu *ICM20948) SetMagResync(failures int) error {
+	if failures < 0 {
+		return errors.New("ICM20948 Error: magnetometer resync failures must not be negative")
+	}
+	mpu.mu.Lock()
+	mpu.magResyncFailures = failures
+	mpu.mu.Unlock()
+	return nil
+}
+
+// armMagSlave0 sets up Slave 0 to read the AK09916 status and data registers into EXT_SENS_DATA on every I2C
+// master cycle.  The caller must have selected register bank 3.
+func (mpu *ICM20948) armMagSlave0() error {
+	// Set slave 0 address to AK09916 with read bit
+	if err := mpu.i2cWrite(ICMREG_I2C_SLV0_ADDR, BIT_I2C_READ|AK09916_I2C_ADDR); err != nil {
+		return errors.New("Error setting up AK09916 slave address")
+	}
+
+	// Start reading from ST1 register
+	if err := mpu.i2cWrite(ICMREG_I2C_SLV0_REG, AK09916_ST1); err != nil {
+		return errors.New("Error setting up AK09916 read register")
+	}
+
+	// Enable 9-byte reads on slave 0 (ST1 + 6 bytes mag data + ST2 + 1 reserved)
+	if err := mpu.i2cWrite(ICMREG_I2C_SLV0_CTRL, BIT_SLAVE_EN|9); err != nil {
+		return errors.New("Error setting up AK09916 read control")
+	}
+	return nil
+}
+
+// resyncMag re-initializes the magnetometer after failures consecutive failed reads and counts it in Stats.
+// In single-measurement mode the AK09916 is left powered down for readSensors to trigger.
+func (mpu *ICM20948) resyncMag(failures int, single bool) {
+	log.Printf("ICM20948 Warning: %d consecutive failed magnetometer reads, re-initializing the magnetometer\n", failures)
+	mpu.mu.Lock()
+	mpu.stats.MagResyncs++
+	mpu.mu.Unlock()
+
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+	if err := mpu.reinitMag(single); err != nil {
+		log.Printf("ICM20948 Warning: couldn't re-initialize the magnetometer: %s\n", err)
+	}
+}
+
+// reinitMag re-issues the AK09916 measurement mode through Slave 4 and re-arms Slaves 0 and 1.
+// The caller must hold busMu.
+func (mpu *ICM20948) reinitMag(single bool) error {
+	if err := mpu.enableI2CMaster(); err != nil {
+		return err
+	}
+
+	// The AK09916 must be powered down before changing mode.
+	if _, err := mpu.auxTransaction(AK09916_I2C_ADDR, AK09916_CNTL2, AK09916_MODE_POWER_DOWN); err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't power down AK09916: %s", err.Error())
+	}
+	if !single {
+		mode, _ := ak09916Mode(mpu.SampleRate())
+		if _, err := mpu.auxTransaction(AK09916_I2C_ADDR, AK09916_CNTL2, mode); err != nil {
+			return fmt.Errorf("ICM20948 Error: couldn't set AK09916 measurement mode: %s", err.Error())
+		}
+	}
+
+	if err := mpu.setRegBank(3); err != nil {
+		return errors.New("ICM20948 Error: change register bank.")
+	}
+	if err := mpu.armMagSlave0(); err != nil {
+		mpu.setRegBank(0)
+		return err
+	}
+	if err := mpu.setRegBank(0); err != nil {
+		return errors.New("ICM20948 Error: change register bank.")
+	}
+	if single {
+		return nil
+	}
+	return mpu.setMagSingle(false) // Re-enable Slave 1 writing the continuous mode
+}
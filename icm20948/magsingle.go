@@ -0,0 +1,88 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const ak09916MeasureTime = 9 * time.Millisecond // AK09916 single measurement time (8.2 ms max) plus margin
+
+/*
+SetMagSingleMeasurement switches the AK09916 between continuous mode (the default), where it free-runs at a fixed
+rate, and single-measurement mode, where readSensors triggers each measurement itself so that TM is the time
+the field was actually measured, within the measurement time of about 8 ms.  This gives mag samples that are
+time-aligned with the accel/gyro samples for sensor fusion.
+
+In single-measurement mode each measurement is triggered on the magnetometer clock and read on a later tick,
+once the measurement time and one I2C master cycle (one gyro sample period) have passed.  The mag rate is
+therefore at most 1/(9 ms + one gyro sample period) and no faster than the magnetometer clock (100 Hz at most):
+about 90 Hz with the gyro at 1125 Hz, 45 Hz with it at 100 Hz and 20 Hz with it at 50 Hz.
+*/
+func (mpu *ICM20948) SetMagSingleMeasurement(enable bool) error {
+	if !mpu.enableMag {
+		return errors.New("ICM20948 Error: magnetometer is not enabled")
+	}
+
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	// While the magnetometer is powered down the mode is only applied when SetMagEnabled powers it up.
+	mpu.mu.Lock()
+	off := mpu.magOff
+	mpu.mu.Unlock()
+	if !off {
+		if err := mpu.setMagSingle(enable); err != nil {
+			return err
+		}
+	}
+	mpu.mu.Lock()
+	mpu.magSingle = enable
+	mpu.mu.Unlock()
+	return nil
+}
+
+// setMagSingle stops Slave 1 from writing the continuous mode to the AK09916 on every I2C master cycle and powers
+// the AK09916 down ready for triggered measurements, or restores continuous mode.
+// The caller must hold busMu or be configuring the chip.
+func (mpu *ICM20948) setMagSingle(single bool) error {
+	if errWrite := mpu.setRegBank(3); errWrite != nil {
+		return errors.New("ICM20948 Error: change register bank.")
+	}
+
+	if single {
+		if err := mpu.i2cWrite(ICMREG_I2C_SLV1_CTRL, 0); err != nil {
+			mpu.setRegBank(0)
+			return errors.New("ICM20948 Error: couldn't disable AK09916 slave 1")
+		}
+		if err := mpu.setRegBank(0); err != nil {
+			return errors.New("ICM20948 Error: change register bank.")
+		}
+		// The AK09916 must be powered down before changing mode.
+		if _, err := mpu.auxTransaction(AK09916_I2C_ADDR, AK09916_CNTL2, AK09916_MODE_POWER_DOWN); err != nil {
+			return fmt.Errorf("ICM20948 Error: couldn't power down AK09916: %s", err.Error())
+		}
+		log.Println("ICM20948: AK09916 set to single measurement mode")
+		return nil
+	}
+
+	defer mpu.setRegBank(0)
+	magMode, _ := ak09916Mode(mpu.SampleRate())
+	if err := mpu.i2cWrite(ICMREG_I2C_SLV1_DO, magMode); err != nil {
+		return errors.New("ICM20948 Error: couldn't set AK09916 measurement mode")
+	}
+	if err := mpu.i2cWrite(ICMREG_I2C_SLV1_CTRL, BIT_SLAVE_EN|1); err != nil {
+		return errors.New("ICM20948 Error: couldn't enable AK09916 slave 1")
+	}
+	log.Printf("ICM20948: AK09916 set to continuous mode 0x%02X\n", magMode)
+	return nil
+}
+
+// triggerMag starts a single AK09916 measurement.
+func (mpu *ICM20948) triggerMag() error {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+	_, err := mpu.auxTransaction(AK09916_I2C_ADDR, AK09916_CNTL2, AK09916_MODE_SINGLE)
+	return err
+}
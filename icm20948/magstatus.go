@@ -0,0 +1,27 @@
+package icm20948
+
+/*
+MagStatus returns the AK09916 ST1 and ST2 status registers as readSensors last read them, for debugging the
+magnetometer: ST1 holds DRDY (AK09916_ST1_DRDY) and DOR (AK09916_ST1_DOR), ST2 holds HOFL (AK09916_ST2_HOFL).
+ST2 is only read when ST1 reports new data, so it belongs to the last new reading.  Both are 0 until the first
+read.  See MagStatusFlags for the decoded bits.
+
+A data overrun (DOR) means the AK09916 finished a measurement before the previous one was read, so a
+measurement was lost.  It is counted in Stats.MagOverruns and flagged on the sample as MPUData.MagOverrun.  An
+occasional one is harmless; frequent ones mean the magnetometer is read more slowly than its continuous mode
+produces data.  The remedy is to read it faster or run it slower: it is polled at the sample rate, up to 100 Hz,
+and its mode follows the sample rate too (100 Hz from a sample rate of 100 Hz, then 50, 20 and 10 Hz), so
+overruns usually mean the read loop is falling behind, e.g. on a busy CPU or bus.
+*/
+func (mpu *ICM20948) MagStatus() (st1, st2 byte) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return mpu.magST1, mpu.magST2
+}
+
+// MagStatusFlags decodes MagStatus: whether the last ST1 reported new data (dataReady) and data skipped because it
+// wasn't read in time (overrun), and whether the last new reading saturated the sensor (overflow).
+func (mpu *ICM20948) MagStatusFlags() (dataReady, overrun, overflow bool) {
+	st1, st2 := mpu.MagStatus()
+	return st1&AK09916_ST1_DRDY != 0, st1&AK09916_ST1_DOR != 0, st2&AK09916_ST2_HOFL != 0
+}
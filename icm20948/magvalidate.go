@@ -0,0 +1,86 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const magValidatePoll = 10 * time.Millisecond // How often ValidateMagCalibration looks for new mag readings
+
+/*
+ValidateMagCalibration checks whether the current magnetometer calibration still fits the environment, e.g.
+after a GPS puck or battery has been moved nearby.  It collects calibrated readings for duration while the device
+is rotated through all orientations and reports how far they are from a sphere of the expected field, as given by
+ExpectedField, or of their mean magnitude if it isn't known.  The residual
+is the RMS distance as a fraction of the field, as for the passive calibration's ellipsoid fit, and ok is true if
+it is below a third of the tolerance of the noise model (see SetMagNoiseModel), 5% by default, or 5% if the field
+isn't known.  The calibration isn't changed.  An error is returned if the readings are too few or don't cover
+enough directions to judge, in which case the device should be rotated more thoroughly.
+*/
+func (mpu *ICM20948) ValidateMagCalibration(duration time.Duration) (ok bool, residual float64, err error) {
+	if !mpu.enableMag {
+		return false, 0, errors.New("ICM20948 Error: magnetometer is not enabled")
+	}
+	if duration <= 0 {
+		return false, 0, errors.New("ICM20948 Error: validation duration must be positive")
+	}
+
+	var (
+		p      passiveCal // Only for its spacing of the recorded mag points
+		lastTM time.Time
+	)
+	done := time.NewTimer(duration)
+	defer done.Stop()
+	tick := time.NewTicker(magValidatePoll)
+	defer tick.Stop()
+loop:
+	for {
+		select {
+		case <-tick.C:
+		case <-done.C:
+			break loop
+		case <-mpu.cDone:
+			return false, 0, errors.New("ICM20948 Error: driver closed during magnetometer validation")
+		}
+		d := mpu.latestData()
+		if d == nil || d.MagError != nil || d.TM.IsZero() || d.TM == lastTM {
+			continue
+		}
+		lastTM = d.TM
+		p.addMag(d.M1, d.M2, d.M3)
+	}
+
+	mpu.mu.Lock()
+	field, tolerance := mpu.expectedMagField()
+	mpu.mu.Unlock()
+	maxResid := passiveCalMaxMagResid
+	if field > 0 {
+		maxResid = tolerance / field / 3
+	}
+	return magCalResidual(p.magPoints, field, maxResid)
+}
+
+// magCalResidual returns how far calibrated magnetometer points are from a sphere about the origin of radius
+// field, or of their mean magnitude if field is 0, and whether that is under maxResid, close enough to trust the
+// calibration.
+func magCalResidual(points [][3]float64, field, maxResid float64) (ok bool, residual float64, err error) {
+	if len(points) < passiveCalMinMagPoints {
+		return false, 0, fmt.Errorf("ICM20948 Error: only %d distinct magnetometer readings, rotate the device more",
+			len(points))
+	}
+	if field <= 0 {
+		for _, p := range points {
+			field += math.Sqrt(p[0]*p[0] + p[1]*p[1] + p[2]*p[2])
+		}
+		field /= float64(len(points))
+	}
+	var center [3]float64
+	radii := [3]float64{field, field, field}
+	residual = ellipsoidResid(points, center, radii)
+	if !coverage(points, center, radii) {
+		return false, residual, errors.New("ICM20948 Error: magnetometer readings don't cover enough directions, rotate the device more")
+	}
+	return residual < maxResid, residual, nil
+}
@@ -0,0 +1,27 @@
+package icm20948
+
+import "fmt"
+
+// WithMemVerify sets whether writes to the DMP memory, e.g. by EnableGyroBiasCal, are read back and compared
+// with what was written, so that a write that only partly landed is reported as an error rather than leaving the
+// DMP subtly broken.  It costs a read of the same size after every write.  It is off by default.
+func WithMemVerify(verify bool) Option {
+	return func(mpu *ICM20948) {
+		mpu.memVerify = verify
+	}
+}
+
+// verifyMem reads back the DMP memory at addr and checks that it holds data.  The caller must hold busMu.
+func (mpu *ICM20948) verifyMem(addr uint16, data []byte) error {
+	got, err := mpu.memRead(addr, len(data))
+	if err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't read back the memory bank: %s", err.Error())
+	}
+	for i := range data {
+		if got[i] != data[i] {
+			return fmt.Errorf("ICM20948 Error: memory at 0x%04X reads back as 0x%02X, wrote 0x%02X",
+				int(addr)+i, got[i], data[i])
+		}
+	}
+	return nil
+}
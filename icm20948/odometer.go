@@ -0,0 +1,58 @@
+package icm20948
+
+import "time"
+
+// odometer integrates the gyro rates to track the total rotation about each axis.
+type odometer struct {
+	enabled    bool
+	o1, o2, o3 float64   // Integrated angle, °
+	last       time.Time // Time of the last sample integrated
+}
+
+// update adds the rotation since the previous sample.  The caller must hold mpu.mu.
+func (o *odometer) update(d *MPUData) {
+	if !o.enabled || d.GAError != nil {
+		return
+	}
+	if !o.last.IsZero() {
+		dt := d.T.Sub(o.last).Seconds()
+		o.o1 += d.G1 * dt
+		o.o2 += d.G2 * dt
+		o.o3 += d.G3 * dt
+	}
+	o.last = d.T
+}
+
+// WithOdometer turns on the odometer from the first sample; see EnableOdometer.
+func WithOdometer(enable bool) Option {
+	return func(mpu *ICM20948) {
+		mpu.odo = odometer{enabled: enable}
+	}
+}
+
+/*
+EnableOdometer turns on or off the integration of gyro rates into a total rotation angle per axis, which is
+useful for bench procedures like "rotate 720° about Z".  Enabling it resets the angles.
+The odometer simply integrates the bias-corrected gyro, so any residual bias accumulates linearly: a 0.1°/s bias
+drifts 6° per minute.  It is intended for procedures lasting seconds to a few minutes, not for navigation.
+*/
+func (mpu *ICM20948) EnableOdometer(enable bool) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.odo = odometer{enabled: enable}
+}
+
+// ResetOdometer zeroes the integrated rotation angles.
+func (mpu *ICM20948) ResetOdometer() {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.odo = odometer{enabled: mpu.odo.enabled}
+}
+
+// IntegratedAngle returns the rotation about each sensor axis, in degrees, since the odometer was enabled or last
+// reset.
+func (mpu *ICM20948) IntegratedAngle() (x, y, z float64) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return mpu.odo.o1, mpu.odo.o2, mpu.odo.o3
+}
@@ -0,0 +1,192 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	gyroOffsetScale  = 4.0 / 131   // °/s per LSB of XG_OFFS_USR, at any gyro full scale
+	accelOffsetScale = 0.98 / 1000 // G per LSB of XA_OFFS[14:0], at any accel full scale
+	accelOffsetMin   = -1 << 14    // Range of XA_OFFS[14:0]
+	accelOffsetMax   = 1<<14 - 1
+)
+
+// gyroOffsetRegs and accelOffsetRegs are the high bytes of the X, Y and Z offset registers, on banks 2 and 1.
+var (
+	gyroOffsetRegs  = [3]byte{ICMREG_XG_OFFS_USRH, ICMREG_YG_OFFS_USRH, ICMREG_ZG_OFFS_USRH}
+	accelOffsetRegs = [3]byte{ICMREG_XA_OFFSET_H, ICMREG_YA_OFFSET_H, ICMREG_ZA_OFFSET_H}
+)
+
+/*
+WriteGyroOffsets programs the gyro offset registers (XG_OFFS_USR etc.), which the chip adds to the gyro outputs
+before they are read, in units of 4/131 °/s (about 0.0305 °/s) whatever the full scale.  To remove a bias of b °/s
+write about -b/0.0305.  The driver's software bias is still subtracted as well, so either set it to zero or let
+SetHWBiasRemoval manage both.  The registers are cleared when the chip is reset.
+*/
+func (mpu *ICM20948) WriteGyroOffsets(x, y, z int16) error {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+	return mpu.writeOffsets(2, gyroOffsetRegs, [3]int16{x, y, z})
+}
+
+/*
+WriteAccelOffsets programs the accel offset registers (XA_OFFS etc.), which the chip adds to the accel outputs
+before they are read, in units of 0.98 mG whatever the full scale; they must be from -16384 to 16383.  Unlike the
+gyro's, these registers hold the factory trim, which this replaces: to remove a further bias of b G, add about
+-b/0.00098 to the trim.  As for WriteGyroOffsets, the driver's software bias is still subtracted.  The factory
+trim is restored when the chip is reset.
+*/
+func (mpu *ICM20948) WriteAccelOffsets(x, y, z int16) error {
+	for _, v := range []int16{x, y, z} {
+		if v < accelOffsetMin || v > accelOffsetMax {
+			return fmt.Errorf("ICM20948 Error: accel offset %d is out of range", v)
+		}
+	}
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+	return mpu.writeOffsets(1, accelOffsetRegs, [3]int16{x, y, z})
+}
+
+// WithHWBiasRemoval sets whether the gyro and accel biases are removed by the chip's offset registers; see
+// SetHWBiasRemoval.
+func WithHWBiasRemoval(enable bool) Option {
+	return func(mpu *ICM20948) {
+		mpu.hwBias = enable
+	}
+}
+
+/*
+SetHWBiasRemoval chooses whether the gyro and accel biases are removed in hardware, by programming the chip's
+offset registers with them, rather than subtracted in software.  The registers have coarser steps than the
+biases (see WriteGyroOffsets and WriteAccelOffsets), so the remainder is still subtracted in software and the
+output is the same either way.  The registers are programmed with the biases as they are when this is called,
+and again whenever the chip is reconfigured; after the biases change, e.g. with SetGyroBias, the difference is
+removed in software until this is called again.  Disabling it clears the gyro offsets and restores the accel
+factory trim.
+
+With it enabled, ReadGyroBias and ReadAccelBias read the programmed offsets rather than the factory ones.
+*/
+func (mpu *ICM20948) SetHWBiasRemoval(enable bool) error {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	mpu.mu.Lock()
+	mpu.hwBias = enable
+	mpu.mu.Unlock()
+	return mpu.applyHWBias()
+}
+
+// applyHWBias programs the offset registers for hardware bias removal if it is enabled, or clears them if it was
+// enabled before.  The caller must hold busMu or be configuring the chip.
+func (mpu *ICM20948) applyHWBias() error {
+	mpu.mu.Lock()
+	enable, trimRead, trim := mpu.hwBias, mpu.accelTrimRead, mpu.accelTrim
+	mpu.mu.Unlock()
+	if !enable && !trimRead {
+		return nil
+	}
+
+	if !trimRead {
+		var err error
+		if trim, err = mpu.readOffsets(1, accelOffsetRegs); err != nil {
+			return fmt.Errorf("ICM20948 Error: couldn't read the accel factory trim: %s", err.Error())
+		}
+	}
+
+	var gyro, accel [3]int16
+	var gyroApplied, accelApplied [3]float64
+	if enable {
+		mpu.mu.Lock()
+		gyro, gyroApplied = gyroOffsets([3]float64{mpu.G01, mpu.G02, mpu.G03}, mpu.scaleGyro)
+		accel, accelApplied = accelOffsets([3]float64{mpu.A01, mpu.A02, mpu.A03}, mpu.scaleAccel, trim)
+		mpu.mu.Unlock()
+	} else {
+		accel = trim
+	}
+	if err := mpu.writeOffsets(2, gyroOffsetRegs, gyro); err != nil {
+		return err
+	}
+	if err := mpu.writeOffsets(1, accelOffsetRegs, accel); err != nil {
+		return err
+	}
+
+	mpu.mu.Lock()
+	mpu.accelTrim, mpu.accelTrimRead = trim, true
+	mpu.gyroHWOffset, mpu.accelHWOffset = gyroApplied, accelApplied
+	mpu.mu.Unlock()
+	return nil
+}
+
+// gyroOffsets returns the gyro offset register values that remove the biases, in raw units at scale, and the
+// biases they remove, in °/s.
+func gyroOffsets(bias [3]float64, scale float64) (regs [3]int16, applied [3]float64) {
+	for i, b := range bias {
+		regs[i] = int16(clamp(math.Round(-b*scale/gyroOffsetScale), math.MinInt16, math.MaxInt16))
+		applied[i] = -float64(regs[i]) * gyroOffsetScale
+	}
+	return regs, applied
+}
+
+// accelOffsets returns the accel offset register values that remove the biases, in raw units at scale, on top of
+// the factory trim, and the biases they remove, in G.
+func accelOffsets(bias [3]float64, scale float64, trim [3]int16) (regs [3]int16, applied [3]float64) {
+	for i, b := range bias {
+		regs[i] = int16(clamp(float64(trim[i])+math.Round(-b*scale/accelOffsetScale), accelOffsetMin, accelOffsetMax))
+		applied[i] = -float64(regs[i]-trim[i]) * accelOffsetScale
+	}
+	return regs, applied
+}
+
+// clamp limits v to the range lo to hi.
+func clamp(v, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, v))
+}
+
+// writeOffsets writes the X, Y and Z offset registers starting at the high bytes regs on register bank bank.  The
+// accel registers hold 15 bits above a reserved bit 0, which is preserved.  The caller must hold busMu or be
+// configuring the chip.
+func (mpu *ICM20948) writeOffsets(bank byte, regs [3]byte, vals [3]int16) error {
+	if err := mpu.setRegBank(bank); err != nil {
+		return errors.New("ICM20948 Error: change register bank.")
+	}
+	defer mpu.setRegBank(0)
+	for i, reg := range regs {
+		v := uint16(vals[i])
+		if bank == 1 {
+			lo, err := mpu.i2cRead(reg + 1)
+			if err != nil {
+				return fmt.Errorf("ICM20948 Error: couldn't read offset register: %s", err.Error())
+			}
+			v = v<<1 | uint16(lo&1)
+		}
+		if err := mpu.i2cWrite(reg, byte(v>>8)); err != nil {
+			return fmt.Errorf("ICM20948 Error: couldn't write offset register: %s", err.Error())
+		}
+		if err := mpu.i2cWrite(reg+1, byte(v)); err != nil {
+			return fmt.Errorf("ICM20948 Error: couldn't write offset register: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// readOffsets reads the X, Y and Z offset registers as writeOffsets writes them.  The caller must hold busMu or be
+// configuring the chip.
+func (mpu *ICM20948) readOffsets(bank byte, regs [3]byte) (vals [3]int16, err error) {
+	if err := mpu.setRegBank(bank); err != nil {
+		return vals, errors.New("ICM20948 Error: change register bank.")
+	}
+	defer mpu.setRegBank(0)
+	for i, reg := range regs {
+		v, err := mpu.i2cRead2(reg)
+		if err != nil {
+			return vals, err
+		}
+		if bank == 1 {
+			v >>= 1
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
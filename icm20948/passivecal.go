@@ -0,0 +1,342 @@
+package icm20948
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	passiveCalWindow         = time.Second // Window over which the sensor must be still to record an orientation
+	passiveCalMaxGyro        = 2.0         // Max gyro rate while still, °/s
+	passiveCalMaxAccelStdDev = 0.02        // Max accel noise while still, G
+	passiveCalMinAngle       = 30.0        // Min angle between recorded orientations, °
+	passiveCalMinOrients     = 6           // Orientations needed before fitting the accel offsets
+	passiveCalMaxAccelResid  = 0.02        // Max RMS accel fit residual to trust the offsets, G
+	passiveCalMinMagSpacing  = 5.0         // Min distance between recorded mag points, µT
+	passiveCalMaxMagPoints   = 500         // Cap on the mag points kept, to bound memory and fitting time
+	passiveCalMinMagPoints   = 30          // Mag points needed before fitting the hard/soft-iron calibration
+	passiveCalMaxMagResid    = 0.05        // Max RMS mag fit residual, as a fraction of the field, to trust the fit
+	passiveCalMinCoverage    = 0.7         // Fraction of each axis' full ±range that must have been seen
+)
+
+// PassiveCalProgress reports the state of a passive calibration started with StartPassiveCalibration.
+type PassiveCalProgress struct {
+	Orientations int     // Distinct still orientations recorded for the accel offsets
+	MagPoints    int     // Distinct magnetometer readings recorded for the hard/soft-iron calibration
+	AccelResid   float64 // RMS residual of the latest accel fit, G; 0 before the first fit
+	MagResid     float64 // RMS residual of the latest mag fit, as a fraction of the field; 0 before the first fit
+	AccelDone    bool    // The accel offsets have been applied and saved
+	MagDone      bool    // The hard/soft-iron calibration has been applied and saved
+	Err          error   // Error saving the calibration, if any
+}
+
+// passiveCal collects still orientations and magnetometer readings from the running sensor and fits the
+// calibration once there is enough well-spread data.
+type passiveCal struct {
+	c        chan PassiveCalProgress
+	progress PassiveCalProgress
+
+	// Accel/gyro window being tested for stillness.
+	winStart            time.Time
+	winN                float64
+	winS1, winS2, winS3 float64
+	winSS               float64
+	winMoving           bool
+	orients             [][3]float64
+
+	lastTM    time.Time
+	magPoints [][3]float64
+}
+
+/*
+StartPassiveCalibration starts calibrating the accelerometer offsets and the magnetometer hard- and soft-iron
+correction from normal use, without prompts, for headless installations.  It watches the same samples that are
+sent on CBuf (without consuming them): whenever the sensor is still for a second in an orientation at least 30°
+from those already seen, the orientation is recorded, and magnetometer readings are recorded as the sensor
+turns.  Once there are enough well-spread orientations or readings and the fit is good, the corresponding
+calibration is applied and saved to the calibration file.
+
+Progress is sent on the returned channel whenever it changes; updates are dropped if the channel isn't read.
+The channel is closed when both calibrations are done or StopPassiveCalibration is called.
+An installed unit may never see enough different orientations to calibrate the accelerometer; the magnetometer
+needs turns through a wide range of headings and, ideally, some pitch and roll.
+*/
+func (mpu *ICM20948) StartPassiveCalibration() <-chan PassiveCalProgress {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	if mpu.passiveCal != nil {
+		close(mpu.passiveCal.c)
+	}
+	mpu.passiveCal = &passiveCal{c: make(chan PassiveCalProgress, 1)}
+	if !mpu.enableMag {
+		mpu.passiveCal.progress.MagDone = true
+	}
+	return mpu.passiveCal.c
+}
+
+// StopPassiveCalibration stops a passive calibration, keeping whatever has already been applied.
+func (mpu *ICM20948) StopPassiveCalibration() {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	if mpu.passiveCal != nil {
+		close(mpu.passiveCal.c)
+		mpu.passiveCal = nil
+	}
+}
+
+// updatePassiveCal feeds a sample to the passive calibration, if one is running.  m1-m3 are the magnetometer
+// readings in µT before the hard/soft-iron calibration.  The caller must hold mpu.mu.
+func (mpu *ICM20948) updatePassiveCal(d *MPUData, m1, m2, m3 float64) {
+	p := mpu.passiveCal
+	if p == nil || d.GAError != nil {
+		return
+	}
+	changed := false
+
+	if !p.progress.AccelDone && p.addAccel(d) {
+		changed = true
+		if len(p.orients) >= passiveCalMinOrients {
+			if b, resid, err := fitSphere(p.orients); err == nil {
+				p.progress.AccelResid = resid
+				if resid < passiveCalMaxAccelResid && coverage(p.orients, b, [3]float64{1, 1, 1}) {
+					// The fit is in the output axes but the offsets are in the chip's.
+					b1, b2, b3 := mpu.toChipAxes(b[0], b[1], b[2])
+					mpu.A01 += b1 / mpu.scaleAccel
+					mpu.A02 += b2 / mpu.scaleAccel
+					mpu.A03 += b3 / mpu.scaleAccel
+					p.progress.AccelDone = true
+					p.progress.Err = mpu.savePassiveCal()
+				}
+			}
+		}
+	}
+
+	if !p.progress.MagDone && d.MagError == nil && d.TM != p.lastTM {
+		p.lastTM = d.TM
+		if p.addMag(m1, m2, m3) {
+			changed = true
+			if n := len(p.magPoints); n >= passiveCalMinMagPoints && n%10 == 0 {
+				if c, r, resid, err := fitEllipsoid(p.magPoints); err == nil {
+					p.progress.MagResid = resid
+					if resid < passiveCalMaxMagResid && coverage(p.magPoints, c, r) {
+						rMean := (r[0] + r[1] + r[2]) / 3
+						mpu.M01, mpu.M02, mpu.M03 = c[0], c[1], c[2]
+						mpu.Ms11, mpu.Ms12, mpu.Ms13 = rMean/r[0], 0, 0
+						mpu.Ms21, mpu.Ms22, mpu.Ms23 = 0, rMean/r[1], 0
+						mpu.Ms31, mpu.Ms32, mpu.Ms33 = 0, 0, rMean/r[2]
+						mpu.MagField, mpu.MagNoise = rMean, resid
+						p.progress.MagDone = true
+						p.progress.Err = mpu.savePassiveCal()
+					}
+				}
+			}
+		}
+	}
+
+	if !changed {
+		return
+	}
+	p.progress.Orientations, p.progress.MagPoints = len(p.orients), len(p.magPoints)
+	select {
+	case <-p.c: // Replace an unread update with the latest.
+	default:
+	}
+	p.c <- p.progress
+	if p.progress.AccelDone && p.progress.MagDone {
+		close(p.c)
+		mpu.passiveCal = nil
+	}
+}
+
+// savePassiveCal saves the calibration after the passive calibration changed it.  The caller must hold mpu.mu.
+func (mpu *ICM20948) savePassiveCal() error {
+	mpu.calTime, mpu.calSource = time.Now(), "passive calibration"
+	return mpu.mpuCalData.save(mpu.calPath)
+}
+
+// addAccel adds d to the stillness window and, at the end of a still window, records its orientation if it is
+// new.  It returns whether an orientation was recorded.
+func (p *passiveCal) addAccel(d *MPUData) bool {
+	if p.winStart.IsZero() {
+		p.winStart = d.T
+	}
+	if math.Abs(d.G1) > passiveCalMaxGyro || math.Abs(d.G2) > passiveCalMaxGyro || math.Abs(d.G3) > passiveCalMaxGyro {
+		p.winMoving = true
+	}
+	p.winN++
+	p.winS1, p.winS2, p.winS3 = p.winS1+d.A1, p.winS2+d.A2, p.winS3+d.A3
+	p.winSS += d.A1*d.A1 + d.A2*d.A2 + d.A3*d.A3
+	if d.T.Sub(p.winStart) < passiveCalWindow {
+		return false
+	}
+
+	n, moving := p.winN, p.winMoving
+	a := [3]float64{p.winS1 / n, p.winS2 / n, p.winS3 / n}
+	variance := p.winSS/n - (a[0]*a[0] + a[1]*a[1] + a[2]*a[2])
+	p.winStart, p.winN, p.winS1, p.winS2, p.winS3, p.winSS, p.winMoving = d.T, 0, 0, 0, 0, 0, false
+
+	if moving || n < 2 || variance > 3*passiveCalMaxAccelStdDev*passiveCalMaxAccelStdDev {
+		return false
+	}
+	for _, o := range p.orients {
+		if angleBetween(a, o) < passiveCalMinAngle {
+			return false
+		}
+	}
+	p.orients = append(p.orients, a)
+	return true
+}
+
+// addMag records a magnetometer reading if it is far enough from those already recorded.
+func (p *passiveCal) addMag(m1, m2, m3 float64) bool {
+	if len(p.magPoints) >= passiveCalMaxMagPoints {
+		return false
+	}
+	m := [3]float64{m1, m2, m3}
+	for _, q := range p.magPoints {
+		if math.Sqrt((m[0]-q[0])*(m[0]-q[0])+(m[1]-q[1])*(m[1]-q[1])+(m[2]-q[2])*(m[2]-q[2])) < passiveCalMinMagSpacing {
+			return false
+		}
+	}
+	p.magPoints = append(p.magPoints, m)
+	return true
+}
+
+// angleBetween returns the angle between two vectors in degrees.
+func angleBetween(a, b [3]float64) float64 {
+	na := math.Sqrt(a[0]*a[0] + a[1]*a[1] + a[2]*a[2])
+	nb := math.Sqrt(b[0]*b[0] + b[1]*b[1] + b[2]*b[2])
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	c := (a[0]*b[0] + a[1]*b[1] + a[2]*b[2]) / (na * nb)
+	return math.Acos(math.Max(-1, math.Min(1, c))) / deg
+}
+
+// coverage reports whether the points about center span at least passiveCalMinCoverage of ±r on each axis.
+func coverage(points [][3]float64, center, r [3]float64) bool {
+	for i := 0; i < 3; i++ {
+		lo, hi := math.Inf(1), math.Inf(-1)
+		for _, p := range points {
+			lo, hi = math.Min(lo, p[i]-center[i]), math.Max(hi, p[i]-center[i])
+		}
+		if hi < passiveCalMinCoverage*r[i] || -lo < passiveCalMinCoverage*r[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// fitSphere fits a sphere to points by least squares and returns its center and the RMS radial residual.
+func fitSphere(points [][3]float64) (center [3]float64, resid float64, err error) {
+	// |p|² = 2 p·c + k, with k = r² - |c|², is linear in c and k.
+	rows := make([][]float64, len(points))
+	rhs := make([]float64, len(points))
+	for i, p := range points {
+		rows[i] = []float64{2 * p[0], 2 * p[1], 2 * p[2], 1}
+		rhs[i] = p[0]*p[0] + p[1]*p[1] + p[2]*p[2]
+	}
+	x, err := leastSquares(rows, rhs)
+	if err != nil {
+		return center, 0, err
+	}
+	center = [3]float64{x[0], x[1], x[2]}
+	r2 := x[3] + x[0]*x[0] + x[1]*x[1] + x[2]*x[2]
+	if r2 <= 0 {
+		return center, 0, errors.New("ICM20948 Error: degenerate sphere fit")
+	}
+	r := math.Sqrt(r2)
+	for _, p := range points {
+		d := math.Sqrt((p[0]-center[0])*(p[0]-center[0])+(p[1]-center[1])*(p[1]-center[1])+(p[2]-center[2])*(p[2]-center[2])) - r
+		resid += d * d
+	}
+	return center, math.Sqrt(resid / float64(len(points))), nil
+}
+
+// fitEllipsoid fits an axis-aligned ellipsoid to points by least squares and returns its center, its radii and
+// the RMS residual as a fraction of the radius.
+func fitEllipsoid(points [][3]float64) (center, radii [3]float64, resid float64, err error) {
+	// A x² + B y² + C z² + D x + E y + F z = 1
+	rows := make([][]float64, len(points))
+	rhs := make([]float64, len(points))
+	for i, p := range points {
+		rows[i] = []float64{p[0] * p[0], p[1] * p[1], p[2] * p[2], p[0], p[1], p[2]}
+		rhs[i] = 1
+	}
+	x, err := leastSquares(rows, rhs)
+	if err != nil {
+		return
+	}
+	g := 1.0
+	for i := 0; i < 3; i++ {
+		if x[i] <= 0 {
+			return center, radii, 0, errors.New("ICM20948 Error: magnetometer readings don't fit an ellipsoid")
+		}
+		center[i] = -x[i+3] / (2 * x[i])
+		g += x[i] * center[i] * center[i]
+	}
+	for i := 0; i < 3; i++ {
+		radii[i] = math.Sqrt(g / x[i])
+	}
+	return center, radii, ellipsoidResid(points, center, radii), nil
+}
+
+// ellipsoidResid returns the RMS distance of points from the axis-aligned ellipsoid with the given center and
+// radii, as a fraction of the radius.
+func ellipsoidResid(points [][3]float64, center, radii [3]float64) float64 {
+	var resid float64
+	for _, p := range points {
+		var s float64
+		for i := 0; i < 3; i++ {
+			s += (p[i] - center[i]) * (p[i] - center[i]) / (radii[i] * radii[i])
+		}
+		d := math.Sqrt(s) - 1
+		resid += d * d
+	}
+	return math.Sqrt(resid / float64(len(points)))
+}
+
+// leastSquares solves the overdetermined system rows·x = rhs through its normal equations.
+func leastSquares(rows [][]float64, rhs []float64) ([]float64, error) {
+	n := len(rows[0])
+	m := make([][]float64, n)
+	for i := range m {
+		m[i] = make([]float64, n+1)
+		for k, row := range rows {
+			for j := 0; j < n; j++ {
+				m[i][j] += row[i] * row[j]
+			}
+			m[i][n] += row[i] * rhs[k]
+		}
+	}
+
+	// Gaussian elimination with partial pivoting.
+	for c := 0; c < n; c++ {
+		p := c
+		for r := c + 1; r < n; r++ {
+			if math.Abs(m[r][c]) > math.Abs(m[p][c]) {
+				p = r
+			}
+		}
+		if math.Abs(m[p][c]) < 1e-12 {
+			return nil, errors.New("ICM20948 Error: calibration data too poorly spread to fit")
+		}
+		m[c], m[p] = m[p], m[c]
+		for r := c + 1; r < n; r++ {
+			f := m[r][c] / m[c][c]
+			for j := c; j <= n; j++ {
+				m[r][j] -= f * m[c][j]
+			}
+		}
+	}
+	x := make([]float64, n)
+	for r := n - 1; r >= 0; r-- {
+		s := m[r][n]
+		for j := r + 1; j < n; j++ {
+			s -= m[r][j] * x[j]
+		}
+		x[r] = s / m[r][r]
+	}
+	return x, nil
+}
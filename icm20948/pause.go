@@ -0,0 +1,49 @@
+package icm20948
+
+import "time"
+
+/*
+Pause stops the driver reading the sensors, e.g. to leave the bus free for a long AuxRead of another device or
+while reconfiguring, without closing it.  C, CAvg and CExpAvg keep sending the last values, and nothing is added
+to CBuf, so consumers aren't starved; the polling clocks are stopped, so a paused driver uses no CPU.  The
+watchdog doesn't fire while paused.  Once Pause returns, no further reads are started until Resume.
+Pause does nothing if the driver is already paused or closed.
+*/
+func (mpu *ICM20948) Pause() {
+	mpu.setPaused(true)
+}
+
+// Resume restarts reading the sensors after Pause.  It does nothing if the driver isn't paused.
+func (mpu *ICM20948) Resume() {
+	mpu.setPaused(false)
+}
+
+// Paused returns whether reads are paused.
+func (mpu *ICM20948) Paused() bool {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return mpu.paused
+}
+
+func (mpu *ICM20948) setPaused(pause bool) {
+	if mpu.cPause == nil {
+		return
+	}
+	mpu.pauseMu.Lock()
+	defer mpu.pauseMu.Unlock()
+	if mpu.Paused() == pause {
+		return
+	}
+
+	select {
+	case mpu.cPause <- pause:
+	case <-mpu.cDone:
+		return
+	}
+	mpu.mu.Lock()
+	mpu.paused = pause
+	if !pause {
+		mpu.lastGoodRead = time.Now() // Give the watchdog a fresh start.
+	}
+	mpu.mu.Unlock()
+}
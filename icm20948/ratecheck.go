@@ -0,0 +1,146 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	rateWindow       = time.Second // Window over which AchievedRate counts the gyro reads
+	rateShortfall    = 0.9         // Fraction of the gyro polling rate below which a window counts as a shortfall
+	rateCheckSamples = 10          // Samples read to time the registers for WithRateCheck
+)
+
+// rateMeter measures the rate of gyro reads over successive windows of rateWindow.
+type rateMeter struct {
+	start time.Time // Start of the current window; zero until the first read
+	n     int       // Reads in the current window after the first
+	rate  float64   // Rate over the last complete window, Hz; 0 until there is one
+}
+
+// update counts a gyro read at t and returns whether it completed a window, whose rate is then in r.rate.
+// The caller must hold mpu.mu.
+func (r *rateMeter) update(t time.Time) bool {
+	if r.start.IsZero() {
+		r.start = t
+		return false
+	}
+	r.n++
+	elapsed := t.Sub(r.start)
+	if elapsed < rateWindow {
+		return false
+	}
+	r.rate = float64(r.n) / elapsed.Seconds()
+	r.start, r.n = t, 0
+	return true
+}
+
+// restart starts a new window with the next read, after a pause or a change of rate.  The caller must hold mpu.mu.
+func (r *rateMeter) restart() {
+	r.start, r.n = time.Time{}, 0
+}
+
+/*
+AchievedRate returns the rate at which the gyro is actually being read, in Hz, counted over the last whole second
+of reads: the polling rate for the requested rate (see SetGyroSampleRate) if the reads keep up, less if the bus or
+host can't, since the polling clock then drops ticks.  The polling period is 1125/rate ms rounded to whole
+milliseconds, so the polling rate is not quite the requested one: 43.5 Hz for 50 Hz and 90.9 Hz for 100 Hz.
+It is 0 until the driver has been reading for a second, and for a second after a Pause or a change of rate.
+Seconds in which it falls below 90% of the polling rate are counted in Stats as RateShortfalls, and logged with
+WithRateCheck.
+*/
+func (mpu *ICM20948) AchievedRate() float64 {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return mpu.rate.rate
+}
+
+/*
+WithRateCheck makes the constructor check that the requested rates can be read over the bus: it times a few full
+sample reads and estimates the fraction of the time the read loop will spend on the bus, from the measured time
+per register and the reads EstimateBusLoad counts.  If reading would take longer than the time available, the
+constructor fails with an error if strict is true, and otherwise logs a warning, with the measured times and
+EstimateBusLoad's figure for the configured bus clock.  While running, each second in which AchievedRate falls
+short of the requested rate is then logged too.
+*/
+func WithRateCheck(strict bool) Option {
+	return func(mpu *ICM20948) {
+		mpu.rateCheck, mpu.rateCheckStrict = true, strict
+	}
+}
+
+// checkRate times full sample reads and fails, or warns, if the configured rates can't be read in time.
+func (mpu *ICM20948) checkRate() error {
+	mpu.mu.Lock()
+	gyroRate, accelRate, sampleRate, tempEvery := mpu.gyroRate, mpu.accelRate, mpu.sampleRate, mpu.temp.every
+	mpu.mu.Unlock()
+
+	regs := []byte{ICMREG_GYRO_XOUT_H, ICMREG_GYRO_YOUT_H, ICMREG_GYRO_ZOUT_H,
+		ICMREG_ACCEL_XOUT_H, ICMREG_ACCEL_YOUT_H, ICMREG_ACCEL_ZOUT_H}
+	if tempEvery == 1 {
+		regs = append(regs, ICMREG_TEMP_OUT_H)
+	}
+	mpu.busMu.Lock()
+	start := time.Now()
+	for i := 0; i < rateCheckSamples; i++ {
+		for _, reg := range regs {
+			if _, err := mpu.i2cRead2(reg); err != nil {
+				mpu.busMu.Unlock()
+				return fmt.Errorf("ICM20948 Error: couldn't time the sample reads: %s", err.Error())
+			}
+		}
+	}
+	perReg := time.Since(start) / time.Duration(rateCheckSamples*len(regs))
+	mpu.busMu.Unlock()
+
+	// Register reads per second, as in EstimateBusLoad.
+	reads := float64(gyroRate * len(regs))
+	if accelRate != gyroRate {
+		reads = float64(gyroRate*(len(regs)-3) + accelRate*3)
+	}
+	if mpu.enableMag {
+		pollRate := sampleRate
+		if pollRate > 100 {
+			pollRate = 100
+		}
+		_, magRate := ak09916Mode(sampleRate)
+		if magRate > pollRate {
+			magRate = pollRate
+		}
+		reads += float64(pollRate + 4*magRate)
+	}
+	busy := reads * perReg.Seconds()
+	if busy <= 1 {
+		return nil
+	}
+	msg := fmt.Sprintf("reading the sensors at %d Hz would take %.0f%% of the time (%s per register, "+
+		"estimated %.0f%% bus load); lower the sample rate or raise the bus clock",
+		sampleRate, 100*busy, perReg.Round(time.Microsecond), 100*EstimateBusLoad(mpu.cfg).Utilization)
+	if mpu.rateCheckStrict {
+		return errors.New("ICM20948 Error: " + msg)
+	}
+	log.Printf("ICM20948 Warning: %s\n", msg)
+	return nil
+}
+
+// tickRate returns the rate, Hz, at which readSensors polls a sensor sampled at rate Hz; see tickerPeriod.
+func tickRate(rate int) float64 {
+	return float64(time.Second) / float64(tickerPeriod(rate))
+}
+
+// rateShort checks a completed window of the rate meter against the polling rate for gyroRate, counting a
+// shortfall, and returns the warning to log, if any.  The caller must hold mpu.mu.
+func (mpu *ICM20948) rateShort(gyroRate int) string {
+	expected := tickRate(gyroRate)
+	if mpu.rate.rate >= rateShortfall*expected {
+		return ""
+	}
+	mpu.stats.RateShortfalls++
+	if !mpu.rateCheck || !mpu.logThrottle.allow(uint64(mpu.stats.RateShortfalls)) {
+		return ""
+	}
+	return fmt.Sprintf("ICM20948 Warning: gyro read at %.1f Hz, short of %.1f Hz polling for %d Hz (%d seconds so far)\n",
+		mpu.rate.rate, expected, gyroRate, mpu.stats.RateShortfalls)
+}
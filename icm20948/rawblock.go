@@ -0,0 +1,48 @@
+package icm20948
+
+import (
+	"fmt"
+	"time"
+)
+
+const rawBlockGALen = 14 // Bytes of the accel, gyro and temperature registers, ACCEL_XOUT_H to TEMP_OUT_L
+
+/*
+ReadRawBlock reads the sensor registers in one burst read, for callers that parse the data themselves, and returns
+the bytes and the time of the read.  It is the cheapest read of the sensors possible: one I2C transaction for
+everything.  The bytes are those of bank 0 from ACCEL_XOUT_H on, so all 16-bit values are big-endian except the
+magnetometer's, and all are in the chip's axes, without the calibration, axis map or any filtering:
+
+	0-5    ACCEL_XOUT, ACCEL_YOUT, ACCEL_ZOUT   int16, 32768/range LSB per G; see SetAccelSensitivity
+	6-11   GYRO_XOUT, GYRO_YOUT, GYRO_ZOUT      int16, 32768/range LSB per °/s; see SetGyroSensitivity
+	12-13  TEMP_OUT                             int16, °C = TEMP_OUT/333.87 + 21
+
+If the magnetometer is enabled or aux slaves are set up with ConfigureAuxSlave, the bytes of EXT_SENS_DATA that
+they use follow, as many as AuxDataBudget reports used.  With the magnetometer, which reads on Slave 0, they start:
+
+	14     AK09916 ST1                          bit 0 DRDY: new data; bit 1 DOR: a measurement was missed
+	15-20  HX, HY, HZ                           int16 little-endian, 0.15 µT per LSB, in the AK09916's axes
+	21     AK09916 TMPS                         dummy
+	22     AK09916 ST2                          bit 3 HOFL: the field overflowed the sensor and HX-HZ are invalid
+
+and the aux slaves' bytes follow in slave order, as many as each was set up to read.  Without the magnetometer
+the aux slaves' bytes start at 14.  The read doesn't disturb the read loop, which it is serialized with.
+*/
+func (mpu *ICM20948) ReadRawBlock() (block []byte, t time.Time, err error) {
+	mpu.mu.Lock()
+	slaves := mpu.auxSlaves
+	mpu.mu.Unlock()
+	_, ext := auxOffsets(slaves, mpu.enableMag)
+
+	block = make([]byte, rawBlockGALen+ext)
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+	_, err = mpu.busOp(func() (uint16, error) {
+		return 0, mpu.i2cbus.ReadFromReg(mpu.address, ICMREG_ACCEL_XOUT_H, block)
+	})
+	t = time.Now()
+	if err != nil {
+		return nil, t, fmt.Errorf("ICM20948 Error: couldn't read the raw sensor block: %w", err)
+	}
+	return block, t, nil
+}
@@ -0,0 +1,108 @@
+package icm20948
+
+import (
+	"fmt"
+	"log"
+)
+
+// ErrorSource says which part of the driver a ReadError came from.
+type ErrorSource int
+
+const (
+	SourceGyroAccel ErrorSource = iota // Reading the gyro or accelerometer
+	SourceMag                          // Reading or triggering the magnetometer
+	SourceBus                          // Other bus accesses of the read loop: the config check and aux slaves
+)
+
+func (s ErrorSource) String() string {
+	switch s {
+	case SourceGyroAccel:
+		return "gyro/accel"
+	case SourceMag:
+		return "magnetometer"
+	case SourceBus:
+		return "bus"
+	}
+	return fmt.Sprintf("ErrorSource(%d)", int(s))
+}
+
+// ReadError is an error the read loop ran into and carried on from, as passed to the function set with SetOnError.
+// Err is the underlying error, so e.g. errors.Is(err, ErrBusTimeout) reports bus timeouts.
+type ReadError struct {
+	Source ErrorSource
+	Count  uint64 // Errors from Source so far, including this one
+	Err    error
+}
+
+func (e *ReadError) Error() string {
+	return fmt.Sprintf("%s error #%d: %s", e.Source, e.Count, e.Err)
+}
+
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// logReadError is the default function for SetOnError.
+func logReadError(err error) {
+	log.Printf("ICM20948 Warning: %s\n", err)
+}
+
+// WithOnError sets the function called with the errors of the read loop; see SetOnError.
+func WithOnError(f func(err error)) Option {
+	return func(mpu *ICM20948) {
+		mpu.onError = f
+	}
+}
+
+/*
+SetOnError sets a function that the read loop calls with each error it carries on from, a *ReadError saying
+whether it came from the gyro/accel, the magnetometer or another bus access, e.g. to show a sensor health warning
+as soon as reads start failing rather than when data goes missing.  The calls are rate limited like the routine
+log messages (see SetLogThrottle), separately for each source: with the defaults, the first error from each
+source and then one in every 100.  Every error is counted in Stats.
+
+f is called from the read loop with no locks held, so it may call the driver's methods, but it must return
+quickly.  The default, and nil, log the errors.
+*/
+func (mpu *ICM20948) SetOnError(f func(err error)) {
+	mpu.mu.Lock()
+	mpu.onError = f
+	mpu.mu.Unlock()
+}
+
+// readError counts err from src and, unless the rate limit holds it back, queues it for reportErrors.  It may
+// be called with busMu held.
+func (mpu *ICM20948) readError(src ErrorSource, err error) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	var count uint64
+	switch src {
+	case SourceGyroAccel:
+		mpu.stats.GyroAccelErrors++
+		count = mpu.stats.GyroAccelErrors
+	case SourceMag:
+		mpu.stats.MagErrors++
+		count = mpu.stats.MagErrors
+	default:
+		mpu.stats.BusErrors++
+		count = mpu.stats.BusErrors
+	}
+	if mpu.logThrottle.allow(count) {
+		mpu.pendingErrors = append(mpu.pendingErrors, &ReadError{Source: src, Count: count, Err: err})
+	}
+}
+
+// reportErrors passes the errors queued by readError to the function set with SetOnError.  It must be called
+// without busMu or mu held.
+func (mpu *ICM20948) reportErrors() {
+	mpu.mu.Lock()
+	errs, f := mpu.pendingErrors, mpu.onError
+	mpu.pendingErrors = nil
+	mpu.mu.Unlock()
+	if f == nil {
+		f = logReadError
+	}
+	for _, err := range errs {
+		f(err)
+	}
+}
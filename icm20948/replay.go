@@ -0,0 +1,360 @@
+package icm20948
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WithReplaySpeed sets how fast ReplayFromCSV plays back a log: 1 (the default) at the recorded timing, 2 twice
+// as fast and so on, or 0 as fast as the consumer of CBuf takes the samples.
+func WithReplaySpeed(speed float64) Option {
+	return func(mpu *ICM20948) {
+		mpu.replaySpeed = speed
+	}
+}
+
+/*
+ReplayFromCSV creates an ICM20948 that plays back a log written by MPUDataLogger (or NewGzipMPUDataLogger, if
+path ends in ".gz") instead of reading hardware, so that fusion and logging code can be developed and tested
+offline.  Samples are sent on C, CBuf, CAvg, CExpAvg, CResampled, CFiltered, DecimatedStream and AverageSince,
+and fed to the horizon filter and odometer, just as from the sensor, with times shifted to start now.  By default
+they are sent at the recorded timing; see WithReplaySpeed.  Pause and Resume hold the playback.
+The log is read as by ParseMPUDataCSV.
+When the log is exhausted the channels are closed, as after CloseMPU.  Methods that access the bus, e.g. the
+Set* and Read* methods, must not be called on a replay.
+*/
+func ReplayFromCSV(path string, opts ...Option) (*ICM20948, error) {
+	data, err := readMPUDataCSV(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("ICM20948 Error: no samples in %s", path)
+	}
+	mpu, err := newReplay(opts)
+	if err != nil {
+		return nil, err
+	}
+	mpu.startReplay(data)
+	return mpu, nil
+}
+
+// newReplay creates an ICM20948 for playing back samples, configured by opts.
+func newReplay(opts []Option) (*ICM20948, error) {
+	var mpu = new(ICM20948)
+	mpu.replaySpeed = 1
+	mpu.expAvg = expAvg{tau: defaultExpAvgTau.Seconds()}
+	for _, opt := range opts {
+		opt(mpu)
+	}
+	if mpu.replaySpeed < 0 {
+		return nil, fmt.Errorf("ICM20948 Error: %g is not a valid replay speed", mpu.replaySpeed)
+	}
+	if mpu.biquad != nil && (mpu.biquad.cutoff < 0 || !finite(mpu.biquad.cutoff)) {
+		return nil, fmt.Errorf("ICM20948 Error: %g Hz is not a valid filter cutoff", mpu.biquad.cutoff)
+	}
+	if mpu.gyroHighPass != nil && mpu.gyroHighPass.tau < 0 {
+		return nil, errors.New("ICM20948 Error: gyro high-pass time constant must not be negative")
+	}
+	if err := mpu.makeSamples(); err != nil {
+		return nil, err
+	}
+	if mpu.horizon != nil {
+		if mpu.horizon.tau < 0 {
+			return nil, errors.New("ICM20948 Error: horizon time constant must not be negative")
+		}
+		mpu.horizon.magAligned = mpu.axisMap != nil
+	}
+	return mpu, nil
+}
+
+// startReplay starts playing back data, whose times are relative to the zero time.
+func (mpu *ICM20948) startReplay(data []*MPUData) {
+	mpu.enableMag = data[0].MagError == nil
+	mpu.mpuCalData.reset()
+	if n := len(data); n > 1 && data[n-1].T.After(data[0].T) {
+		mpu.sampleRate = int(float64(n-1)/data[n-1].T.Sub(data[0].T).Seconds() + 0.5)
+	}
+	mpu.gyroRate, mpu.accelRate = mpu.sampleRate, mpu.sampleRate
+
+	mpu.makeChannels()
+	go mpu.replay(data)
+}
+
+// readMPUDataCSV reads the samples in a log written by MPUDataLogger, compressed if path ends in ".gz".  Their
+// times are relative to the zero time.
+func readMPUDataCSV(path string) ([]*MPUData, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("ICM20948 Error: couldn't decompress %s: %s", path, err.Error())
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return parseMPUDataCSV(r, path)
+}
+
+/*
+ParseMPUDataCSV reads a log written by MPUDataLogger, with its standard columns, back into MPUData, for offline
+analysis.  Columns are matched by name, so their order doesn't matter, and missing columns read as 0; without
+M1-M3 the samples have a MagError.  N and NM are 1, and DT and DTM are the intervals from the previous row.
+
+The log holds T and TM in ms since the t0 it was written with, but not t0 itself, so the times are rebuilt
+relative to the zero time, which is returned as t0: d.T.Sub(t0) is the logged time, and logging the samples
+again with LogMPUData(t0, d) writes the same rows.  An empty log gives no samples and no error.
+*/
+func ParseMPUDataCSV(r io.Reader) ([]*MPUData, time.Time, error) {
+	data, err := parseMPUDataCSV(r, "MPUData CSV")
+	return data, time.Time{}, err
+}
+
+// parseMPUDataCSV reads the samples in a log written by MPUDataLogger from r, naming it name in errors.
+func parseMPUDataCSV(r io.Reader, name string) ([]*MPUData, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("ICM20948 Error: couldn't parse %s: %s", name, err.Error())
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	header := rows[0]
+	hasMag := false
+	for _, col := range header {
+		hasMag = hasMag || col == "M1"
+	}
+
+	// Rounded, as v*1e6 may fall just short of a whole ns, which would lose a µs when logged again.
+	ms := func(v float64) time.Time {
+		return time.Time{}.Add(time.Duration(math.Round(v * float64(time.Millisecond))))
+	}
+	data := make([]*MPUData, 0, len(rows)-1)
+	for i, row := range rows[1:] {
+		d := &MPUData{N: 1}
+		if hasMag {
+			d.NM = 1
+		} else {
+			d.MagError = errors.New("ICM20948 Error: no magnetometer values in log")
+		}
+		for j, col := range header {
+			v, err := strconv.ParseFloat(row[j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("ICM20948 Error: bad %s value on line %d of %s: %s", col, i+2, name, err.Error())
+			}
+			switch col {
+			case "T":
+				d.T = ms(v)
+			case "TM":
+				d.TM = ms(v)
+			case "A1":
+				d.A1 = v
+			case "A2":
+				d.A2 = v
+			case "A3":
+				d.A3 = v
+			case "B1":
+				d.G1 = v
+			case "B2":
+				d.G2 = v
+			case "B3":
+				d.G3 = v
+			case "M1":
+				d.M1 = v
+			case "M2":
+				d.M2 = v
+			case "M3":
+				d.M3 = v
+			case "Temp":
+				d.Temp = v
+			}
+		}
+		if n := len(data); n > 0 {
+			d.DT = d.T.Sub(data[n-1].T)
+			d.DTM = d.TM.Sub(data[n-1].TM)
+		}
+		data = append(data, d)
+	}
+	return data, nil
+}
+
+// replay sends the logged samples on the channels, standing in for readSensors.
+func (mpu *ICM20948) replay(data []*MPUData) {
+	var (
+		curdata, expAvgData *MPUData
+		avg                 replayAvg
+		magFixed            bool
+		pausedAt            time.Time
+	)
+
+	cC, cAvg, cBuf, cExpAvg := mpu.cC, mpu.cAvg, mpu.cBuf, mpu.cExpAvg
+	defer close(cC)
+	defer close(cAvg)
+	defer close(cExpAvg)
+	defer close(cBuf)
+	defer close(mpu.cResampled)
+	defer close(mpu.cFiltered)
+	defer close(mpu.cHorizon)
+	defer mpu.closeDecimators() // After cDone, so DecimatedStream can't add a stream that is never closed
+	defer close(mpu.cDone)
+
+	policy := mpu.bufPolicy
+	if mpu.replaySpeed == 0 {
+		policy = BlockProducer
+	}
+	start, first := time.Now(), data[0].T
+	shift := start.Sub(first)
+	next := time.NewTimer(0)
+	defer next.Stop()
+	// delay returns how long to wait before sending data[i].
+	delay := func(i int) time.Duration {
+		if mpu.replaySpeed == 0 {
+			return 0
+		}
+		return time.Until(start.Add(time.Duration(float64(data[i].T.Sub(first)) / mpu.replaySpeed)))
+	}
+
+	for i := 0; ; {
+		// Until there is a first sample, C, CAvg and CExpAvg have nothing to send.
+		var sendC, sendAvg, sendExpAvg chan *MPUData
+		if curdata != nil {
+			sendC, sendAvg, sendExpAvg = cC, cAvg, cExpAvg
+		}
+
+		select {
+		case <-next.C:
+			mpu.mu.Lock()
+			d := mpu.newSample()
+			*d = *data[i]
+			d.Seq = uint64(i + 1)
+			d.T = d.T.Add(shift)
+			if !d.TM.IsZero() {
+				d.TM = d.TM.Add(shift)
+			}
+			mpu.highPassGyro(d)
+			mpu.mu.Unlock()
+			curdata = d
+			avg.add(curdata)
+			if !magFixed && d.MagError == nil {
+				close(mpu.cMagFix)
+				magFixed = true
+			}
+			mpu.mu.Lock()
+			mpu.latest = curdata
+			mpu.stats.Samples = d.Seq
+			mpu.lastGoodRead, mpu.lastSample = curdata.T, curdata.T
+			mpu.odo.update(curdata)
+			if mpu.horizon != nil && mpu.horizon.update(curdata, true) {
+				mpu.sendHorizon()
+			}
+			mpu.expAvg.update(curdata)
+			expAvgData = mpu.expAvg.d
+			mpu.resample(curdata)
+			mpu.filter(curdata)
+			mpu.decimate(curdata)
+			mpu.mu.Unlock()
+			mpu.buffer(curdata, policy)
+
+			i++
+			if i == len(data) {
+				return
+			}
+			next.Reset(delay(i))
+		case sendC <- curdata: // Send the latest values
+		case sendAvg <- avg.mpuData(): // Send the averages
+			avg.reset(curdata)
+		case req := <-mpu.cAvgReq: // Send the averages to AverageSince
+			req.c <- avg.mpuData()
+			if req.reset {
+				avg.reset(curdata)
+			}
+		case sendExpAvg <- expAvgData: // Send the exponential average
+		case pause := <-mpu.cPause: // Stop or restart the playback, shifting the rest of the log by the pause
+			if pause {
+				pausedAt = time.Now()
+				if !next.Stop() {
+					select {
+					case <-next.C:
+					default:
+					}
+				}
+			} else {
+				start = start.Add(time.Since(pausedAt))
+				shift = start.Sub(first)
+				next.Reset(delay(i))
+			}
+		case <-mpu.cClose:
+			return
+		}
+	}
+}
+
+// replayAvg accumulates the averages of replayed samples, which are already calibrated.
+type replayAvg struct {
+	sum    MPUData
+	n, nm  int
+	t0, tm time.Time // Start of the window for the accel/gyro and the magnetometer
+}
+
+func (a *replayAvg) add(d *MPUData) {
+	a.sum.G1, a.sum.G2, a.sum.G3 = a.sum.G1+d.G1, a.sum.G2+d.G2, a.sum.G3+d.G3
+	a.sum.A1, a.sum.A2, a.sum.A3 = a.sum.A1+d.A1, a.sum.A2+d.A2, a.sum.A3+d.A3
+	a.sum.Temp += d.Temp
+	a.sum.T, a.sum.Seq = d.T, d.Seq
+	a.n++
+	if d.MagError == nil {
+		a.sum.M1, a.sum.M2, a.sum.M3 = a.sum.M1+d.M1, a.sum.M2+d.M2, a.sum.M3+d.M3
+		a.sum.TM = d.TM
+		a.nm++
+	}
+}
+
+// reset starts a new window at the time of the latest sample, d.
+func (a *replayAvg) reset(d *MPUData) {
+	*a = replayAvg{}
+	if d != nil {
+		a.t0, a.tm = d.T, d.TM
+	}
+}
+
+func (a *replayAvg) mpuData() *MPUData {
+	d := MPUData{}
+	if a.n > 0 {
+		n := float64(a.n)
+		d.G1, d.G2, d.G3 = a.sum.G1/n, a.sum.G2/n, a.sum.G3/n
+		d.A1, d.A2, d.A3 = a.sum.A1/n, a.sum.A2/n, a.sum.A3/n
+		d.Temp = a.sum.Temp / n
+		d.N = a.n
+		d.T, d.Seq = a.sum.T, a.sum.Seq
+		if !a.t0.IsZero() {
+			d.DT = d.T.Sub(a.t0)
+		}
+	} else {
+		d.GAError = errNoGAValues
+	}
+	if a.nm > 0 {
+		nm := float64(a.nm)
+		d.M1, d.M2, d.M3 = a.sum.M1/nm, a.sum.M2/nm, a.sum.M3/nm
+		d.NM = a.nm
+		d.TM = a.sum.TM
+		if !a.tm.IsZero() {
+			d.DTM = d.TM.Sub(a.tm)
+		}
+	} else {
+		d.MagError = errNoMagValues
+	}
+	return &d
+}
@@ -0,0 +1,136 @@
+package icm20948
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	resampledBufSize = 100                    // Size of the CResampled buffer
+	resampleMaxGap   = 500 * time.Millisecond // Gap in the input after which the output grid restarts
+)
+
+// Interpolation is how SetResampling fills in the fixed-rate output between input samples.
+type Interpolation int
+
+const (
+	ZeroOrderHold Interpolation = iota // Each output holds the values of the latest input at or before it
+	Linear                             // Each output is interpolated between the inputs either side of it
+)
+
+// resampler turns the irregular samples from readSensors into samples on a fixed grid of times.
+type resampler struct {
+	period time.Duration
+	interp Interpolation
+	prev   *MPUData  // Latest input sample
+	next   time.Time // Time of the next output sample
+	seq    uint64    // Seq of the latest output sample
+}
+
+// push adds an input sample and returns the output samples it completes: those at grid times after the previous
+// input and up to and including d.T.  The first sample, and the first after a gap, start the grid at their time.
+func (r *resampler) push(d *MPUData) []*MPUData {
+	if d.GAError != nil {
+		return nil
+	}
+	if r.prev == nil || d.T.Sub(r.prev.T) > resampleMaxGap {
+		r.prev, r.next = d, d.T
+		return []*MPUData{r.sample(d, d, 0)}
+	}
+	if !d.T.After(r.prev.T) {
+		return nil
+	}
+
+	var out []*MPUData
+	span := float64(d.T.Sub(r.prev.T))
+	for !r.next.After(d.T) {
+		f := float64(r.next.Sub(r.prev.T)) / span
+		switch {
+		case r.next.Equal(d.T):
+			out = append(out, r.sample(d, d, 0))
+		case r.interp == Linear:
+			out = append(out, r.sample(r.prev, d, f))
+		default:
+			out = append(out, r.sample(r.prev, r.prev, 0))
+		}
+	}
+	r.prev = d
+	return out
+}
+
+// sample returns the output sample at r.next, a fraction f of the way from a to b, and advances r.next.
+func (r *resampler) sample(a, b *MPUData, f float64) *MPUData {
+	lerp := func(x, y float64) float64 { return x + f*(y-x) }
+	v := *b
+	v.G1, v.G2, v.G3 = lerp(a.G1, b.G1), lerp(a.G2, b.G2), lerp(a.G3, b.G3)
+	v.A1, v.A2, v.A3 = lerp(a.A1, b.A1), lerp(a.A2, b.A2), lerp(a.A3, b.A3)
+	if a.MagError == nil && b.MagError == nil {
+		v.M1, v.M2, v.M3 = lerp(a.M1, b.M1), lerp(a.M2, b.M2), lerp(a.M3, b.M3)
+	}
+	v.Temp = lerp(a.Temp, b.Temp)
+	v.Saturated = a.Saturated | b.Saturated
+	v.T, v.DT, v.Jitter = r.next, r.period, 0
+	r.seq++
+	v.Seq = r.seq
+	r.next = r.next.Add(r.period)
+	return &v
+}
+
+// newResampler returns a resampler to hz, or nil for 0.  A negative hz gives a resampler with no period, for
+// NewWithOptions to reject.
+func newResampler(hz int, interp Interpolation) *resampler {
+	switch {
+	case hz == 0:
+		return nil
+	case hz < 0:
+		return &resampler{interp: interp}
+	}
+	return &resampler{period: time.Second / time.Duration(hz), interp: interp}
+}
+
+// WithResampling turns on resampling to a fixed rate; see SetResampling.
+func WithResampling(hz int, interp Interpolation) Option {
+	return func(mpu *ICM20948) {
+		mpu.resampler = newResampler(hz, interp)
+	}
+}
+
+/*
+SetResampling turns on a resampling stage that puts the samples onto a fixed grid of hz samples per second and
+sends them on CResampled, for filters and control loops that assume a constant DT.  The reads are driven by a
+ticker, so the samples on C and CBuf come at irregular intervals (see MPUData.Jitter); on CResampled T is exactly
+1/hz apart, DT is 1/hz and Seq counts the resampled samples.  With Linear the values are interpolated between the
+samples either side of each output time, with ZeroOrderHold they are those of the latest sample at or before it.
+
+An output sample is only sent once the input sample after it has been read, so CResampled lags the sensor by up
+to one input sample period.  After a gap of more than 500 ms, e.g. while paused, the grid restarts.  hz of 0
+turns resampling off; CResampled is then no longer sent to but isn't closed until CloseMPU.
+*/
+func (mpu *ICM20948) SetResampling(hz int, interp Interpolation) error {
+	if hz < 0 {
+		return fmt.Errorf("ICM20948 Error: %d Hz is not a valid resampling rate", hz)
+	}
+	mpu.mu.Lock()
+	mpu.resampler = newResampler(hz, interp)
+	mpu.mu.Unlock()
+	return nil
+}
+
+// resample feeds d to the resampler, if enabled, and sends the samples it completes on CResampled, dropping the
+// oldest if it is full.  The caller must hold mpu.mu.
+func (mpu *ICM20948) resample(d *MPUData) {
+	if mpu.resampler == nil {
+		return
+	}
+	for _, v := range mpu.resampler.push(d) {
+		select {
+		case mpu.cResampled <- v:
+		default:
+			select {
+			case <-mpu.cResampled:
+			default:
+			}
+			mpu.cResampled <- v
+		}
+	}
+}
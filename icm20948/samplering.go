@@ -0,0 +1,58 @@
+package icm20948
+
+import "errors"
+
+// sampleRing hands out the MPUData for new samples from a fixed set of structs, reusing each once the ring has
+// gone round, instead of allocating one per sample.
+type sampleRing struct {
+	buf  []MPUData
+	next int
+}
+
+// get returns the next struct of the ring, zeroed.
+func (r *sampleRing) get() *MPUData {
+	d := &r.buf[r.next]
+	r.next = (r.next + 1) % len(r.buf)
+	*d = MPUData{}
+	return d
+}
+
+/*
+WithPreallocatedSamples makes the driver reuse a fixed set of MPUData for the instantaneous samples sent on C and
+CBuf, rather than allocating a new one for each, to spare the garbage collector at high sample rates on small
+machines.  This changes who owns a sample: instead of never being modified once sent, each sample is overwritten
+by a later one, at the earliest once another n samples have been taken, after the 250 that CBuf can hold.  So a
+consumer must copy out what it needs, e.g. with v := *d, within n samples of receiving it, and mustn't keep the
+pointer.  The averages and the other derived streams are allocated as usual.
+
+n must not be negative.  It can't be used with the DropNewest buffer policy, with which samples can sit in CBuf
+for any length of time.
+*/
+func WithPreallocatedSamples(n int) Option {
+	return func(mpu *ICM20948) {
+		mpu.preallocSamples = n
+	}
+}
+
+// makeSamples checks the WithPreallocatedSamples option and allocates the samples.
+func (mpu *ICM20948) makeSamples() error {
+	switch n := mpu.preallocSamples; {
+	case n < 0:
+		return errors.New("ICM20948 Error: preallocated samples must not be negative")
+	case n > 0 && mpu.bufPolicy == DropNewest:
+		return errors.New("ICM20948 Error: preallocated samples can't be used with DropNewest")
+	case n > 0:
+		// CBuf can hold bufSize samples, and the latest sample and the one before it are kept for C and resampling.
+		mpu.samples = &sampleRing{buf: make([]MPUData, n+bufSize+2)}
+	}
+	return nil
+}
+
+// newSample returns the MPUData to fill in for a new sample: a new one, or the next of the preallocated ones.
+// The caller must hold mpu.mu.
+func (mpu *ICM20948) newSample() *MPUData {
+	if mpu.samples == nil {
+		return new(MPUData)
+	}
+	return mpu.samples.get()
+}
@@ -0,0 +1,54 @@
+package icm20948
+
+// ScannedDevice describes a device found by ScanDevices.
+type ScannedDevice struct {
+	Address byte   // I2C address
+	ID      byte   // WHO_AM_I (ICM20948) or WIA2 (AK09916) as read
+	Model   string // "ICM20948" or "AK09916" if ID matched, otherwise ""
+}
+
+// scanAddresses are the addresses probed by Scan: the ICM20948 with AD0 low and high, and the AK09916, which is
+// only on the host bus when the ICM20948's aux bus is bypassed.
+var scanAddresses = []struct {
+	addr, reg, id byte
+	model         string
+}{
+	{MPU_ADDRESS, ICMREG_WHOAMI, ICM20948_WHOAMI, "ICM20948"},
+	{MPU_ADDRESS + 1, ICMREG_WHOAMI, ICM20948_WHOAMI, "ICM20948"},
+	{AK09916_I2C_ADDR, AK09916_WIA2, AK09916_Device_ID, "AK09916"},
+}
+
+/*
+Scan probes the addresses an ICM20948 (0x68, 0x69) or its AK09916 magnetometer (0x0C) can have on bus and
+returns those that responded, e.g. to find which address to pass to WithAddress.  See ScanDevices for the chip
+IDs.  Scan only reads ID registers, so it doesn't change the state of any device.
+*/
+func Scan(bus I2C) []byte {
+	var addrs []byte
+	for _, d := range ScanDevices(bus) {
+		addrs = append(addrs, d.Address)
+	}
+	return addrs
+}
+
+/*
+ScanDevices is Scan, also returning the ID each device reported.  A device with an unexpected ID is still
+listed, with no Model: it may be another chip at the same address, or an ICM20948 left on a register bank other
+than 0 by an earlier program, since WHO_AM_I can only be read on bank 0 and switching banks would change the
+chip's state.
+*/
+func ScanDevices(bus I2C) []ScannedDevice {
+	var devices []ScannedDevice
+	for _, a := range scanAddresses {
+		id, err := bus.ReadByteFromReg(a.addr, a.reg)
+		if err != nil {
+			continue
+		}
+		d := ScannedDevice{Address: a.addr, ID: id}
+		if id == a.id {
+			d.Model = a.model
+		}
+		devices = append(devices, d)
+	}
+	return devices
+}
@@ -0,0 +1,116 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const wakeTime = 40 * time.Millisecond // Time for the gyro to start up after the chip leaves sleep
+
+/*
+Sleep stops reading the sensors, as Pause does, and puts the chip into sleep mode (PWR_MGMT_1 SLEEP) to save
+power on battery devices.  The chip then draws about 8 µA, rather than about 3 mA with the gyro and accelerometer
+running.  The magnetometer, if enabled, is powered down first.  If disableSensors is true the gyro and
+accelerometer are also disabled in PWR_MGMT_2, so they stay off if the chip is woken by anything else.
+C, CAvg and CExpAvg keep sending the last values.  Call Wake to restart; CloseMPU leaves the chip asleep.
+Sleep does nothing if the chip is already asleep.
+*/
+func (mpu *ICM20948) Sleep(disableSensors bool) error {
+	if mpu.Asleep() {
+		return nil
+	}
+	wasPaused := mpu.Paused()
+	mpu.Pause()
+
+	pwrMgmt2, err := mpu.sleep(disableSensors)
+	if err != nil {
+		if !wasPaused {
+			mpu.Resume()
+		}
+		return err
+	}
+	mpu.mu.Lock()
+	mpu.asleep, mpu.sleepPaused, mpu.pwrMgmt2 = true, wasPaused, pwrMgmt2
+	mpu.mu.Unlock()
+	return nil
+}
+
+// sleep powers the magnetometer down and puts the chip to sleep, returning PWR_MGMT_2 as it was before.
+func (mpu *ICM20948) sleep(disableSensors bool) (byte, error) {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	if mpu.enableMag {
+		// Stop Slave 1 from re-enabling continuous mode, and power the AK09916 down.
+		if err := mpu.setMagSingle(true); err != nil {
+			return 0, err
+		}
+	}
+	pwrMgmt2, err := mpu.i2cRead(ICMREG_PWR_MGMT_2)
+	if err != nil {
+		return 0, errors.New("ICM20948 Error: Sleep error reading chip")
+	}
+	if disableSensors {
+		if err := mpu.i2cWrite(ICMREG_PWR_MGMT_2, pwrMgmt2|BITS_DISABLE_ACCEL|BITS_DISABLE_GYRO); err != nil {
+			return 0, fmt.Errorf("ICM20948 Error: couldn't disable sensors: %s", err.Error())
+		}
+	}
+	if err := mpu.i2cWrite(ICMREG_PWR_MGMT_1, mpu.pwrMgmt1|BIT_SLEEP); err != nil {
+		return 0, fmt.Errorf("ICM20948 Error: couldn't put the chip to sleep: %s", err.Error())
+	}
+	return pwrMgmt2, nil
+}
+
+// Wake takes the chip out of sleep mode, restores the sensors and magnetometer as they were before Sleep and
+// restarts reading them, unless they were already paused before Sleep.  It does nothing if the chip isn't asleep.
+func (mpu *ICM20948) Wake() error {
+	mpu.mu.Lock()
+	asleep, wasPaused, pwrMgmt2 := mpu.asleep, mpu.sleepPaused, mpu.pwrMgmt2
+	mpu.mu.Unlock()
+	if !asleep {
+		return nil
+	}
+
+	if err := mpu.wake(pwrMgmt2); err != nil {
+		return err
+	}
+	mpu.mu.Lock()
+	mpu.asleep = false
+	mpu.mu.Unlock()
+	if !wasPaused {
+		mpu.Resume()
+	}
+	return nil
+}
+
+// wake takes the chip out of sleep, restoring PWR_MGMT_2 and the magnetometer mode.
+func (mpu *ICM20948) wake(pwrMgmt2 byte) error {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	if err := mpu.i2cWrite(ICMREG_PWR_MGMT_1, mpu.pwrMgmt1); err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't wake the chip: %s", err.Error())
+	}
+	if err := mpu.i2cWrite(ICMREG_PWR_MGMT_2, pwrMgmt2); err != nil {
+		return fmt.Errorf("ICM20948 Error: couldn't enable sensors: %s", err.Error())
+	}
+	time.Sleep(wakeTime)
+
+	mpu.mu.Lock()
+	single, magOff := mpu.magSingle, mpu.magOff
+	mpu.mu.Unlock()
+	if mpu.enableMag && !magOff {
+		if err := mpu.setMagSingle(single); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Asleep returns whether the chip has been put to sleep by Sleep.
+func (mpu *ICM20948) Asleep() bool {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return mpu.asleep
+}
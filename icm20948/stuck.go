@@ -0,0 +1,114 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+)
+
+const defaultStuckAxisSamples = 200 // Identical readings in a row after which an axis is taken to be stuck
+
+// Stuck axis flags, for Stats.StuckAxes.  The axes are the chip's, before any axis map.
+const (
+	StuckG1 uint16 = 1 << iota
+	StuckG2
+	StuckG3
+	StuckA1
+	StuckA2
+	StuckA3
+	StuckM1
+	StuckM2
+	StuckM3
+	numStuckAxes = iota
+)
+
+var stuckAxisNames = [numStuckAxes]string{"gyro X", "gyro Y", "gyro Z", "accel X", "accel Y", "accel Z", "mag X",
+	"mag Y", "mag Z"}
+
+// ErrStuckAxis is wrapped by the errors sent on Faults when an axis is found stuck.
+var ErrStuckAxis = errors.New("ICM20948 Error: sensor axis stuck")
+
+// stuckDetector counts how many readings in a row each axis has returned the same value.
+type stuckDetector struct {
+	last  [numStuckAxes]int16
+	run   [numStuckAxes]int
+	stuck uint16 // Flags of the axes currently stuck
+}
+
+// update records the readings vs of the axes from first on and returns the flags of the axes that have become
+// stuck and that have recovered.  Readings at full scale don't count, as a saturated axis is legitimately constant.
+func (s *stuckDetector) update(limit, first int, vs ...int16) (stuck, recovered uint16) {
+	for i, v := range vs {
+		axis, bit := first+i, uint16(1)<<(first+i)
+		switch {
+		case saturated(v):
+			s.run[axis] = 0
+		case s.run[axis] > 0 && v == s.last[axis]:
+			s.run[axis]++
+		default:
+			s.last[axis], s.run[axis] = v, 1
+		}
+		if s.run[axis] >= limit {
+			stuck |= bit &^ s.stuck
+		} else {
+			recovered |= bit & s.stuck
+		}
+	}
+	s.stuck = (s.stuck | stuck) &^ recovered
+	return stuck, recovered
+}
+
+// WithStuckAxisCheck sets after how many identical readings an axis is taken to be stuck; see SetStuckAxisCheck.
+func WithStuckAxisCheck(samples int) Option {
+	return func(mpu *ICM20948) {
+		mpu.stuckAxisSamples = samples
+	}
+}
+
+/*
+SetStuckAxisCheck sets after how many identical readings in a row a gyro, accel or magnetometer axis is taken to
+be stuck, a failure mode where one axis returns a constant while the others work, giving plausible but wrong
+data.  The noise of a working axis changes its reading every few samples even at rest, so the default of 200 never
+triggers on a healthy sensor; readings at full scale are ignored.  When an axis becomes stuck an error wrapping
+ErrStuckAxis is sent on Faults and the axis is flagged in Stats.StuckAxes until its reading changes.  0 disables
+the check.
+*/
+func (mpu *ICM20948) SetStuckAxisCheck(samples int) error {
+	if samples < 0 {
+		return errors.New("ICM20948 Error: stuck axis samples must not be negative")
+	}
+	mpu.mu.Lock()
+	mpu.stuckAxisSamples = samples
+	if samples == 0 {
+		mpu.stuck = stuckDetector{}
+		mpu.stats.StuckAxes = 0
+	}
+	mpu.mu.Unlock()
+	return nil
+}
+
+// checkStuck records the raw readings vs of the axes from first on (0 for G1, 3 for A1 or 6 for M1), and reports a
+// fault for each axis that becomes stuck.
+func (mpu *ICM20948) checkStuck(first int, vs ...int16) {
+	mpu.mu.Lock()
+	if mpu.stuckAxisSamples == 0 {
+		mpu.mu.Unlock()
+		return
+	}
+	limit := mpu.stuckAxisSamples
+	stuck, recovered := mpu.stuck.update(limit, first, vs...)
+	mpu.stats.StuckAxes = mpu.stuck.stuck
+	mpu.stats.StuckAxisFaults += bits.OnesCount16(stuck)
+	mpu.mu.Unlock()
+
+	for i, v := range vs {
+		axis := first + i
+		switch bit := uint16(1) << axis; {
+		case stuck&bit != 0:
+			mpu.fault(fmt.Errorf("%w: %s read %d for %d samples in a row", ErrStuckAxis, stuckAxisNames[axis], v, limit))
+		case recovered&bit != 0:
+			log.Printf("ICM20948: %s no longer stuck\n", stuckAxisNames[axis])
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	defaultSyntheticRate  = 100 // Samples per second of a Trajectory that doesn't set SampleRate
+	defaultSyntheticField = 50  // Magnetic field of a Trajectory that doesn't set MagField, µT
+	syntheticTemp         = 25  // Die temperature of synthetic samples, °C
+)
+
+/*
+Trajectory describes the motion NewSynthetic generates samples for.  Axes and signs are those of the horizon
+filter: axis 1 to the nose, 2 to the left wing and 3 up, pitch positive nose up, roll positive right wing down and
+heading clockwise from magnetic north.  The device starts at the attitude given by Heading, Pitch and Roll and then
+rotates through the segments in order, each at constant body rates, e.g.
+
+	Trajectory{
+		Heading:     90,
+		Inclination: 60,
+		Segments: []TrajectorySegment{
+			{Duration: time.Second},                                  // Still, facing east
+			{Duration: 6 * time.Second, Rate: [3]float64{0, 0, -30}}, // Yaw right at 30°/s, to face west
+		},
+	}
+
+Each sample reads gravity (1 G up, with no linear acceleration) and the fixed magnetic field rotated into the
+body axes, the body rates plus GyroBias on the gyro, and 25 °C.  There is no noise, so the results can be checked
+exactly.
+*/
+type Trajectory struct {
+	SampleRate  int                 // Samples per second; 0 gives 100
+	Heading     float64             // Initial magnetic heading of the nose, °
+	Pitch, Roll float64             // Initial attitude, °
+	MagField    float64             // Magnitude of the magnetic field, µT; 0 gives 50
+	Inclination float64             // Dip of the field below the horizon, °; positive in the northern hemisphere
+	GyroBias    [3]float64          // Added to the gyro readings, °/s
+	Segments    []TrajectorySegment // The motion, in order
+}
+
+// TrajectorySegment is a stretch of a Trajectory at constant body rates.
+type TrajectorySegment struct {
+	Duration time.Duration
+	Rate     [3]float64 // Rotation rate about axes 1-3, °/s, signed as G1-G3: G3 positive yaws left
+}
+
+/*
+NewSynthetic creates an ICM20948 that plays back samples generated for the trajectory tr instead of reading
+hardware, as a fixture for testing the whole stack, from the channels through the averaging to the horizon filter
+and the heading, against a known motion.  The samples play back as from ReplayFromCSV, and take the same options;
+WithReplaySpeed(0) with BlockProducer plays them as fast as they are read.  The magnetometer readings are in the
+AK09916's axes, as the driver outputs them, unless WithAxisMap or WithBoardPreset is given, in which case all the
+readings are in the trajectory's axes.
+*/
+func NewSynthetic(tr Trajectory, opts ...Option) (*ICM20948, error) {
+	mpu, err := newReplay(opts)
+	if err != nil {
+		return nil, err
+	}
+	data, err := tr.samples(mpu.axisMap != nil)
+	if err != nil {
+		return nil, err
+	}
+	mpu.startReplay(data)
+	return mpu, nil
+}
+
+// samples generates the samples of tr, with times relative to the zero time.  If magAligned the magnetometer
+// readings are in the accel/gyro axes, otherwise in the AK09916's.
+func (tr Trajectory) samples(magAligned bool) ([]*MPUData, error) {
+	rate, field := tr.SampleRate, tr.MagField
+	if rate == 0 {
+		rate = defaultSyntheticRate
+	}
+	if field == 0 {
+		field = defaultSyntheticField
+	}
+	if rate < 0 {
+		return nil, fmt.Errorf("ICM20948 Error: %d is not a valid trajectory sample rate", rate)
+	}
+	if len(tr.Segments) == 0 {
+		return nil, errors.New("ICM20948 Error: trajectory has no segments")
+	}
+	if !finite(tr.Heading, tr.Pitch, tr.Roll, field, tr.Inclination) || !finite(tr.GyroBias[:]...) {
+		return nil, errors.New("ICM20948 Error: trajectory values must be finite")
+	}
+	for i, seg := range tr.Segments {
+		if seg.Duration <= 0 || !finite(seg.Rate[:]...) {
+			return nil, fmt.Errorf("ICM20948 Error: trajectory segment %d must have a positive duration and finite rates", i)
+		}
+	}
+
+	// r rotates the body axes into north, west and up.
+	r := rotAxis(2, -tr.Heading).mul(rotAxis(1, -tr.Pitch)).mul(rotAxis(0, tr.Roll))
+	inc := tr.Inclination * deg
+	f1, f2, f3 := field*math.Cos(inc), 0.0, -field*math.Sin(inc)
+	period := time.Second / time.Duration(rate)
+
+	sample := func(t time.Duration, rate [3]float64) *MPUData {
+		rt := r.transpose()
+		d := &MPUData{N: 1, NM: 1, Temp: syntheticTemp, T: time.Time{}.Add(t)}
+		d.TM = d.T
+		d.G1, d.G2, d.G3 = rate[0]+tr.GyroBias[0], rate[1]+tr.GyroBias[1], rate[2]+tr.GyroBias[2]
+		d.A1, d.A2, d.A3 = rt.apply(0, 0, 1)
+		d.M1, d.M2, d.M3 = rt.apply(f1, f2, f3)
+		if !magAligned {
+			d.M1, d.M2, d.M3 = flipMag.apply(d.M1, d.M2, d.M3)
+		}
+		d.DT, d.DTM = period, period
+		return d
+	}
+
+	data := []*MPUData{sample(0, tr.Segments[0].Rate)}
+	data[0].DT, data[0].DTM = 0, 0
+	var t, end time.Duration
+	for _, seg := range tr.Segments {
+		step := rotVec(seg.Rate[0]*period.Seconds(), seg.Rate[1]*period.Seconds(), seg.Rate[2]*period.Seconds())
+		for end += seg.Duration; t+period <= end; {
+			t += period
+			r = r.mul(step)
+			data = append(data, sample(t, seg.Rate))
+		}
+	}
+	return data, nil
+}
+
+// rotAxis returns the rotation by angle (°) about axis i (0-2), counterclockwise looking down the axis.
+func rotAxis(i int, angle float64) AxisMap {
+	var v [3]float64
+	v[i] = angle
+	return rotVec(v[0], v[1], v[2])
+}
+
+// rotVec returns the rotation about the vector v1, v2, v3 by its length in degrees.
+func rotVec(v1, v2, v3 float64) AxisMap {
+	theta := math.Sqrt(v1*v1+v2*v2+v3*v3) * deg
+	if theta == 0 {
+		return IdentityAxisMap
+	}
+	k1, k2, k3 := v1*deg/theta, v2*deg/theta, v3*deg/theta
+	k := AxisMap{{0, -k3, k2}, {k3, 0, -k1}, {-k2, k1, 0}}
+	k2m := k.mul(k)
+	s, c := math.Sin(theta), 1-math.Cos(theta)
+	r := IdentityAxisMap
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			r[i][j] += s*k[i][j] + c*k2m[i][j]
+		}
+	}
+	return r
+}
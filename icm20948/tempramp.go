@@ -0,0 +1,176 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+)
+
+const (
+	defaultTempRampInterval    = 10 * time.Second
+	defaultTempRampStableDelta = 0.2 // °C
+	defaultTempRampStableTime  = 5 * time.Minute
+	defaultTempRampTimeout     = 2 * time.Hour
+	tempRampMinSpan            = 1.0 // Smallest temperature range, °C, over which a fit is made
+)
+
+// TempRampConfig describes how CalibrateGyroTemperatureRamp runs.  Zero values take the defaults given below.
+type TempRampConfig struct {
+	Interval    time.Duration // Averaging window for each row of the log; default 10s
+	StableDelta float64       // Temperature change, °C, below which the temperature is stable; default 0.2
+	StableTime  time.Duration // How long the temperature must be stable to stop; default 5 min
+	Timeout     time.Duration // Longest the ramp runs; default 2h
+	Fit         bool          // Whether to fit the gyro bias temperature coefficients at the end
+}
+
+// withDefaults returns cfg with the defaults filled in.
+func (cfg TempRampConfig) withDefaults() TempRampConfig {
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultTempRampInterval
+	}
+	if cfg.StableDelta == 0 {
+		cfg.StableDelta = defaultTempRampStableDelta
+	}
+	if cfg.StableTime == 0 {
+		cfg.StableTime = defaultTempRampStableTime
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTempRampTimeout
+	}
+	return cfg
+}
+
+// TempRampResult describes the outcome of CalibrateGyroTemperatureRamp.
+type TempRampResult struct {
+	Rows     int        // Number of averaged rows logged
+	Stable   bool       // The ramp stopped because the temperature was stable, rather than on the timeout
+	MinTemp  float64    // Lowest averaged die temperature seen, °C
+	MaxTemp  float64    // Highest averaged die temperature seen, °C
+	Fitted   bool       // The coefficients below were fitted
+	TempCoef [3]float64 // Gyro bias change per degree, °/s/°C, for each axis
+	Bias     [3]float64 // Gyro bias at RefTemp, °/s
+	RefTemp  float64    // Mean temperature of the rows, °C
+}
+
+/*
+CalibrateGyroTemperatureRamp records the gyro bias as the die temperature changes, e.g. while the sensor warms
+up or moves from a fridge to room temperature, to build a temperature compensation model.  The sensor must be
+kept still throughout.  Every Interval, the averaged sensor values from AverageSince are logged to a CSV at path
+with MPUDataLogger, so the file has the usual columns and can be read back with ReplayFromCSV; the B1-B3 columns
+hold the gyro bias, relative to the current calibration, and Temp the die temperature.
+
+The ramp stops once the temperature has changed by less than StableDelta over StableTime, or after Timeout.  If
+cfg.Fit is set and the temperature covered at least 1°C, straight lines are fitted to the bias of each axis
+against temperature.  CalibrateGyroTemperatureRamp blocks while it runs and shares the averaging window with
+CAvg, which mustn't be read meanwhile.
+*/
+func (mpu *ICM20948) CalibrateGyroTemperatureRamp(path string, cfg TempRampConfig) (TempRampResult, error) {
+	var res TempRampResult
+	cfg = cfg.withDefaults()
+	if cfg.Interval < 0 || cfg.StableDelta < 0 || cfg.StableTime < 0 || cfg.Timeout < 0 {
+		return res, errors.New("ICM20948 Error: temperature ramp settings must not be negative")
+	}
+	// MPUDataLogger can't return an error, so check that the log can be created first.
+	f, err := os.Create(path)
+	if err != nil {
+		return res, fmt.Errorf("ICM20948 Error: couldn't create %s: %s", path, err.Error())
+	}
+	f.Close()
+	l := NewMPUDataLogger(path)
+	defer l.Close()
+
+	var (
+		times []time.Time
+		temps []float64
+		bias  [3][]float64
+	)
+	start := time.Now()
+	timeout := time.NewTimer(cfg.Timeout)
+	defer timeout.Stop()
+	tick := time.NewTicker(cfg.Interval)
+	defer tick.Stop()
+	mpu.AverageSince(true)
+
+	log.Printf("ICM20948: Recording gyro bias against temperature to %s\n", path)
+loop:
+	for {
+		select {
+		case <-tick.C:
+		case <-timeout.C:
+			break loop
+		case <-mpu.cDone:
+			return res, errors.New("ICM20948 Error: driver closed during temperature ramp")
+		}
+
+		d := mpu.AverageSince(true)
+		if d.GAError != nil {
+			continue
+		}
+		l.LogMPUData(start, d)
+		times, temps = append(times, d.T), append(temps, d.Temp)
+		bias[0], bias[1], bias[2] = append(bias[0], d.G1), append(bias[1], d.G2), append(bias[2], d.G3)
+		if res.Rows == 0 || d.Temp < res.MinTemp {
+			res.MinTemp = d.Temp
+		}
+		if res.Rows == 0 || d.Temp > res.MaxTemp {
+			res.MaxTemp = d.Temp
+		}
+		res.Rows++
+
+		if tempStable(times, temps, cfg.StableTime, cfg.StableDelta) {
+			res.Stable = true
+			break loop
+		}
+	}
+	log.Printf("ICM20948: Temperature ramp finished after %d rows, %.1f°C to %.1f°C\n", res.Rows, res.MinTemp, res.MaxTemp)
+
+	if !cfg.Fit {
+		return res, nil
+	}
+	if res.MaxTemp-res.MinTemp < tempRampMinSpan {
+		log.Printf("ICM20948 Warning: temperature only changed by %.1f°C, not fitting gyro temperature coefficients\n",
+			res.MaxTemp-res.MinTemp)
+		return res, nil
+	}
+	for i := range bias {
+		res.TempCoef[i], res.Bias[i], res.RefTemp = fitLine(temps, bias[i])
+	}
+	res.Fitted = true
+	return res, nil
+}
+
+// tempStable returns whether temps, measured at times, spanned less than delta over the last period.
+func tempStable(times []time.Time, temps []float64, period time.Duration, delta float64) bool {
+	n := len(times)
+	if n == 0 || times[n-1].Sub(times[0]) < period {
+		return false
+	}
+	lo, hi := temps[n-1], temps[n-1]
+	for i := n - 1; i >= 0 && times[n-1].Sub(times[i]) <= period; i-- {
+		lo, hi = math.Min(lo, temps[i]), math.Max(hi, temps[i])
+	}
+	return hi-lo < delta
+}
+
+// fitLine fits y = slope*(x-xMean) + yMean by least squares, returning slope, yMean and xMean.
+func fitLine(x, y []float64) (slope, yMean, xMean float64) {
+	n := float64(len(x))
+	for i := range x {
+		xMean += x[i]
+		yMean += y[i]
+	}
+	xMean /= n
+	yMean /= n
+	var sxy, sxx float64
+	for i := range x {
+		sxy += (x[i] - xMean) * (y[i] - yMean)
+		sxx += (x[i] - xMean) * (x[i] - xMean)
+	}
+	if sxx > 0 {
+		slope = sxy / sxx
+	}
+	return
+}
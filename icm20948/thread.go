@@ -0,0 +1,56 @@
+package icm20948
+
+import (
+	"log"
+	"runtime"
+)
+
+/*
+WithPinnedThread runs the read loop on an OS thread of its own (runtime.LockOSThread) and, if nice isn't 0, sets
+that thread's nice value to nice, from -20 (highest priority) to 19, to cut the jitter (see Stats) that the Go
+scheduler and other processes add to the samples on a busy host.  It is for real-time users such as control loops;
+the costs are an OS thread given over to the read loop, which the Go scheduler can't use for anything else, and,
+with a raised priority, less CPU for the rest of the system when the sample rate is high.
+
+The priority can only be set on Linux, and a negative nice needs root, CAP_SYS_NICE or a high enough RLIMIT_NICE;
+if it can't be set, a warning is logged and the thread is only pinned.  Real-time scheduling classes (SCHED_FIFO)
+aren't used, as a read loop that falls behind could then starve the host; use chrt on the process for that.  With
+the bus timeout on (see WithBusTimeout), each transaction runs on a goroutine of its own, which isn't pinned, so
+WithBusTimeout(0) keeps the reads themselves on the pinned thread.  When the driver is closed the priority is
+restored and the thread released; if the priority can't be restored, the thread ends with the read loop instead
+of returning to the Go scheduler.
+*/
+func WithPinnedThread(nice int) Option {
+	return func(mpu *ICM20948) {
+		mpu.threadPinned, mpu.threadNice = true, nice
+	}
+}
+
+// pinThread locks the calling goroutine, the read loop, to its OS thread and sets its priority, as set with
+// WithPinnedThread.  It returns the function that restores the priority and unlocks the thread, for the read loop
+// to defer.
+func (mpu *ICM20948) pinThread() (release func()) {
+	if !mpu.threadPinned {
+		return func() {}
+	}
+	runtime.LockOSThread()
+	if mpu.threadNice == 0 {
+		return runtime.UnlockOSThread
+	}
+	old, err := threadNice()
+	if err == nil {
+		err = setThreadNice(mpu.threadNice)
+	}
+	if err != nil {
+		log.Printf("ICM20948 Warning: couldn't set the read loop's nice value to %d: %s\n", mpu.threadNice, err)
+		return runtime.UnlockOSThread
+	}
+	return func() {
+		if err := setThreadNice(old); err != nil {
+			// Left locked, the thread ends with the goroutine rather than running others at this priority.
+			log.Printf("ICM20948 Warning: couldn't restore the read loop's nice value to %d: %s\n", old, err)
+			return
+		}
+		runtime.UnlockOSThread()
+	}
+}
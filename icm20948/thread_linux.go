@@ -0,0 +1,15 @@
+package icm20948
+
+import "syscall"
+
+// threadNice returns the nice value of the calling thread.
+func threadNice() (int, error) {
+	// The system call returns 20 - nice, to keep it positive.
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, syscall.Gettid())
+	return 20 - prio, err
+}
+
+// setThreadNice sets the nice value of the calling thread, which Linux schedules separately from the process.
+func setThreadNice(nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, syscall.Gettid(), nice)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package icm20948
+
+import "errors"
+
+var errThreadPriority = errors.New("thread priorities are only supported on Linux")
+
+// threadNice returns the nice value of the calling thread.
+func threadNice() (int, error) {
+	return 0, errThreadPriority
+}
+
+// setThreadNice sets the nice value of the calling thread.
+func setThreadNice(nice int) error {
+	return errThreadPriority
+}
@@ -0,0 +1,126 @@
+package icm20948
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+const udpWriteTimeout = 10 * time.Millisecond // A receiver that can't keep up loses samples rather than stalling us
+
+// UDPStreamer relays MPUData from one of the ICM20948 channels (typically C or CBuf) to a ground station as
+// JSON datagrams, one sample per datagram.
+type UDPStreamer struct {
+	conn     *net.UDPConn
+	c        <-chan *MPUData
+	interval time.Duration
+	cStop    chan bool
+	cDone    chan bool
+}
+
+// udpDatagram is the wire format of a single MPUData sample.  Times are in Unix nanoseconds.
+type udpDatagram struct {
+	G1, G2, G3        float64
+	A1, A2, A3        float64
+	M1, M2, M3        float64
+	Temp              float64
+	GAError, MagError string `json:",omitempty"`
+	N, NM             int
+	T, TM             int64
+}
+
+/*
+NewUDPStreamer starts sending the samples received on c to the UDP address addr (e.g. "192.168.10.255:4000").
+At most maxRate samples per second are sent; samples arriving faster than that are dropped, as are samples the
+network can't accept immediately, so the sensor is never blocked by a slow or unreachable receiver.
+A maxRate of 0 sends every sample.
+*/
+func NewUDPStreamer(c <-chan *MPUData, addr string, maxRate float64) (*UDPStreamer, error) {
+	if maxRate < 0 {
+		return nil, errors.New("ICM20948 Error: UDP stream rate must not be negative")
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &UDPStreamer{
+		conn:  conn,
+		c:     c,
+		cStop: make(chan bool),
+		cDone: make(chan bool),
+	}
+	if maxRate > 0 {
+		s.interval = time.Duration(float64(time.Second) / maxRate)
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *UDPStreamer) run() {
+	var last time.Time
+
+	defer close(s.cDone)
+	defer s.conn.Close()
+
+	for {
+		select {
+		case <-s.cStop:
+			return
+		case d, ok := <-s.c:
+			if !ok {
+				return
+			}
+			if d == nil || time.Since(last) < s.interval {
+				continue
+			}
+			last = time.Now()
+
+			buf, err := json.Marshal(newUDPDatagram(d))
+			if err != nil {
+				log.Printf("ICM20948 Warning: couldn't marshal UDP datagram: %s\n", err)
+				continue
+			}
+			s.conn.SetWriteDeadline(time.Now().Add(udpWriteTimeout))
+			s.conn.Write(buf) // Errors (e.g. no receiver) just mean this sample is dropped.
+		}
+	}
+}
+
+// Stop stops streaming and closes the UDP socket.  It is safe to call more than once.
+func (s *UDPStreamer) Stop() {
+	select {
+	case <-s.cDone:
+	case s.cStop <- true:
+		<-s.cDone
+	}
+}
+
+func newUDPDatagram(d *MPUData) *udpDatagram {
+	u := &udpDatagram{
+		G1: d.G1, G2: d.G2, G3: d.G3,
+		A1: d.A1, A2: d.A2, A3: d.A3,
+		M1: d.M1, M2: d.M2, M3: d.M3,
+		Temp: d.Temp,
+		N:    d.N, NM: d.NM,
+	}
+	if !d.T.IsZero() {
+		u.T = d.T.UnixNano()
+	}
+	if !d.TM.IsZero() {
+		u.TM = d.TM.UnixNano()
+	}
+	if d.GAError != nil {
+		u.GAError = d.GAError.Error()
+	}
+	if d.MagError != nil {
+		u.MagError = d.MagError.Error()
+	}
+	return u
+}
@@ -0,0 +1,80 @@
+package icm20948
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPStreamerLoopback(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := make(chan *MPUData)
+	s, err := NewUDPStreamer(c, conn.LocalAddr().String(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	now := time.Now()
+	c <- &MPUData{G1: 1.5, A3: 1, M2: -20, Temp: 25, N: 1, T: now, MagError: errors.New("no mag")}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var u udpDatagram
+	if err := json.Unmarshal(buf[:n], &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.G1 != 1.5 || u.A3 != 1 || u.M2 != -20 || u.Temp != 25 || u.N != 1 {
+		t.Errorf("values not relayed correctly: %+v", u)
+	}
+	if u.T != now.UnixNano() || u.TM != 0 {
+		t.Errorf("timestamps not relayed correctly: %d, %d", u.T, u.TM)
+	}
+	if u.MagError != "no mag" || u.GAError != "" {
+		t.Errorf("errors not relayed correctly: %q, %q", u.GAError, u.MagError)
+	}
+}
+
+func TestUDPStreamerThrottles(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := make(chan *MPUData)
+	s, err := NewUDPStreamer(c, conn.LocalAddr().String(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		c <- &MPUData{N: i}
+	}
+	s.Stop()
+	s.Stop()
+
+	buf := make([]byte, 1024)
+	received := 0
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+		received++
+	}
+	if received != 1 {
+		t.Errorf("expected 1 datagram at 1 Hz, got %d", received)
+	}
+}
@@ -0,0 +1,47 @@
+package icm20948
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+/*
+AccelRMS measures vibration as the root-mean-square of the accelerometer magnitude minus 1 G, in G, over the
+samples read from CBuf during the next window, e.g. for prop balancing or checking how stiff a mount is.  The
+device should otherwise be still: any sustained acceleration or a poor accel calibration also shows up in the
+result.  Samples with errors are skipped.
+
+It consumes the samples on CBuf, so it must not be used while another consumer is reading CBuf.  It returns an
+error if there are no good samples in the window or the driver is closed.
+*/
+func (mpu *ICM20948) AccelRMS(window time.Duration) (float64, error) {
+	if window <= 0 {
+		return 0, errors.New("ICM20948 Error: vibration window must be positive")
+	}
+
+	var (
+		n, ss float64
+		end   = time.NewTimer(window)
+	)
+	defer end.Stop()
+	for {
+		select {
+		case d, ok := <-mpu.CBuf:
+			if !ok {
+				return 0, errors.New("ICM20948 Error: driver closed while measuring vibration")
+			}
+			if d.GAError != nil {
+				continue
+			}
+			e := math.Sqrt(d.A1*d.A1+d.A2*d.A2+d.A3*d.A3) - 1
+			ss += e * e
+			n++
+		case <-end.C:
+			if n == 0 {
+				return 0, errors.New("ICM20948 Error: no accelerometer samples to measure vibration")
+			}
+			return math.Sqrt(ss / n), nil
+		}
+	}
+}
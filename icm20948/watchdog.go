@@ -0,0 +1,102 @@
+package icm20948
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	defaultWatchdogTimeout = time.Second
+	faultsBufSize          = 8 // Faults are dropped rather than blocking if nobody reads them
+)
+
+// watchdog raises a fault on Faults if readSensors hasn't made a successful accel/gyro read within the watchdog
+// timeout, e.g. because the I2C bus hung.  It runs in its own goroutine so that it still works if readSensors is
+// stuck inside a bus operation, and stops when readSensors stops.
+func (mpu *ICM20948) watchdog() {
+	var (
+		faulted bool
+		start   = time.Now()
+	)
+
+	clock := time.NewTicker(defaultWatchdogTimeout / 4)
+	defer clock.Stop()
+
+	for {
+		select {
+		case <-mpu.cDone:
+			return
+		case now := <-clock.C:
+			mpu.mu.Lock()
+			timeout, autoReset := mpu.watchdogTimeout, mpu.watchdogAutoReset
+			last, paused := mpu.lastGoodRead, mpu.paused
+			mpu.mu.Unlock()
+			if last.IsZero() {
+				last = start
+			}
+
+			if timeout == 0 || paused || now.Sub(last) < timeout {
+				faulted = false
+				continue
+			}
+			if faulted {
+				continue // Only report each silence once
+			}
+			faulted = true
+
+			mpu.mu.Lock()
+			mpu.stats.WatchdogFaults++
+			mpu.mu.Unlock()
+			mpu.fault(fmt.Errorf("ICM20948 Error: no sensor data for %s", now.Sub(last).Truncate(time.Millisecond)))
+
+			if autoReset {
+				log.Println("ICM20948: Watchdog resetting sensor")
+				if err := mpu.Reset(); err != nil {
+					mpu.fault(err)
+				}
+			}
+		}
+	}
+}
+
+// fault reports err on Faults without blocking; if the channel is full the fault is only logged.
+func (mpu *ICM20948) fault(err error) {
+	select {
+	case mpu.cFaults <- err:
+	default:
+		log.Println(err)
+	}
+}
+
+/*
+SetWatchdog sets how long the sensor may go without a successful read before an error is sent on Faults and
+counted in Stats, and whether the chip is then Reset.  A timeout of 0 disables the watchdog.
+The watchdog checks four times per default timeout (1s), so short timeouts are only approximate.
+*/
+func (mpu *ICM20948) SetWatchdog(timeout time.Duration, autoReset bool) error {
+	if timeout < 0 {
+		return errors.New("ICM20948 Error: watchdog timeout must not be negative")
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.watchdogTimeout = timeout
+	mpu.watchdogAutoReset = autoReset
+	return nil
+}
+
+// Reset resets the chip and re-applies the driver configuration without stopping the driver.
+// It waits for any bus operation in progress, up to the bus timeout (see SetBusTimeout).
+func (mpu *ICM20948) Reset() error {
+	mpu.busMu.Lock()
+	defer mpu.busMu.Unlock()
+
+	if err := mpu.configure(); err != nil {
+		return err
+	}
+	mpu.mu.Lock()
+	mpu.stats.Resets++
+	mpu.mu.Unlock()
+	return nil
+}
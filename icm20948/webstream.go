@@ -0,0 +1,213 @@
+package icm20948
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	webStreamRate      = 10                     // Messages per second sent to each WebSocket client
+	webWriteTimeout    = time.Second            // A client that can't take a message in this time is dropped
+	webShutdownTimeout = 2 * time.Second        // Time allowed for the HTTP server to shut down
+	webSocketPath      = "/ws"                  // Path of the WebSocket endpoint
+	webBufferSize      = 1024                   // WebSocket read and write buffer sizes
+	webPingPeriod      = 10 * time.Second       // How often idle clients are pinged
+	webPongWait        = 3 * webPingPeriod      // How long a client may go without answering
+	webMessageLimit    = 512                    // Largest message accepted from a client; they aren't used
+	webCloseGrace      = 100 * time.Millisecond // Time allowed to send the close message
+)
+
+// webMessage is the JSON sent to WebSocket clients: the latest sample, in the UDPStreamer format, and the horizon
+// if it is enabled.
+type webMessage struct {
+	*udpDatagram
+	Horizon *HorizonData `json:",omitempty"`
+}
+
+var webUpgrader = websocket.Upgrader{ReadBufferSize: webBufferSize, WriteBufferSize: webBufferSize}
+
+/*
+ServeHTTP runs a small web server on addr (e.g. ":8080") for watching the sensor during bring-up and demos: the
+page at / shows the live values and, if EnableHorizon is on, the pitch, roll and heading, which it gets as JSON
+from a WebSocket at /ws.  Each client gets the latest sample 10 times a second, so the server never takes samples
+from the channels or slows the driver.  It blocks until ctx is cancelled, then closes the connections and returns
+nil, or returns an error if it can't listen on addr.
+*/
+func (mpu *ICM20948) ServeHTTP(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return mpu.serveWeb(ctx, ln)
+}
+
+// serveWeb runs the server of ServeHTTP on ln until ctx is cancelled.
+func (mpu *ICM20948) serveWeb(ctx context.Context, ln net.Listener) error {
+	var clients sync.WaitGroup
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(webPage))
+	})
+	mux.HandleFunc(webSocketPath, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := webUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return // Upgrade has already replied with the error.
+		}
+		clients.Add(1)
+		defer clients.Done()
+		mpu.streamWeb(ctx, conn)
+	})
+
+	srv := &http.Server{Handler: mux}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	sctx, cancel := context.WithTimeout(context.Background(), webShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		log.Printf("ICM20948 Warning: web server didn't shut down cleanly: %s\n", err)
+	}
+	<-errc
+	clients.Wait() // The WebSocket connections are hijacked, so Shutdown doesn't wait for them.
+	return nil
+}
+
+// streamWeb sends the latest sample to conn at webStreamRate until ctx is cancelled, the driver stops or the
+// client goes away.
+func (mpu *ICM20948) streamWeb(ctx context.Context, conn *websocket.Conn) {
+	defer conn.Close()
+
+	// Read (and discard) from the client, so that pings, pongs and closes are handled.
+	gone := make(chan bool)
+	conn.SetReadLimit(webMessageLimit)
+	conn.SetReadDeadline(time.Now().Add(webPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(webPongWait))
+	})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	tick := time.NewTicker(time.Second / webStreamRate)
+	defer tick.Stop()
+	ping := time.NewTicker(webPingPeriod)
+	defer ping.Stop()
+	var last *MPUData
+	for {
+		select {
+		case <-ctx.Done():
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(webCloseGrace))
+			return
+		case <-mpu.cDone:
+			msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "driver closed")
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(webCloseGrace))
+			return
+		case <-gone:
+			return
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(webWriteTimeout)); err != nil {
+				return
+			}
+		case <-tick.C:
+			d := mpu.latestData()
+			if d == nil || d == last {
+				continue
+			}
+			last = d
+			buf, err := mpu.webMessage(d)
+			if err != nil {
+				log.Printf("ICM20948 Warning: couldn't marshal web message: %s\n", err)
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(webWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, buf); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// webMessage returns the JSON message for d.
+func (mpu *ICM20948) webMessage(d *MPUData) ([]byte, error) {
+	msg := webMessage{udpDatagram: newUDPDatagram(d)}
+	mpu.mu.Lock()
+	if mpu.horizon != nil {
+		h := mpu.horizon.h
+		msg.Horizon = &h
+	}
+	mpu.mu.Unlock()
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return nil, errors.New("ICM20948 Error: " + err.Error())
+	}
+	return buf, nil
+}
+
+// webPage is the page served at / by ServeHTTP.
+const webPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ICM20948</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 1em; text-align: right; }
+th { text-align: left; }
+#status { color: gray; }
+</style>
+</head>
+<body>
+<h1>ICM20948</h1>
+<p id="status">Connecting...</p>
+<table>
+<tr><th>Gyro (°/s)</th><td id="G1"></td><td id="G2"></td><td id="G3"></td></tr>
+<tr><th>Accel (G)</th><td id="A1"></td><td id="A2"></td><td id="A3"></td></tr>
+<tr><th>Mag (µT)</th><td id="M1"></td><td id="M2"></td><td id="M3"></td></tr>
+<tr><th>Temp (°C)</th><td id="Temp"></td></tr>
+<tr><th>Pitch, roll, heading (°)</th><td id="Pitch"></td><td id="Roll"></td><td id="Heading"></td></tr>
+</table>
+<script>
+function show(id, v) { document.getElementById(id).textContent = v === undefined ? "" : v.toFixed(2); }
+var ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/ws");
+ws.onopen = function() { document.getElementById("status").textContent = "Live"; };
+ws.onclose = function(e) { document.getElementById("status").textContent = "Disconnected " + (e.reason || ""); };
+ws.onmessage = function(e) {
+	var d = JSON.parse(e.data);
+	["G1", "G2", "G3", "A1", "A2", "A3", "Temp"].forEach(function(k) { show(k, d.GAError ? undefined : d[k]); });
+	["M1", "M2", "M3"].forEach(function(k) { show(k, d.MagError ? undefined : d[k]); });
+	var h = d.Horizon || {};
+	show("Pitch", h.AttitudeValid ? h.Pitch : undefined);
+	show("Roll", h.AttitudeValid ? h.Roll : undefined);
+	show("Heading", h.HeadingValid ? h.Heading : undefined);
+};
+</script>
+</body>
+</html>
+`